@@ -3,83 +3,675 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/kexec"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
 )
 
 type ApiCallResult struct {
-	Result  string `json:"result"`
-	Log     string `json:"log"`
-	Message string `json:"message"`
+	Result   string        `json:"result"`
+	Uuid     string        `json:"uuid,omitempty"`
+	Log      string        `json:"log"`
+	Message  string        `json:"message"`
+	Attempts []*ApiAttempt `json:"attempts,omitempty"`
+	// JSON return value of the function, omitted if it returned none
+	Output json.RawMessage `json:"output,omitempty"`
+	// "warm" or "cold", and the time from the call to the completion
+	Mode      string `json:"mode,omitempty"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+}
+
+// ApiAttempt is one pod run of a function execution
+type ApiAttempt struct {
+	Pod      string    `json:"pod"`
+	Phase    string    `json:"phase"`
+	ExitCode int32     `json:"exitCode"`
+	Reason   string    `json:"reason,omitempty"`
+	Message  string    `json:"message,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+}
+
+type ApiExecution struct {
+	Uuid      string          `json:"uuid"`
+	Params    string          `json:"params"`
+	Result    string          `json:"result"`
+	Log       string          `json:"log"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Mode      string          `json:"mode,omitempty"`
+	LatencyMs int64           `json:"latencyMs,omitempty"`
+	Trigger   string          `json:"trigger,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Attempts  []*ApiAttempt   `json:"attempts"`
+	Children  []*ApiExecution `json:"children,omitempty"`
+	// Deliveries of the completion callback
+	Callbacks []*ApiCallbackAttempt `json:"callbacks,omitempty"`
+}
+
+// ApiCallbackAttempt is one delivery of a completion callback. StatusCode
+// is 0 if the receiver did not respond.
+type ApiCallbackAttempt struct {
+	URL        string    `json:"url"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"statusCode"`
+	Error      string    `json:"error,omitempty"`
+	Created    time.Time `json:"created"`
 }
 
 var ResError = "Error"
 
-func ApiCallFunctionHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+// Name of the input sent as an application/octet-stream call body
+var DefaultInputName = "input"
+
+// Multipart call bodies beyond this many bytes are buffered on disk
+var MaxMultipartMemory int64 = 1 << 20
 
-	res := callUserFunction(a, request)
+func ApiCallFunctionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+
+	res := callUserFunction(ctx, a, response, request)
 
 	// Log the error if there is one
 	if res.Message != "" {
-		log.Println(res.Message)
+		a.logger(ctx).Warn("Function call failed", "error", res.Message)
+	}
+	if res.Result == ResError {
+		auditFailed(ctx, errors.New(res.Message))
 	}
+	auditDetail(ctx, "execution", res.Uuid, "result", res.Result)
 
 	// Write to response
-	response.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	response.WriteHeader(http.StatusOK)
-	e := json.NewEncoder(response)
-	e.SetIndent("", "\t")
-	if err := e.Encode(res); err != nil {
+	if err := writeJSON(response, res); err != nil {
 		return StatusError{http.StatusInternalServerError, err, MessageCallFunctionFailed, true}
 	}
 	return nil
 }
 
-func callUserFunction(a *appContext, request *http.Request) ApiCallResult {
+func callUserFunction(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) ApiCallResult {
 	vars := mux.Vars(request)
 	userName := vars["username"]
 	functionName := vars["function"]
 	// Sanity check
 	if userName == "" || functionName == "" {
-		return ApiCallResult{ResError, "", "Missing user name or function name."}
+		return ApiCallResult{Result: ResError, Message: "Missing user name or function name."}
 	}
 
 	// Check if function already exists
-	_, err := a.dal.GetFunction(userName, functionName)
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
 	if err == sql.ErrNoRows {
-		return ApiCallResult{ResError, "", fmt.Sprintf("Function %s not exist for user %s.", functionName, userName)}
+		return ApiCallResult{Result: ResError, Message: fmt.Sprintf("Function %s not exist for user %s.", functionName, userName)}
 	} else if err != nil {
-		return ApiCallResult{ResError, "", err.Error()}
+		return ApiCallResult{Result: ResError, Message: err.Error()}
 	}
 
-	// Get function parameters from request body
-	params, err := ioutil.ReadAll(request.Body)
+	// Get function parameters and inputs from request body
+	paramsStr, inputs, err := readCallInput(response, request)
 	if err != nil {
-		return ApiCallResult{ResError, "", err.Error()}
+		return ApiCallResult{Result: ResError, Message: err.Error()}
 	}
-	paramsStr := string(params)
-	if paramsStr == "" {
-		log.Println("Calling function", functionName, "for user", userName)
-	} else {
-		log.Println("Calling function", functionName, "with parameters", paramsStr, "for user", userName)
+	a.logger(ctx).Info("Calling function", "user", userName, "function", functionName,
+		"params", shortParams(paramsStr), "inputs", len(inputs))
+
+	// With a callback, return once the call started
+	if callback := request.URL.Query().Get("callback"); callback != "" {
+		return callUserFunctionAsync(ctx, a, f, userName, paramsStr, inputs, callback)
 	}
 
 	// Call function. This will create a job in OpenShift
 	timestamp := time.Now()
-	res, err := callFunction(a, userName, functionName, paramsStr)
+	res, err := callFunction(ctx, a, userName, functionName, paramsStr, inputs)
 	if err != nil {
-		return ApiCallResult{ResError, "", err.Error()}
+		return ApiCallResult{Result: ResError, Message: err.Error()}
 	}
 
 	// Insert function execution into DB
-	if err := PutFunctionExecution(a, userName, functionName, paramsStr, res, timestamp); err != nil {
-		return ApiCallResult{ResError, "", err.Error()}
+	res.Trigger = TriggerHTTP
+	if err := PutFunctionExecution(ctx, a, userName, functionName, paramsStr, res, timestamp); err != nil {
+		return ApiCallResult{Result: ResError, Message: err.Error()}
+	}
+
+	return ApiCallResult{
+		Result:    res.Result,
+		Uuid:      res.Uuid,
+		Log:       res.Log,
+		Attempts:  apiAttempts(executionAttempts(res.Attempts)),
+		Output:    apiOutput(res.Output),
+		Mode:      res.Mode,
+		LatencyMs: latencyMs(res.Latency),
+	}
+}
+
+// readCallInput reads the params and binary inputs of a function call.
+// The request body is one of:
+//   - the JSON params
+//   - a multipart/form-data form, with the params in its "params" field
+//     and one file per input, named after its field
+//   - an application/octet-stream binary input named DefaultInputName,
+//     with the params in the "params" query parameter
+//
+// Inputs are passed to the function but not recorded with the execution.
+func readCallInput(response http.ResponseWriter, request *http.Request) (string, map[string][]byte, error) {
+	request.Body = http.MaxBytesReader(response, request.Body, int64(kexec.MaxInputSize))
+	mediaType, _, _ := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	switch mediaType {
+	case "multipart/form-data":
+		if err := request.ParseMultipartForm(MaxMultipartMemory); err != nil {
+			return "", nil, err
+		}
+		defer request.MultipartForm.RemoveAll()
+		inputs := make(map[string][]byte)
+		for name, files := range request.MultipartForm.File {
+			if err := kexec.ValidateInputName(name); err != nil {
+				return "", nil, err
+			}
+			if len(files) != 1 {
+				return "", nil, errors.New(fmt.Sprintf("Input %s must be a single file.", name))
+			}
+			f, err := files[0].Open()
+			if err != nil {
+				return "", nil, err
+			}
+			inputs[name], err = ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return "", nil, err
+			}
+		}
+		return request.FormValue("params"), inputs, nil
+	case "application/octet-stream":
+		input, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return "", nil, err
+		}
+		return request.URL.Query().Get("params"), map[string][]byte{DefaultInputName: input}, nil
+	default:
+		params, err := ioutil.ReadAll(request.Body)
+		return string(params), nil, err
+	}
+}
+
+type ApiFanOutRequest struct {
+	Items       json.RawMessage `json:"items"`
+	Parallelism int             `json:"parallelism"`
+}
+
+type ApiFanOutResult struct {
+	Result  string           `json:"result"`
+	Uuid    string           `json:"uuid"`
+	Message string           `json:"message"`
+	Items   []*ApiFanOutItem `json:"items,omitempty"`
+}
+
+type ApiFanOutItem struct {
+	Result   string          `json:"result"`
+	Uuid     string          `json:"uuid"`
+	Log      string          `json:"log"`
+	Output   json.RawMessage `json:"output,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Attempts []*ApiAttempt   `json:"attempts,omitempty"`
+
+	Mode      string `json:"mode,omitempty"`
+	LatencyMs int64  `json:"latencyMs,omitempty"`
+}
+
+// ApiFanOutHandler calls a function once per item of the request, and
+// returns the status and log of every item.
+func ApiFanOutHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	res := fanOutUserFunction(ctx, a, request)
+
+	// Log the error if there is one
+	if res.Message != "" {
+		a.logger(ctx).Warn("Fan-out call failed", "error", res.Message)
+	}
+	if res.Result == ResError {
+		auditFailed(ctx, errors.New(res.Message))
+	}
+	auditDetail(ctx, "fanout", res.Uuid, "result", res.Result)
+
+	if err := writeJSON(response, res); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageCallFunctionFailed, true}
+	}
+	return nil
+}
+
+func fanOutUserFunction(ctx context.Context, a *appContext, request *http.Request) ApiFanOutResult {
+	vars := mux.Vars(request)
+	userName := vars["username"]
+	functionName := vars["function"]
+
+	if _, err := a.dal.GetFunction(ctx, userName, functionName); err == sql.ErrNoRows {
+		return ApiFanOutResult{Result: ResError, Message: fmt.Sprintf("Function %s not exist for user %s.", functionName, userName)}
+	} else if err != nil {
+		return ApiFanOutResult{Result: ResError, Message: err.Error()}
+	}
+
+	var req ApiFanOutRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		return ApiFanOutResult{Result: ResError, Message: err.Error()}
+	}
+	items, err := parseFanOutItems(req.Items)
+	if err != nil {
+		return ApiFanOutResult{Result: ResError, Message: err.Error()}
+	}
+
+	timestamp := time.Now()
+	res, err := callFunctionFanOut(ctx, a, userName, functionName, items, req.Parallelism)
+	if err != nil {
+		return ApiFanOutResult{Result: ResError, Message: err.Error()}
+	}
+
+	if err := PutFanOutExecution(a, userName, functionName, string(req.Items), res, timestamp); err != nil {
+		return ApiFanOutResult{Result: ResError, Uuid: res.Uuid, Message: err.Error()}
+	}
+
+	apiRes := ApiFanOutResult{Result: res.Result, Uuid: res.Uuid}
+	for _, item := range res.Items {
+		if item.Err != nil {
+			apiRes.Items = append(apiRes.Items, &ApiFanOutItem{Result: ResError, Message: item.Err.Error()})
+			continue
+		}
+		apiRes.Items = append(apiRes.Items, &ApiFanOutItem{
+			Result:    item.Res.Result,
+			Uuid:      item.Res.Uuid,
+			Log:       item.Res.Log,
+			Output:    apiOutput(item.Res.Output),
+			Attempts:  apiAttempts(executionAttempts(item.Res.Attempts)),
+			Mode:      item.Res.Mode,
+			LatencyMs: latencyMs(item.Res.Latency),
+		})
+	}
+	return apiRes
+}
+
+func latencyMs(latency time.Duration) int64 {
+	return int64(latency / time.Millisecond)
+}
+
+// apiOutput returns the output of an execution as raw JSON, or nil if the
+// function returned none. An output that is not valid JSON, e.g. written
+// by a function outside of the wrapper, is returned as a JSON string.
+func apiOutput(output string) json.RawMessage {
+	if output == "" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(output), &v); err != nil {
+		quoted, _ := json.Marshal(output)
+		return quoted
+	}
+	return json.RawMessage(output)
+}
+
+func apiAttempts(attempts []*dal.ExecutionAttempt) []*ApiAttempt {
+	res := make([]*ApiAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		res = append(res, &ApiAttempt{a.Pod, a.Phase, a.ExitCode, a.Reason, a.Message, a.Started, a.Finished})
+	}
+	return res
+}
+
+// ApiCancelExecutionHandler cancels a running execution. The call of the
+// execution returns with the "Cancelled" result.
+func ApiCancelExecutionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	err := cancelExecution(ctx, a, vars["username"], vars["function"], vars["uuid"])
+	if err == errExecutionNotRunning {
+		return StatusError{http.StatusNotFound, err, MessageCancelExecutionFailed, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageCancelExecutionFailed, true}
+	}
+	return writeJSON(response, ApiCallResult{Result: ExecutionCancelled})
+}
+
+func apiExecutions(execs []*dal.FunctionExecution) []*ApiExecution {
+	res := make([]*ApiExecution, 0, len(execs))
+	for _, e := range execs {
+		ae := &ApiExecution{
+			Uuid:      e.Uuid,
+			Params:    e.Params,
+			Result:    e.Status,
+			Log:       e.Log,
+			Output:    apiOutput(e.Output),
+			Mode:      e.Mode,
+			LatencyMs: latencyMs(e.Latency),
+			Trigger:   e.Trigger,
+			Timestamp: e.Timestamp,
+			Attempts:  apiAttempts(e.Attempts),
+		}
+		if len(e.Children) > 0 {
+			ae.Children = apiExecutions(e.Children)
+		}
+		for _, c := range e.Callbacks {
+			ae.Callbacks = append(ae.Callbacks, &ApiCallbackAttempt{c.URL, c.Attempt, c.StatusCode, c.Error, c.Created})
+		}
+		res = append(res, ae)
+	}
+	return res
+}
+
+// ApiListExecutionsHandler returns the recent executions of a function,
+// with the attempts of each execution.
+func ApiListExecutionsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	userName := vars["username"]
+	functionName := vars["function"]
+
+	execs, err := a.dal.ListExecution(ctx, userName, functionName)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageListExecutionsFailed, true}
+	}
+
+	if err := writeJSON(response, apiExecutions(execs)); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageListExecutionsFailed, true}
+	}
+	return nil
+}
+
+type ApiFunctionSettings struct {
+	CPU          string `json:"cpu"`
+	Memory       string `json:"memory"`
+	Timeout      int64  `json:"timeout"`
+	MaxLogSize   int64  `json:"maxLogSize"`
+	MaxAttempts  int64  `json:"maxAttempts"`
+	RetryBackoff int64  `json:"retryBackoff"`
+	RetryOn      string `json:"retryOn"`
+	WarmPoolSize int64  `json:"warmPoolSize"`
+}
+
+func ApiGetFunctionSettingsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	return writeJSON(response, ApiFunctionSettings{
+		CPU:          f.CPU,
+		Memory:       f.Memory,
+		Timeout:      f.Timeout,
+		MaxLogSize:   f.MaxLogSize,
+		MaxAttempts:  f.MaxAttempts,
+		RetryBackoff: f.RetryBackoff,
+		RetryOn:      f.RetryOn,
+		WarmPoolSize: f.WarmPoolSize,
+	})
+}
+
+func ApiUpdateFunctionSettingsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
 	}
+	vars := mux.Vars(request)
+	userName := vars["username"]
+	functionName := vars["function"]
+
+	var s ApiFunctionSettings
+	if err := json.NewDecoder(request.Body).Decode(&s); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSettingsFailed, true}
+	}
+	settings := &dal.FunctionSettings{
+		CPU:          s.CPU,
+		Memory:       s.Memory,
+		Timeout:      s.Timeout,
+		MaxLogSize:   s.MaxLogSize,
+		MaxAttempts:  s.MaxAttempts,
+		RetryBackoff: s.RetryBackoff,
+		RetryOn:      s.RetryOn,
+		WarmPoolSize: s.WarmPoolSize,
+	}
+	if err := validateFunctionSettings(a, settings); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSettingsFailed, true}
+	}
+
+	if _, err := a.dal.GetFunction(ctx, userName, functionName); err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	if err := a.dal.UpdateFunctionSettings(ctx, userName, functionName, settings); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateSettingsFailed, true}
+	}
+
+	return writeJSON(response, s)
+}
 
-	return ApiCallResult{res.Result, res.Log, ""}
+// ApiSchedule is a cron schedule of a function. Params are a JSON
+// document, passed to every run.
+type ApiSchedule struct {
+	ID         int64     `json:"id"`
+	Spec       string    `json:"spec"`
+	Params     string    `json:"params"`
+	TimeZone   string    `json:"timeZone"`
+	MissedRuns string    `json:"missedRuns"`
+	LastRun    time.Time `json:"lastRun"`
+	NextRun    time.Time `json:"nextRun"`
+}
+
+func apiSchedule(s *dal.Schedule) *ApiSchedule {
+	res := &ApiSchedule{
+		ID:         s.ID,
+		Spec:       s.Spec,
+		Params:     s.Params,
+		TimeZone:   s.TimeZone,
+		MissedRuns: s.MissedRuns,
+		LastRun:    s.LastRun,
+	}
+	if cron, err := parseCron(s.Spec); err == nil {
+		if loc, err := time.LoadLocation(s.TimeZone); err == nil {
+			from := time.Now()
+			if s.LastRun.After(from) {
+				from = s.LastRun
+			}
+			res.NextRun = cron.next(from.In(loc))
+		}
+	}
+	return res
+}
+
+func ApiListSchedulesHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	schedules, err := a.dal.ListSchedules(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	res := make([]*ApiSchedule, 0, len(schedules))
+	for _, s := range schedules {
+		res = append(res, apiSchedule(s))
+	}
+	return writeJSON(response, res)
+}
+
+func ApiCreateScheduleHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	var s ApiSchedule
+	if err := json.NewDecoder(request.Body).Decode(&s); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateScheduleFailed, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	schedule := &dal.Schedule{
+		FunctionID: f.ID,
+		Spec:       strings.TrimSpace(s.Spec),
+		Params:     s.Params,
+		TimeZone:   s.TimeZone,
+		MissedRuns: s.MissedRuns,
+		Created:    time.Now(),
+	}
+	if err := validateSchedule(schedule); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateScheduleFailed, true}
+	}
+	if schedule.ID, err = a.dal.PutSchedule(ctx, schedule); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateScheduleFailed, true}
+	}
+	return writeJSON(response, apiSchedule(schedule))
+}
+
+func ApiDeleteScheduleHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	scheduleID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return StatusError{http.StatusNotFound, err, MessageScheduleNotFound, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	err = a.dal.DeleteSchedule(ctx, f.ID, scheduleID)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageScheduleNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateScheduleFailed, true}
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// requireOwner checks that the request comes from the session of the
+// user named in its path, who owns the functions and workflows it acts on
+func requireOwner(a *appContext, request *http.Request) error {
+	userName := getUserName(a, request)
+	if userName == "" {
+		return StatusError{http.StatusUnauthorized, errors.New("Not logged in"), MessageOwnerRequired, true}
+	}
+	if owner := mux.Vars(request)["username"]; userName != owner {
+		return StatusError{http.StatusForbidden, errors.New("User " + userName + " is not " + owner), MessageOwnerRequired, true}
+	}
+	return nil
+}
+
+func writeJSON(response http.ResponseWriter, v interface{}) error {
+	return writeJSONStatus(response, http.StatusOK, v)
+}
+
+func writeJSONStatus(response http.ResponseWriter, code int, v interface{}) error {
+	response.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	response.WriteHeader(code)
+	e := json.NewEncoder(response)
+	e.SetIndent("", "\t")
+	return e.Encode(v)
+}
+
+type ApiFunctionEnv struct {
+	Env map[string]string `json:"env"`
+	// Secret values are always returned as SecretMask. Sending SecretMask
+	// back keeps the stored value.
+	Secrets map[string]string `json:"secrets"`
+}
+
+func ApiGetFunctionEnvHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	env, err := a.dal.ListFunctionEnv(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	plain, secrets := splitEnv(env)
+	for name := range secrets {
+		secrets[name] = SecretMask
+	}
+	return writeJSON(response, ApiFunctionEnv{Env: plain, Secrets: secrets})
+}
+
+func ApiUpdateFunctionEnvHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	var e ApiFunctionEnv
+	if err := json.NewDecoder(request.Body).Decode(&e); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateEnvFailed, true}
+	}
+	existing, err := a.dal.ListFunctionEnv(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	env, err := buildFunctionEnv(e.Env, e.Secrets, existing)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateEnvFailed, true}
+	}
+
+	tx, err := a.dal.Begin(ctx)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateEnvFailed, true}
+	}
+	if err := tx.PutFunctionEnv(ctx, f.ID, env); err != nil {
+		tx.Rollback()
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateEnvFailed, true}
+	}
+	if err := tx.Commit(); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateEnvFailed, true}
+	}
+
+	plain, secrets := splitEnv(env)
+	for name := range secrets {
+		secrets[name] = SecretMask
+	}
+	return writeJSON(response, ApiFunctionEnv{Env: plain, Secrets: secrets})
 }
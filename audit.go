@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+// Audited actions
+var (
+	AuditLogin              = "login"
+	AuditLogout             = "logout"
+	AuditGroupChange        = "user.group"
+	AuditCreateFunction     = "function.create"
+	AuditEditFunction       = "function.edit"
+	AuditDeleteFunction     = "function.delete"
+	AuditCallFunction       = "function.call"
+	AuditCancelExecution    = "execution.cancel"
+	AuditUpdateSettings     = "function.settings"
+	AuditUpdateEnv          = "function.env"
+	AuditUpdateCallback     = "function.callback"
+	AuditCreateSchedule     = "schedule.create"
+	AuditDeleteSchedule     = "schedule.delete"
+	AuditCreateWebhook      = "webhook.create"
+	AuditDeleteWebhook      = "webhook.delete"
+	AuditCreateSubscription = "subscription.create"
+	AuditDeleteSubscription = "subscription.delete"
+	AuditPublishEvent       = "event.publish"
+	AuditPutWorkflow        = "workflow.put"
+	AuditDeleteWorkflow     = "workflow.delete"
+	AuditRunWorkflow        = "workflow.run"
+	AuditReadAudit          = "audit.read"
+)
+
+// Outcomes of the audited actions. Denied actions were rejected for lack
+// of authentication or permission.
+var (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// How the actor of an action was authenticated. The function API does not
+// authenticate its callers, their actor is empty unless they also have a
+// session.
+var (
+	AuthPassword = "password"
+	AuthSession  = "session"
+	AuthWebhook  = "webhook"
+	AuthNone     = "none"
+)
+
+// auditedRoute is the action of a route. The routes of the web UI, which
+// share the names of the API routes but have no {username}, act on the
+// functions of the user of the session and require one if `session`.
+type auditedRoute struct {
+	action  string
+	session bool
+}
+
+// auditedRoutes are the audited routes, by method and route name
+var auditedRoutes = map[string]auditedRoute{
+	"POST Login":           {AuditLogin, false},
+	"GET Logout":           {AuditLogout, true},
+	"POST Create":          {AuditCreateFunction, true},
+	"POST Edit":            {AuditEditFunction, true},
+	"POST Delete":          {AuditDeleteFunction, true},
+	"POST Call":            {AuditCallFunction, true},
+	"POST FanOut":          {AuditCallFunction, false},
+	"POST Hook":            {AuditCallFunction, false},
+	"POST CancelExecution": {AuditCancelExecution, true},
+	"POST Settings":        {AuditUpdateSettings, false},
+	"POST Env":             {AuditUpdateEnv, false},
+	"POST Callback":        {AuditUpdateCallback, false},
+	"POST Schedules":       {AuditCreateSchedule, false},
+	"DELETE Schedule":      {AuditDeleteSchedule, false},
+	"POST Webhooks":        {AuditCreateWebhook, false},
+	"DELETE Webhook":       {AuditDeleteWebhook, false},
+	"POST Subscriptions":   {AuditCreateSubscription, false},
+	"DELETE Subscription":  {AuditDeleteSubscription, false},
+	"POST PublishEvent":    {AuditPublishEvent, false},
+	"POST Workflows":       {AuditPutWorkflow, false},
+	"DELETE Workflow":      {AuditDeleteWorkflow, false},
+	"POST RunWorkflow":     {AuditRunWorkflow, true},
+	"POST WorkflowRuns":    {AuditRunWorkflow, false},
+	"GET Audit":            {AuditReadAudit, false},
+	"GET AuditExport":      {AuditReadAudit, false},
+}
+
+// Route variables not recorded in the detail of the events. Webhook
+// tokens are secrets.
+var auditHiddenVars = map[string]bool{"username": true, "function": true, "token": true}
+
+// auditRecord is the audit event of the request being served. It is
+// recorded once the handler returns, which may complete it through the
+// context with the audit* functions.
+type auditRecord struct {
+	a       *appContext
+	request *http.Request
+	session bool
+	event   dal.AuditEvent
+	detail  []string
+	err     error
+	denied  bool
+}
+
+type auditRecordKey struct{}
+
+// startAudit returns the audit record of a request, nil if its route is
+// not audited
+func startAudit(ctx context.Context, a *appContext, request *http.Request, route string) (context.Context, *auditRecord) {
+	r, ok := auditedRoutes[request.Method+" "+route]
+	if !ok {
+		return ctx, nil
+	}
+	rec := &auditRecord{
+		a:       a,
+		request: request,
+		session: r.session && mux.Vars(request)["username"] == "",
+		event: dal.AuditEvent{
+			Action:     r.action,
+			SourceIP:   sourceIP(request),
+			AuthMethod: AuthNone,
+		},
+	}
+	if userName := getUserName(a, request); userName != "" {
+		rec.event.Actor = userName
+		rec.event.AuthMethod = AuthSession
+		if rec.session {
+			rec.event.TargetUser = userName
+		}
+	}
+	return context.WithValue(ctx, auditRecordKey{}, rec), rec
+}
+
+func auditRecordFromContext(ctx context.Context) *auditRecord {
+	rec, _ := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return rec
+}
+
+// auditActor sets who acts, for the requests not authenticated by a
+// session
+func auditActor(ctx context.Context, actor, authMethod string) {
+	if rec := auditRecordFromContext(ctx); rec != nil {
+		rec.event.Actor = actor
+		rec.event.AuthMethod = authMethod
+	}
+}
+
+// auditTarget sets the function acted on, for the requests not naming it
+// in their route
+func auditTarget(ctx context.Context, userName, functionName string) {
+	if rec := auditRecordFromContext(ctx); rec != nil {
+		rec.event.TargetUser = userName
+		rec.event.TargetFunction = functionName
+	}
+}
+
+// auditDetail adds key/value pairs to the detail of the event. Pairs of
+// empty values are skipped.
+func auditDetail(ctx context.Context, keyvals ...string) {
+	rec := auditRecordFromContext(ctx)
+	if rec == nil {
+		return
+	}
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i+1] == "" {
+			continue
+		}
+		rec.detail = append(rec.detail, keyvals[i]+"="+keyvals[i+1])
+	}
+}
+
+// auditFailed marks the action as failed, for the handlers reporting
+// failures in their response rather than with an error
+func auditFailed(ctx context.Context, err error) {
+	if rec := auditRecordFromContext(ctx); rec != nil && err != nil {
+		rec.err = err
+	}
+}
+
+// auditDenied marks the action as denied, e.g. a login with bad
+// credentials
+func auditDenied(ctx context.Context, err error) {
+	if rec := auditRecordFromContext(ctx); rec != nil {
+		rec.err = err
+		rec.denied = true
+	}
+}
+
+// recordAuditEvent records an action resulting from the request of ctx,
+// e.g. the change of the group of a user logging in
+func recordAuditEvent(ctx context.Context, action, userName, detail string) {
+	rec := auditRecordFromContext(ctx)
+	if rec == nil {
+		return
+	}
+	e := rec.event
+	e.Action = action
+	e.TargetUser = userName
+	e.Outcome = AuditSuccess
+	e.Detail = detail
+	rec.put(ctx, &e)
+}
+
+// record records the event once the request is served with `status` and
+// the error of its handler
+func (rec *auditRecord) record(ctx context.Context, status int, err error) {
+	e := rec.event
+	vars := mux.Vars(rec.request)
+	if e.TargetFunction == "" {
+		e.TargetFunction = vars["function"]
+		if e.TargetFunction == "" {
+			e.TargetFunction = rec.request.FormValue("functionName")
+		}
+	}
+	if e.TargetUser == "" {
+		e.TargetUser = vars["username"]
+	}
+
+	names := make([]string, 0, len(vars))
+	for name := range vars {
+		if !auditHiddenVars[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	detail := make([]string, 0, len(names)+len(rec.detail)+1)
+	for _, name := range names {
+		detail = append(detail, name+"="+vars[name])
+	}
+	detail = append(detail, rec.detail...)
+
+	if err == nil {
+		err = rec.err
+	}
+	switch {
+	case rec.denied || status == http.StatusUnauthorized || status == http.StatusForbidden || (rec.session && e.Actor == ""):
+		e.Outcome = AuditDenied
+	case err != nil || status >= http.StatusBadRequest:
+		e.Outcome = AuditFailure
+	default:
+		e.Outcome = AuditSuccess
+	}
+	if err != nil {
+		detail = append(detail, "error="+err.Error())
+	}
+	e.Detail = strings.Join(detail, " ")
+	rec.put(ctx, &e)
+}
+
+func (rec *auditRecord) put(ctx context.Context, e *dal.AuditEvent) {
+	// Recorded even if the client went away
+	ctx = detachContext(ctx)
+	if _, err := rec.a.dal.PutAuditEvent(ctx, e); err != nil {
+		rec.a.logger(ctx).Error("Failed to record audit event", "action", e.Action, "actor", e.Actor, "error", err)
+	}
+}
+
+// sourceIP returns the IP address of the client of a request
+func sourceIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+// ApiAuditEvent is an audit event, as returned by the audit API and
+// exported as JSON lines
+type ApiAuditEvent struct {
+	ID         int64     `json:"id"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	User       string    `json:"user,omitempty"`
+	Function   string    `json:"function,omitempty"`
+	SourceIP   string    `json:"sourceIp"`
+	AuthMethod string    `json:"authMethod"`
+	Outcome    string    `json:"outcome"`
+	Detail     string    `json:"detail,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func apiAuditEvent(e *dal.AuditEvent) *ApiAuditEvent {
+	return &ApiAuditEvent{
+		ID:         e.ID,
+		Actor:      e.Actor,
+		Action:     e.Action,
+		User:       e.TargetUser,
+		Function:   e.TargetFunction,
+		SourceIP:   e.SourceIP,
+		AuthMethod: e.AuthMethod,
+		Outcome:    e.Outcome,
+		Detail:     e.Detail,
+		Timestamp:  e.Created,
+	}
+}
+
+// requireAdmin checks that the request comes from the session of an
+// administrator
+func requireAdmin(a *appContext, request *http.Request) error {
+	userName := getUserName(a, request)
+	if userName == "" {
+		return StatusError{http.StatusUnauthorized, errors.New("Not logged in"), MessageAdminRequired, true}
+	}
+	for _, admin := range a.conf.Admins {
+		if admin == userName {
+			return nil
+		}
+	}
+	return StatusError{http.StatusForbidden, errors.New("User " + userName + " is not an administrator"), MessageAdminRequired, true}
+}
+
+// parseAuditFilter reads the filter of an audit query: the actor, action,
+// user, function and outcome query parameters, and the since and until
+// RFC 3339 times
+func parseAuditFilter(request *http.Request) (*dal.AuditFilter, error) {
+	q := request.URL.Query()
+	f := &dal.AuditFilter{
+		Actor:          q.Get("actor"),
+		Action:         q.Get("action"),
+		TargetUser:     q.Get("user"),
+		TargetFunction: q.Get("function"),
+		Outcome:        q.Get("outcome"),
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errors.New("Invalid since time, expected RFC 3339: " + v)
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errors.New("Invalid until time, expected RFC 3339: " + v)
+		}
+	}
+	return f, nil
+}
+
+// ApiListAuditHandler returns the audit events matching the filter of
+// the query, most recent first. The events before the event of id
+// `before` are returned, at most `limit` of them.
+func ApiListAuditHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireAdmin(a, request); err != nil {
+		return err
+	}
+	f, err := parseAuditFilter(request)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageListAuditFailed, true}
+	}
+	q := request.URL.Query()
+	if v := q.Get("before"); v != "" {
+		if f.BeforeID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return StatusError{http.StatusBadRequest, err, MessageListAuditFailed, true}
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil {
+			return StatusError{http.StatusBadRequest, err, MessageListAuditFailed, true}
+		}
+	}
+
+	events, err := a.dal.ListAuditEvents(ctx, f)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageListAuditFailed, true}
+	}
+	res := make([]*ApiAuditEvent, 0, len(events))
+	for _, e := range events {
+		res = append(res, apiAuditEvent(e))
+	}
+	return writeJSON(response, res)
+}
+
+// ApiExportAuditHandler writes all the audit events matching the filter
+// of the query as JSON lines, most recent first
+func ApiExportAuditHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireAdmin(a, request); err != nil {
+		return err
+	}
+	f, err := parseAuditFilter(request)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageListAuditFailed, true}
+	}
+	auditDetail(ctx, "export", "jsonl")
+
+	response.Header().Set("Content-Type", "application/x-ndjson")
+	response.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+	encoder := json.NewEncoder(response)
+	written := false
+	for {
+		events, err := a.dal.ListAuditEvents(ctx, f)
+		if err != nil {
+			if written {
+				// Too late for an error status, the export is cut short
+				a.logger(ctx).Error("Audit export failed", "error", err)
+				auditFailed(ctx, err)
+				return nil
+			}
+			return StatusError{http.StatusInternalServerError, err, MessageListAuditFailed, true}
+		}
+		for _, e := range events {
+			if err := encoder.Encode(apiAuditEvent(e)); err != nil {
+				auditFailed(ctx, err)
+				return nil
+			}
+			written = true
+		}
+		if len(events) < dal.MAX_NUM_AUDIT_EVENTS {
+			return nil
+		}
+		f.BeforeID = events[len(events)-1].ID
+	}
+}
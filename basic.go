@@ -2,21 +2,33 @@ package main
 
 import (
 	"crypto/tls"
+	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Symantec/Go-kexec/dal"
 	"github.com/Symantec/Go-kexec/docker"
+	"github.com/Symantec/Go-kexec/kexec"
+	"github.com/Symantec/Go-kexec/tracing"
 	"github.com/wayn3h0/go-uuid"
+	"golang.org/x/net/context"
 	"gopkg.in/ldap.v2"
 )
 
-func createFunction(a *appContext, userName, functionName, runtime, code string) error {
+// createFunction builds and pushes the function image and stores the
+// function in the DB. It is used for both creating and editing a
+// function. The steps run as a saga, so that a failure midway does not
+// leave a DB row for an image that was never pushed, or a pushed image
+// without a DB row.
+//
+// `env` replaces the environment of the function, unless it is nil.
+func createFunction(ctx context.Context, a *appContext, userName, functionName, runtime, code string, settings *dal.FunctionSettings, env []*dal.EnvVar) (err error) {
 	// Check if function name is empty;
 	// check if runtime template is chosen;
 	// check if the input code is empty.
@@ -27,16 +39,129 @@ func createFunction(a *appContext, userName, functionName, runtime, code string)
 	} else if code == "" {
 		return errors.New("Function code is empty.")
 	}
+	if err := validateFunctionSettings(a, settings); err != nil {
+		return err
+	}
+
+	a.logger(ctx).Info("Creating function", "user", userName, "function", functionName, "runtime", runtime)
+	ctx, span := tracing.Start(ctx, "createFunction", "user", userName, "function", functionName, "runtime", runtime)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	// Keep the previous version around to restore its image if the
+	// function is being edited and the saga fails after the push.
+	previous, err := a.dal.GetFunction(ctx, userName, functionName)
+	if err == sql.ErrNoRows {
+		previous = nil
+	} else if err != nil {
+		return err
+	}
+
+	// The image is pushed before the DB transaction begins, so the
+	// transaction is not held open across the push. It is the last step
+	// and commits or rolls back on its own.
+	s := newSaga(ctx, "create function "+functionName+" for user "+userName, a.logger(ctx))
+	s.Add("build function image",
+		func() error {
+			return buildFunctionImage(ctx, a, userName, functionName, runtime, code)
+		}, nil)
+	s.Add("push function image",
+		func() error {
+			return a.d.RegisterFunction(ctx, a.conf.DockerCfg.DockerRegistry, userName, strings.ToLower(functionName))
+		},
+		func() error {
+			// Compensate even if the request was cancelled
+			if previous == nil {
+				return deleteFunctionImage(context.Background(), a, userName, functionName)
+			}
+			return restoreFunctionImage(context.Background(), a, userName, previous)
+		})
+	s.Add("put function into DB",
+		func() error {
+			tx, err := a.dal.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			if _, _, err = tx.PutFunction(ctx, userName, functionName, code, -1); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err = tx.UpdateFunctionSettings(ctx, userName, functionName, settings); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if env != nil {
+				f, err := tx.GetFunction(ctx, userName, functionName)
+				if err == nil {
+					err = tx.PutFunctionEnv(ctx, f.ID, env)
+				}
+				if err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+			return tx.Commit()
+		}, nil)
+
+	// If all the above operation succeeded, the function is created
+	// successfully.
+	return s.Run()
+}
+
+// deleteFunction deletes the function from the DB and its image from the
+// registry. The DB deletion is only committed once the image is gone; if
+// the commit fails the image is rebuilt from the stored code.
+func deleteFunction(ctx context.Context, a *appContext, userName, functionName string) error {
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
+	if err != nil {
+		return err
+	}
+
+	var tx dal.Tx
+	s := newSaga(ctx, "delete function "+functionName+" for user "+userName, a.logger(ctx))
+	s.Add("delete function from DB",
+		func() error {
+			if tx, err = a.dal.Begin(ctx); err != nil {
+				return err
+			}
+			if err = tx.DeleteFunction(ctx, userName, functionName); err != nil {
+				tx.Rollback()
+				return err
+			}
+			return nil
+		},
+		func() error {
+			return tx.Rollback()
+		})
+	s.Add("delete function image",
+		func() error {
+			return deleteFunctionImage(ctx, a, userName, functionName)
+		},
+		func() error {
+			// Compensate even if the request was cancelled
+			return restoreFunctionImage(context.Background(), a, userName, f)
+		})
+	s.Add("commit DB transaction",
+		func() error {
+			return tx.Commit()
+		}, nil)
+
+	return s.Run()
+}
 
+// buildFunctionImage writes the function code into a fresh build context
+// and builds the function image from it.
+func buildFunctionImage(ctx context.Context, a *appContext, userName, functionName, runtime, code string) error {
 	newCode := formatCode(runtime, code, functionName)
-	log.Printf("Code uploaded:\n%s", newCode)
-	log.Printf("Start creating function \"%s\" with runtime \"%s\"", functionName, runtime)
+	a.logger(ctx).Debug("Code uploaded", "user", userName, "function", functionName, "code", newCode)
 
 	// Create a time based uuid as part of the context directory name
 	uuid, err := uuid.NewTimeBased()
 
 	if err != nil {
-		log.Println("Failed to create uuid for function call.")
+		a.logger(ctx).Error("Failed to create uuid for build context", "error", err)
 		return err
 	}
 
@@ -49,6 +174,8 @@ func createFunction(a *appContext, userName, functionName, runtime, code string)
 	if err := os.Mkdir(ctxDir, os.ModePerm); err != nil {
 		return err
 	}
+	// The context is only needed for the build
+	defer os.RemoveAll(ctxDir)
 
 	exeFileName := filepath.Join(ctxDir, docker.ExecutionFile)
 	exeFile, err := os.Create(exeFileName)
@@ -63,72 +190,144 @@ func createFunction(a *appContext, userName, functionName, runtime, code string)
 		return err
 	}
 
-	functionNameLower := strings.ToLower(functionName)
 	// Build funtion
-	if err = a.d.BuildFunction(a.conf.DockerCfg.DockerRegistry, userName, functionNameLower, runtime, ctxDir); err != nil {
-		log.Println("Build function failed")
-		return err
-	}
-
-	// Register function to configured docker registry
-	if err = a.d.RegisterFunction(a.conf.DockerCfg.DockerRegistry, userName, functionNameLower); err != nil {
-		log.Println("Register function failed")
+	if err = a.d.BuildFunction(ctx, a.conf.DockerCfg.DockerRegistry, userName, strings.ToLower(functionName), runtime, ctxDir); err != nil {
+		a.logger(ctx).Error("Function build failed", "user", userName, "function", functionName, "error", err)
 		return err
 	}
+	return nil
+}
 
-	// Put function into db
-	if err = putUserFunction(a, userName, functionName, code, -1); err != nil {
-		log.Println("Failed to put function into DB")
+// restoreFunctionImage rebuilds and pushes the image of a function as
+// stored in the DB.
+func restoreFunctionImage(ctx context.Context, a *appContext, userName string, f *dal.Function) error {
+	a.logger(ctx).Info("Restoring function image", "user", userName, "function", f.Name)
+	if err := buildFunctionImage(ctx, a, userName, f.Name, "python27", f.Content); err != nil {
 		return err
 	}
-
-	// If all the above operation succeeded, the function is created
-	// successfully.
-	return nil
+	return a.d.RegisterFunction(ctx, a.conf.DockerCfg.DockerRegistry, userName, strings.ToLower(f.Name))
 }
 
 //return success/failed, log and error
-func callFunction(a *appContext, userName, functionName, params string) (*CallResult, error) {
-	var status, funcLog string
-
+func callFunction(ctx context.Context, a *appContext, userName, functionName, params string, inputs map[string][]byte) (*CallResult, error) {
 	// create a uuid for each function call. This uuid can be
 	// seen as the execution id for the function (notice there
 	// are multiple executions for a single function)
 	uuid, err := uuid.NewTimeBased()
 
 	if err != nil {
-		log.Println("Failed to create uuid for function call.")
+		a.logger(ctx).Error("Failed to create uuid for function call", "error", err)
 		return nil, err
 	}
 
-	uuidStr := uuid.String()
+	return callFunctionWithUuid(ctx, a, uuid.String(), userName, functionName, params, inputs)
+}
 
-	nsName := SERVERLESS_NAMESPACE
+// callFunctionWithUuid calls a function with a uuid created by the
+// caller, e.g. to return it before the execution completes.
+func callFunctionWithUuid(ctx context.Context, a *appContext, uuidStr, userName, functionName, params string, inputs map[string][]byte) (*CallResult, error) {
+	executionsInFlight.Inc()
+	defer executionsInFlight.Dec()
+	ctx, span := tracing.Start(ctx, "callFunction", "user", userName, "function", functionName, "execution", uuidStr)
+	defer span.End()
+	start := time.Now()
+	res, err := runFunction(ctx, a, uuidStr, userName, functionName, params, inputs)
+	observeInvocation(userName, functionName, res, err, time.Since(start))
+	if err != nil {
+		span.SetError(err)
+	} else {
+		span.SetAttributes("result", res.Result, "mode", res.Mode)
+	}
+	return res, err
+}
+
+// runFunction runs a function execution, warm if the function has a warm
+// pool, and as a job otherwise.
+func runFunction(ctx context.Context, a *appContext, uuidStr, userName, functionName, params string, inputs map[string][]byte) (*CallResult, error) {
+	start := time.Now()
+	var status, funcLog, output string
+	var attempts []*kexec.Attempt
+	var cancelled bool
+
+	nsName, err := functionNamespace(ctx, a, userName)
+	if err != nil {
+		a.logger(ctx).Error("Failed to set up namespace", "user", userName, "error", err)
+		return nil, err
+	}
 	functionNameLower := strings.ToLower(functionName)
 	jobName := functionNameLower + "-" + strings.Replace(userName, "_", "-", -1) + "-" + uuidStr
 	image := a.conf.DockerCfg.DockerRegistry + "/" + userName + "/" + functionNameLower
-	labels := make(map[string]string)
+	labels := map[string]string{
+		kexec.JobLabelUser:     userName,
+		kexec.JobLabelFunction: functionNameLower,
+	}
 
-	if err := a.k.CreateFunctionJob(jobName, image, params, nsName, labels); err != nil {
-		log.Println("Failed to call function", functionName)
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
+	if err != nil {
 		return nil, err
 	}
-	// Run the job
-	err = a.k.RunJob(jobName, nsName)
+	opts := jobOptions(a, &f.FunctionSettings)
+	env, err := a.dal.ListFunctionEnv(ctx, f.ID)
 	if err != nil {
+		return nil, err
+	}
+	opts.Env, opts.Secrets = splitEnv(env)
+	opts.Inputs = inputs
+	opts.TraceParent = tracing.Traceparent(ctx)
+
+	if f.WarmPoolSize > 0 && a.conf.FunctionCfg.MaxWarmPoolSize > 0 {
+		res, err := callFunctionWarm(ctx, a, userName, f, uuidStr, jobName, image, params, nsName, labels, opts, start)
+		if err != kexec.ErrNoWarmWorker {
+			return res, err
+		}
+		a.logger(ctx).Info("No warm worker, running the function as a job", "user", userName, "function", functionName)
+	}
+
+	// Warm workers serve many requests, only jobs carry the request id
+	if id := requestIDFromContext(ctx); id != "" {
+		labels[kexec.JobLabelRequest] = id
+	}
+
+	if err := a.k.CreateFunctionJob(ctx, jobName, image, params, nsName, labels, opts); err != nil {
+		a.logger(ctx).Error("Failed to create function job", "user", userName, "function", functionName, "error", err)
+		return nil, err
+	}
+	a.executions.start(userName, functionName, uuidStr, nsName, jobName)
+	// Run the job. If ctx is done first, e.g. because the client went
+	// away, the execution is cancelled and the job deleted below.
+	err = a.k.RunJob(ctx, jobName, nsName, opts)
+	if err == kexec.ErrJobCancelled {
+		// Keep what the function logged until it was cancelled
+		cancelled = true
+		err = nil
+	} else if err != nil {
 		goto delete
 	}
 
-	// Get the log
-	status, funcLog, err = a.k.GetFunctionLog(jobName, nsName)
-	if err != nil {
+	// Get the log of every attempt. The job is collected and deleted even
+	// if ctx is done, so the rest does not use it.
+	attempts, err = a.k.GetFunctionAttempts(detachContext(ctx), jobName, nsName, opts.MaxLogSize)
+	if err != nil && cancelled {
+		// Cancelled before a pod started
+		err = nil
+	} else if err != nil {
 		goto delete
 	}
-	log.Printf("Function Log:\n %s", funcLog)
+	status, funcLog = kexec.AggregateAttempts(attempts)
+	output = kexec.AttemptsOutput(attempts)
+	if cancelled {
+		status = ExecutionCancelled
+	}
+	a.logger(ctx).Debug("Function log", "execution", uuidStr, "log", funcLog)
 
 	// Delete the job
 delete:
-	err2 := a.k.DeleteFunctionJob(jobName, nsName)
+	err2 := a.k.DeleteFunctionJob(detachContext(ctx), jobName, nsName)
+	a.executions.complete(uuidStr)
+	if err != nil || err2 != nil {
+		// No execution record will be stored
+		a.executions.finalize(uuidStr)
+	}
 	if err2 != nil && err == nil {
 		return nil, err2
 	} else if err2 != nil && err != nil {
@@ -137,7 +336,123 @@ delete:
 		return nil, err
 	}
 
-	return &CallResult{status, uuidStr, funcLog}, nil
+	return &CallResult{
+		Result:   status,
+		Uuid:     uuidStr,
+		Log:      funcLog,
+		Output:   output,
+		Attempts: attempts,
+		Mode:     ExecutionModeCold,
+		Latency:  time.Since(start),
+	}, nil
+}
+
+// deleteFunctionImage removes the function image from the local docker
+// daemon and from the docker registry.
+func deleteFunctionImage(ctx context.Context, a *appContext, userName, functionName string) error {
+	functionNameLower := strings.ToLower(functionName)
+	if err := a.d.DeleteFunctionImage(ctx, a.conf.DockerCfg.DockerRegistry, userName, functionNameLower); err != nil {
+		// The image may have been built by another server, in which
+		// case it is not present locally. Still delete it from registry.
+		a.logger(ctx).Warn("Failed to delete local function image", "user", userName, "function", functionName, "error", err)
+	}
+	return a.r.DeleteImage(ctx, userName+"/"+functionNameLower, "latest")
+}
+
+// jobOptions converts function settings into job options, using the
+// configured defaults for the settings the function does not set.
+func jobOptions(a *appContext, s *dal.FunctionSettings) *kexec.JobOptions {
+	c := &a.conf.FunctionCfg
+	opts := &kexec.JobOptions{
+		CPU:        s.CPU,
+		Memory:     s.Memory,
+		Timeout:    time.Duration(s.Timeout) * time.Second,
+		MaxLogSize: s.MaxLogSize,
+	}
+	if opts.CPU == "" {
+		opts.CPU = c.DefaultCPU
+	}
+	if opts.Memory == "" {
+		opts.Memory = c.DefaultMemory
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = time.Duration(c.DefaultTimeout) * time.Second
+	}
+	if opts.MaxLogSize == 0 {
+		opts.MaxLogSize = c.DefaultMaxLogSize
+	}
+
+	opts.Retry.MaxAttempts = int(s.MaxAttempts)
+	if opts.Retry.MaxAttempts == 0 {
+		opts.Retry.MaxAttempts = int(c.DefaultMaxAttempts)
+	}
+	opts.Retry.Backoff = time.Duration(s.RetryBackoff) * time.Second
+	if opts.Retry.Backoff == 0 {
+		opts.Retry.Backoff = time.Duration(c.DefaultRetryBackoff) * time.Second
+	}
+	retryOn := s.RetryOn
+	if retryOn == "" {
+		retryOn = c.DefaultRetryOn
+	}
+	// The settings are validated before they are stored
+	opts.Retry.RetryOn, _ = kexec.ParseRetryOn(retryOn)
+	return opts
+}
+
+// validateFunctionSettings checks the function settings against the
+// operator configured ceilings.
+func validateFunctionSettings(a *appContext, s *dal.FunctionSettings) error {
+	c := &a.conf.FunctionCfg
+	if _, err := kexec.ParseRetryOn(s.RetryOn); err != nil {
+		return err
+	}
+	if err := validateWarmPoolSize(a, s.WarmPoolSize); err != nil {
+		return err
+	}
+	return jobOptions(a, s).Validate(&kexec.JobOptions{
+		CPU:        c.MaxCPU,
+		Memory:     c.MaxMemory,
+		Timeout:    time.Duration(c.MaxTimeout) * time.Second,
+		MaxLogSize: c.MaxLogSize,
+		Retry:      kexec.RetryPolicy{MaxAttempts: int(c.MaxAttempts)},
+	})
+}
+
+// parseFunctionSettings reads the function settings from a submitted
+// function form.
+func parseFunctionSettings(request *http.Request) (*dal.FunctionSettings, error) {
+	s := &dal.FunctionSettings{
+		CPU:     strings.TrimSpace(request.FormValue("cpu")),
+		Memory:  strings.TrimSpace(request.FormValue("memory")),
+		RetryOn: strings.TrimSpace(request.FormValue("retryOn")),
+	}
+	var err error
+	if v := strings.TrimSpace(request.FormValue("timeout")); v != "" {
+		if s.Timeout, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("Invalid timeout: " + v)
+		}
+	}
+	if v := strings.TrimSpace(request.FormValue("maxLogSize")); v != "" {
+		if s.MaxLogSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("Invalid max log size: " + v)
+		}
+	}
+	if v := strings.TrimSpace(request.FormValue("maxAttempts")); v != "" {
+		if s.MaxAttempts, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("Invalid max attempts: " + v)
+		}
+	}
+	if v := strings.TrimSpace(request.FormValue("retryBackoff")); v != "" {
+		if s.RetryBackoff, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("Invalid retry backoff: " + v)
+		}
+	}
+	if v := strings.TrimSpace(request.FormValue("warmPoolSize")); v != "" {
+		if s.WarmPoolSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, errors.New("Invalid warm pool size: " + v)
+		}
+	}
+	return s, nil
 }
 
 func setSession(a *appContext, userName string, response http.ResponseWriter) {
@@ -174,12 +489,12 @@ func getUserName(a *appContext, request *http.Request) (userName string) {
 	return userName
 }
 
-func putUserIfNotExistedInDB(a *appContext, groupName, userName string) (int64, int64, error) {
-	return a.dal.PutUserIfNotExisted(groupName, userName)
+func putUserIfNotExistedInDB(ctx context.Context, a *appContext, groupName, userName string) (int64, int64, error) {
+	return a.dal.PutUserIfNotExisted(ctx, groupName, userName)
 }
 
-func getUserFunctions(a *appContext, username string, userId int64) ([]*FunctionRow, error) {
-	functions, err := a.dal.ListFunctionsOfUser(username, userId)
+func getUserFunctions(ctx context.Context, a *appContext, username string, userId int64) ([]*FunctionRow, error) {
+	functions, err := a.dal.ListFunctionsOfUser(ctx, username, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -196,24 +511,66 @@ func getUserFunctions(a *appContext, username string, userId int64) ([]*Function
 	return funcToBeListed, nil
 }
 
-func putUserFunction(a *appContext, username, funcName, funcContent string, userId int64) error {
-	_, _, err := a.dal.PutFunction(username, funcName, funcContent, -1)
-	return err
-}
-
-func PutFunctionExecution(a *appContext, userName, functionName, params string, callRes *CallResult, timestamp time.Time) error {
-	log.Println("Inserting executing of function", functionName, "of user", userName, "with parameters", params, "into DB...")
-	f, err := a.dal.GetFunction(userName, functionName)
+// PutFunctionExecution records an execution. Cancelled executions are
+// recorded too, so ctx is detached from the request.
+func PutFunctionExecution(ctx context.Context, a *appContext, userName, functionName, params string, callRes *CallResult, timestamp time.Time) (err error) {
+	ctx, span := tracing.Start(detachContext(ctx), "recordExecution", "execution", callRes.Uuid)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	a.logger(ctx).Info("Recording execution", "execution", callRes.Uuid, "user", userName, "function", functionName,
+		"params", shortParams(params), "result", callRes.Result)
+	defer a.executions.finalize(callRes.Uuid)
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
 	if err != nil {
 		return err
 	}
-	if _, _, err := a.dal.PutExecution(f.ID, params, callRes.Result, callRes.Uuid, callRes.Log, timestamp); err != nil {
+	executionID, _, err := a.dal.PutExecution(ctx, f.ID, params, callRes.Result, callRes.Uuid, callRes.Log, callRes.Output, timestamp)
+	if err != nil {
 		return err
 	}
-	return nil
+	if err := a.dal.PutExecutionLatency(ctx, executionID, callRes.Mode, callRes.Latency); err != nil {
+		return err
+	}
+	if callRes.Trigger != "" {
+		if err := a.dal.PutExecutionTrigger(ctx, executionID, callRes.Trigger); err != nil {
+			return err
+		}
+	}
+	if err := a.dal.PutExecutionAttempts(ctx, executionID, executionAttempts(callRes.Attempts)); err != nil {
+		return err
+	}
+	return startCallback(ctx, a, f, executionID, userName, callRes, timestamp)
 }
 
-func checkCredentials(a *appContext, name string, pass string) (bool, error) {
+// shortParams shortens params for logging
+func shortParams(params string) string {
+	if len(params) <= MaxLoggedParamsSize {
+		return params
+	}
+	return fmt.Sprintf("%s... (%d bytes)", params[:MaxLoggedParamsSize], len(params))
+}
+
+// executionAttempts converts the attempts of a job into their DB records
+func executionAttempts(attempts []*kexec.Attempt) []*dal.ExecutionAttempt {
+	res := make([]*dal.ExecutionAttempt, 0, len(attempts))
+	for _, a := range attempts {
+		res = append(res, &dal.ExecutionAttempt{
+			Pod:      a.Pod,
+			Phase:    a.Phase,
+			ExitCode: a.ExitCode,
+			Reason:   a.Reason,
+			Message:  a.Message,
+			Started:  a.StartTime,
+			Finished: a.FinishTime,
+		})
+	}
+	return res
+}
+
+func checkCredentials(ctx context.Context, a *appContext, name string, pass string) (bool, error) {
 	var l *ldap.Conn
 	var err error
 
@@ -222,12 +579,13 @@ func checkCredentials(a *appContext, name string, pass string) (bool, error) {
 	retries := a.conf.LDAPCfg.LDAPRetries
 	username := fmt.Sprintf(a.conf.LDAPCfg.LDAPBaseDn, name)
 
-	log.Println("Authenticating user", name)
+	logger := a.logger(ctx).With("user", name)
+	logger.Info("Authenticating user")
 
 	//Connect to LDAP servers with retries
 	for i := 0; i < retries; i++ {
 		for _, s := range servers {
-			log.Println("Connecting to LDAP server", s, "......")
+			logger.Debug("Connecting to LDAP server", "server", s)
 			l, err = ldap.DialTLS("tcp", fmt.Sprintf("%s:%d", s, port),
 				&tls.Config{ServerName: s})
 			if err == nil {
@@ -235,13 +593,12 @@ func checkCredentials(a *appContext, name string, pass string) (bool, error) {
 			}
 		}
 		if err == nil {
-			log.Println("Connected")
 			break
 		}
 	}
 
 	if err != nil {
-		log.Println(err)
+		logger.Error("Cannot connect to LDAP", "error", err)
 		return false, err
 	}
 	defer l.Close()
@@ -249,52 +606,145 @@ func checkCredentials(a *appContext, name string, pass string) (bool, error) {
 	//Bind
 	err = l.Bind(username, pass)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Authentication failed", "error", err)
 		return false, err
 	}
-	log.Printf("Bound user %s\n", name)
+	logger.Info("Authenticated user")
 	return true, nil
 }
 
+// Params are cut to this many bytes in the server log
+const MaxLoggedParamsSize = 256
+
+// Maximum size of the JSON return value of a function. It is passed back
+// as the termination message of the container, which Kubernetes truncates
+// beyond this size.
+const MaxOutputSize = 4096
+
 const python27Tmpl = `%s
 
+import BaseHTTPServer
+import StringIO
+import base64
 import json
 import os
 import sys 
+import tempfile
+import time
 import traceback
 
-params = os.environ["SERVERLESS_PARAMS"]
-
-try:
-    p = json.loads(params)
-except ValueError as e:
-    print 'Parameters are not in valid json format:', e
-    sys.exit(1)
-except:
-    print e
-    sys.exit(1)
-
-try:
-    %s(p)
-except NameError as e:
-    print e
-    sys.exit(1)
-except:
-    exc_type, exc_value, exc_traceback = sys.exc_info()
-    tr = traceback.extract_tb(exc_traceback)
-    for item in tr[1:]:
-        print "line", str(item[1]), "in", item[2], "\n\t", item[3]
-    print traceback.format_exc().splitlines()[-1]
-    sys.exit(1)
+# Runs the function on its JSON params and prints its log. Returns the
+# exit code and the JSON return value, None if it returned none.
+def serverless_call(params):
+    try:
+        p = json.loads(params)
+    except ValueError as e:
+        print 'Parameters are not in valid json format:', e
+        return 1, None
+
+    try:
+        result = %s(p)
+    except NameError as e:
+        print e
+        return 1, None
+    except:
+        exc_type, exc_value, exc_traceback = sys.exc_info()
+        tr = traceback.extract_tb(exc_traceback)
+        for item in tr[1:]:
+            print "line", str(item[1]), "in", item[2], "\n\t", item[3]
+        print traceback.format_exc().splitlines()[-1]
+        return 1, None
+
+    # The return value is the output of the function, apart from its log
+    if result is None:
+        return 0, None
+    try:
+        output = json.dumps(result)
+    except (TypeError, ValueError) as e:
+        print 'Return value is not JSON serializable:', e
+        return 1, None
+    if len(output) > %d:
+        print 'Return value exceeds %d bytes of JSON.'
+        return 1, None
+    return 0, output
+
+# Serves the executions of a warm worker, one at a time. GET is the
+# readiness probe, POST runs the function on the params in the body. The
+# trace context of the execution is passed in the traceparent header.
+class ServerlessHandler(BaseHTTPServer.BaseHTTPRequestHandler):
+    def do_GET(self):
+        self.send_response(200)
+        self.end_headers()
+
+    def do_POST(self):
+        params = self.rfile.read(int(self.headers.getheader("Content-Length", 0)))
+        traceparent = self.headers.getheader("traceparent")
+        if traceparent:
+            os.environ["TRACEPARENT"] = traceparent
+        log = StringIO.StringIO()
+        sys.stdout = log
+        try:
+            code, output = serverless_call(params)
+        finally:
+            sys.stdout = sys.__stdout__
+            os.environ.pop("TRACEPARENT", None)
+        body = json.dumps({"exitCode": code, "output": output or "", "log": log.getvalue()})
+        self.send_response(200)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+if os.environ.get("SERVERLESS_MODE") == "warm":
+    server = BaseHTTPServer.HTTPServer(("", int(os.environ["SERVERLESS_PORT"])), ServerlessHandler)
+    server.serve_forever()
+
+# The pods of a fan-out execution run the item the server assigns them in
+# their annotations, which show up in a file once set
+if "SERVERLESS_ITEM_FILE" in os.environ:
+    item = None
+    while item is None:
+        with open(os.environ["SERVERLESS_ITEM_FILE"]) as f:
+            for line in f:
+                key, _, value = line.strip().partition("=")
+                if key == "serverless-item":
+                    item = json.loads(value)
+        if item is None:
+            time.sleep(1)
+    with open(os.path.join(os.environ["SERVERLESS_ITEMS_DIR"], "item-" + item + ".json")) as f:
+        params = f.read()
+# Large params are passed in a file instead of the environment
+elif "SERVERLESS_PARAMS_FILE" in os.environ:
+    with open(os.environ["SERVERLESS_PARAMS_FILE"]) as f:
+        params = f.read()
+else:
+    params = os.environ["SERVERLESS_PARAMS"]
+
+# Binary inputs are passed base64 encoded, decode them for the function
+if "SERVERLESS_INPUT_DIR" in os.environ:
+    input_dir = tempfile.mkdtemp()
+    for name in os.listdir(os.environ["SERVERLESS_INPUT_DIR"]):
+        if not name.endswith(".b64"):
+            continue
+        with open(os.path.join(os.environ["SERVERLESS_INPUT_DIR"], name)) as src:
+            with open(os.path.join(input_dir, name[:-4]), "wb") as dst:
+                dst.write(base64.b64decode(src.read()))
+    os.environ["SERVERLESS_INPUT_DIR"] = input_dir
+
+code, output = serverless_call(params)
+if output is not None:
+    with open(os.environ.get("SERVERLESS_RESULT_PATH", "/dev/termination-log"), "w") as f:
+        f.write(output)
+sys.exit(code)
 `
 
 // Add imports and the remaining code
 func formatCode(runtime, code, functionName string) string {
 	switch runtime {
 	case "python27":
-		return fmt.Sprintf(python27Tmpl, code, functionName)
+		return fmt.Sprintf(python27Tmpl, code, functionName, MaxOutputSize, MaxOutputSize)
 	default:
-		return fmt.Sprintf(python27Tmpl, code, functionName)
+		return fmt.Sprintf(python27Tmpl, code, functionName, MaxOutputSize, MaxOutputSize)
 	}
 }
 
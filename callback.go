@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/gorilla/mux"
+	"github.com/wayn3h0/go-uuid"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Deliveries of a completion callback before giving up, and the delay
+	// before the first retry, doubled for each next one
+	CallbackMaxAttempts = 5
+	CallbackBackoff     = 10 * time.Second
+
+	// Time a receiver has to respond to a callback
+	CallbackTimeout = 10 * time.Second
+
+	// Request headers of the callbacks. The signature is the HMAC-SHA256
+	// of the body keyed with the callback secret of the function, as
+	// "sha256=<hex>".
+	CallbackSignatureHeader = "X-Kexec-Signature-256"
+	CallbackExecutionHeader = "X-Kexec-Execution"
+)
+
+// Result of a call returning before the execution completes. The
+// completion is posted to the callback of the call.
+var ExecutionAccepted = "Accepted"
+
+var errNoCallbackSecret = errors.New("Function has no callback secret, set its callback first")
+
+// Callbacks are only posted to public addresses, checked when connecting
+// so that names resolved again, or redirects, cannot reach the cluster
+// network
+var callbackClient = &http.Client{
+	Timeout:   CallbackTimeout,
+	Transport: &http.Transport{Dial: dialPublic},
+}
+
+// Networks of the private, loopback, link-local and other special purpose
+// addresses, e.g. the cloud metadata service at 169.254.169.254
+var nonPublicNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4",
+	"240.0.0.0/4", "::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isPublicIP returns whether `ip` is a public unicast address
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublicNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialPublic connects to the first public address of a host, and fails
+// if it has none
+func dialPublic(network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if isPublicIP(ip) {
+			return net.DialTimeout(network, net.JoinHostPort(ip.String(), port), CallbackTimeout)
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("Callback host %s has no public address", host))
+}
+
+// CallbackPayload is the body of a completion callback
+type CallbackPayload struct {
+	Uuid      string          `json:"uuid"`
+	User      string          `json:"user"`
+	Function  string          `json:"function"`
+	Status    string          `json:"status"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	Log       string          `json:"log"`
+	Timestamp time.Time       `json:"timestamp"`
+}
+
+// validateCallbackURL checks the URL of a callback. Its host must be one
+// of the configured callback hosts, if any, and not a private address.
+func validateCallbackURL(a *appContext, callback string) error {
+	u, err := url.Parse(callback)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(fmt.Sprintf("Invalid callback URL %q, expected an http or https URL.", callback))
+	}
+	host := u.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if ip := net.ParseIP(host); ip != nil && !isPublicIP(ip) {
+		return errors.New(fmt.Sprintf("Callback host %s is not a public address.", host))
+	}
+	if !callbackHostAllowed(a.conf.FunctionCfg.CallbackHosts, host) {
+		return errors.New(fmt.Sprintf("Callback host %s is not allowed.", host))
+	}
+	return nil
+}
+
+// callbackHostAllowed returns whether `host` matches one of `allowed`,
+// names like "hooks.example.com", or "*.example.com" for its subdomains.
+// Every host is allowed if `allowed` is empty.
+func callbackHostAllowed(allowed []string, host string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		if pattern == host || (strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// startCallback posts the completion of a recorded execution to the
+// callback of the call, or else of the function, in the background. The
+// deliveries are not retried after a restart of the server.
+func startCallback(ctx context.Context, a *appContext, f *dal.Function, executionID int64, userName string, callRes *CallResult, timestamp time.Time) error {
+	functionURL, secret, err := a.dal.GetFunctionCallback(ctx, f.ID)
+	if err != nil {
+		return err
+	}
+	callback := callRes.CallbackURL
+	if callback == "" {
+		callback = functionURL
+	}
+	if callback == "" {
+		return nil
+	}
+	if secret == "" {
+		a.logger(ctx).Warn("Not posting completion", "execution", callRes.Uuid, "callback", callback, "error", errNoCallbackSecret)
+		return nil
+	}
+
+	body, err := json.Marshal(CallbackPayload{
+		Uuid:      callRes.Uuid,
+		User:      userName,
+		Function:  f.Name,
+		Status:    callRes.Result,
+		Output:    apiOutput(callRes.Output),
+		Log:       callRes.Log,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	go deliverCallback(detachContext(ctx), a, executionID, callRes.Uuid, callback, secret, body)
+	return nil
+}
+
+// deliverCallback posts a callback until it is acknowledged with a 2xx
+// response, or CallbackMaxAttempts deliveries failed. Each delivery is
+// recorded with the execution. ctx carries the id of the request that
+// started the execution, and is not cancelled.
+func deliverCallback(ctx context.Context, a *appContext, executionID int64, uuid, callback, secret string, body []byte) {
+	logger := a.logger(ctx).With("execution", uuid, "callback", callback)
+	backoff := CallbackBackoff
+	for attempt := 1; ; attempt++ {
+		code, err := postCallback(uuid, callback, secret, body)
+		record := &dal.CallbackAttempt{
+			ExecutionID: executionID,
+			URL:         callback,
+			Attempt:     attempt,
+			StatusCode:  code,
+		}
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if err := a.dal.PutCallbackAttempt(ctx, record); err != nil {
+			logger.Error("Failed to record callback", "error", err)
+		}
+		if err == nil {
+			return
+		}
+		if attempt >= CallbackMaxAttempts {
+			logger.Error("Giving up callback", "attempts", attempt, "error", err)
+			return
+		}
+		logger.Warn("Callback failed", "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// postCallback posts a signed callback, and returns the response status
+// code, or 0 if there was no response
+func postCallback(uuid, callback, secret string, body []byte) (int, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	request, err := http.NewRequest("POST", callback, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	request.Header.Set(CallbackSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	request.Header.Set(CallbackExecutionHeader, uuid)
+	response, err := callbackClient.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, errors.New("Callback responded " + response.Status)
+	}
+	return response.StatusCode, nil
+}
+
+// callUserFunctionAsync starts an execution in the background, and
+// returns its uuid. The completion is posted to `callback`, signed with
+// the callback secret of the function.
+func callUserFunctionAsync(ctx context.Context, a *appContext, f *dal.Function, userName, params string, inputs map[string][]byte, callback string) ApiCallResult {
+	if err := validateCallbackURL(a, callback); err != nil {
+		return ApiCallResult{Result: ResError, Message: err.Error()}
+	}
+	if _, secret, err := a.dal.GetFunctionCallback(ctx, f.ID); err != nil {
+		return ApiCallResult{Result: ResError, Message: err.Error()}
+	} else if secret == "" {
+		return ApiCallResult{Result: ResError, Message: errNoCallbackSecret.Error()}
+	}
+	uuid, err := uuid.NewTimeBased()
+	if err != nil {
+		return ApiCallResult{Result: ResError, Message: err.Error()}
+	}
+	uuidStr := uuid.String()
+
+	ctx = detachContext(ctx)
+	go func() {
+		timestamp := time.Now()
+		res, err := callFunctionWithUuid(ctx, a, uuidStr, userName, f.Name, params, inputs)
+		if err != nil {
+			// Record the failure, for the callback to report it
+			a.logger(ctx).Error("Asynchronous call failed", "execution", uuidStr, "user", userName, "function", f.Name, "error", err)
+			res = &CallResult{Result: ResError, Uuid: uuidStr, Log: err.Error()}
+		}
+		res.Trigger = TriggerHTTP
+		res.CallbackURL = callback
+		if err := PutFunctionExecution(ctx, a, userName, f.Name, params, res, timestamp); err != nil {
+			a.logger(ctx).Error("Failed to record asynchronous call", "execution", uuidStr, "user", userName, "function", f.Name, "error", err)
+		}
+	}()
+	return ApiCallResult{Result: ExecutionAccepted, Uuid: uuidStr}
+}
+
+// ApiCallback is the completion callback of a function. The secret is
+// only returned when the callback is set.
+type ApiCallback struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+}
+
+func ApiGetCallbackHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	callback, _, err := a.dal.GetFunctionCallback(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	return writeJSON(response, ApiCallback{URL: callback})
+}
+
+// ApiSetCallbackHandler sets the callback the completions of the function
+// executions are posted to, with a new secret. An empty URL removes the
+// callback, calls can then not set their own.
+func ApiSetCallbackHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	var req ApiCallback
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateCallbackFailed, true}
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if req.URL != "" {
+		if err := validateCallbackURL(a, req.URL); err != nil {
+			return StatusError{http.StatusBadRequest, err, MessageUpdateCallbackFailed, true}
+		}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	res := ApiCallback{URL: req.URL}
+	if res.URL != "" {
+		if res.Secret, err = randomHex(32); err != nil {
+			return StatusError{http.StatusInternalServerError, err, MessageUpdateCallbackFailed, true}
+		}
+	}
+	if err := a.dal.SetFunctionCallback(ctx, f.ID, res.URL, res.Secret); err == dal.ErrNoSecretKey {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateCallbackFailed, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateCallbackFailed, true}
+	}
+	return writeJSON(response, res)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/kexec"
+	"golang.org/x/net/context"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+)
+
+// Kinds of drift between the DB, the docker registry and the cluster
+const (
+	// A function in the DB has no image in the registry
+	DriftMissingImage = "missing-image"
+	// An image in a user's registry namespace has no function in the DB
+	DriftOrphanedImage = "orphaned-image"
+	// A function job was left behind in the cluster
+	DriftOrphanedJob = "orphaned-job"
+)
+
+// OrphanedJobMargin is added to the longest time a function job may run
+// before the consistency check reports it as left behind
+var OrphanedJobMargin = 10 * time.Minute
+
+type drift struct {
+	Kind     string
+	User     string
+	Function string
+	Detail   string
+	Repaired bool
+	Err      error
+}
+
+func (d *drift) String() string {
+	s := fmt.Sprintf("%s\t%s/%s\t%s", d.Kind, d.User, d.Function, d.Detail)
+	if d.Err != nil {
+		s += "\trepair failed: " + d.Err.Error()
+	} else if d.Repaired {
+		s += "\trepaired"
+	}
+	return s
+}
+
+// knownFunctions returns the functions of every user in the DB, keyed by
+// user name and then by lower case function name (the name used for
+// images and jobs).
+func knownFunctions(ctx context.Context, a *appContext) (map[string]map[string]*dal.Function, error) {
+	users, err := a.dal.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]map[string]*dal.Function)
+	for _, u := range users {
+		functions, err := a.dal.ListFunctionsOfUser(ctx, u.Name, u.ID)
+		if err != nil {
+			return nil, err
+		}
+		byName := make(map[string]*dal.Function)
+		for _, f := range functions {
+			byName[strings.ToLower(f.Name)] = f
+		}
+		known[u.Name] = byName
+	}
+	return known, nil
+}
+
+// checkConsistency compares the DB, the docker registry and the cluster
+// and reports the drift between them. If repair is true, missing images
+// are rebuilt from the code in the DB, and orphaned images and jobs are
+// deleted.
+func checkConsistency(ctx context.Context, a *appContext, repair bool) ([]*drift, error) {
+	known, err := knownFunctions(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+	drifts := make([]*drift, 0)
+
+	// DB vs registry
+	for user, functions := range known {
+		for name, f := range functions {
+			digest, err := a.r.GetManifestDigest(ctx, user+"/"+name, "latest")
+			if err != nil {
+				return drifts, err
+			}
+			if digest != "" {
+				continue
+			}
+			d := &drift{Kind: DriftMissingImage, User: user, Function: f.Name,
+				Detail: "function has no image in the registry"}
+			if repair {
+				d.Err = restoreFunctionImage(ctx, a, user, f)
+				d.Repaired = d.Err == nil
+			}
+			drifts = append(drifts, d)
+		}
+	}
+
+	// Registry vs DB
+	repos, err := a.r.ListRepositories(ctx)
+	if err != nil {
+		return drifts, err
+	}
+	for _, repo := range repos {
+		parts := strings.SplitN(repo, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		functions, ok := known[parts[0]]
+		if !ok || functions[parts[1]] != nil {
+			continue
+		}
+		// Skip images pushed recently: the function they belong to may
+		// not be committed to the DB yet.
+		created, err := a.r.GetImageCreated(ctx, repo, "latest")
+		if err != nil {
+			return drifts, err
+		}
+		if created.IsZero() || time.Since(created) < RegistryGCGrace {
+			continue
+		}
+		d := &drift{Kind: DriftOrphanedImage, User: parts[0], Function: parts[1],
+			Detail: "image has no function in the DB"}
+		if repair {
+			d.Err = a.r.DeleteImage(ctx, repo, "latest")
+			d.Repaired = d.Err == nil
+		}
+		drifts = append(drifts, d)
+	}
+
+	// Cluster vs DB. Jobs are deleted once the execution completes, so a
+	// job older than its function may run was left behind.
+	jobs, err := listFunctionJobs(ctx, a)
+	if err != nil {
+		return drifts, err
+	}
+	for _, job := range jobs {
+		user := job.Labels[kexec.JobLabelUser]
+		function := job.Labels[kexec.JobLabelFunction]
+		age := time.Since(job.CreationTimestamp.Time)
+
+		detail := ""
+		if known[user] == nil || known[user][function] == nil {
+			detail = "job " + job.Name + " has no function in the DB"
+		} else if age > maxJobAge(a, &job, known[user][function]) {
+			detail = fmt.Sprintf("job %s is %s old", job.Name, age)
+		} else {
+			continue
+		}
+		d := &drift{Kind: DriftOrphanedJob, User: user, Function: function, Detail: detail}
+		if repair {
+			d.Err = a.k.DeleteFunctionJob(ctx, job.Name, job.Namespace)
+			d.Repaired = d.Err == nil
+		}
+		drifts = append(drifts, d)
+	}
+
+	return drifts, nil
+}
+
+// maxJobAge returns how long a job of function f may run: every attempt
+// up to the timeout, the backoffs between them and, for fan-out jobs,
+// each wave of parallel pods.
+func maxJobAge(a *appContext, job *batchv1.Job, f *dal.Function) time.Duration {
+	opts := jobOptions(a, &f.FunctionSettings)
+	if opts.Timeout == 0 {
+		opts.Timeout = kexec.MaxPodExecTime * time.Second
+	}
+	attempts := opts.Retry.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	age := time.Duration(attempts)*opts.Timeout + time.Duration(attempts-1)*kexec.MaxRetryBackoff
+
+	// A fan-out job runs its items in waves of parallel pods
+	waves := int32(1)
+	if c := job.Spec.Completions; c != nil && *c > 1 {
+		waves = *c
+		if p := job.Spec.Parallelism; p != nil && *p > 1 {
+			waves = (*c + *p - 1) / *p
+		}
+	}
+	return time.Duration(waves)*age + OrphanedJobMargin
+}
+
+// listFunctionJobs lists the function jobs of all namespaces functions
+// run in.
+func listFunctionJobs(ctx context.Context, a *appContext) ([]batchv1.Job, error) {
+	users, err := a.dal.ListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	namespaces := map[string]bool{SERVERLESS_NAMESPACE: true}
+	for _, u := range users {
+		namespaces[namespaceOfUser(a, u)] = true
+	}
+
+	jobs := make([]batchv1.Job, 0)
+	for namespace := range namespaces {
+		j, err := a.k.ListFunctionJobs(ctx, namespace)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j...)
+	}
+	return jobs, nil
+}
+
+// runConsistencyCheck runs the consistency checker and writes a report to
+// w. It returns the number of drifts that are left unrepaired.
+func runConsistencyCheck(a *appContext, repair bool, w io.Writer) (int, error) {
+	drifts, err := checkConsistency(context.Background(), a, repair)
+	unrepaired := 0
+	for _, d := range drifts {
+		fmt.Fprintln(w, d)
+		a.log.Info("Consistency check found a drift", "drift", d)
+		if !d.Repaired {
+			unrepaired++
+		}
+	}
+	fmt.Fprintf(w, "%d drift(s) found, %d left unrepaired\n", len(drifts), unrepaired)
+	return unrepaired, err
+}
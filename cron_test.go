@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, c := range []struct {
+		spec  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"*/15 9-17 * * 1-5", true},
+		{"0 0 1,15 * *", true},
+		{"5/10 * * * *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{" @hourly ", true},
+		{"", false},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"5-1 * * * *", false},
+		{"*/0 * * * *", false},
+		{"a * * * *", false},
+		{"@never", false},
+	} {
+		if _, err := parseCron(c.spec); (err == nil) != c.valid {
+			t.Errorf("parseCron(%q): unexpected error %v", c.spec, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	utc := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	for _, c := range []struct {
+		spec     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"* * * * *", utc(2021, 1, 1, 0, 0), utc(2021, 1, 1, 0, 1)},
+		{"* * * * *", time.Date(2021, 1, 1, 0, 0, 30, 0, time.UTC), utc(2021, 1, 1, 0, 1)},
+		{"*/15 * * * *", utc(2021, 1, 1, 0, 15), utc(2021, 1, 1, 0, 30)},
+		{"0 9-17 * * 1-5", utc(2021, 1, 1, 17, 0), utc(2021, 1, 4, 9, 0)},
+		{"@monthly", utc(2021, 1, 31, 12, 0), utc(2021, 2, 1, 0, 0)},
+		{"0 0 29 2 *", utc(2021, 1, 1, 0, 0), utc(2024, 2, 29, 0, 0)},
+		{"0 0 30 2 *", utc(2021, 1, 1, 0, 0), time.Time{}},
+		// Sunday is 0 and 7
+		{"0 0 * * 7", utc(2021, 1, 1, 0, 0), utc(2021, 1, 3, 0, 0)},
+		// Both days restricted: either matches. 2021-01-04 is a Monday.
+		{"0 0 15 * 1", utc(2021, 1, 1, 0, 0), utc(2021, 1, 4, 0, 0)},
+		{"0 0 15 * 1", utc(2021, 1, 12, 0, 0), utc(2021, 1, 15, 0, 0)},
+		// One day restricted: it alone decides
+		{"0 0 15 * *", utc(2021, 1, 1, 0, 0), utc(2021, 1, 15, 0, 0)},
+		{"0 0 * * 1", utc(2021, 1, 5, 0, 0), utc(2021, 1, 11, 0, 0)},
+		{"0 0 */10 * *", utc(2021, 1, 1, 0, 0), utc(2021, 1, 11, 0, 0)},
+		// A step over "*" does not restrict: both days must match
+		{"0 0 */2 * 1", utc(2021, 1, 1, 0, 0), utc(2021, 1, 11, 0, 0)},
+		{"0 0 1 * */2", utc(2021, 1, 1, 0, 0), utc(2021, 4, 1, 0, 0)},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next := s.next(c.from); !next.Equal(c.expected) {
+			t.Errorf("%q after %s: expected %s, got %s", c.spec, c.from, c.expected, next)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("No time zone database:", err)
+	}
+	date := func(month time.Month, day, hour, min int, offset int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, time.FixedZone("", offset*3600)).In(loc)
+	}
+	for _, c := range []struct {
+		spec     string
+		from     time.Time
+		expected []time.Time
+	}{
+		// 2021-03-14 02:00 EST is 03:00 EDT: 02:30 does not exist that day
+		{"30 2 * * *", date(3, 14, 0, 0, -5), []time.Time{date(3, 15, 2, 30, -4)}},
+		{"0 * * * *", date(3, 14, 0, 30, -5), []time.Time{date(3, 14, 1, 0, -5), date(3, 14, 3, 0, -4)}},
+		{"30 3 * * *", date(3, 14, 0, 0, -5), []time.Time{date(3, 14, 3, 30, -4)}},
+		// 2021-11-07 02:00 EDT is 01:00 EST: 01:30 happens twice and runs
+		// once
+		{"30 1 * * *", date(11, 7, 0, 0, -4), []time.Time{date(11, 7, 1, 30, -4), date(11, 8, 1, 30, -5)}},
+		{"0 * * * *", date(11, 7, 0, 30, -4), []time.Time{date(11, 7, 1, 0, -4), date(11, 7, 2, 0, -5)}},
+		{"30 1 * * *", date(11, 7, 1, 10, -5), []time.Time{date(11, 8, 1, 30, -5)}},
+		{"0 12 * * *", date(11, 6, 12, 0, -4), []time.Time{date(11, 7, 12, 0, -5)}},
+	} {
+		s, err := parseCron(c.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := c.from
+		for _, expected := range c.expected {
+			next = s.next(next)
+			if !next.Equal(expected) || next.Location() != loc {
+				t.Errorf("%q after %s: expected %s, got %s", c.spec, c.from, expected, next)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Maximum number of audit events returned by ListAuditEvents
+var MAX_NUM_AUDIT_EVENTS = 1000
+
+// PutAuditEvent records an audit event
+func (dal *mysqlStore) PutAuditEvent(ctx context.Context, e *AuditEvent) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutAuditEvent").End()
+	if e.Created.IsZero() {
+		e.Created = time.Now()
+	}
+	res, err := dal.q.Exec(fmt.Sprintf(
+		`INSERT INTO %s (actor, action, target_user, target_function, source_ip, auth_method, outcome, detail, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		dal.AuditTable), e.Actor, e.Action, e.TargetUser, e.TargetFunction, e.SourceIP, e.AuthMethod,
+		e.Outcome, e.Detail, e.Created)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// ListAuditEvents returns the audit events matching a filter, most
+// recent first
+func (dal *mysqlStore) ListAuditEvents(ctx context.Context, f *AuditFilter) ([]*AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListAuditEvents").End()
+
+	where := []string{"1 = 1"}
+	args := make([]interface{}, 0)
+	for _, c := range []struct{ column, value string }{
+		{"actor", f.Actor},
+		{"action", f.Action},
+		{"target_user", f.TargetUser},
+		{"target_function", f.TargetFunction},
+		{"outcome", f.Outcome},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !f.Since.IsZero() {
+		where = append(where, "created >= ?")
+		args = append(args, f.Since)
+	}
+	if !f.Until.IsZero() {
+		where = append(where, "created < ?")
+		args = append(args, f.Until)
+	}
+	if f.BeforeID > 0 {
+		where = append(where, "au_id < ?")
+		args = append(args, f.BeforeID)
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > MAX_NUM_AUDIT_EVENTS {
+		limit = MAX_NUM_AUDIT_EVENTS
+	}
+
+	rows, err := dal.q.Query(fmt.Sprintf(
+		`SELECT au_id, actor, action, target_user, target_function, source_ip, auth_method, outcome, detail, created
+		FROM %s WHERE %s ORDER BY au_id DESC LIMIT %d`,
+		dal.AuditTable, strings.Join(where, " AND "), limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]*AuditEvent, 0)
+	for rows.Next() {
+		e := &AuditEvent{}
+		var detail sql.NullString
+		if err := rows.Scan(&e.ID, &e.Actor, &e.Action, &e.TargetUser, &e.TargetFunction, &e.SourceIP,
+			&e.AuthMethod, &e.Outcome, &detail, &e.Created); err != nil {
+			return events, err
+		}
+		e.Detail = detail.String
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return events, err
+	}
+	return events, nil
+}
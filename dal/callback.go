@@ -0,0 +1,100 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// PutCallbackAttempt records a delivery of the completion callback of an
+// execution
+func (dal *mysqlStore) PutCallbackAttempt(ctx context.Context, a *CallbackAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutCallbackAttempt").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (e_id, url, attempt, status_code, error) VALUES (?, ?, ?, ?, ?)",
+		dal.CallbacksTable), a.ExecutionID, a.URL, a.Attempt, a.StatusCode, a.Error)
+	return err
+}
+
+// ListCallbackAttempts returns the deliveries of the completion callback
+// of an execution, in order
+func (dal *mysqlStore) ListCallbackAttempts(ctx context.Context, executionID int64) ([]*CallbackAttempt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListCallbackAttempts").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT e_id, url, attempt, status_code, error, created FROM %s WHERE e_id = ? ORDER BY ca_id",
+		dal.CallbacksTable), executionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make([]*CallbackAttempt, 0)
+	for rows.Next() {
+		a := &CallbackAttempt{}
+		var errMsg sql.NullString
+		if err := rows.Scan(&a.ExecutionID, &a.URL, &a.Attempt, &a.StatusCode, &errMsg, &a.Created); err != nil {
+			return attempts, err
+		}
+		a.Error = errMsg.String
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return attempts, err
+	}
+	return attempts, nil
+}
+
+// SetFunctionCallback sets the completion callback of a function. An
+// empty URL removes it.
+func (dal *mysqlStore) SetFunctionCallback(ctx context.Context, functionID int64, url, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "SetFunctionCallback").End()
+	dal.logger(ctx).Info("Setting completion callback", "function_id", functionID)
+
+	var sealed sql.NullString
+	if secret != "" {
+		s, err := dal.box.seal(secret)
+		if err != nil {
+			return err
+		}
+		sealed = sql.NullString{String: s, Valid: true}
+	}
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET callback_url = ?, callback_secret = ? WHERE f_id = ?",
+		dal.FunctionsTable), url, sealed, functionID)
+	return err
+}
+
+// GetFunctionCallback returns the completion callback URL of a function,
+// and the secret signing the callbacks
+func (dal *mysqlStore) GetFunctionCallback(ctx context.Context, functionID int64) (string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	defer startSpan(ctx, "GetFunctionCallback").End()
+	var url string
+	var sealed sql.NullString
+	err := dal.q.QueryRow(fmt.Sprintf(
+		"SELECT callback_url, callback_secret FROM %s WHERE f_id = ?",
+		dal.FunctionsTable), functionID).Scan(&url, &sealed)
+	if err != nil {
+		return "", "", err
+	}
+	if sealed.String == "" {
+		return url, "", nil
+	}
+	secret, err := dal.box.open(sealed.String)
+	if err != nil {
+		return "", "", err
+	}
+	return url, secret, nil
+}
@@ -0,0 +1,68 @@
+package dal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+)
+
+var ErrNoSecretKey = errors.New("No secret key configured, cannot store secrets")
+
+// secretBox encrypts and decrypts secret values with AES-256-GCM. The key
+// is derived from the configured server-side secret key.
+type secretBox struct {
+	aead cipher.AEAD
+}
+
+func newSecretBox(key string) (*secretBox, error) {
+	if key == "" {
+		return nil, nil
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &secretBox{aead}, nil
+}
+
+// seal returns the base64 encoded nonce and ciphertext of `plaintext`
+func (b *secretBox) seal(plaintext string) (string, error) {
+	if b == nil {
+		return "", ErrNoSecretKey
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// open reverses seal
+func (b *secretBox) open(ciphertext string) (string, error) {
+	if b == nil {
+		return "", ErrNoSecretKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	n := b.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errors.New("Secret value is too short")
+	}
+	plaintext, err := b.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
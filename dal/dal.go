@@ -4,10 +4,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/net/context"
 )
 
 var MAX_NUM_FUNC = 100
@@ -23,26 +25,95 @@ type DalConfig struct {
 	DBName string
 
 	// tables
-	UsersTable      string
-	FunctionsTable  string
-	ExecutionsTable string
+	UsersTable         string
+	FunctionsTable     string
+	ExecutionsTable    string
+	EnvTable           string
+	AttemptsTable      string
+	SchedulesTable     string
+	LeasesTable        string
+	WebhooksTable      string
+	DeliveriesTable    string
+	SubscriptionsTable string
+	WorkflowsTable     string
+	WorkflowRunsTable  string
+	WorkflowStepsTable string
+	CallbacksTable     string
+	AuditTable         string
+
+	// Server-side key used to encrypt function secrets
+	SecretKey string
+
+	// Logger of the calls made without a request logger in their
+	// context. logging.Default if nil.
+	Logger *logging.Logger
 }
 
 func (c *DalConfig) getDataSourceName() string {
 	return fmt.Sprintf("%s:%s@tcp(%s:3306)/%s?parseTime=true", c.Username, c.Password, c.DBHost, c.DBName)
 }
 
+// querier is implemented by both *sql.DB and *sql.Tx, so that the same
+// queries can run inside or outside of a transaction.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// mysqlStore implements Store on top of a querier. database/sql cannot
+// interrupt a running statement in the Go versions we support, so a
+// cancelled context fails the calls made after the cancellation.
+type mysqlStore struct {
+	q querier
+
+	UsersTable         string
+	FunctionsTable     string
+	ExecutionsTable    string
+	EnvTable           string
+	AttemptsTable      string
+	SchedulesTable     string
+	LeasesTable        string
+	WebhooksTable      string
+	DeliveriesTable    string
+	SubscriptionsTable string
+	WorkflowsTable     string
+	WorkflowRunsTable  string
+	WorkflowStepsTable string
+	CallbacksTable     string
+	AuditTable         string
+
+	// nil if no secret key is configured
+	box *secretBox
+
+	log *logging.Logger
+}
+
+// logger returns the logger of the request of ctx, if any, so that the
+// records carry its id
+func (dal *mysqlStore) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, dal.log)
+}
+
 type MySQL struct {
 	*sql.DB
+	mysqlStore
 
 	DBName string
+}
 
-	UsersTable      string
-	FunctionsTable  string
-	ExecutionsTable string
+// MySQLTx is a MySQL transaction. It implements Tx.
+type MySQLTx struct {
+	tx *sql.Tx
+	mysqlStore
 }
 
 func NewMySQL(config *DalConfig) (*MySQL, error) {
+	logger := config.Logger
+	if logger == nil {
+		logger = logging.Default
+	}
 	db, err := sql.Open("mysql", config.getDataSourceName())
 	if err != nil {
 		return nil, err
@@ -91,7 +162,7 @@ func NewMySQL(config *DalConfig) (*MySQL, error) {
 	CREATE TABLE IF NOT EXISTS %s (
 		e_id INT NOT NULL AUTO_INCREMENT, 
 		f_id INT NOT NULL,
-		params TEXT,
+		params MEDIUMTEXT,
 		status VARCHAR(255) NOT NULL,
 		uuid VARCHAR(255) NOT NULL,
 		log TEXT, 
@@ -104,18 +175,377 @@ func NewMySQL(config *DalConfig) (*MySQL, error) {
 		return nil, err
 	}
 
+	// Create the function environment table if not already existed.
+	// Values of secrets are encrypted.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		f_id INT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		value TEXT,
+		secret BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY (f_id, name),
+		FOREIGN KEY (f_id) REFERENCES %s(f_id) ON DELETE CASCADE
+	)`, config.EnvTable, config.FunctionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the execution attempts table if not already existed. An
+	// attempt is one pod run of an execution.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		a_id INT NOT NULL AUTO_INCREMENT,
+		e_id INT NOT NULL,
+		attempt INT NOT NULL,
+		pod VARCHAR(255) NOT NULL,
+		phase VARCHAR(255) NOT NULL,
+		exit_code INT NOT NULL,
+		reason VARCHAR(255) NOT NULL DEFAULT '',
+		message TEXT,
+		started TIMESTAMP NULL,
+		finished TIMESTAMP NULL,
+		PRIMARY KEY (a_id),
+		FOREIGN KEY (e_id) REFERENCES %s(e_id) ON DELETE CASCADE
+	)`, config.AttemptsTable, config.ExecutionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the callback attempts table if not already existed. An
+	// attempt is one POST of the completion callback of an execution.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		ca_id INT NOT NULL AUTO_INCREMENT,
+		e_id INT NOT NULL,
+		url VARCHAR(2048) NOT NULL,
+		attempt INT NOT NULL,
+		status_code INT NOT NULL DEFAULT 0,
+		error TEXT,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ca_id),
+		FOREIGN KEY (e_id) REFERENCES %s(e_id) ON DELETE CASCADE
+	)`, config.CallbacksTable, config.ExecutionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the schedules table if not already existed. A schedule runs
+	// a function with fixed params on a cron expression.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		s_id INT NOT NULL AUTO_INCREMENT,
+		f_id INT NOT NULL,
+		spec VARCHAR(255) NOT NULL,
+		params MEDIUMTEXT,
+		timezone VARCHAR(64) NOT NULL DEFAULT '',
+		missed_runs VARCHAR(16) NOT NULL DEFAULT '',
+		last_run TIMESTAMP NULL,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (s_id),
+		FOREIGN KEY (f_id) REFERENCES %s(f_id) ON DELETE CASCADE
+	)`, config.SchedulesTable, config.FunctionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the leases table if not already existed. A lease is held by
+	// one server at a time, e.g. to elect the one firing the schedules.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		name VARCHAR(255) NOT NULL,
+		holder VARCHAR(255) NOT NULL,
+		expires TIMESTAMP NULL,
+		PRIMARY KEY (name)
+	)`, config.LeasesTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the webhooks table if not already existed. The token is the
+	// public identifier of the webhook in its URL, the secret is
+	// encrypted.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		w_id INT NOT NULL AUTO_INCREMENT,
+		f_id INT NOT NULL,
+		token VARCHAR(64) NOT NULL,
+		secret TEXT,
+		signature_header VARCHAR(255) NOT NULL DEFAULT '',
+		algorithm VARCHAR(16) NOT NULL DEFAULT '',
+		headers VARCHAR(1024) NOT NULL DEFAULT '',
+		delivery_header VARCHAR(255) NOT NULL DEFAULT '',
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (w_id),
+		UNIQUE (token),
+		FOREIGN KEY (f_id) REFERENCES %s(f_id) ON DELETE CASCADE
+	)`, config.WebhooksTable, config.FunctionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the webhook deliveries table if not already existed. It
+	// holds the delivery ids seen recently, to reject replayed requests.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		w_id INT NOT NULL,
+		delivery VARCHAR(255) NOT NULL,
+		received TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (w_id, delivery),
+		FOREIGN KEY (w_id) REFERENCES %s(w_id) ON DELETE CASCADE
+	)`, config.DeliveriesTable, config.WebhooksTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the subscriptions table if not already existed. A
+	// subscription calls a function with the messages of a topic.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		sub_id INT NOT NULL AUTO_INCREMENT,
+		f_id INT NOT NULL,
+		source VARCHAR(64) NOT NULL,
+		topic VARCHAR(255) NOT NULL,
+		max_deliveries INT NOT NULL DEFAULT 0,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (sub_id),
+		FOREIGN KEY (f_id) REFERENCES %s(f_id) ON DELETE CASCADE
+	)`, config.SubscriptionsTable, config.FunctionsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the workflows table if not already existed. The definition
+	// is the JSON document of the steps.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		wf_id INT NOT NULL AUTO_INCREMENT,
+		u_id INT NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		definition MEDIUMTEXT,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated TIMESTAMP NULL,
+		PRIMARY KEY (wf_id),
+		UNIQUE (u_id, name),
+		FOREIGN KEY (u_id) REFERENCES %s(u_id) ON DELETE CASCADE
+	)`, config.WorkflowsTable, config.UsersTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the workflow runs table if not already existed. A run keeps
+	// the definition it was started with, and is unfinished as long as
+	// finished is NULL.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		run_id INT NOT NULL AUTO_INCREMENT,
+		wf_id INT NOT NULL,
+		definition MEDIUMTEXT,
+		status VARCHAR(255) NOT NULL,
+		input MEDIUMTEXT,
+		output MEDIUMTEXT,
+		created TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		finished TIMESTAMP NULL,
+		PRIMARY KEY (run_id),
+		FOREIGN KEY (wf_id) REFERENCES %s(wf_id) ON DELETE CASCADE
+	)`, config.WorkflowRunsTable, config.WorkflowsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the workflow steps table if not already existed. It holds
+	// the state of the steps of the runs, by path in the definition.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		run_id INT NOT NULL,
+		path VARCHAR(255) NOT NULL,
+		status VARCHAR(255) NOT NULL,
+		params MEDIUMTEXT,
+		output MEDIUMTEXT,
+		uuid VARCHAR(255) NOT NULL DEFAULT '',
+		message TEXT,
+		started TIMESTAMP NULL,
+		finished TIMESTAMP NULL,
+		PRIMARY KEY (run_id, path),
+		FOREIGN KEY (run_id) REFERENCES %s(run_id) ON DELETE CASCADE
+	)`, config.WorkflowStepsTable, config.WorkflowRunsTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the audit table if not already existed. Events are kept
+	// after the functions they target are deleted, so there is no
+	// foreign key.
+	_, err = db.Exec(fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		au_id INT NOT NULL AUTO_INCREMENT,
+		actor VARCHAR(255) NOT NULL DEFAULT '',
+		action VARCHAR(64) NOT NULL,
+		target_user VARCHAR(255) NOT NULL DEFAULT '',
+		target_function VARCHAR(255) NOT NULL DEFAULT '',
+		source_ip VARCHAR(64) NOT NULL DEFAULT '',
+		auth_method VARCHAR(32) NOT NULL DEFAULT '',
+		outcome VARCHAR(16) NOT NULL,
+		detail TEXT,
+		created TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (au_id),
+		INDEX (created),
+		INDEX (actor),
+		INDEX (target_user, target_function)
+	)`, config.AuditTable))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Columns added after the tables were first released. They are added
+	// to existing tables on startup.
+	columns := []struct{ table, column, definition string }{
+		{config.FunctionsTable, "cpu", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{config.FunctionsTable, "memory", "VARCHAR(32) NOT NULL DEFAULT ''"},
+		{config.FunctionsTable, "timeout", "INT NOT NULL DEFAULT 0"},
+		{config.FunctionsTable, "max_log_size", "BIGINT NOT NULL DEFAULT 0"},
+		{config.FunctionsTable, "max_attempts", "INT NOT NULL DEFAULT 0"},
+		{config.FunctionsTable, "retry_backoff", "INT NOT NULL DEFAULT 0"},
+		{config.FunctionsTable, "retry_on", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{config.UsersTable, "grp", "VARCHAR(255) NOT NULL DEFAULT ''"},
+		{config.ExecutionsTable, "parent_id", "INT NULL"},
+		{config.ExecutionsTable, "output", "TEXT NULL"},
+		{config.FunctionsTable, "warm_pool_size", "INT NOT NULL DEFAULT 0"},
+		{config.ExecutionsTable, "mode", "VARCHAR(16) NOT NULL DEFAULT ''"},
+		{config.ExecutionsTable, "latency_ms", "BIGINT NOT NULL DEFAULT 0"},
+		{config.ExecutionsTable, "trigger_type", "VARCHAR(16) NOT NULL DEFAULT ''"},
+		{config.FunctionsTable, "callback_url", "VARCHAR(2048) NOT NULL DEFAULT ''"},
+		{config.FunctionsTable, "callback_secret", "TEXT NULL"},
+	}
+	for _, c := range columns {
+		if err := addColumnIfNotExisted(logger, db, config.DBName, c.table, c.column, c.definition); err != nil {
+			return nil, err
+		}
+	}
+
+	// Params were limited to 64KB before large params could be passed
+	// in a ConfigMap
+	if err := modifyColumnType(logger, db, config.DBName, config.ExecutionsTable, "params", "mediumtext"); err != nil {
+		return nil, err
+	}
+
+	box, err := newSecretBox(config.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MySQL{
-		db,
-		config.DBName,
-		config.UsersTable,
-		config.FunctionsTable,
-		config.ExecutionsTable,
+		DB: db,
+		mysqlStore: mysqlStore{
+			q:                  timedQuerier{db},
+			UsersTable:         config.UsersTable,
+			FunctionsTable:     config.FunctionsTable,
+			ExecutionsTable:    config.ExecutionsTable,
+			EnvTable:           config.EnvTable,
+			AttemptsTable:      config.AttemptsTable,
+			SchedulesTable:     config.SchedulesTable,
+			LeasesTable:        config.LeasesTable,
+			WebhooksTable:      config.WebhooksTable,
+			DeliveriesTable:    config.DeliveriesTable,
+			SubscriptionsTable: config.SubscriptionsTable,
+			WorkflowsTable:     config.WorkflowsTable,
+			WorkflowRunsTable:  config.WorkflowRunsTable,
+			WorkflowStepsTable: config.WorkflowStepsTable,
+			CallbacksTable:     config.CallbacksTable,
+			AuditTable:         config.AuditTable,
+			box:                box,
+			log:                logger,
+		},
+		DBName: config.DBName,
 	}, nil
 }
 
+// addColumnIfNotExisted adds a column to an existing table, unless the
+// table already has it.
+func addColumnIfNotExisted(logger *logging.Logger, db *sql.DB, dbName, table, column, definition string) error {
+	var n int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		dbName, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	logger.Info("Adding column", "table", table, "column", column)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// modifyColumnType changes the type of an existing column, unless it
+// already has type `dataType`.
+func modifyColumnType(logger *logging.Logger, db *sql.DB, dbName, table, column, dataType string) error {
+	var current string
+	err := db.QueryRow(
+		"SELECT DATA_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND COLUMN_NAME = ?",
+		dbName, table, column).Scan(&current)
+	if err != nil || strings.EqualFold(current, dataType) {
+		return err
+	}
+	logger.Info("Changing column type", "table", table, "column", column, "type", dataType)
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s MODIFY COLUMN %s %s", table, column, dataType))
+	return err
+}
+
+// Begin starts a transaction. Changes made through the returned Tx are
+// only visible to others after Commit.
+func (dal *MySQL) Begin(ctx context.Context) (Tx, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "Begin").End()
+	tx, err := dal.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	store := dal.mysqlStore
+	store.q = timedQuerier{tx}
+	return &MySQLTx{tx, store}, nil
+}
+
+// Ping checks that the database is reachable
+func (dal *MySQL) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "Ping").End()
+	return dal.DB.Ping()
+}
+
+func (t *MySQLTx) Commit() error {
+	return t.tx.Commit()
+}
+
+// Rollback aborts the transaction. Rolling back a transaction which is
+// already committed or rolled back is a no-op.
+func (t *MySQLTx) Rollback() error {
+	if err := t.tx.Rollback(); err != nil && err != sql.ErrTxDone {
+		return err
+	}
+	return nil
+}
+
 // List all functions created by a user
-func (dal *MySQL) ListFunctionsOfUser(username string, userId int64) ([]*Function, error) {
-	log.Println("Listing functions for user", username)
+func (dal *mysqlStore) ListFunctionsOfUser(ctx context.Context, username string, userId int64) ([]*Function, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListFunctionsOfUser").End()
+	dal.logger(ctx).Debug("Listing functions", "user", username)
 
 	uid := userId
 
@@ -124,14 +554,14 @@ func (dal *MySQL) ListFunctionsOfUser(username string, userId int64) ([]*Functio
 	}
 
 	if uid < 0 {
-		err := dal.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), username).Scan(&uid)
+		err := dal.q.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), username).Scan(&uid)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	stmt, err := dal.Prepare(fmt.Sprintf(
-		"SELECT f_id, name, content, updated FROM %s WHERE u_id = ?",
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"SELECT f_id, name, content, updated, cpu, memory, timeout, max_log_size, max_attempts, retry_backoff, retry_on, warm_pool_size FROM %s WHERE u_id = ?",
 		dal.FunctionsTable))
 	if err != nil {
 		return nil, err
@@ -154,7 +584,9 @@ func (dal *MySQL) ListFunctionsOfUser(username string, userId int64) ([]*Functio
 			Updated: time.Time{},
 		}
 
-		err := rows.Scan(&function.ID, &function.Name, &function.Content, &function.Updated)
+		err := rows.Scan(&function.ID, &function.Name, &function.Content, &function.Updated,
+			&function.CPU, &function.Memory, &function.Timeout, &function.MaxLogSize,
+			&function.MaxAttempts, &function.RetryBackoff, &function.RetryOn, &function.WarmPoolSize)
 		if err != nil {
 			return funcList, err
 		}
@@ -172,11 +604,15 @@ func (dal *MySQL) ListFunctionsOfUser(username string, userId int64) ([]*Functio
 // PutUserIfNotExists inserts user into DB if the user
 // is not already inserted. The caller is responsible for
 // making sure `userName` is not empty.
-func (dal *MySQL) PutUserIfNotExisted(groupName, userName string) (int64, int64, error) {
-	log.Println("Adding user", userName, "to DB...")
+func (dal *mysqlStore) PutUserIfNotExisted(ctx context.Context, groupName, userName string) (int64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, -1, err
+	}
+	defer startSpan(ctx, "PutUserIfNotExisted").End()
+	dal.logger(ctx).Debug("Adding user", "user", userName, "group", groupName)
 
-	stmt, err := dal.Prepare(fmt.Sprintf(
-		"INSERT IGNORE INTO %s (name) VALUES (?)",
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"INSERT IGNORE INTO %s (name, grp) VALUES (?, ?)",
 		dal.UsersTable))
 
 	if err != nil {
@@ -184,7 +620,7 @@ func (dal *MySQL) PutUserIfNotExisted(groupName, userName string) (int64, int64,
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(userName)
+	res, err := stmt.Exec(userName, groupName)
 	if err != nil {
 		return -1, -1, err
 	}
@@ -202,10 +638,64 @@ func (dal *MySQL) PutUserIfNotExisted(groupName, userName string) (int64, int64,
 	return lastId, rowCnt, nil
 }
 
+func (dal *mysqlStore) GetUser(ctx context.Context, userName string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetUser").End()
+	var u User
+	err := dal.q.QueryRow(fmt.Sprintf("SELECT u_id, name, grp, created FROM %s WHERE name = ?", dal.UsersTable),
+		userName).Scan(&u.ID, &u.Name, &u.Group, &u.Created)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (dal *mysqlStore) SetUserGroup(ctx context.Context, userName, groupName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "SetUserGroup").End()
+	_, err := dal.q.Exec(fmt.Sprintf("UPDATE %s SET grp = ? WHERE name = ?", dal.UsersTable), groupName, userName)
+	return err
+}
+
+// List all users known to the DB
+func (dal *mysqlStore) ListUsers(ctx context.Context) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListUsers").End()
+	rows, err := dal.q.Query(fmt.Sprintf("SELECT u_id, name, grp, created FROM %s", dal.UsersTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make([]*User, 0)
+	for rows.Next() {
+		u := &User{ID: -1}
+		if err := rows.Scan(&u.ID, &u.Name, &u.Group, &u.Created); err != nil {
+			return users, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
 //
 // When both `userName` and `userId` are not empty, the function check
 // userId first.
-func (dal *MySQL) PutFunction(userName, funcName, funcContent string, userId int64) (int64, int64, error) {
+func (dal *mysqlStore) PutFunction(ctx context.Context, userName, funcName, funcContent string, userId int64) (int64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, -1, err
+	}
+	defer startSpan(ctx, "PutFunction").End()
 	var res sql.Result
 	var fid int
 	uid := userId
@@ -215,19 +705,19 @@ func (dal *MySQL) PutFunction(userName, funcName, funcContent string, userId int
 	}
 
 	if uid < 0 {
-		err := dal.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), userName).Scan(&uid)
+		err := dal.q.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), userName).Scan(&uid)
 		if err != nil {
 			return -1, -1, err
 		}
 	}
 
 	// Check if the function exists
-	err := dal.QueryRow(fmt.Sprintf("SELECT f_id FROM %s WHERE name = ? AND u_id = ?", dal.FunctionsTable), funcName, uid).Scan(&fid)
+	err := dal.q.QueryRow(fmt.Sprintf("SELECT f_id FROM %s WHERE name = ? AND u_id = ?", dal.FunctionsTable), funcName, uid).Scan(&fid)
 	// Not exist, insert a new one
 	if err == sql.ErrNoRows {
-		log.Println("Inserting function", funcName, "into DB...")
+		dal.logger(ctx).Info("Inserting function", "user", userName, "function", funcName)
 
-		stmt, err := dal.Prepare(fmt.Sprintf(
+		stmt, err := dal.q.Prepare(fmt.Sprintf(
 			"INSERT INTO %s (u_id, name, content) VALUES (?, ?, ?)",
 			dal.FunctionsTable))
 
@@ -241,14 +731,13 @@ func (dal *MySQL) PutFunction(userName, funcName, funcContent string, userId int
 			return -1, -1, err
 		}
 
-		log.Println("Inserted!")
 
 	} else if err != nil {
 		return -1, -1, err
 		// Already exist, update the function
 	} else {
-		log.Println("Updating function", funcName, "in DB...")
-		stmt, err := dal.Prepare(fmt.Sprintf(
+		dal.logger(ctx).Info("Updating function", "user", userName, "function", funcName)
+		stmt, err := dal.q.Prepare(fmt.Sprintf(
 			"UPDATE %s SET content = ? WHERE f_id = ?",
 			dal.FunctionsTable))
 		if err != nil {
@@ -259,7 +748,6 @@ func (dal *MySQL) PutFunction(userName, funcName, funcContent string, userId int
 		if err != nil {
 			return -1, -1, err
 		}
-		log.Println("Updated!")
 	}
 	lastId, err := res.LastInsertId()
 	if err != nil {
@@ -275,14 +763,20 @@ func (dal *MySQL) PutFunction(userName, funcName, funcContent string, userId int
 
 }
 
-func (dal *MySQL) GetFunction(userName, funcName string) (*Function, error) {
-	log.Println("Retriving function", funcName, "for user", userName)
+func (dal *mysqlStore) GetFunction(ctx context.Context, userName, funcName string) (*Function, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetFunction").End()
+	dal.logger(ctx).Debug("Retrieving function", "user", userName, "function", funcName)
 
 	var function Function
-	err := dal.QueryRow(fmt.Sprintf(
-		"SELECT f.f_id, f.u_id, f.name, content, updated FROM %s f INNER JOIN %s u ON f.u_id=u.u_id WHERE f.name = ? AND u.name = ?",
+	err := dal.q.QueryRow(fmt.Sprintf(
+		"SELECT f.f_id, f.u_id, f.name, content, updated, cpu, memory, timeout, max_log_size, max_attempts, retry_backoff, retry_on, warm_pool_size FROM %s f INNER JOIN %s u ON f.u_id=u.u_id WHERE f.name = ? AND u.name = ?",
 		dal.FunctionsTable, dal.UsersTable), funcName, userName).Scan(
-		&function.ID, &function.UserID, &function.Name, &function.Content, &function.Updated)
+		&function.ID, &function.UserID, &function.Name, &function.Content, &function.Updated,
+		&function.CPU, &function.Memory, &function.Timeout, &function.MaxLogSize,
+		&function.MaxAttempts, &function.RetryBackoff, &function.RetryOn, &function.WarmPoolSize)
 	if err != nil {
 		return nil, err
 	}
@@ -291,16 +785,40 @@ func (dal *MySQL) GetFunction(userName, funcName string) (*Function, error) {
 
 }
 
-func (dal *MySQL) DeleteFunction(userName, funcName string) error {
+func (dal *mysqlStore) UpdateFunctionSettings(ctx context.Context, userName, funcName string, settings *FunctionSettings) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "UpdateFunctionSettings").End()
+	dal.logger(ctx).Info("Updating function settings", "user", userName, "function", funcName)
+
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"UPDATE %s f INNER JOIN %s u ON f.u_id=u.u_id SET f.cpu = ?, f.memory = ?, f.timeout = ?, f.max_log_size = ?, f.max_attempts = ?, f.retry_backoff = ?, f.retry_on = ?, f.warm_pool_size = ? WHERE f.name = ? AND u.name = ?",
+		dal.FunctionsTable, dal.UsersTable))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(settings.CPU, settings.Memory, settings.Timeout, settings.MaxLogSize,
+		settings.MaxAttempts, settings.RetryBackoff, settings.RetryOn, settings.WarmPoolSize, funcName, userName)
+	return err
+}
+
+func (dal *mysqlStore) DeleteFunction(ctx context.Context, userName, funcName string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "DeleteFunction").End()
 	var uid int64
 
-	log.Println("Deleting function", funcName, "for user", userName)
+	dal.logger(ctx).Info("Deleting function", "user", userName, "function", funcName)
 
-	err := dal.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), userName).Scan(&uid)
+	err := dal.q.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), userName).Scan(&uid)
 	if err != nil {
 		return err
 	}
-	stmt, err := dal.Prepare(fmt.Sprintf(
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
 		"DELETE FROM %s WHERE name = ? AND u_id = ?",
 		dal.FunctionsTable))
 
@@ -316,9 +834,97 @@ func (dal *MySQL) DeleteFunction(userName, funcName string) error {
 	return nil
 }
 
-func (dal *MySQL) PutExecution(functionID int64, params, status, uuid, log string, timestamp time.Time) (int64, int64, error) {
-	stmt, err := dal.Prepare(fmt.Sprintf(
-		"INSERT INTO %s (f_id, params, status, uuid, log, created) VALUES (?, ?, ?, ?, ?, ?)",
+// PutFunctionEnv replaces the environment of a function. Run it in a
+// transaction to replace the environment atomically.
+func (dal *mysqlStore) PutFunctionEnv(ctx context.Context, functionID int64, env []*EnvVar) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutFunctionEnv").End()
+	dal.logger(ctx).Info("Putting function environment", "function_id", functionID, "count", len(env))
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s WHERE f_id = ?", dal.EnvTable), functionID); err != nil {
+		return err
+	}
+	if len(env) == 0 {
+		return nil
+	}
+
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (f_id, name, value, secret) VALUES (?, ?, ?, ?)",
+		dal.EnvTable))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range env {
+		value := e.Value
+		if e.Secret {
+			if value, err = dal.box.seal(e.Value); err != nil {
+				return err
+			}
+		}
+		if _, err := stmt.Exec(functionID, e.Name, value, e.Secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListFunctionEnv returns the environment of a function, with secrets
+// decrypted.
+func (dal *mysqlStore) ListFunctionEnv(ctx context.Context, functionID int64) ([]*EnvVar, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListFunctionEnv").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT name, value, secret FROM %s WHERE f_id = ? ORDER BY name", dal.EnvTable), functionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	env := make([]*EnvVar, 0)
+	for rows.Next() {
+		e := &EnvVar{}
+		if err := rows.Scan(&e.Name, &e.Value, &e.Secret); err != nil {
+			return env, err
+		}
+		if e.Secret {
+			if e.Value, err = dal.box.open(e.Value); err != nil {
+				return env, err
+			}
+		}
+		env = append(env, e)
+	}
+	if err := rows.Err(); err != nil {
+		return env, err
+	}
+
+	return env, nil
+}
+
+func (dal *mysqlStore) PutExecution(ctx context.Context, functionID int64, params, status, uuid, log, output string, timestamp time.Time) (int64, int64, error) {
+	return dal.putExecution(ctx, sql.NullInt64{}, functionID, params, status, uuid, log, output, timestamp)
+}
+
+// PutChildExecution records an execution that is part of the fan-out
+// execution `parentID`.
+func (dal *mysqlStore) PutChildExecution(ctx context.Context, parentID, functionID int64, params, status, uuid, log, output string, timestamp time.Time) (int64, int64, error) {
+	return dal.putExecution(ctx, sql.NullInt64{Int64: parentID, Valid: true}, functionID, params, status, uuid, log, output, timestamp)
+}
+
+// putExecution inserts an execution. An empty output is stored as NULL:
+// the function returned nothing, which is not the JSON value null.
+func (dal *mysqlStore) putExecution(ctx context.Context, parentID sql.NullInt64, functionID int64, params, status, uuid, log, output string, timestamp time.Time) (int64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, -1, err
+	}
+	defer startSpan(ctx, "PutExecution").End()
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (f_id, parent_id, params, status, uuid, log, output, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
 		dal.ExecutionsTable))
 
 	if err != nil {
@@ -326,7 +932,8 @@ func (dal *MySQL) PutExecution(functionID int64, params, status, uuid, log strin
 	}
 	defer stmt.Close()
 
-	res, err := stmt.Exec(functionID, params, status, uuid, log, timestamp)
+	res, err := stmt.Exec(functionID, parentID, params, status, uuid, log,
+		sql.NullString{String: output, Valid: output != ""}, timestamp)
 	if err != nil {
 		return -1, -1, err
 	}
@@ -344,28 +951,115 @@ func (dal *MySQL) PutExecution(functionID int64, params, status, uuid, log strin
 	return lastId, rowCnt, nil
 }
 
-func (dal *MySQL) ListExecution(userName, funcName string) ([]*FunctionExecution, error) {
-	log.Println("Listing executions for function", funcName, "of user", userName)
+// PutExecutionLatency records how an execution ran, and the time from the
+// call to its completion.
+func (dal *mysqlStore) PutExecutionLatency(ctx context.Context, executionID int64, mode string, latency time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutExecutionLatency").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET mode = ?, latency_ms = ? WHERE e_id = ?",
+		dal.ExecutionsTable), mode, int64(latency/time.Millisecond), executionID)
+	return err
+}
+
+// PutExecutionTrigger records what started an execution
+func (dal *mysqlStore) PutExecutionTrigger(ctx context.Context, executionID int64, trigger string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutExecutionTrigger").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET trigger_type = ? WHERE e_id = ?",
+		dal.ExecutionsTable), trigger, executionID)
+	return err
+}
+
+func (dal *mysqlStore) ListExecution(ctx context.Context, userName, funcName string) ([]*FunctionExecution, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListExecution").End()
+	dal.logger(ctx).Debug("Listing executions", "user", userName, "function", funcName)
 
 	// Get function ID. Given username and function name, the function ID is unique
 	var funcID int64
-	err := dal.QueryRow(fmt.Sprintf(
+	err := dal.q.QueryRow(fmt.Sprintf(
 		"SELECT f.f_id FROM %s f INNER JOIN %s u ON f.u_id=u.u_id WHERE f.name = ? AND u.name = ?",
 		dal.FunctionsTable, dal.UsersTable), funcName, userName).Scan(&funcID)
 	if err != nil {
 		return nil, err
 	}
 
-	// Get exections for a specific function ID
-	stmt, err := dal.Prepare(fmt.Sprintf(
-		"SELECT e_id, f_id, params, status, uuid, log, created FROM %s WHERE f_id = ? ORDER BY created DESC LIMIT %d",
-		dal.ExecutionsTable, MAX_NUM_FUNC_EXEC))
+	// Get exections for a specific function ID. Children of fan-out
+	// executions are listed with their parent.
+	execList, err := dal.listExecutions(ctx, fmt.Sprintf(
+		"SELECT e_id, f_id, params, status, uuid, log, output, mode, latency_ms, trigger_type, created FROM %s WHERE f_id = ? AND parent_id IS NULL ORDER BY created DESC LIMIT %d",
+		dal.ExecutionsTable, MAX_NUM_FUNC_EXEC), funcID)
+	if err != nil {
+		return execList, err
+	}
+
+	for _, e := range execList {
+		if e.Children, err = dal.ListChildExecutions(ctx, e.ID); err != nil {
+			return execList, err
+		}
+	}
+
+	return execList, nil
+}
+
+// GetExecution returns an execution of a function by uuid, with its
+// attempts and children.
+func (dal *mysqlStore) GetExecution(ctx context.Context, userName, funcName, uuid string) (*FunctionExecution, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetExecution").End()
+	execList, err := dal.listExecutions(ctx, fmt.Sprintf(
+		"SELECT e.e_id, e.f_id, e.params, e.status, e.uuid, e.log, e.output, e.mode, e.latency_ms, e.trigger_type, e.created FROM %s e INNER JOIN %s f ON e.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id WHERE e.uuid = ? AND f.name = ? AND u.name = ?",
+		dal.ExecutionsTable, dal.FunctionsTable, dal.UsersTable), uuid, funcName, userName)
+	if err != nil {
+		return nil, err
+	}
+	if len(execList) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	e := execList[0]
+	if e.Children, err = dal.ListChildExecutions(ctx, e.ID); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ListChildExecutions returns the executions of a fan-out execution, in
+// the order they were recorded.
+func (dal *mysqlStore) ListChildExecutions(ctx context.Context, parentID int64) ([]*FunctionExecution, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListChildExecutions").End()
+	return dal.listExecutions(ctx, fmt.Sprintf(
+		"SELECT e_id, f_id, params, status, uuid, log, output, mode, latency_ms, trigger_type, created FROM %s WHERE parent_id = ? ORDER BY e_id",
+		dal.ExecutionsTable), parentID)
+}
+
+// listExecutions runs an executions query and fills the attempts and
+// callback attempts of each execution.
+func (dal *mysqlStore) listExecutions(ctx context.Context, query string, args ...interface{}) ([]*FunctionExecution, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListExecutions").End()
+	stmt, err := dal.q.Prepare(query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query(funcID)
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		return nil, err
 	}
@@ -374,32 +1068,164 @@ func (dal *MySQL) ListExecution(userName, funcName string) ([]*FunctionExecution
 	execList := make([]*FunctionExecution, 0, MAX_NUM_FUNC_EXEC)
 	for rows.Next() {
 		e := FunctionExecution{ID: -1, FunctionID: -1}
-		err := rows.Scan(&e.ID, &e.FunctionID, &e.Params, &e.Status, &e.Uuid, &e.Log, &e.Timestamp)
+		var output sql.NullString
+		var latency int64
+		err := rows.Scan(&e.ID, &e.FunctionID, &e.Params, &e.Status, &e.Uuid, &e.Log, &output, &e.Mode, &latency, &e.Trigger, &e.Timestamp)
 		if err != nil {
 			return execList, err
 		}
+		e.Output = output.String
+		e.Latency = time.Duration(latency) * time.Millisecond
 
 		execList = append(execList, &e)
 	}
 	if err := rows.Err(); err != nil {
 		return execList, err
 	}
+	rows.Close()
+
+	for _, e := range execList {
+		if e.Attempts, err = dal.ListExecutionAttempts(ctx, e.ID); err != nil {
+			return execList, err
+		}
+		if e.Callbacks, err = dal.ListCallbackAttempts(ctx, e.ID); err != nil {
+			return execList, err
+		}
+	}
 
 	return execList, nil
 }
 
+// PutExecutionAttempts records the attempts of an execution, in order.
+func (dal *mysqlStore) PutExecutionAttempts(ctx context.Context, executionID int64, attempts []*ExecutionAttempt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutExecutionAttempts").End()
+	stmt, err := dal.q.Prepare(fmt.Sprintf(
+		"INSERT INTO %s (e_id, attempt, pod, phase, exit_code, reason, message, started, finished) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		dal.AttemptsTable))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for i, a := range attempts {
+		_, err := stmt.Exec(executionID, i+1, a.Pod, a.Phase, a.ExitCode, a.Reason, a.Message,
+			nullTime(a.Started), nullTime(a.Finished))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListExecutionAttempts returns the attempts of an execution, in order.
+func (dal *mysqlStore) ListExecutionAttempts(ctx context.Context, executionID int64) ([]*ExecutionAttempt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListExecutionAttempts").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT pod, phase, exit_code, reason, message, started, finished FROM %s WHERE e_id = ? ORDER BY attempt",
+		dal.AttemptsTable), executionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := make([]*ExecutionAttempt, 0)
+	for rows.Next() {
+		a := &ExecutionAttempt{}
+		var message sql.NullString
+		var started, finished mysql.NullTime
+		if err := rows.Scan(&a.Pod, &a.Phase, &a.ExitCode, &a.Reason, &message, &started, &finished); err != nil {
+			return attempts, err
+		}
+		a.Message = message.String
+		a.Started = started.Time
+		a.Finished = finished.Time
+		attempts = append(attempts, a)
+	}
+	if err := rows.Err(); err != nil {
+		return attempts, err
+	}
+
+	return attempts, nil
+}
+
+// nullTime stores the zero time as NULL
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
 // Be careful with this function, it drops your entire database.
 // Only used for test purpose.
-func (dal *MySQL) ClearDatabase() error {
-	if _, err := dal.Exec(fmt.Sprintf("DELETE FROM %s", dal.ExecutionsTable)); err != nil {
+func (dal *mysqlStore) ClearDatabase(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "ClearDatabase").End()
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.AttemptsTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.CallbacksTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.AuditTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.SchedulesTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.WorkflowStepsTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.WorkflowRunsTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.WorkflowsTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.SubscriptionsTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.DeliveriesTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.WebhooksTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.LeasesTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.EnvTable)); err != nil {
+		return err
+	}
+
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.ExecutionsTable)); err != nil {
 		return err
 	}
 
-	if _, err := dal.Exec(fmt.Sprintf("DELETE FROM %s", dal.FunctionsTable)); err != nil {
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.FunctionsTable)); err != nil {
 		return err
 	}
 
-	if _, err := dal.Exec(fmt.Sprintf("DELETE FROM %s", dal.UsersTable)); err != nil {
+	if _, err := dal.q.Exec(fmt.Sprintf("DELETE FROM %s", dal.UsersTable)); err != nil {
 		return err
 	}
 
@@ -1,11 +1,14 @@
 package dal
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
 	"os"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 var funcContentTemp = `
@@ -23,6 +26,8 @@ var (
 	status       = "Failed"
 	uuid         = "xxx"
 	execLog      = "log"
+	output       = "{\"y\":2}"
+	ctx          = context.Background()
 )
 
 func TestMain(m *testing.M) {
@@ -34,9 +39,23 @@ func TestMain(m *testing.M) {
 
 		DBName: "kexectest",
 
-		UsersTable:      "users",
-		FunctionsTable:  "functions",
-		ExecutionsTable: "executions",
+		UsersTable:         "users",
+		FunctionsTable:     "functions",
+		ExecutionsTable:    "executions",
+		EnvTable:           "function_env",
+		AttemptsTable:      "execution_attempts",
+		SchedulesTable:     "schedules",
+		LeasesTable:        "leases",
+		WebhooksTable:      "webhooks",
+		DeliveriesTable:    "webhook_deliveries",
+		SubscriptionsTable: "subscriptions",
+		WorkflowsTable:     "workflows",
+		WorkflowRunsTable:  "workflow_runs",
+		WorkflowStepsTable: "workflow_steps",
+		CallbacksTable:     "callback_attempts",
+		AuditTable:         "audit_log",
+
+		SecretKey: "test",
 	}
 
 	db, err = NewMySQL(config)
@@ -46,14 +65,14 @@ func TestMain(m *testing.M) {
 	}
 
 	// Clear DB before test
-	if err = db.ClearDatabase(); err != nil {
+	if err = db.ClearDatabase(ctx); err != nil {
 		panic(err)
 	}
 
 	code := m.Run()
 
 	// Clear DB after test
-	if err = db.ClearDatabase(); err != nil {
+	if err = db.ClearDatabase(ctx); err != nil {
 		panic(err)
 	}
 
@@ -64,7 +83,7 @@ func TestPutUserIfNotExisted(t *testing.T) {
 	if db == nil {
 		return
 	}
-	lastId, rowCount, err := db.PutUserIfNotExisted("", testUsername)
+	lastId, rowCount, err := db.PutUserIfNotExisted(ctx, "", testUsername)
 	userId = lastId
 	if err != nil {
 		t.Error(err)
@@ -72,12 +91,35 @@ func TestPutUserIfNotExisted(t *testing.T) {
 	if rowCount != 1 {
 		t.Error("First user insert error")
 	}
-	lastId, rowCount, err = db.PutUserIfNotExisted("", testUsername)
+	lastId, rowCount, err = db.PutUserIfNotExisted(ctx, "", testUsername)
 	if rowCount != 0 {
 		t.Error("Second user insert error")
 	}
 }
 
+func TestUserGroup(t *testing.T) {
+	if err := db.SetUserGroup(ctx, testUsername, "TestGroup"); err != nil {
+		t.Error(err)
+	}
+	user, err := db.GetUser(ctx, testUsername)
+	if err != nil {
+		t.Error(err)
+	}
+	if user.ID != userId || user.Group != "TestGroup" {
+		t.Error("Get user error")
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	users, err := db.ListUsers(ctx)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(users) != 1 || users[0].Name != testUsername {
+		t.Error("List users error")
+	}
+}
+
 func TestPutFunction(t *testing.T) {
 	funcList := make([]*Function, 0, 5)
 	for i := 0; i < 3; i++ {
@@ -91,7 +133,7 @@ func TestPutFunction(t *testing.T) {
 
 	for i, function := range funcList {
 		log.Printf("Inserting function %s...", function.Name)
-		_, rowCount, err := db.PutFunction("", function.Name, function.Content, function.UserID)
+		_, rowCount, err := db.PutFunction(ctx, "", function.Name, function.Content, function.UserID)
 		if err != nil {
 			t.Error(err)
 		}
@@ -103,7 +145,7 @@ func TestPutFunction(t *testing.T) {
 	// Insert again. No rows should be updated.
 	for i, function := range funcList {
 		log.Printf("Inserting function %s...", function.Name)
-		_, rowCount, err := db.PutFunction("", function.Name, function.Content, function.UserID)
+		_, rowCount, err := db.PutFunction(ctx, "", function.Name, function.Content, function.UserID)
 		if err != nil {
 			t.Error(err)
 		}
@@ -128,7 +170,7 @@ func TestUpdateFunction(t *testing.T) {
 
 	for i, function := range funcList {
 		log.Printf("Inserting function %s...", function.Name)
-		_, rowCount, err := db.PutFunction("", function.Name, function.Content, function.UserID)
+		_, rowCount, err := db.PutFunction(ctx, "", function.Name, function.Content, function.UserID)
 		if err != nil {
 			t.Error(err)
 		}
@@ -140,7 +182,7 @@ func TestUpdateFunction(t *testing.T) {
 }
 
 func TestListFunctionsOfUser(t *testing.T) {
-	functions, err := db.ListFunctionsOfUser(testUsername, -1)
+	functions, err := db.ListFunctionsOfUser(ctx, testUsername, -1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -150,7 +192,7 @@ func TestListFunctionsOfUser(t *testing.T) {
 }
 
 func TestGetFunction(t *testing.T) {
-	function, err := db.GetFunction(testUsername, "TestFunction1")
+	function, err := db.GetFunction(ctx, testUsername, "TestFunction1")
 	if err != nil {
 		t.Error(err)
 	}
@@ -163,8 +205,50 @@ func TestGetFunction(t *testing.T) {
 	functionId = function.ID
 }
 
+func TestUpdateFunctionSettings(t *testing.T) {
+	settings := FunctionSettings{CPU: "500m", Memory: "128Mi", Timeout: 30, MaxLogSize: 1024,
+		MaxAttempts: 3, RetryBackoff: 5, RetryOn: "1,Evicted", WarmPoolSize: 2}
+	if err := db.UpdateFunctionSettings(ctx, testUsername, "TestFunction2", &settings); err != nil {
+		t.Error(err)
+	}
+	function, err := db.GetFunction(ctx, testUsername, "TestFunction2")
+	if err != nil {
+		t.Error(err)
+	}
+	if function.FunctionSettings != settings {
+		t.Error("Update function settings error")
+	}
+}
+
+func TestFunctionEnv(t *testing.T) {
+	env := []*EnvVar{
+		&EnvVar{Name: "A", Value: "plain"},
+		&EnvVar{Name: "B", Value: "secret", Secret: true},
+	}
+	if err := db.PutFunctionEnv(ctx, functionId, env); err != nil {
+		t.Error(err)
+	}
+
+	// Secrets are not stored in clear
+	var stored string
+	if err := db.QueryRow("SELECT value FROM function_env WHERE name = 'B'").Scan(&stored); err != nil {
+		t.Error(err)
+	}
+	if stored == "secret" {
+		t.Error("Secret stored in clear")
+	}
+
+	list, err := db.ListFunctionEnv(ctx, functionId)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 || *list[0] != *env[0] || *list[1] != *env[1] {
+		t.Error("List function env error")
+	}
+}
+
 func TestPutExecution(t *testing.T) {
-	_, rowCount, err := db.PutExecution(functionId, params, status, uuid, execLog, time.Now())
+	_, rowCount, err := db.PutExecution(ctx, functionId, params, status, uuid, execLog, output, time.Now())
 	if err != nil {
 		t.Error(err)
 	}
@@ -174,7 +258,7 @@ func TestPutExecution(t *testing.T) {
 }
 
 func TestListExecution(t *testing.T) {
-	exec, err := db.ListExecution(testUsername, "TestFunction1")
+	exec, err := db.ListExecution(ctx, testUsername, "TestFunction1")
 	if err != nil {
 		t.Error(err)
 	}
@@ -182,18 +266,412 @@ func TestListExecution(t *testing.T) {
 		exec[0].Params != params ||
 		exec[0].Status != status ||
 		exec[0].Uuid != uuid ||
-		exec[0].Log != execLog {
+		exec[0].Log != execLog ||
+		exec[0].Output != output {
 		t.Error("List execution error")
 	}
 }
 
+func TestExecutionLatency(t *testing.T) {
+	executionID, _, err := db.PutExecution(ctx, functionId, params, status, "latency-uuid", execLog, output, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutExecutionLatency(ctx, executionID, "warm", 1500*time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	e, err := db.GetExecution(ctx, testUsername, "TestFunction1", "latency-uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Mode != "warm" || e.Latency != 1500*time.Millisecond {
+		t.Error("Execution latency error")
+	}
+	if err := db.PutExecutionTrigger(ctx, executionID, "schedule"); err != nil {
+		t.Error(err)
+	}
+	if e, err = db.GetExecution(ctx, testUsername, "TestFunction1", "latency-uuid"); err != nil {
+		t.Fatal(err)
+	}
+	if e.Trigger != "schedule" {
+		t.Error("Execution trigger error")
+	}
+}
+
+func TestSchedules(t *testing.T) {
+	s := &Schedule{FunctionID: functionId, Spec: "*/5 * * * *", Params: params, TimeZone: "Europe/Paris", MissedRuns: "skip"}
+	scheduleID, err := db.PutSchedule(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastRun := time.Now().Truncate(time.Second)
+	if err := db.SetScheduleLastRun(ctx, scheduleID, lastRun); err != nil {
+		t.Error(err)
+	}
+
+	schedules, err := db.ListAllSchedules(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedules) != 1 ||
+		schedules[0].ID != scheduleID ||
+		schedules[0].UserName != testUsername ||
+		schedules[0].FunctionName != "TestFunction1" ||
+		schedules[0].Spec != s.Spec ||
+		schedules[0].Params != params ||
+		schedules[0].TimeZone != s.TimeZone ||
+		schedules[0].MissedRuns != s.MissedRuns ||
+		!schedules[0].LastRun.Equal(lastRun) {
+		t.Error("List schedules error")
+	}
+
+	if err := db.DeleteSchedule(ctx, functionId, scheduleID); err != nil {
+		t.Error(err)
+	}
+	if err := db.DeleteSchedule(ctx, functionId, scheduleID); err != sql.ErrNoRows {
+		t.Error("Expected sql.ErrNoRows, got", err)
+	}
+	if schedules, err = db.ListSchedules(ctx, functionId); err != nil || len(schedules) != 0 {
+		t.Error("Delete schedule error")
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	w := &Webhook{FunctionID: functionId, Token: "token", Secret: "secret", SignatureHeader: "X-Hub-Signature-256",
+		Algorithm: "sha256", Headers: "X-GitHub-Event", DeliveryHeader: "X-GitHub-Delivery"}
+	webhookID, err := db.PutWebhook(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := db.GetWebhook(ctx, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != webhookID ||
+		got.UserName != testUsername ||
+		got.FunctionName != "TestFunction1" ||
+		got.Secret != w.Secret ||
+		got.SignatureHeader != w.SignatureHeader ||
+		got.Algorithm != w.Algorithm ||
+		got.Headers != w.Headers ||
+		got.DeliveryHeader != w.DeliveryHeader {
+		t.Error("Get webhook error")
+	}
+	if webhooks, err := db.ListWebhooks(ctx, functionId); err != nil || len(webhooks) != 1 || webhooks[0].Secret != "" {
+		t.Error("List webhooks error", err)
+	}
+
+	if ok, err := db.PutWebhookDelivery(ctx, webhookID, "1", time.Hour); err != nil || !ok {
+		t.Error("Put webhook delivery error", err)
+	}
+	if ok, err := db.PutWebhookDelivery(ctx, webhookID, "1", time.Hour); err != nil || ok {
+		t.Error("Replayed webhook delivery accepted", err)
+	}
+
+	if err := db.DeleteWebhook(ctx, functionId, webhookID); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetWebhook(ctx, "token"); err != sql.ErrNoRows {
+		t.Error("Expected sql.ErrNoRows, got", err)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := &Subscription{FunctionID: functionId, Source: "local", Topic: "orders", MaxDeliveries: 3}
+	subscriptionID, err := db.PutSubscription(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriptions, err := db.ListAllSubscriptions(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subscriptions) != 1 ||
+		subscriptions[0].ID != subscriptionID ||
+		subscriptions[0].UserName != testUsername ||
+		subscriptions[0].FunctionName != "TestFunction1" ||
+		subscriptions[0].Source != s.Source ||
+		subscriptions[0].Topic != s.Topic ||
+		subscriptions[0].MaxDeliveries != s.MaxDeliveries {
+		t.Error("List subscriptions error")
+	}
+
+	if err := db.DeleteSubscription(ctx, functionId, subscriptionID); err != nil {
+		t.Error(err)
+	}
+	if err := db.DeleteSubscription(ctx, functionId, subscriptionID); err != sql.ErrNoRows {
+		t.Error("Expected sql.ErrNoRows, got", err)
+	}
+	if subscriptions, err = db.ListSubscriptions(ctx, functionId); err != nil || len(subscriptions) != 0 {
+		t.Error("Subscription not deleted", err)
+	}
+}
+
+func TestAcquireLease(t *testing.T) {
+	if ok, err := db.AcquireLease(ctx, "test", "a", time.Minute); err != nil || !ok {
+		t.Error("Acquire lease error", err)
+	}
+	if ok, err := db.AcquireLease(ctx, "test", "b", time.Minute); err != nil || ok {
+		t.Error("Lease acquired by a second holder", err)
+	}
+	if ok, err := db.AcquireLease(ctx, "test", "a", time.Minute); err != nil || !ok {
+		t.Error("Renew lease error", err)
+	}
+	if err := db.ReleaseLease(ctx, "test", "a"); err != nil {
+		t.Error(err)
+	}
+	if ok, err := db.AcquireLease(ctx, "test", "b", time.Minute); err != nil || !ok {
+		t.Error("Acquire released lease error", err)
+	}
+}
+
+func TestWorkflows(t *testing.T) {
+	w := &Workflow{Name: "TestWorkflow", Definition: `{"steps": []}`}
+	workflowID, err := db.PutWorkflow(ctx, testUsername, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Definition = `{"steps": [{"function": "TestFunction1"}]}`
+	if id, err := db.PutWorkflow(ctx, testUsername, w); err != nil || id != workflowID {
+		t.Error("Update workflow error", err)
+	}
+	got, err := db.GetWorkflow(ctx, testUsername, "TestWorkflow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != workflowID || got.Definition != w.Definition {
+		t.Error("Get workflow error")
+	}
+	if workflows, err := db.ListWorkflows(ctx, testUsername); err != nil || len(workflows) != 1 {
+		t.Error("List workflows error", err)
+	}
+
+	r := &WorkflowRun{WorkflowID: workflowID, Definition: w.Definition, Status: "Running", Input: params}
+	runID, err := db.PutWorkflowRun(ctx, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runs, err := db.ListUnfinishedWorkflowRuns(ctx); err != nil || len(runs) != 1 || runs[0].WorkflowName != "TestWorkflow" {
+		t.Error("List unfinished runs error", err)
+	}
+	step := &WorkflowStep{RunID: runID, Path: "0", Status: "Running", Params: params, Started: time.Now()}
+	if err := db.PutWorkflowStep(ctx, step); err != nil {
+		t.Error(err)
+	}
+	step.Status, step.Output, step.Uuid, step.Finished = "Succeeded", output, uuid, time.Now()
+	if err := db.PutWorkflowStep(ctx, step); err != nil {
+		t.Error(err)
+	}
+	steps, err := db.ListWorkflowSteps(ctx, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Status != "Succeeded" || steps[0].Output != output || steps[0].Finished.IsZero() {
+		t.Error("List workflow steps error")
+	}
+
+	if err := db.FinishWorkflowRun(ctx, runID, "Succeeded", output); err != nil {
+		t.Error(err)
+	}
+	run, err := db.GetWorkflowRun(ctx, runID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.Status != "Succeeded" || run.Output != output || run.Finished.IsZero() {
+		t.Error("Get workflow run error")
+	}
+	if runs, err := db.ListUnfinishedWorkflowRuns(ctx); err != nil || len(runs) != 0 {
+		t.Error("Finished run listed as unfinished", err)
+	}
+
+	if err := db.DeleteWorkflow(ctx, testUsername, "TestWorkflow"); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetWorkflowRun(ctx, runID); err != sql.ErrNoRows {
+		t.Error("Expected sql.ErrNoRows, got", err)
+	}
+}
+
+func TestExecutionAttempts(t *testing.T) {
+	executionID, _, err := db.PutExecution(ctx, functionId, params, status, uuid, execLog, output, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := []*ExecutionAttempt{
+		&ExecutionAttempt{Pod: "pod-1", Phase: "Failed", ExitCode: 1, Reason: "Error"},
+		&ExecutionAttempt{Pod: "pod-2", Phase: "Succeeded", ExitCode: 0},
+	}
+	if err := db.PutExecutionAttempts(ctx, executionID, attempts); err != nil {
+		t.Error(err)
+	}
+	list, err := db.ListExecutionAttempts(ctx, executionID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(list) != 2 || *list[0] != *attempts[0] || *list[1] != *attempts[1] {
+		t.Error("List execution attempts error")
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	if err := db.SetFunctionCallback(ctx, functionId, "https://example.com/done", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if url, secret, err := db.GetFunctionCallback(ctx, functionId); err != nil || url != "https://example.com/done" || secret != "secret" {
+		t.Error("Get function callback error", err)
+	}
+
+	executionID, _, err := db.PutExecution(ctx, functionId, params, status, "callback-uuid", execLog, output, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	attempts := []*CallbackAttempt{
+		&CallbackAttempt{ExecutionID: executionID, URL: "https://example.com/done", Attempt: 1, StatusCode: 503},
+		&CallbackAttempt{ExecutionID: executionID, URL: "https://example.com/done", Attempt: 2, StatusCode: 200},
+	}
+	for _, a := range attempts {
+		if err := db.PutCallbackAttempt(ctx, a); err != nil {
+			t.Error(err)
+		}
+	}
+	e, err := db.GetExecution(ctx, testUsername, "TestFunction1", "callback-uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Callbacks) != 2 || e.Callbacks[0].StatusCode != 503 || e.Callbacks[1].Attempt != 2 {
+		t.Error("List callback attempts error")
+	}
+
+	if err := db.SetFunctionCallback(ctx, functionId, "", ""); err != nil {
+		t.Error(err)
+	}
+	if url, secret, err := db.GetFunctionCallback(ctx, functionId); err != nil || url != "" || secret != "" {
+		t.Error("Function callback not removed", err)
+	}
+}
+
+func TestAuditEvents(t *testing.T) {
+	since := time.Now().Add(-time.Minute)
+	events := []*AuditEvent{
+		&AuditEvent{Actor: testUsername, Action: "login", SourceIP: "10.0.0.1", AuthMethod: "password", Outcome: "success"},
+		&AuditEvent{Actor: testUsername, Action: "function.create", TargetUser: testUsername, TargetFunction: "TestFunction1",
+			SourceIP: "10.0.0.1", AuthMethod: "session", Outcome: "failure", Detail: "build failed"},
+		&AuditEvent{Actor: "", Action: "function.call", TargetUser: testUsername, TargetFunction: "TestFunction1",
+			SourceIP: "10.0.0.2", AuthMethod: "none", Outcome: "success"},
+	}
+	for _, e := range events {
+		id, err := db.PutAuditEvent(ctx, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.ID = id
+	}
+
+	all, err := db.ListAuditEvents(ctx, &AuditFilter{Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) < 3 || all[0].ID != events[2].ID || all[0].AuthMethod != "none" {
+		t.Error("List audit events error")
+	}
+
+	failed, err := db.ListAuditEvents(ctx, &AuditFilter{TargetFunction: "TestFunction1", Outcome: "failure", Since: since})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed[0].Detail != "build failed" || failed[0].Actor != testUsername {
+		t.Error("Filter audit events error")
+	}
+
+	page, err := db.ListAuditEvents(ctx, &AuditFilter{Since: since, BeforeID: events[2].ID, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].ID != events[1].ID {
+		t.Error("Page audit events error")
+	}
+}
+
+func TestChildExecutions(t *testing.T) {
+	parentID, _, err := db.PutExecution(ctx, functionId, "[1, 2]", status, "parent-uuid", execLog, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1", "2"} {
+		if _, _, err := db.PutChildExecution(ctx, parentID, functionId, p, status, "child-uuid-"+p, execLog, p, time.Now()); err != nil {
+			t.Error(err)
+		}
+	}
+	children, err := db.ListChildExecutions(ctx, parentID)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(children) != 2 || children[0].Params != "1" || children[1].Params != "2" || children[1].Output != "2" {
+		t.Error("List child executions error")
+	}
+
+	// Children are listed with their parent only
+	execs, err := db.ListExecution(ctx, testUsername, "TestFunction1")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, e := range execs {
+		if e.Uuid == "child-uuid-1" || e.Uuid == "child-uuid-2" {
+			t.Error("Child execution listed as a top level execution")
+		}
+		if e.ID == parentID && len(e.Children) != 2 {
+			t.Error("Parent execution listed without its children")
+		}
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	// Rolled back changes are discarded
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.PutFunction(ctx, testUsername, "TestFunctionTx", "", -1); err != nil {
+		t.Error(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetFunction(ctx, testUsername, "TestFunctionTx"); err != sql.ErrNoRows {
+		t.Error("Rolled back function is visible")
+	}
+
+	// Committed changes are kept, and a later rollback is a no-op
+	tx, err = db.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.PutFunction(ctx, testUsername, "TestFunctionTx", "", -1); err != nil {
+		t.Error(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Error(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Error(err)
+	}
+	if _, err := db.GetFunction(ctx, testUsername, "TestFunctionTx"); err != nil {
+		t.Error("Committed function is not visible")
+	}
+	if err := db.DeleteFunction(ctx, testUsername, "TestFunctionTx"); err != nil {
+		t.Error(err)
+	}
+}
+
 func TestDeleteFunction(t *testing.T) {
 	// Delete TestFunction1
-	err := db.DeleteFunction(testUsername, "TestFunction1")
+	err := db.DeleteFunction(ctx, testUsername, "TestFunction1")
 	if err != nil {
 		t.Error(err)
 	}
-	functions, err := db.ListFunctionsOfUser(testUsername, -1)
+	functions, err := db.ListFunctionsOfUser(ctx, testUsername, -1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -201,3 +679,27 @@ func TestDeleteFunction(t *testing.T) {
 		t.Error("Size of function list is not right.")
 	}
 }
+
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := box.seal("value")
+	if err != nil {
+		t.Error(err)
+	}
+	if opened, err := box.open(sealed); err != nil || opened != "value" {
+		t.Error("Secret box round trip error")
+	}
+
+	other, _ := newSecretBox("other key")
+	if _, err := other.open(sealed); err == nil {
+		t.Error("Secret opened with the wrong key")
+	}
+
+	var none *secretBox
+	if _, err := none.seal("value"); err != ErrNoSecretKey {
+		t.Error("Sealing without a key should fail")
+	}
+}
@@ -1,17 +1,40 @@
 package dal
 
-import "time"
+import (
+	"time"
 
-type DAL interface {
+	"golang.org/x/net/context"
+)
+
+// Store holds the data access methods. They are available both on the
+// DAL and within a transaction.
+type Store interface {
 	// List functions created by a user
-	ListFunctionsOfUser(username string, userId int64) ([]*Function, error)
+	ListFunctionsOfUser(ctx context.Context, username string, userId int64) ([]*Function, error)
 
 	// Insert user into DB if not existed.
 	//
 	// Returns: (int64) insert row id,
 	//          (int64) # of rows influenced,
 	//          (error) if there is one
-	PutUserIfNotExisted(groupName, userName string) (int64, int64, error)
+	PutUserIfNotExisted(ctx context.Context, groupName, userName string) (int64, int64, error)
+
+	// Get a user by name
+	//
+	// Returns: (*User) the user
+	//			(error) sql.ErrNoRows if the user does not exist
+	GetUser(ctx context.Context, userName string) (*User, error)
+
+	// Set the group of a user
+	//
+	// Returns: (error) if there is one
+	SetUserGroup(ctx context.Context, userName, groupName string) error
+
+	// List all users
+	//
+	// Returns: ([]*User) the users
+	//			(error) if there is one
+	ListUsers(ctx context.Context) ([]*User, error)
 
 	// Put the function into the DB
 	// If the function does not exist, insert one,
@@ -20,30 +43,267 @@ type DAL interface {
 	// Returns: (int64) insert row id,
 	//          (int64) # of rows influenced,
 	//          (error) if there is one
-	PutFunction(userName, funcName, funcContent string, userId int64) (int64, int64, error)
+	PutFunction(ctx context.Context, userName, funcName, funcContent string, userId int64) (int64, int64, error)
 
 	// Get the content of a function
 	//
 	// Returns: (Function) the function
 	//			(error) if there is one
-	GetFunction(userName, funcName string) (*Function, error)
+	GetFunction(ctx context.Context, userName, funcName string) (*Function, error)
+
+	// Update the execution settings of a function
+	//
+	// Returns: (error) if there is one
+	UpdateFunctionSettings(ctx context.Context, userName, funcName string, settings *FunctionSettings) error
 
 	// Delete the function from the DB
 	//
 	// Returns: (error) if there is one
-	DeleteFunction(userName, funcName string) error
+	DeleteFunction(ctx context.Context, userName, funcName string) error
 
-	// Put the function execution into the DB
+	// Replace the environment variables of a function
+	//
+	// Returns: (error) if there is one
+	PutFunctionEnv(ctx context.Context, functionID int64, env []*EnvVar) error
+
+	// List the environment variables of a function, secrets decrypted
+	ListFunctionEnv(ctx context.Context, functionID int64) ([]*EnvVar, error)
+
+	// Put the function execution into the DB. `output` is the JSON return
+	// value of the function, empty if it returned none.
+	//
+	// Returns: (int64) insert row id,
+	//          (int64) # of rows influenced,
+	//          (error) if there is one
+	PutExecution(ctx context.Context, functionID int64, params, status, uuid, log, output string, timestamp time.Time) (int64, int64, error)
+
+	// Insert an execution of one item of the fan-out execution `parentID`
 	//
 	// Returns: (int64) insert row id,
 	//          (int64) # of rows influenced,
 	//          (error) if there is one
-	PutExecution(functionID int64, params, status, uuid, log string, timestamp time.Time) (int64, int64, error)
+	PutChildExecution(ctx context.Context, parentID, functionID int64, params, status, uuid, log, output string, timestamp time.Time) (int64, int64, error)
+
+	// Record the execution mode ("warm" or "cold") and latency of an
+	// execution
+	//
+	// Returns: (error) if there is one
+	PutExecutionLatency(ctx context.Context, executionID int64, mode string, latency time.Duration) error
+
+	// Record what started an execution, e.g. "schedule"
+	//
+	// Returns: (error) if there is one
+	PutExecutionTrigger(ctx context.Context, executionID int64, trigger string) error
+
+	// List the executions of the items of a fan-out execution
+	ListChildExecutions(ctx context.Context, parentID int64) ([]*FunctionExecution, error)
+
+	// Record the attempts of a function execution
+	//
+	// Returns: (error) if there is one
+	PutExecutionAttempts(ctx context.Context, executionID int64, attempts []*ExecutionAttempt) error
+
+	// List the attempts of a function execution
+	ListExecutionAttempts(ctx context.Context, executionID int64) ([]*ExecutionAttempt, error)
+
+	// Record a delivery of the completion callback of an execution
+	//
+	// Returns: (error) if there is one
+	PutCallbackAttempt(ctx context.Context, a *CallbackAttempt) error
+
+	// List the deliveries of the completion callback of an execution
+	ListCallbackAttempts(ctx context.Context, executionID int64) ([]*CallbackAttempt, error)
+
+	// Set the completion callback of a function. The secret signing the
+	// callbacks is stored encrypted.
+	//
+	// Returns: (error) ErrNoSecretKey if no secret key is configured
+	SetFunctionCallback(ctx context.Context, functionID int64, url, secret string) error
+
+	// Get the completion callback of a function, with its secret
+	// decrypted. Both are empty if none is set.
+	//
+	// Returns: (string) the callback URL,
+	//          (string) the secret,
+	//          (error) if there is one
+	GetFunctionCallback(ctx context.Context, functionID int64) (string, string, error)
+
+	// List function executions, with their attempts and the executions of
+	// fan-out items
+	ListExecution(ctx context.Context, userName, funcName string) ([]*FunctionExecution, error)
+
+	// Get a function execution by uuid
+	//
+	// Returns: (*FunctionExecution) the execution
+	//			(error) sql.ErrNoRows if there is no such execution
+	GetExecution(ctx context.Context, userName, funcName, uuid string) (*FunctionExecution, error)
+
+	// Add a schedule to a function
+	//
+	// Returns: (int64) the schedule id,
+	//          (error) if there is one
+	PutSchedule(ctx context.Context, s *Schedule) (int64, error)
+
+	// List the schedules of a function
+	ListSchedules(ctx context.Context, functionID int64) ([]*Schedule, error)
+
+	// List the schedules of all functions, with their owner and name
+	ListAllSchedules(ctx context.Context) ([]*Schedule, error)
+
+	// Delete a schedule of a function
+	//
+	// Returns: (error) sql.ErrNoRows if the function has no such schedule
+	DeleteSchedule(ctx context.Context, functionID, scheduleID int64) error
+
+	// Record the time a schedule was last checked
+	//
+	// Returns: (error) if there is one
+	SetScheduleLastRun(ctx context.Context, scheduleID int64, lastRun time.Time) error
+
+	// Add a webhook to a function. Its secret is stored encrypted.
+	//
+	// Returns: (int64) the webhook id,
+	//          (error) ErrNoSecretKey if no secret key is configured
+	PutWebhook(ctx context.Context, w *Webhook) (int64, error)
+
+	// Get a webhook by token, with its secret decrypted
+	//
+	// Returns: (*Webhook) the webhook
+	//			(error) sql.ErrNoRows if there is no such webhook
+	GetWebhook(ctx context.Context, token string) (*Webhook, error)
+
+	// List the webhooks of a function, without their secrets
+	ListWebhooks(ctx context.Context, functionID int64) ([]*Webhook, error)
+
+	// Delete a webhook of a function
+	//
+	// Returns: (error) sql.ErrNoRows if the function has no such webhook
+	DeleteWebhook(ctx context.Context, functionID, webhookID int64) error
+
+	// Record a delivery of a webhook, forgetting the deliveries older
+	// than `window`
+	//
+	// Returns: (bool) false if the delivery was already recorded,
+	//          (error) if there is one
+	PutWebhookDelivery(ctx context.Context, webhookID int64, delivery string, window time.Duration) (bool, error)
 
-	// List function executions
-	ListExecution(userName, funcName string) ([]*FunctionExecution, error)
+	// Subscribe a function to a topic
+	//
+	// Returns: (int64) the subscription id,
+	//          (error) if there is one
+	PutSubscription(ctx context.Context, s *Subscription) (int64, error)
+
+	// List the subscriptions of a function
+	ListSubscriptions(ctx context.Context, functionID int64) ([]*Subscription, error)
+
+	// List the subscriptions of all functions, with their owner and name
+	ListAllSubscriptions(ctx context.Context) ([]*Subscription, error)
+
+	// Delete a subscription of a function
+	//
+	// Returns: (error) sql.ErrNoRows if the function has no such
+	//          subscription
+	DeleteSubscription(ctx context.Context, functionID, subscriptionID int64) error
+
+	// Acquire or renew a lease for `ttl`
+	//
+	// Returns: (bool) whether `holder` holds the lease,
+	//          (error) if there is one
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+
+	// Release a lease held by `holder`
+	//
+	// Returns: (error) if there is one
+	ReleaseLease(ctx context.Context, name, holder string) error
+
+	// Add a workflow to a user, or replace the definition of the
+	// workflow of the same name
+	//
+	// Returns: (int64) the workflow id,
+	//          (error) sql.ErrNoRows if there is no such user
+	PutWorkflow(ctx context.Context, userName string, w *Workflow) (int64, error)
+
+	// Get a workflow of a user
+	//
+	// Returns: (*Workflow) the workflow
+	//			(error) sql.ErrNoRows if there is no such workflow
+	GetWorkflow(ctx context.Context, userName, name string) (*Workflow, error)
+
+	// List the workflows of a user, without their definitions
+	ListWorkflows(ctx context.Context, userName string) ([]*Workflow, error)
+
+	// Delete a workflow of a user, with its runs
+	//
+	// Returns: (error) sql.ErrNoRows if the user has no such workflow
+	DeleteWorkflow(ctx context.Context, userName, name string) error
+
+	// Add a run to a workflow
+	//
+	// Returns: (int64) the run id,
+	//          (error) if there is one
+	PutWorkflowRun(ctx context.Context, r *WorkflowRun) (int64, error)
+
+	// Get a workflow run, with the owner and name of its workflow
+	//
+	// Returns: (*WorkflowRun) the run
+	//			(error) sql.ErrNoRows if there is no such run
+	GetWorkflowRun(ctx context.Context, runID int64) (*WorkflowRun, error)
+
+	// List the last `limit` runs of a workflow, most recent first
+	ListWorkflowRuns(ctx context.Context, workflowID int64, limit int) ([]*WorkflowRun, error)
+
+	// List the unfinished runs of all workflows
+	ListUnfinishedWorkflowRuns(ctx context.Context) ([]*WorkflowRun, error)
+
+	// Record the status and output of a finished run
+	//
+	// Returns: (error) if there is one
+	FinishWorkflowRun(ctx context.Context, runID int64, status, output string) error
+
+	// Insert or replace the state of a step of a run
+	//
+	// Returns: (error) if there is one
+	PutWorkflowStep(ctx context.Context, s *WorkflowStep) error
+
+	// List the state of the steps of a run
+	ListWorkflowSteps(ctx context.Context, runID int64) ([]*WorkflowStep, error)
+
+	// Record an audit event. Its creation time is set if zero.
+	//
+	// Returns: (int64) the event id,
+	//          (error) if there is one
+	PutAuditEvent(ctx context.Context, e *AuditEvent) (int64, error)
+
+	// List the audit events matching a filter, most recent first
+	ListAuditEvents(ctx context.Context, f *AuditFilter) ([]*AuditEvent, error)
 
 	// Clear content from all tables
 	// Returns: (error) if there is one
-	ClearDatabase() error
+	ClearDatabase(ctx context.Context) error
+}
+
+type DAL interface {
+	Store
+
+	// Begin a transaction
+	//
+	// Returns: (Tx) the transaction
+	//			(error) if there is one
+	Begin(ctx context.Context) (Tx, error)
+
+	// Check that the database is reachable
+	//
+	// Returns: (error) if it is not
+	Ping(ctx context.Context) error
+}
+
+// Tx is a DAL transaction. Either Commit or Rollback must be called to
+// release it.
+type Tx interface {
+	Store
+
+	Commit() error
+
+	// Rollback the transaction. It is safe to call after Commit.
+	Rollback() error
 }
@@ -0,0 +1,51 @@
+package dal
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/Symantec/Go-kexec/metrics"
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+)
+
+var queryDuration = metrics.NewHistogram("kexec_dal_query_duration_seconds",
+	"Duration of the DB statements, by kind: exec, query or prepare.",
+	metrics.DefaultBuckets, "op")
+
+// timedQuerier times the statements run through a querier. Statements
+// prepared with Prepare are only timed while being prepared.
+type timedQuerier struct {
+	q querier
+}
+
+func (t timedQuerier) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer observeQuery(time.Now(), "exec")
+	return t.q.Exec(query, args...)
+}
+
+func (t timedQuerier) Prepare(query string) (*sql.Stmt, error) {
+	defer observeQuery(time.Now(), "prepare")
+	return t.q.Prepare(query)
+}
+
+func (t timedQuerier) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	defer observeQuery(time.Now(), "query")
+	return t.q.Query(query, args...)
+}
+
+func (t timedQuerier) QueryRow(query string, args ...interface{}) *sql.Row {
+	defer observeQuery(time.Now(), "query")
+	return t.q.QueryRow(query, args...)
+}
+
+func observeQuery(start time.Time, op string) {
+	queryDuration.ObserveDuration(time.Since(start), op)
+}
+
+// startSpan starts the span of a DAL call, named after its method. The
+// statements it runs are not traced on their own.
+func startSpan(ctx context.Context, method string) *tracing.Span {
+	_, span := tracing.Start(ctx, "dal."+method)
+	return span
+}
@@ -0,0 +1,156 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/net/context"
+)
+
+// PutSchedule inserts a schedule of a function
+func (dal *mysqlStore) PutSchedule(ctx context.Context, s *Schedule) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutSchedule").End()
+	dal.logger(ctx).Info("Adding schedule", "function_id", s.FunctionID, "spec", s.Spec)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (f_id, spec, params, timezone, missed_runs) VALUES (?, ?, ?, ?, ?)",
+		dal.SchedulesTable), s.FunctionID, s.Spec, s.Params, s.TimeZone, s.MissedRuns)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// ListSchedules returns the schedules of a function
+func (dal *mysqlStore) ListSchedules(ctx context.Context, functionID int64) ([]*Schedule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListSchedules").End()
+	return dal.listSchedules(fmt.Sprintf(
+		"SELECT s.s_id, s.f_id, u.name, f.name, s.spec, s.params, s.timezone, s.missed_runs, s.last_run, s.created FROM %s s INNER JOIN %s f ON s.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id WHERE s.f_id = ? ORDER BY s.s_id",
+		dal.SchedulesTable, dal.FunctionsTable, dal.UsersTable), functionID)
+}
+
+// ListAllSchedules returns the schedules of all functions
+func (dal *mysqlStore) ListAllSchedules(ctx context.Context) ([]*Schedule, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListAllSchedules").End()
+	return dal.listSchedules(fmt.Sprintf(
+		"SELECT s.s_id, s.f_id, u.name, f.name, s.spec, s.params, s.timezone, s.missed_runs, s.last_run, s.created FROM %s s INNER JOIN %s f ON s.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id ORDER BY s.s_id",
+		dal.SchedulesTable, dal.FunctionsTable, dal.UsersTable))
+}
+
+func (dal *mysqlStore) listSchedules(query string, args ...interface{}) ([]*Schedule, error) {
+	rows, err := dal.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := make([]*Schedule, 0)
+	for rows.Next() {
+		s := &Schedule{}
+		var params sql.NullString
+		var lastRun mysql.NullTime
+		err := rows.Scan(&s.ID, &s.FunctionID, &s.UserName, &s.FunctionName, &s.Spec, &params,
+			&s.TimeZone, &s.MissedRuns, &lastRun, &s.Created)
+		if err != nil {
+			return schedules, err
+		}
+		s.Params = params.String
+		s.LastRun = lastRun.Time
+		schedules = append(schedules, s)
+	}
+	if err := rows.Err(); err != nil {
+		return schedules, err
+	}
+	return schedules, nil
+}
+
+// DeleteSchedule deletes a schedule of a function. It returns
+// sql.ErrNoRows if the function has no such schedule.
+func (dal *mysqlStore) DeleteSchedule(ctx context.Context, functionID, scheduleID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "DeleteSchedule").End()
+	dal.logger(ctx).Info("Deleting schedule", "function_id", functionID, "schedule_id", scheduleID)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE s_id = ? AND f_id = ?",
+		dal.SchedulesTable), scheduleID, functionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetScheduleLastRun records the time a schedule was last checked
+func (dal *mysqlStore) SetScheduleLastRun(ctx context.Context, scheduleID int64, lastRun time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "SetScheduleLastRun").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET last_run = ? WHERE s_id = ?",
+		dal.SchedulesTable), lastRun, scheduleID)
+	return err
+}
+
+// AcquireLease acquires or renews the lease `name` for `holder`, unless
+// another holder has it and it did not expire. Expiry is computed by the
+// DB, so the clocks of the servers do not matter.
+func (dal *mysqlStore) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	defer startSpan(ctx, "AcquireLease").End()
+	seconds := int64(ttl / time.Second)
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT IGNORE INTO %s (name, holder, expires) VALUES (?, ?, NOW() + INTERVAL ? SECOND)",
+		dal.LeasesTable), name, holder, seconds)
+	if err != nil {
+		return false, err
+	}
+	_, err = dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET holder = ?, expires = NOW() + INTERVAL ? SECOND WHERE name = ? AND (holder = ? OR expires < NOW())",
+		dal.LeasesTable), holder, seconds, name, holder)
+	if err != nil {
+		return false, err
+	}
+
+	var current string
+	err = dal.q.QueryRow(fmt.Sprintf(
+		"SELECT holder FROM %s WHERE name = ?",
+		dal.LeasesTable), name).Scan(&current)
+	if err != nil {
+		return false, err
+	}
+	return current == holder, nil
+}
+
+// ReleaseLease gives up a lease held by `holder`, so that it does not
+// linger until it expires
+func (dal *mysqlStore) ReleaseLease(ctx context.Context, name, holder string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "ReleaseLease").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE name = ? AND holder = ?",
+		dal.LeasesTable), name, holder)
+	return err
+}
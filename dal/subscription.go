@@ -0,0 +1,93 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// PutSubscription inserts a subscription of a function to a topic
+func (dal *mysqlStore) PutSubscription(ctx context.Context, s *Subscription) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutSubscription").End()
+	dal.logger(ctx).Info("Subscribing function", "function_id", s.FunctionID, "source", s.Source, "topic", s.Topic)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (f_id, source, topic, max_deliveries) VALUES (?, ?, ?, ?)",
+		dal.SubscriptionsTable), s.FunctionID, s.Source, s.Topic, s.MaxDeliveries)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// ListSubscriptions returns the subscriptions of a function
+func (dal *mysqlStore) ListSubscriptions(ctx context.Context, functionID int64) ([]*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListSubscriptions").End()
+	return dal.listSubscriptions(fmt.Sprintf(
+		"SELECT s.sub_id, s.f_id, u.name, f.name, s.source, s.topic, s.max_deliveries, s.created FROM %s s INNER JOIN %s f ON s.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id WHERE s.f_id = ? ORDER BY s.sub_id",
+		dal.SubscriptionsTable, dal.FunctionsTable, dal.UsersTable), functionID)
+}
+
+// ListAllSubscriptions returns the subscriptions of all functions
+func (dal *mysqlStore) ListAllSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListAllSubscriptions").End()
+	return dal.listSubscriptions(fmt.Sprintf(
+		"SELECT s.sub_id, s.f_id, u.name, f.name, s.source, s.topic, s.max_deliveries, s.created FROM %s s INNER JOIN %s f ON s.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id ORDER BY s.sub_id",
+		dal.SubscriptionsTable, dal.FunctionsTable, dal.UsersTable))
+}
+
+func (dal *mysqlStore) listSubscriptions(query string, args ...interface{}) ([]*Subscription, error) {
+	rows, err := dal.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make([]*Subscription, 0)
+	for rows.Next() {
+		s := &Subscription{}
+		err := rows.Scan(&s.ID, &s.FunctionID, &s.UserName, &s.FunctionName, &s.Source, &s.Topic,
+			&s.MaxDeliveries, &s.Created)
+		if err != nil {
+			return subscriptions, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return subscriptions, err
+	}
+	return subscriptions, nil
+}
+
+// DeleteSubscription deletes a subscription of a function. It returns
+// sql.ErrNoRows if the function has no such subscription.
+func (dal *mysqlStore) DeleteSubscription(ctx context.Context, functionID, subscriptionID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "DeleteSubscription").End()
+	dal.logger(ctx).Info("Deleting subscription", "function_id", functionID, "subscription_id", subscriptionID)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE sub_id = ? AND f_id = ?",
+		dal.SubscriptionsTable), subscriptionID, functionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
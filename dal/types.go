@@ -12,6 +12,7 @@ type Group struct {
 type User struct {
 	ID      int64
 	Name    string
+	Group   string
 	Created time.Time
 }
 
@@ -21,6 +22,29 @@ type Function struct {
 	Name    string
 	Content string
 	Updated time.Time
+	FunctionSettings
+}
+
+// FunctionSettings are the per function execution settings. Zero values
+// mean the operator configured default is used.
+type FunctionSettings struct {
+	// Kubernetes quantities, e.g. "500m" and "128Mi"
+	CPU    string
+	Memory string
+	// Execution timeout in seconds
+	Timeout int64
+	// Maximum size of the execution log in bytes
+	MaxLogSize int64
+	// Number of attempts of an execution, including the first one
+	MaxAttempts int64
+	// Seconds to wait before the first retry, doubled for each next one
+	RetryBackoff int64
+	// Comma separated exit codes and termination reasons that are
+	// retried, e.g. "1,Evicted". Empty means every failure is retried.
+	RetryOn string
+	// Number of warm worker pods kept running. 0 runs every execution
+	// in a new job.
+	WarmPoolSize int64
 }
 
 type FunctionExecution struct {
@@ -30,5 +54,186 @@ type FunctionExecution struct {
 	Status     string
 	Uuid       string
 	Log        string
-	Timestamp  time.Time
+	// JSON return value of the function, empty if it returned none
+	Output string
+	// "warm" or "cold", and the time from the call to the completion.
+	// Empty and 0 for executions recorded before they were tracked.
+	Mode    string
+	Latency time.Duration
+	// What started the execution, e.g. "http" or "schedule". Empty for
+	// executions recorded before it was tracked.
+	Trigger   string
+	Timestamp time.Time
+	Attempts  []*ExecutionAttempt
+	// Deliveries of the completion callback, in order
+	Callbacks []*CallbackAttempt
+	// Executions of the items of a fan-out execution
+	Children []*FunctionExecution
+}
+
+// ExecutionAttempt is one pod run of a function execution
+type ExecutionAttempt struct {
+	Pod      string
+	Phase    string
+	ExitCode int32
+	Reason   string
+	Message  string
+	Started  time.Time
+	Finished time.Time
+}
+
+// CallbackAttempt is one delivery of the completion callback of an
+// execution. StatusCode is 0 if no response was received.
+type CallbackAttempt struct {
+	ExecutionID int64
+	URL         string
+	Attempt     int
+	StatusCode  int
+	Error       string
+	Created     time.Time
+}
+
+// AuditEvent is a management action, e.g. the creation of a function.
+// TargetUser and TargetFunction are empty for the actions not on a
+// function, e.g. a login.
+type AuditEvent struct {
+	ID             int64
+	Actor          string
+	Action         string
+	TargetUser     string
+	TargetFunction string
+	SourceIP       string
+	AuthMethod     string
+	Outcome        string
+	Detail         string
+	Created        time.Time
+}
+
+// AuditFilter selects audit events. Empty fields match all events.
+type AuditFilter struct {
+	Actor          string
+	Action         string
+	TargetUser     string
+	TargetFunction string
+	Outcome        string
+	// Events created at or after Since, and before Until
+	Since time.Time
+	Until time.Time
+	// Events older than the event BeforeID, for paging
+	BeforeID int64
+	// Maximum number of events, MAX_NUM_AUDIT_EVENTS if 0
+	Limit int
+}
+
+// EnvVar is an environment variable of a function. Values of secrets are
+// stored encrypted.
+type EnvVar struct {
+	Name   string
+	Value  string
+	Secret bool
+}
+
+// Schedule runs a function with fixed params on a cron expression
+type Schedule struct {
+	ID         int64
+	FunctionID int64
+	// Owner and name of the function. Only set by ListAllSchedules.
+	UserName     string
+	FunctionName string
+	// Five field cron expression, e.g. "*/15 * * * *"
+	Spec   string
+	Params string
+	// IANA time zone the expression is evaluated in. Empty means UTC.
+	TimeZone string
+	// What to do with the runs missed while no server fired them
+	MissedRuns string
+	// Time the schedule was last checked, zero if never. Runs due up to
+	// then were fired or skipped.
+	LastRun time.Time
+	Created time.Time
+}
+
+// Webhook calls a function on the requests signed with its secret
+type Webhook struct {
+	ID         int64
+	FunctionID int64
+	// Owner and name of the function. Only set by GetWebhook.
+	UserName     string
+	FunctionName string
+	// Public identifier of the webhook in its URL
+	Token string
+	// Key of the request signatures. Only set by GetWebhook.
+	Secret string
+	// Request header holding the signature, and how it is computed from
+	// the body, e.g. "sha256" for a HMAC-SHA256
+	SignatureHeader string
+	Algorithm       string
+	// Comma separated names of the request headers passed to the function
+	Headers string
+	// Request header holding the unique id of a delivery. Empty disables
+	// replay protection.
+	DeliveryHeader string
+	Created        time.Time
+}
+
+// Subscription calls a function with the messages published to a topic
+type Subscription struct {
+	ID         int64
+	FunctionID int64
+	// Owner and name of the function
+	UserName     string
+	FunctionName string
+	// Event source the topic belongs to, e.g. "local"
+	Source string
+	Topic  string
+	// Deliveries of a message before it is dead-lettered. 0 means the
+	// server default.
+	MaxDeliveries int
+	Created       time.Time
+}
+
+// Workflow is a composition of functions of a user
+type Workflow struct {
+	ID       int64
+	UserID   int64
+	UserName string
+	Name     string
+	// JSON document of the steps
+	Definition string
+	Created    time.Time
+	Updated    time.Time
+}
+
+// WorkflowRun is an execution of a workflow
+type WorkflowRun struct {
+	ID         int64
+	WorkflowID int64
+	// Owner and name of the workflow
+	UserName     string
+	WorkflowName string
+	// Definition of the workflow when the run started
+	Definition string
+	Status     string
+	Input      string
+	Output     string
+	Created    time.Time
+	// Zero while the run is not finished
+	Finished time.Time
+}
+
+// WorkflowStep is the state of a step of a workflow run
+type WorkflowStep struct {
+	RunID int64
+	// Position of the step in the definition, e.g. "1.0" for the first
+	// branch of the second step
+	Path   string
+	Status string
+	Params string
+	Output string
+	// Uuid of the function execution of the step, if any
+	Uuid    string
+	Message string
+	// Zero until the step starts, and until it finishes
+	Started  time.Time
+	Finished time.Time
 }
@@ -0,0 +1,135 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// PutWebhook inserts a webhook of a function, its secret encrypted
+func (dal *mysqlStore) PutWebhook(ctx context.Context, w *Webhook) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutWebhook").End()
+	dal.logger(ctx).Info("Adding webhook", "function_id", w.FunctionID)
+
+	secret, err := dal.box.seal(w.Secret)
+	if err != nil {
+		return -1, err
+	}
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (f_id, token, secret, signature_header, algorithm, headers, delivery_header) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		dal.WebhooksTable), w.FunctionID, w.Token, secret, w.SignatureHeader, w.Algorithm, w.Headers, w.DeliveryHeader)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// GetWebhook returns a webhook by token, with its secret decrypted and
+// the owner and name of its function.
+func (dal *mysqlStore) GetWebhook(ctx context.Context, token string) (*Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetWebhook").End()
+	w := &Webhook{}
+	var secret sql.NullString
+	err := dal.q.QueryRow(fmt.Sprintf(
+		"SELECT w.w_id, w.f_id, u.name, f.name, w.token, w.secret, w.signature_header, w.algorithm, w.headers, w.delivery_header, w.created FROM %s w INNER JOIN %s f ON w.f_id=f.f_id INNER JOIN %s u ON f.u_id=u.u_id WHERE w.token = ?",
+		dal.WebhooksTable, dal.FunctionsTable, dal.UsersTable), token).Scan(
+		&w.ID, &w.FunctionID, &w.UserName, &w.FunctionName, &w.Token, &secret,
+		&w.SignatureHeader, &w.Algorithm, &w.Headers, &w.DeliveryHeader, &w.Created)
+	if err != nil {
+		return nil, err
+	}
+	if w.Secret, err = dal.box.open(secret.String); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ListWebhooks returns the webhooks of a function. Their secrets are not
+// returned.
+func (dal *mysqlStore) ListWebhooks(ctx context.Context, functionID int64) ([]*Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListWebhooks").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT w_id, f_id, token, signature_header, algorithm, headers, delivery_header, created FROM %s WHERE f_id = ? ORDER BY w_id",
+		dal.WebhooksTable), functionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := make([]*Webhook, 0)
+	for rows.Next() {
+		w := &Webhook{}
+		err := rows.Scan(&w.ID, &w.FunctionID, &w.Token, &w.SignatureHeader, &w.Algorithm,
+			&w.Headers, &w.DeliveryHeader, &w.Created)
+		if err != nil {
+			return webhooks, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return webhooks, err
+	}
+	return webhooks, nil
+}
+
+// DeleteWebhook deletes a webhook of a function. It returns sql.ErrNoRows
+// if the function has no such webhook.
+func (dal *mysqlStore) DeleteWebhook(ctx context.Context, functionID, webhookID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "DeleteWebhook").End()
+	dal.logger(ctx).Info("Deleting webhook", "function_id", functionID, "webhook_id", webhookID)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE w_id = ? AND f_id = ?",
+		dal.WebhooksTable), webhookID, functionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PutWebhookDelivery records a delivery of a webhook. It returns false if
+// the delivery was recorded already, i.e. the request is replayed. The
+// deliveries older than `window` are forgotten.
+func (dal *mysqlStore) PutWebhookDelivery(ctx context.Context, webhookID int64, delivery string, window time.Duration) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	defer startSpan(ctx, "PutWebhookDelivery").End()
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE FROM %s WHERE w_id = ? AND received < NOW() - INTERVAL ? SECOND",
+		dal.DeliveriesTable), webhookID, int64(window/time.Second))
+	if err != nil {
+		return false, err
+	}
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT IGNORE INTO %s (w_id, delivery) VALUES (?, ?)",
+		dal.DeliveriesTable), webhookID, delivery)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
@@ -0,0 +1,261 @@
+package dal
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/net/context"
+)
+
+// PutWorkflow inserts a workflow of a user, or replaces the definition of
+// the workflow of the same name
+func (dal *mysqlStore) PutWorkflow(ctx context.Context, userName string, w *Workflow) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutWorkflow").End()
+	dal.logger(ctx).Info("Putting workflow", "user", userName, "workflow", w.Name)
+
+	var uid int64
+	err := dal.q.QueryRow(fmt.Sprintf("SELECT u_id FROM %s WHERE name = ?", dal.UsersTable), userName).Scan(&uid)
+	if err != nil {
+		return -1, err
+	}
+	// LAST_INSERT_ID(wf_id) makes the id of an updated workflow the
+	// insert id
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (u_id, name, definition, updated) VALUES (?, ?, ?, NOW()) ON DUPLICATE KEY UPDATE wf_id = LAST_INSERT_ID(wf_id), definition = VALUES(definition), updated = NOW()",
+		dal.WorkflowsTable), uid, w.Name, w.Definition)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// GetWorkflow returns a workflow of a user
+func (dal *mysqlStore) GetWorkflow(ctx context.Context, userName, name string) (*Workflow, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetWorkflow").End()
+	w := &Workflow{}
+	var definition sql.NullString
+	var updated mysql.NullTime
+	err := dal.q.QueryRow(fmt.Sprintf(
+		"SELECT w.wf_id, w.u_id, u.name, w.name, w.definition, w.created, w.updated FROM %s w INNER JOIN %s u ON w.u_id=u.u_id WHERE u.name = ? AND w.name = ?",
+		dal.WorkflowsTable, dal.UsersTable), userName, name).Scan(
+		&w.ID, &w.UserID, &w.UserName, &w.Name, &definition, &w.Created, &updated)
+	if err != nil {
+		return nil, err
+	}
+	w.Definition = definition.String
+	w.Updated = updated.Time
+	return w, nil
+}
+
+// ListWorkflows returns the workflows of a user, without their
+// definitions
+func (dal *mysqlStore) ListWorkflows(ctx context.Context, userName string) ([]*Workflow, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListWorkflows").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT w.wf_id, w.u_id, u.name, w.name, w.created, w.updated FROM %s w INNER JOIN %s u ON w.u_id=u.u_id WHERE u.name = ? ORDER BY w.name",
+		dal.WorkflowsTable, dal.UsersTable), userName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workflows := make([]*Workflow, 0)
+	for rows.Next() {
+		w := &Workflow{}
+		var updated mysql.NullTime
+		if err := rows.Scan(&w.ID, &w.UserID, &w.UserName, &w.Name, &w.Created, &updated); err != nil {
+			return workflows, err
+		}
+		w.Updated = updated.Time
+		workflows = append(workflows, w)
+	}
+	if err := rows.Err(); err != nil {
+		return workflows, err
+	}
+	return workflows, nil
+}
+
+// DeleteWorkflow deletes a workflow of a user, with its runs. It returns
+// sql.ErrNoRows if the user has no such workflow.
+func (dal *mysqlStore) DeleteWorkflow(ctx context.Context, userName, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "DeleteWorkflow").End()
+	dal.logger(ctx).Info("Deleting workflow", "user", userName, "workflow", name)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"DELETE w FROM %s w INNER JOIN %s u ON w.u_id=u.u_id WHERE u.name = ? AND w.name = ?",
+		dal.WorkflowsTable, dal.UsersTable), userName, name)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// PutWorkflowRun inserts a run of a workflow
+func (dal *mysqlStore) PutWorkflowRun(ctx context.Context, r *WorkflowRun) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+	defer startSpan(ctx, "PutWorkflowRun").End()
+	dal.logger(ctx).Info("Starting workflow run", "workflow_id", r.WorkflowID)
+
+	res, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (wf_id, definition, status, input) VALUES (?, ?, ?, ?)",
+		dal.WorkflowRunsTable), r.WorkflowID, r.Definition, r.Status, r.Input)
+	if err != nil {
+		return -1, err
+	}
+	return res.LastInsertId()
+}
+
+// GetWorkflowRun returns a run of a workflow
+func (dal *mysqlStore) GetWorkflowRun(ctx context.Context, runID int64) (*WorkflowRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "GetWorkflowRun").End()
+	runs, err := dal.listWorkflowRuns(fmt.Sprintf(
+		"SELECT r.run_id, r.wf_id, u.name, w.name, r.definition, r.status, r.input, r.output, r.created, r.finished FROM %s r INNER JOIN %s w ON r.wf_id=w.wf_id INNER JOIN %s u ON w.u_id=u.u_id WHERE r.run_id = ?",
+		dal.WorkflowRunsTable, dal.WorkflowsTable, dal.UsersTable), runID)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return runs[0], nil
+}
+
+// ListWorkflowRuns returns the last `limit` runs of a workflow, most
+// recent first
+func (dal *mysqlStore) ListWorkflowRuns(ctx context.Context, workflowID int64, limit int) ([]*WorkflowRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListWorkflowRuns").End()
+	return dal.listWorkflowRuns(fmt.Sprintf(
+		"SELECT r.run_id, r.wf_id, u.name, w.name, r.definition, r.status, r.input, r.output, r.created, r.finished FROM %s r INNER JOIN %s w ON r.wf_id=w.wf_id INNER JOIN %s u ON w.u_id=u.u_id WHERE r.wf_id = ? ORDER BY r.run_id DESC LIMIT ?",
+		dal.WorkflowRunsTable, dal.WorkflowsTable, dal.UsersTable), workflowID, limit)
+}
+
+// ListUnfinishedWorkflowRuns returns the runs of all workflows which are
+// not finished
+func (dal *mysqlStore) ListUnfinishedWorkflowRuns(ctx context.Context) ([]*WorkflowRun, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListUnfinishedWorkflowRuns").End()
+	return dal.listWorkflowRuns(fmt.Sprintf(
+		"SELECT r.run_id, r.wf_id, u.name, w.name, r.definition, r.status, r.input, r.output, r.created, r.finished FROM %s r INNER JOIN %s w ON r.wf_id=w.wf_id INNER JOIN %s u ON w.u_id=u.u_id WHERE r.finished IS NULL ORDER BY r.run_id",
+		dal.WorkflowRunsTable, dal.WorkflowsTable, dal.UsersTable))
+}
+
+func (dal *mysqlStore) listWorkflowRuns(query string, args ...interface{}) ([]*WorkflowRun, error) {
+	rows, err := dal.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := make([]*WorkflowRun, 0)
+	for rows.Next() {
+		r := &WorkflowRun{}
+		var definition, input, output sql.NullString
+		var finished mysql.NullTime
+		err := rows.Scan(&r.ID, &r.WorkflowID, &r.UserName, &r.WorkflowName, &definition, &r.Status,
+			&input, &output, &r.Created, &finished)
+		if err != nil {
+			return runs, err
+		}
+		r.Definition = definition.String
+		r.Input = input.String
+		r.Output = output.String
+		r.Finished = finished.Time
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return runs, err
+	}
+	return runs, nil
+}
+
+// FinishWorkflowRun records the status and output of a finished run
+func (dal *mysqlStore) FinishWorkflowRun(ctx context.Context, runID int64, status, output string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "FinishWorkflowRun").End()
+	dal.logger(ctx).Info("Workflow run finished", "run_id", runID, "status", status)
+
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"UPDATE %s SET status = ?, output = ?, finished = NOW() WHERE run_id = ?",
+		dal.WorkflowRunsTable), status, output, runID)
+	return err
+}
+
+// PutWorkflowStep inserts or replaces the state of a step of a run
+func (dal *mysqlStore) PutWorkflowStep(ctx context.Context, s *WorkflowStep) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	defer startSpan(ctx, "PutWorkflowStep").End()
+	started := mysql.NullTime{Time: s.Started, Valid: !s.Started.IsZero()}
+	finished := mysql.NullTime{Time: s.Finished, Valid: !s.Finished.IsZero()}
+	_, err := dal.q.Exec(fmt.Sprintf(
+		"INSERT INTO %s (run_id, path, status, params, output, uuid, message, started, finished) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE status = VALUES(status), params = VALUES(params), output = VALUES(output), uuid = VALUES(uuid), message = VALUES(message), started = VALUES(started), finished = VALUES(finished)",
+		dal.WorkflowStepsTable), s.RunID, s.Path, s.Status, s.Params, s.Output, s.Uuid, s.Message, started, finished)
+	return err
+}
+
+// ListWorkflowSteps returns the state of the steps of a run
+func (dal *mysqlStore) ListWorkflowSteps(ctx context.Context, runID int64) ([]*WorkflowStep, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	defer startSpan(ctx, "ListWorkflowSteps").End()
+	rows, err := dal.q.Query(fmt.Sprintf(
+		"SELECT run_id, path, status, params, output, uuid, message, started, finished FROM %s WHERE run_id = ? ORDER BY path",
+		dal.WorkflowStepsTable), runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	steps := make([]*WorkflowStep, 0)
+	for rows.Next() {
+		s := &WorkflowStep{}
+		var params, output, message sql.NullString
+		var started, finished mysql.NullTime
+		err := rows.Scan(&s.RunID, &s.Path, &s.Status, &params, &output, &s.Uuid, &message, &started, &finished)
+		if err != nil {
+			return steps, err
+		}
+		s.Params = params.String
+		s.Output = output.String
+		s.Message = message.String
+		s.Started = started.Time
+		s.Finished = finished.Time
+		steps = append(steps, s)
+	}
+	if err := rows.Err(); err != nil {
+		return steps, err
+	}
+	return steps, nil
+}
@@ -6,12 +6,15 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/metrics"
+	"github.com/Symantec/Go-kexec/tracing"
 	dc "github.com/fsouza/go-dockerclient"
+	"golang.org/x/net/context"
 )
 
 var (
@@ -20,23 +23,55 @@ var (
 	ExecutionFile = "exec"
 )
 
+var (
+	buildsTotal = metrics.NewCounter("kexec_image_builds_total",
+		"Function image builds, by result: success or failure.", "result")
+	buildDuration = metrics.NewHistogram("kexec_image_build_duration_seconds",
+		"Duration of the function image builds, failed ones included.", metrics.LongBuckets)
+)
+
 type Docker struct {
 	client *dc.Client
+	log    *logging.Logger
 }
 
-func NewClient(endpoint string) (*Docker, error) {
+// NewClient creates a docker client. The calls made without a request
+// logger in their context log to `logger`, or logging.Default if nil.
+func NewClient(endpoint string, logger *logging.Logger) (*Docker, error) {
+	if logger == nil {
+		logger = logging.Default
+	}
 	client, err := dc.NewClient(endpoint)
-	return &Docker{client}, err
+	return &Docker{client, logger}, err
+}
+
+// logger returns the logger of the request of ctx, if any, so that the
+// records carry its id
+func (d *Docker) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, d.log)
 }
 
-func (d *Docker) BuildFunction(registry, namespace, funcName, templateName, ctxDir string) error {
+func (d *Docker) BuildFunction(ctx context.Context, registry, namespace, funcName, templateName, ctxDir string) (err error) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "docker.BuildFunction", "image", registry+"/"+namespace+"/"+funcName, "runtime", templateName)
+	defer func() {
+		span.SetError(err)
+		span.End()
+		buildDuration.ObserveDuration(time.Since(start))
+		if err != nil {
+			buildsTotal.Inc("failure")
+		} else {
+			buildsTotal.Inc("success")
+		}
+	}()
+
 	if _, err := os.Stat(filepath.Join(ctxDir, ExecutionFile)); err != nil {
-		log.Printf("Failed build function. Error: Execution file not found.")
+		d.logger(ctx).Warn("Failed to build function: execution file not found", "function", funcName)
 		return errors.New("Execution file not found.")
 	}
 
 	if err := setRuntimeTemplate(templateName, ctxDir); err != nil {
-		log.Printf("Failed to set up runtime template. Error:%s", err)
+		d.logger(ctx).Error("Failed to set up runtime template", "function", funcName, "runtime", templateName, "error", err)
 		return err
 	}
 
@@ -46,7 +81,7 @@ func (d *Docker) BuildFunction(registry, namespace, funcName, templateName, ctxD
 	tr := tar.NewWriter(inputbuf)
 	defer tr.Close()
 
-	log.Println("Building context", ctxDir)
+	d.logger(ctx).Info("Building context", "function", funcName, "dir", ctxDir)
 	if err := filepath.Walk(ctxDir,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -55,7 +90,7 @@ func (d *Docker) BuildFunction(registry, namespace, funcName, templateName, ctxD
 			if info.IsDir() {
 				return nil
 			}
-			log.Println("Adding file", info.Name())
+			d.logger(ctx).Debug("Adding file to context", "file", info.Name())
 			tr.WriteHeader(&tar.Header{Name: info.Name(), Size: info.Size(), ModTime: t, AccessTime: t, ChangeTime: t})
 			file, err := os.Open(path)
 			if err != nil {
@@ -73,33 +108,48 @@ func (d *Docker) BuildFunction(registry, namespace, funcName, templateName, ctxD
 		Name:         registry + "/" + namespace + "/" + funcName,
 		InputStream:  inputbuf,
 		OutputStream: outputbuf,
+		Context:      ctx,
 	}
 	if err := d.client.BuildImage(opts); err != nil {
 		return err
 	}
-	log.Println(string(outputbuf.Bytes()))
+	d.logger(ctx).Debug("Built image", "function", funcName, "output", outputbuf.String())
 
 	return nil
 }
 
-func (d *Docker) RegisterFunction(registry, namespace, funcName string) error {
+func (d *Docker) RegisterFunction(ctx context.Context, registry, namespace, funcName string) (err error) {
+	ctx, span := tracing.Start(ctx, "docker.RegisterFunction", "image", registry+"/"+namespace+"/"+funcName)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	outputbuf := bytes.NewBuffer(nil)
 	opts := dc.PushImageOptions{
 		Name:         registry + "/" + namespace + "/" + funcName,
 		Tag:          "latest",
 		Registry:     registry,
 		OutputStream: outputbuf,
+		Context:      ctx,
 	}
 	if err := d.client.PushImage(opts, dc.AuthConfiguration{}); err != nil {
 		return err
 	}
-	log.Println(string(outputbuf.Bytes()))
+	d.logger(ctx).Debug("Pushed image", "function", funcName, "output", outputbuf.String())
 	return nil
 }
 
-func (d *Docker) DeleteFunctionImage(registry, namespace, funcName string) error {
+func (d *Docker) DeleteFunctionImage(ctx context.Context, registry, namespace, funcName string) (err error) {
+	ctx, span := tracing.Start(ctx, "docker.DeleteFunctionImage", "image", registry+"/"+namespace+"/"+funcName)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	opts := dc.RemoveImageOptions{
-		Force: true,
+		Force:   true,
+		Context: ctx,
 	}
 	if err := d.client.RemoveImageExtended(registry+"/"+namespace+"/"+funcName, opts); err != nil {
 		return err
@@ -107,6 +157,39 @@ func (d *Docker) DeleteFunctionImage(registry, namespace, funcName string) error
 	return nil
 }
 
+// Ping checks that the docker daemon is reachable
+func (d *Docker) Ping(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "docker.Ping")
+	defer span.End()
+	err := d.client.Ping()
+	span.SetError(err)
+	return err
+}
+
+// CleanBuildContexts removes image build context directories under
+// IBContext that were last modified more than `age` ago. Contexts are
+// normally removed right after the build; this catches the ones left
+// behind by a crashed server.
+func CleanBuildContexts(logger *logging.Logger, age time.Duration) error {
+	entries, err := ioutil.ReadDir(IBContext)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || time.Since(e.ModTime()) < age {
+			continue
+		}
+		logger.Info("Removing stale build context", "dir", e.Name())
+		if err := os.RemoveAll(filepath.Join(IBContext, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var python27Template = `FROM python:2.7
 ADD . ./
 ENTRYPOINT [ "python", "exec" ]
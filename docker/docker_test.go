@@ -1,19 +1,125 @@
 package docker
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestBuildFunction(t *testing.T) {
-	d, _ := NewClient("unix:///var/run/docker.sock")
-	if err := d.BuildFunction("registry.paas.symcpe.com:443", "jingjing_ren", "faas:v1", "python27", "example/"); err != nil {
+	d, _ := NewClient("unix:///var/run/docker.sock", nil)
+	if err := d.BuildFunction(context.Background(), "registry.paas.symcpe.com:443", "jingjing_ren", "faas:v1", "python27", "example/"); err != nil {
 		t.Error(err)
 	}
 }
 
 func TestRegisterFunction(t *testing.T) {
-	d, _ := NewClient("unix:///var/run/docker.sock")
-	if err := d.RegisterFunction("registry.paas.symcpe.com:443", "jingjing_ren", "faas:v1"); err != nil {
+	d, _ := NewClient("unix:///var/run/docker.sock", nil)
+	if err := d.RegisterFunction(context.Background(), "registry.paas.symcpe.com:443", "jingjing_ren", "faas:v1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegistryDeleteImage(t *testing.T) {
+	digest := "sha256:0123456789abcdef"
+	deleted := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD" && r.URL.Path == "/v2/user/func/manifests/latest":
+			if r.Header.Get("Accept") != ManifestV2MediaType {
+				t.Error("Manifest v2 media type not requested")
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+		case r.Method == "DELETE" && r.URL.Path == "/v2/user/func/manifests/"+digest:
+			deleted = true
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	r := NewRegistry(&RegistryConfig{Address: ts.URL})
+	if err := r.DeleteImage(context.Background(), "user/func", "latest"); err != nil {
+		t.Error(err)
+	}
+	if !deleted {
+		t.Error("Manifest not deleted")
+	}
+	// Missing images are not an error
+	if err := r.DeleteImage(context.Background(), "user/missing", "latest"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegistryGetImageCreated(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/user/func/manifests/latest":
+			if r.Header.Get("Accept") != ManifestV2MediaType {
+				t.Error("Manifest v2 media type not requested")
+			}
+			w.Write([]byte(`{"schemaVersion":2,"config":{"digest":"sha256:abc"}}`))
+		case "/v2/user/func/blobs/sha256:abc":
+			w.Write([]byte(`{"architecture":"amd64","created":"2016-10-01T12:00:00Z"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	r := NewRegistry(&RegistryConfig{Address: ts.URL})
+	created, err := r.GetImageCreated(context.Background(), "user/func", "latest")
+	if err != nil {
 		t.Error(err)
 	}
+	if !created.Equal(time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Error("Unexpected creation time", created)
+	}
+	// Missing images have no creation time
+	if created, err := r.GetImageCreated(context.Background(), "user/missing", "latest"); err != nil || !created.IsZero() {
+		t.Error("Unexpected creation time of a missing image", created, err)
+	}
+}
+
+func TestRegistryListRepositories(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("last") == "" {
+			w.Header().Set("Link", `</v2/_catalog?last=a%2Fb&n=100>; rel="next"`)
+			w.Write([]byte(`{"repositories":["a/a","a/b"]}`))
+		} else {
+			w.Write([]byte(`{"repositories":["b/a"]}`))
+		}
+	}))
+	defer ts.Close()
+
+	r := NewRegistry(&RegistryConfig{Address: ts.URL})
+	repos, err := r.ListRepositories(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(repos) != 3 || repos[2] != "b/a" {
+		t.Error("List repositories error", repos)
+	}
+}
+
+func TestRegistryPing(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, _ := r.BasicAuth(); r.URL.Path != "/v2/" || user != "user" || pass != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	r := NewRegistry(&RegistryConfig{Address: ts.URL, Username: "user", Password: "pass"})
+	if err := r.Ping(context.Background()); err != nil {
+		t.Error(err)
+	}
+	r = NewRegistry(&RegistryConfig{Address: ts.URL})
+	if err := r.Ping(context.Background()); err == nil {
+		t.Error("Expected an error without credentials")
+	}
 }
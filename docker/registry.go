@@ -0,0 +1,268 @@
+package docker
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Media type the registry must be asked for, otherwise it returns the
+	// digest of a schema1 manifest which cannot be used for deletion.
+	ManifestV2MediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	RegistryTimeout     = 30 * time.Second
+	CatalogPageSize     = 100
+)
+
+type RegistryConfig struct {
+	// Registry address, e.g. registry.example.com:443. Same value as the
+	// one used to tag and push function images.
+	Address  string
+	Username string
+	Password string
+	Insecure bool
+
+	// Logger of the calls made without a request logger in their
+	// context. logging.Default if nil.
+	Logger *logging.Logger
+}
+
+// Registry talks to a docker registry through the Registry HTTP API v2.
+type Registry struct {
+	baseURL  string
+	username string
+	password string
+	client   *http.Client
+	log      *logging.Logger
+}
+
+type catalog struct {
+	Repositories []string `json:"repositories"`
+}
+
+type manifest struct {
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+type imageConfig struct {
+	Created time.Time `json:"created"`
+}
+
+// NewRegistry creates a registry client for the given configuration.
+func NewRegistry(c *RegistryConfig) *Registry {
+	scheme := "https"
+	transport := &http.Transport{}
+	if c.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	address := c.Address
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		scheme = address[:strings.Index(address, "://")]
+		address = address[len(scheme)+3:]
+	}
+	logger := c.Logger
+	if logger == nil {
+		logger = logging.Default
+	}
+	return &Registry{
+		baseURL:  scheme + "://" + strings.TrimSuffix(address, "/"),
+		username: c.Username,
+		password: c.Password,
+		client:   &http.Client{Transport: transport, Timeout: RegistryTimeout},
+		log:      logger,
+	}
+}
+
+// logger returns the logger of the request of ctx, if any
+func (r *Registry) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, r.log)
+}
+
+// DeleteImage deletes the manifest of repository:tag from the registry.
+// Blobs are reclaimed by the registry's own garbage collector.
+//
+// Deleting an image that does not exist in the registry is not an error.
+func (r *Registry) DeleteImage(ctx context.Context, repository, tag string) error {
+	digest, err := r.GetManifestDigest(ctx, repository, tag)
+	if err != nil {
+		return err
+	}
+	if digest == "" {
+		r.logger(ctx).Info("Image not found in registry", "image", repository+":"+tag)
+		return nil
+	}
+
+	r.logger(ctx).Info("Deleting image from registry", "image", repository+":"+tag, "digest", digest)
+	resp, err := r.do(ctx, "DELETE", fmt.Sprintf("/v2/%s/manifests/%s", repository, digest), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return errors.New("Registry does not allow deletion. Enable storage.delete in the registry configuration.")
+	default:
+		return registryError(resp)
+	}
+}
+
+// GetManifestDigest returns the content digest of repository:tag, or an
+// empty string if the image does not exist.
+func (r *Registry) GetManifestDigest(ctx context.Context, repository, tag string) (string, error) {
+	resp, err := r.do(ctx, "HEAD", fmt.Sprintf("/v2/%s/manifests/%s", repository, tag),
+		map[string]string{"Accept": ManifestV2MediaType})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Header.Get("Docker-Content-Digest"), nil
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", registryError(resp)
+	}
+}
+
+// GetImageCreated returns when the image repository:tag was built, read
+// from its config, or the zero time if the image does not exist.
+func (r *Registry) GetImageCreated(ctx context.Context, repository, tag string) (time.Time, error) {
+	var m manifest
+	if ok, err := r.getJSON(ctx, fmt.Sprintf("/v2/%s/manifests/%s", repository, tag), ManifestV2MediaType, &m); err != nil || !ok {
+		return time.Time{}, err
+	}
+	if m.Config.Digest == "" {
+		return time.Time{}, errors.New("Manifest of " + repository + ":" + tag + " has no config.")
+	}
+	var c imageConfig
+	if ok, err := r.getJSON(ctx, fmt.Sprintf("/v2/%s/blobs/%s", repository, m.Config.Digest), "", &c); err != nil || !ok {
+		return time.Time{}, err
+	}
+	return c.Created, nil
+}
+
+// getJSON decodes the JSON document at `path` into v. It returns false if
+// there is none.
+func (r *Registry) getJSON(ctx context.Context, path, accept string, v interface{}) (bool, error) {
+	var headers map[string]string
+	if accept != "" {
+		headers = map[string]string{"Accept": accept}
+	}
+	resp, err := r.do(ctx, "GET", path, headers)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, registryError(resp)
+	}
+}
+
+// Ping checks that the registry is reachable and accepts the
+// credentials of the client
+func (r *Registry) Ping(ctx context.Context) error {
+	resp, err := r.do(ctx, "GET", "/v2/", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return registryError(resp)
+	}
+	return nil
+}
+
+// ListRepositories walks the registry catalog and returns the name of
+// every repository.
+func (r *Registry) ListRepositories(ctx context.Context) ([]string, error) {
+	repos := make([]string, 0, CatalogPageSize)
+	path := fmt.Sprintf("/v2/_catalog?n=%d", CatalogPageSize)
+	for path != "" {
+		resp, err := r.do(ctx, "GET", path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = registryError(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+
+		var c catalog
+		err = json.NewDecoder(resp.Body).Decode(&c)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, c.Repositories...)
+
+		path = nextPage(resp.Header.Get("Link"))
+	}
+	return repos, nil
+}
+
+// do sends a request to the registry. Cancelling `ctx` aborts it.
+func (r *Registry) do(ctx context.Context, method, path string, headers map[string]string) (resp *http.Response, err error) {
+	_, span := tracing.Start(ctx, "registry."+method, "path", path)
+	defer func() {
+		if resp != nil {
+			span.SetAttributes("status", resp.StatusCode)
+		}
+		span.SetError(err)
+		span.End()
+	}()
+
+	req, err := http.NewRequest(method, r.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Cancel = ctx.Done()
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+	return r.client.Do(req)
+}
+
+// nextPage extracts the next catalog page from a Link header of the form
+// `</v2/_catalog?last=x&n=100>; rel="next"`.
+func nextPage(link string) string {
+	if link == "" || !strings.Contains(link, `rel="next"`) {
+		return ""
+	}
+	start := strings.Index(link, "<")
+	end := strings.Index(link, ">")
+	if start < 0 || end <= start {
+		return ""
+	}
+	return link[start+1 : end]
+}
+
+func registryError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return errors.New(fmt.Sprintf("Registry returned %s: %s", resp.Status, strings.TrimSpace(string(body))))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/kexec"
+	"golang.org/x/net/context"
+)
+
+// SecretMask is shown instead of the value of a secret. Submitting it back
+// keeps the stored value.
+var SecretMask = "********"
+
+var envNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvLines parses `NAME=value` lines. Empty lines and lines starting
+// with # are skipped.
+func parseEnvLines(text string) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid environment variable %q, expected NAME=value.", line))
+		}
+		name := strings.TrimSpace(line[:i])
+		values[name] = line[i+1:]
+	}
+	return values, scanner.Err()
+}
+
+// buildFunctionEnv validates the submitted environment variables and
+// secrets and merges them with the `existing` environment: a secret whose
+// value is SecretMask keeps its stored value.
+func buildFunctionEnv(plain, secrets map[string]string, existing []*dal.EnvVar) ([]*dal.EnvVar, error) {
+	stored := make(map[string]*dal.EnvVar)
+	for _, e := range existing {
+		stored[e.Name] = e
+	}
+
+	env := make([]*dal.EnvVar, 0, len(plain)+len(secrets))
+	for name, value := range plain {
+		env = append(env, &dal.EnvVar{Name: name, Value: value})
+	}
+	for name, value := range secrets {
+		if _, ok := plain[name]; ok {
+			return nil, errors.New(fmt.Sprintf("%s is defined both as a variable and as a secret.", name))
+		}
+		if value == SecretMask {
+			old, ok := stored[name]
+			if !ok || !old.Secret {
+				return nil, errors.New(fmt.Sprintf("Secret %s has no stored value.", name))
+			}
+			value = old.Value
+		}
+		env = append(env, &dal.EnvVar{Name: name, Value: value, Secret: true})
+	}
+
+	for _, e := range env {
+		if !envNameRegexp.MatchString(e.Name) {
+			return nil, errors.New(fmt.Sprintf("Invalid environment variable name %q.", e.Name))
+		}
+		switch e.Name {
+		case kexec.JobEnvParams, kexec.JobEnvParamsFile, kexec.JobEnvInputDir, kexec.JobEnvResultPath,
+			kexec.JobEnvMode, kexec.JobEnvPort, kexec.JobEnvTraceParent:
+			return nil, errors.New(fmt.Sprintf("%s is reserved.", e.Name))
+		}
+	}
+	return env, nil
+}
+
+// parseFunctionEnvForm reads the environment from a submitted function
+// form. The fields hold NAME=value lines.
+func parseFunctionEnvForm(ctx context.Context, a *appContext, request *http.Request, userName, functionName string) ([]*dal.EnvVar, error) {
+	plain, err := parseEnvLines(request.FormValue("env"))
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := parseEnvLines(request.FormValue("secrets"))
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getFunctionEnv(ctx, a, userName, functionName)
+	if err != nil {
+		return nil, err
+	}
+	return buildFunctionEnv(plain, secrets, existing)
+}
+
+// getFunctionEnv returns the environment of a function, or nothing if the
+// function does not exist yet.
+func getFunctionEnv(ctx context.Context, a *appContext, userName, functionName string) ([]*dal.EnvVar, error) {
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return a.dal.ListFunctionEnv(ctx, f.ID)
+}
+
+// formatEnvLines is the reverse of parseEnvLines, with secret values
+// replaced by SecretMask.
+func formatEnvLines(env []*dal.EnvVar) (plain string, secrets string) {
+	for _, e := range env {
+		if e.Secret {
+			secrets += e.Name + "=" + SecretMask + "\n"
+		} else {
+			plain += e.Name + "=" + e.Value + "\n"
+		}
+	}
+	return plain, secrets
+}
+
+// splitEnv splits the environment of a function into variables and
+// secrets, as expected by kexec.
+func splitEnv(env []*dal.EnvVar) (map[string]string, map[string]string) {
+	plain := make(map[string]string)
+	secrets := make(map[string]string)
+	for _, e := range env {
+		if e.Secret {
+			secrets[e.Name] = e.Value
+		} else {
+			plain[e.Name] = e.Value
+		}
+	}
+	return plain, secrets
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/events"
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/tracing"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Period at which the subscriptions stored in the DB are opened or
+	// closed, so that changes made on other servers are picked up
+	EventSyncPeriod = 15 * time.Second
+
+	// Maximum size of a message published through the API
+	MaxEventBodySize int64 = 1 << 20
+)
+
+// eventManager keeps a subscription open for each function subscribed to
+// a topic. Every server subscribes with the same group, and the source
+// delivers each message to one of them: the local source delivers a group
+// to one server at a time, the others standing by.
+type eventManager struct {
+	conf    *eventsConfig
+	sources map[string]events.Source
+	log     *logging.Logger
+
+	lock sync.Mutex
+	subs map[int64]events.Subscription
+}
+
+// newEventManager opens the configured event sources
+func newEventManager(conf *eventsConfig, logger *logging.Logger) (*eventManager, error) {
+	m := &eventManager{
+		conf:    conf,
+		sources: make(map[string]events.Source),
+		log:     logger,
+		subs:    make(map[int64]events.Subscription),
+	}
+	for name, c := range conf.Sources {
+		s, err := events.Open(c.Driver, c.Options)
+		if err != nil {
+			m.close()
+			return nil, errors.New(fmt.Sprintf("Failed to open event source %s: %v", name, err))
+		}
+		m.sources[name] = s
+	}
+	return m, nil
+}
+
+// run keeps the open subscriptions in sync with the DB
+func (m *eventManager) run(a *appContext) {
+	ticker := time.NewTicker(EventSyncPeriod)
+	defer ticker.Stop()
+	for {
+		if err := m.sync(context.Background(), a); err != nil {
+			m.log.Error("Failed to sync event subscriptions", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// sync opens the subscriptions added to the DB, and closes the deleted
+// ones
+func (m *eventManager) sync(ctx context.Context, a *appContext) error {
+	subscriptions, err := a.dal.ListAllSubscriptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stored := make(map[int64]bool)
+	for _, s := range subscriptions {
+		stored[s.ID] = true
+		if _, ok := m.subs[s.ID]; ok {
+			continue
+		}
+		source, ok := m.sources[s.Source]
+		if !ok {
+			m.log.Warn("Skipping subscription to unknown event source", "subscription_id", s.ID, "function", s.FunctionName, "source", s.Source)
+			continue
+		}
+		opts := &events.SubscribeOptions{
+			MaxDeliveries: s.MaxDeliveries,
+			Backoff:       time.Duration(m.conf.RetryBackoff) * time.Second,
+			Logger:        m.log.With("subscription_id", s.ID),
+		}
+		if opts.MaxDeliveries <= 0 {
+			opts.MaxDeliveries = m.conf.DefaultMaxDeliveries
+		}
+		sub, err := source.Subscribe(s.Topic, subscriptionGroup(s.ID), opts, eventHandler(a, s))
+		if err != nil {
+			m.log.Error("Failed to open subscription", "subscription_id", s.ID, "function", s.FunctionName, "error", err)
+			continue
+		}
+		m.log.Info("Opened subscription", "subscription_id", s.ID, "function", s.FunctionName, "source", s.Source, "topic", s.Topic)
+		m.subs[s.ID] = sub
+	}
+	for id, sub := range m.subs {
+		if !stored[id] {
+			m.log.Info("Closing deleted subscription", "subscription_id", id)
+			sub.Close()
+			delete(m.subs, id)
+		}
+	}
+	return nil
+}
+
+// publish publishes a message to a topic of a source
+func (m *eventManager) publish(ctx context.Context, source, topic string, body []byte) error {
+	s, ok := m.sources[source]
+	if !ok {
+		return errUnknownEventSource
+	}
+	return s.Publish(ctx, topic, body)
+}
+
+// close closes the subscriptions, then the sources. The messages being
+// handled are delivered again once the servers subscribe again.
+func (m *eventManager) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for id, sub := range m.subs {
+		sub.Close()
+		delete(m.subs, id)
+	}
+	for name, s := range m.sources {
+		if err := s.Close(); err != nil {
+			m.log.Error("Failed to close event source", "source", name, "error", err)
+		}
+	}
+}
+
+var errUnknownEventSource = errors.New("Unknown event source")
+
+// subscriptionGroup is the group the servers subscribe with for a
+// subscription, so that each message is delivered to one of them
+func subscriptionGroup(subscriptionID int64) string {
+	return fmt.Sprintf("serverless-%d", subscriptionID)
+}
+
+// eventHandler calls the function of a subscription with the messages
+// delivered to it. A message is acknowledged only if the execution
+// succeeded.
+func eventHandler(a *appContext, s *dal.Subscription) events.Handler {
+	return func(ctx context.Context, msg *events.Message) error {
+		a.log.Info("Message calls function", "message", msg.ID, "topic", msg.Topic, "user", s.UserName,
+			"function", s.FunctionName, "delivery", msg.Deliveries)
+		ctx, span := tracing.Start(ctx, "event", "message", msg.ID, "topic", msg.Topic, "delivery", msg.Deliveries)
+		defer span.End()
+		params, err := eventParams(msg.Body)
+		if err != nil {
+			span.SetError(err)
+			return err
+		}
+		timestamp := time.Now()
+		res, err := callFunction(ctx, a, s.UserName, s.FunctionName, params, nil)
+		if err != nil {
+			span.SetError(err)
+			return err
+		}
+		res.Trigger = TriggerEvent
+		if err := PutFunctionExecution(ctx, a, s.UserName, s.FunctionName, params, res, timestamp); err != nil {
+			a.log.Error("Failed to record event call", "user", s.UserName, "function", s.FunctionName, "error", err)
+		}
+		if res.Result != ExecutionSucceeded {
+			return errors.New(fmt.Sprintf("Execution %s of function %s %s", res.Uuid, s.FunctionName, res.Result))
+		}
+		return nil
+	}
+}
+
+// eventParams maps a message into the params of the function: the body
+// if it is a JSON document, and the body as a JSON string otherwise.
+func eventParams(body []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		return string(body), nil
+	}
+	params, err := json.Marshal(string(body))
+	if err != nil {
+		return "", err
+	}
+	return string(params), nil
+}
+
+// ApiSubscription is a subscription of a function to a topic. The
+// messages failing MaxDeliveries times are published to DeadLetterTopic.
+type ApiSubscription struct {
+	ID              int64     `json:"id"`
+	Source          string    `json:"source"`
+	Topic           string    `json:"topic"`
+	MaxDeliveries   int       `json:"maxDeliveries"`
+	DeadLetterTopic string    `json:"deadLetterTopic"`
+	Created         time.Time `json:"created"`
+}
+
+func apiSubscription(s *dal.Subscription) *ApiSubscription {
+	return &ApiSubscription{
+		ID:              s.ID,
+		Source:          s.Source,
+		Topic:           s.Topic,
+		MaxDeliveries:   s.MaxDeliveries,
+		DeadLetterTopic: events.DeadLetterTopic(s.Topic),
+		Created:         s.Created,
+	}
+}
+
+func ApiListSubscriptionsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	subscriptions, err := a.dal.ListSubscriptions(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	res := make([]*ApiSubscription, 0, len(subscriptions))
+	for _, s := range subscriptions {
+		res = append(res, apiSubscription(s))
+	}
+	return writeJSON(response, res)
+}
+
+// ApiCreateSubscriptionHandler subscribes a function to a topic. The
+// subscription is opened by the servers within EventSyncPeriod.
+func ApiCreateSubscriptionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	var req ApiSubscription
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSubscriptionFailed, true}
+	}
+
+	s := &dal.Subscription{
+		Source:        strings.TrimSpace(req.Source),
+		Topic:         strings.TrimSpace(req.Topic),
+		MaxDeliveries: req.MaxDeliveries,
+		Created:       time.Now(),
+	}
+	if _, ok := a.events.sources[s.Source]; !ok {
+		err := errors.New(fmt.Sprintf("Unknown event source %q.", s.Source))
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSubscriptionFailed, true}
+	}
+	if err := events.ValidateName(s.Topic); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSubscriptionFailed, true}
+	}
+	if s.MaxDeliveries < 0 {
+		err := errors.New("Max deliveries must not be negative.")
+		return StatusError{http.StatusBadRequest, err, MessageUpdateSubscriptionFailed, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	s.FunctionID = f.ID
+	if s.ID, err = a.dal.PutSubscription(ctx, s); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateSubscriptionFailed, true}
+	}
+	return writeJSON(response, apiSubscription(s))
+}
+
+func ApiDeleteSubscriptionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	subscriptionID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return StatusError{http.StatusNotFound, err, MessageSubscriptionNotFound, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	err = a.dal.DeleteSubscription(ctx, f.ID, subscriptionID)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageSubscriptionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateSubscriptionFailed, true}
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ApiPublishEventHandler publishes the request body to a topic
+func ApiPublishEventHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	vars := mux.Vars(request)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, MaxEventBodySize))
+	if err != nil {
+		return StatusError{http.StatusRequestEntityTooLarge, err, MessagePublishEventFailed, true}
+	}
+	if err := events.ValidateName(vars["topic"]); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessagePublishEventFailed, true}
+	}
+
+	err = a.events.publish(ctx, vars["source"], vars["topic"], body)
+	if err == errUnknownEventSource {
+		return StatusError{http.StatusNotFound, err, MessagePublishEventFailed, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessagePublishEventFailed, true}
+	}
+	response.WriteHeader(http.StatusAccepted)
+	return nil
+}
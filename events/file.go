@@ -0,0 +1,371 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// PollInterval is how often subscriptions of the local source look for
+// messages published by other processes sharing its directory
+var PollInterval = time.Second
+
+func init() {
+	Register("local", func(options map[string]string) (Source, error) {
+		return NewFileSource(options["dir"])
+	})
+}
+
+// fileRecord is a message as stored in the log of a topic, one JSON
+// document per line. Body is base64 encoded by encoding/json.
+type fileRecord struct {
+	ID        string    `json:"id"`
+	Body      []byte    `json:"body"`
+	Published time.Time `json:"published"`
+}
+
+// FileSource is a durable queue embedded in the server. Each topic is an
+// append-only log file in its own directory, and each subscription group
+// keeps the offset of the next message to deliver in a file next to it.
+// Messages are delivered to a group one at a time, in order: a message
+// failing is retried before the next one is delivered.
+//
+// A group is delivered to one subscription at a time, holding a lock on
+// the group. The other subscriptions of the group, e.g. of the other
+// processes sharing the directory, stand by until it is closed. Logs are
+// not compacted.
+type FileSource struct {
+	dir string
+
+	lock   sync.Mutex
+	topics map[string]*fileTopic
+}
+
+// fileTopic is the log of a topic
+type fileTopic struct {
+	dir string
+
+	lock sync.Mutex
+	file *os.File
+	// Closed and replaced when a message is published
+	published chan struct{}
+}
+
+// NewFileSource opens a local source storing its topics in `dir`
+func NewFileSource(dir string) (*FileSource, error) {
+	if dir == "" {
+		return nil, errors.New("No directory given to the local event source")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileSource{dir: dir, topics: make(map[string]*fileTopic)}, nil
+}
+
+func (s *FileSource) topic(name string) (*fileTopic, error) {
+	if err := ValidateName(name); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if t, ok := s.topics[name]; ok {
+		return t, nil
+	}
+	dir := filepath.Join(s.dir, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &fileTopic{dir: dir, file: file, published: make(chan struct{})}
+	s.topics[name] = t
+	return t, nil
+}
+
+// Publish appends a message to the log of a topic, and syncs it to disk
+func (s *FileSource) Publish(ctx context.Context, topic string, body []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t, err := s.topic(topic)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	line, err := json.Marshal(fileRecord{hex.EncodeToString(id), body, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, err := t.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := t.file.Sync(); err != nil {
+		return err
+	}
+	close(t.published)
+	t.published = make(chan struct{})
+	return nil
+}
+
+// Subscribe starts delivering the messages of a topic from the offset of
+// the group, i.e. from the first message the group did not acknowledge.
+func (s *FileSource) Subscribe(topic, group string, opts *SubscribeOptions, h Handler) (Subscription, error) {
+	if err := ValidateName(group); err != nil {
+		return nil, err
+	}
+	t, err := s.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &SubscribeOptions{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sub := &fileSubscription{
+		source:     s,
+		topic:      t,
+		name:       topic,
+		offsetPath: filepath.Join(t.dir, group+".offset"),
+		lockPath:   filepath.Join(t.dir, group+".lock"),
+		opts:       opts,
+		handler:    h,
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go sub.run()
+	return sub, nil
+}
+
+// Close closes the logs of the topics
+func (s *FileSource) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var err error
+	for name, t := range s.topics {
+		t.lock.Lock()
+		if e := t.file.Close(); e != nil {
+			err = e
+		}
+		t.lock.Unlock()
+		delete(s.topics, name)
+	}
+	return err
+}
+
+type fileSubscription struct {
+	source     *FileSource
+	topic      *fileTopic
+	name       string
+	offsetPath string
+	lockPath   string
+	opts       *SubscribeOptions
+	handler    Handler
+
+	// Done once the subscription is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Close stops the deliveries and waits for the subscription to stop
+func (sub *fileSubscription) Close() error {
+	sub.cancel()
+	<-sub.done
+	return nil
+}
+
+func (sub *fileSubscription) run() {
+	defer close(sub.done)
+	lock := sub.lockGroup()
+	if lock == nil {
+		return
+	}
+	// Closing the file releases the lock
+	defer lock.Close()
+	for {
+		err := sub.deliver()
+		if sub.ctx.Err() != nil {
+			return
+		}
+		sub.opts.logger().Error("Subscription failed", "topic", sub.name, "error", err)
+		select {
+		case <-time.After(PollInterval):
+		case <-sub.ctx.Done():
+			return
+		}
+	}
+}
+
+// lockGroup waits for the lock of the group, and returns the locked file.
+// It returns nil if the subscription is closed first.
+func (sub *fileSubscription) lockGroup() *os.File {
+	standby := false
+	for {
+		file, err := os.OpenFile(sub.lockPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err == nil {
+			err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				if standby {
+					sub.opts.logger().Info("Taking over subscription group", "topic", sub.name)
+				}
+				return file
+			}
+			file.Close()
+		}
+		if err == syscall.EWOULDBLOCK {
+			if !standby {
+				sub.opts.logger().Info("Subscription group held by another subscription, standing by", "topic", sub.name)
+				standby = true
+			}
+		} else {
+			sub.opts.logger().Error("Failed to lock subscription group", "topic", sub.name, "error", err)
+		}
+		select {
+		case <-time.After(PollInterval):
+		case <-sub.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// deliver delivers the messages from the offset of the group until the
+// subscription is closed or an error occurs.
+func (sub *fileSubscription) deliver() error {
+	offset, err := sub.readOffset()
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filepath.Join(sub.topic.dir, "log"))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, os.SEEK_SET); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+
+	for {
+		sub.topic.lock.Lock()
+		published := sub.topic.published
+		sub.topic.lock.Unlock()
+
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Partial lines are being written, read them again
+			if _, err := file.Seek(offset, os.SEEK_SET); err != nil {
+				return err
+			}
+			reader.Reset(file)
+			select {
+			case <-published:
+			case <-time.After(PollInterval):
+			case <-sub.ctx.Done():
+				return nil
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		var r fileRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &r); err != nil {
+			sub.opts.logger().Error("Skipping corrupted message", "topic", sub.name, "offset", offset, "error", err)
+		} else if !sub.handle(&r) {
+			return nil
+		}
+		offset += int64(len(line))
+		if err := sub.writeOffset(offset); err != nil {
+			return err
+		}
+	}
+}
+
+// handle delivers a message until it is acknowledged or dead-lettered. It
+// returns false if the subscription was closed first.
+func (sub *fileSubscription) handle(r *fileRecord) bool {
+	m := &Message{ID: r.ID, Topic: sub.name, Body: r.Body, Published: r.Published}
+	maxDeliveries := sub.opts.maxDeliveries()
+	for {
+		m.Deliveries++
+		err := sub.handler(sub.ctx, m)
+		if sub.ctx.Err() != nil {
+			return false
+		}
+		if err == nil {
+			return true
+		}
+		if m.Deliveries >= maxDeliveries {
+			sub.opts.logger().Warn("Dead-lettering message", "topic", sub.name, "message", m.ID, "deliveries", m.Deliveries, "error", err)
+			return sub.deadLetter(m)
+		}
+
+		backoff := sub.opts.backoff(m.Deliveries)
+		sub.opts.logger().Warn("Delivery failed", "topic", sub.name, "message", m.ID, "delivery", m.Deliveries, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-sub.ctx.Done():
+			return false
+		}
+	}
+}
+
+// deadLetter publishes a message to the dead letter topic, until it
+// succeeds or the subscription is closed.
+func (sub *fileSubscription) deadLetter(m *Message) bool {
+	for {
+		err := sub.source.Publish(sub.ctx, DeadLetterTopic(sub.name), m.Body)
+		if err == nil {
+			return true
+		}
+		sub.opts.logger().Error("Failed to dead-letter message", "topic", sub.name, "message", m.ID, "error", err)
+		select {
+		case <-time.After(PollInterval):
+		case <-sub.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (sub *fileSubscription) readOffset() (int64, error) {
+	b, err := ioutil.ReadFile(sub.offsetPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// writeOffset replaces the offset file, so that it is never seen half
+// written
+func (sub *fileSubscription) writeOffset(offset int64) error {
+	tmp := sub.offsetPath + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, sub.offsetPath)
+}
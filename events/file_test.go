@@ -0,0 +1,185 @@
+package events
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var ctx = context.Background()
+
+func newTestSource(t *testing.T) (*FileSource, func()) {
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func receive(t *testing.T, c chan string) string {
+	select {
+	case body := <-c:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("No message delivered")
+	}
+	return ""
+}
+
+func TestFileSourceDelivery(t *testing.T) {
+	s, cleanup := newTestSource(t)
+	defer cleanup()
+
+	if err := s.Publish(ctx, "test", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan string, 10)
+	sub, err := s.Subscribe("test", "group", nil, func(ctx context.Context, m *Message) error {
+		c <- string(m.Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, c); body != "1" {
+		t.Error("Expected message 1, got", body)
+	}
+	if err := s.Publish(ctx, "test", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, c); body != "2" {
+		t.Error("Expected message 2, got", body)
+	}
+	sub.Close()
+
+	// Acknowledged messages are not delivered again to the group
+	if err := s.Publish(ctx, "test", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	sub, err = s.Subscribe("test", "group", nil, func(ctx context.Context, m *Message) error {
+		c <- string(m.Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+	if body := receive(t, c); body != "3" {
+		t.Error("Expected message 3, got", body)
+	}
+}
+
+func TestFileSourceDeadLetter(t *testing.T) {
+	s, cleanup := newTestSource(t)
+	defer cleanup()
+
+	deliveries := make(chan int, 10)
+	opts := &SubscribeOptions{MaxDeliveries: 3, Backoff: time.Millisecond}
+	sub, err := s.Subscribe("test", "group", opts, func(ctx context.Context, m *Message) error {
+		deliveries <- m.Deliveries
+		return errors.New("failed")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Close()
+
+	dead := make(chan string, 10)
+	deadSub, err := s.Subscribe(DeadLetterTopic("test"), "group", nil, func(ctx context.Context, m *Message) error {
+		dead <- string(m.Body)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer deadSub.Close()
+
+	if err := s.Publish(ctx, "test", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, dead); body != "1" {
+		t.Error("Expected dead-lettered message 1, got", body)
+	}
+	if n := len(deliveries); n != 3 {
+		t.Error("Expected 3 deliveries, got", n)
+	}
+}
+
+func TestValidateName(t *testing.T) {
+	for _, name := range []string{"orders", "orders.dead", "a_b-c"} {
+		if err := ValidateName(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{"", ".", "../x", "a/b"} {
+		if err := ValidateName(name); err == nil {
+			t.Error("Expected invalid name", name)
+		}
+	}
+}
+
+func TestFileSourceGroupLock(t *testing.T) {
+	s, cleanup := newTestSource(t)
+	defer cleanup()
+
+	// A second source on the same directory, as another server would open
+	other, err := NewFileSource(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	c := make(chan string, 10)
+	handler := func(name string) Handler {
+		return func(ctx context.Context, m *Message) error {
+			c <- name + ":" + string(m.Body)
+			return nil
+		}
+	}
+	first, err := s.Subscribe("test", "group", nil, handler("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(ctx, "test", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, c); body != "first:1" {
+		t.Error("Expected message 1 delivered to the first subscription, got", body)
+	}
+	second, err := other.Subscribe("test", "group", nil, handler("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if err := s.Publish(ctx, "test", []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, c); body != "first:2" {
+		t.Error("Expected message 2 delivered to the first subscription, got", body)
+	}
+
+	// The standby subscription takes over once the first one is closed
+	first.Close()
+	if err := s.Publish(ctx, "test", []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if body := receive(t, c); body != "second:3" {
+		t.Error("Expected message 3 delivered to the second subscription, got", body)
+	}
+	select {
+	case body := <-c:
+		t.Error("Unexpected delivery", body)
+	case <-time.After(2 * PollInterval):
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Package events delivers the messages published to topics to the
+subscriptions of the server.
+
+A Source is a message broker. The package provides a local source, an
+embedded file-backed queue registered as "local". Adapters for external
+brokers implement Source and register an Opener under their name from an
+init function, like database/sql drivers:
+
+	func init() {
+		events.Register("kafka", openKafka)
+	}
+
+They must meet the same contract as the local source: every message is
+delivered at least once to each subscription group, a message is
+acknowledged only once its handler succeeded, and it is published to
+DeadLetterTopic(topic) once the handler failed MaxDeliveries times on it.
+*/
+package events
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"golang.org/x/net/context"
+)
+
+// Message is an event published to a topic
+type Message struct {
+	ID        string
+	Topic     string
+	Body      []byte
+	Published time.Time
+
+	// Number of times the message was delivered to the subscription,
+	// including this one
+	Deliveries int
+}
+
+// Handler processes a message delivered to a subscription. The message
+// is acknowledged if it returns nil, and delivered again otherwise. The
+// context is done once the subscription is closed.
+type Handler func(ctx context.Context, m *Message) error
+
+// SubscribeOptions tell how failed deliveries are retried
+type SubscribeOptions struct {
+	// Deliveries of a message before it is dead-lettered. 0 means
+	// DefaultMaxDeliveries.
+	MaxDeliveries int
+
+	// Delay before the first redelivery, doubled for each next one
+	Backoff time.Duration
+
+	// Logger of the deliveries. logging.Default if nil.
+	Logger *logging.Logger
+}
+
+var (
+	DefaultMaxDeliveries = 5
+	MaxBackoff           = 5 * time.Minute
+)
+
+// Source is a message broker
+type Source interface {
+	// Publish appends a message to a topic
+	Publish(ctx context.Context, topic string, body []byte) error
+
+	// Subscribe delivers the messages of a topic to `h`. Subscriptions of
+	// the same group share the messages, each message being delivered to
+	// one of them.
+	Subscribe(topic, group string, opts *SubscribeOptions, h Handler) (Subscription, error)
+
+	// Close closes the source. Its subscriptions must be closed first.
+	Close() error
+}
+
+// Subscription is an open subscription to a topic
+type Subscription interface {
+	// Close stops the deliveries. A message being handled is delivered
+	// again later.
+	Close() error
+}
+
+// DeadLetterTopic is the topic the messages of `topic` are published to
+// once their deliveries failed
+func DeadLetterTopic(topic string) string {
+	return topic + ".dead"
+}
+
+var nameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// ValidateName checks the name of a topic or a group
+func ValidateName(name string) error {
+	if len(name) > 200 || !nameRegexp.MatchString(name) {
+		return errors.New(fmt.Sprintf("Invalid name %q, expected letters, digits, '_', '.' and '-'.", name))
+	}
+	return nil
+}
+
+// Opener opens a source of a driver with driver specific options
+type Opener func(options map[string]string) (Source, error)
+
+var (
+	openers    = make(map[string]Opener)
+	openerLock sync.Mutex
+)
+
+// Register makes a source driver available by name. It panics if the
+// name is registered twice.
+func Register(name string, open Opener) {
+	openerLock.Lock()
+	defer openerLock.Unlock()
+	if _, ok := openers[name]; ok {
+		panic("events: source driver " + name + " registered twice")
+	}
+	openers[name] = open
+}
+
+// Open opens a source with the driver registered as `name`
+func Open(name string, options map[string]string) (Source, error) {
+	openerLock.Lock()
+	open, ok := openers[name]
+	openerLock.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Unknown event source driver %q", name))
+	}
+	return open(options)
+}
+
+// backoff returns the delay before the redelivery following the
+// `failures`th failed delivery
+func (o *SubscribeOptions) backoff(failures int) time.Duration {
+	d := o.Backoff
+	for i := 1; i < failures && d < MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxBackoff {
+		d = MaxBackoff
+	}
+	return d
+}
+
+func (o *SubscribeOptions) logger() *logging.Logger {
+	if o.Logger == nil {
+		return logging.Default
+	}
+	return o.Logger
+}
+
+func (o *SubscribeOptions) maxDeliveries() int {
+	if o.MaxDeliveries <= 0 {
+		return DefaultMaxDeliveries
+	}
+	return o.MaxDeliveries
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Status of a cancelled execution
+var ExecutionCancelled = "Cancelled"
+
+// Status of a succeeded execution, the phase of its pod
+var ExecutionSucceeded = "Succeeded"
+
+// What started an execution
+var (
+	TriggerHTTP     = "http"
+	TriggerSchedule = "schedule"
+	TriggerWebhook  = "webhook"
+	TriggerEvent    = "event"
+	TriggerWorkflow = "workflow"
+)
+
+var errExecutionNotRunning = errors.New("Execution is not running on this server")
+
+// runningExecution is an execution whose job is running, or whose record
+// is not stored in the DB yet.
+type runningExecution struct {
+	User      string
+	Function  string
+	Uuid      string
+	Namespace string
+	JobName   string
+	Started   time.Time
+
+	// Closed once the job completed
+	done chan struct{}
+	// Closed once the execution record is stored, or will not be
+	finalized chan struct{}
+
+	once sync.Once
+}
+
+// executionTracker keeps the executions of this server that are not
+// finalized yet, so that they can be looked up by uuid.
+type executionTracker struct {
+	lock    sync.Mutex
+	running map[string]*runningExecution
+}
+
+func newExecutionTracker() *executionTracker {
+	return &executionTracker{running: make(map[string]*runningExecution)}
+}
+
+// start registers a new execution
+func (t *executionTracker) start(userName, functionName, uuid, namespace, jobName string) *runningExecution {
+	e := &runningExecution{
+		User:      userName,
+		Function:  functionName,
+		Uuid:      uuid,
+		Namespace: namespace,
+		JobName:   jobName,
+		Started:   time.Now(),
+		done:      make(chan struct{}),
+		finalized: make(chan struct{}),
+	}
+	t.lock.Lock()
+	t.running[uuid] = e
+	t.lock.Unlock()
+	return e
+}
+
+// complete marks the job of an execution completed
+func (t *executionTracker) complete(uuid string) {
+	if e := t.get(uuid); e != nil {
+		e.once.Do(func() { close(e.done) })
+	}
+}
+
+// finalize forgets an execution once its record is stored. It completes
+// the execution too, for executions that failed to run.
+func (t *executionTracker) finalize(uuid string) {
+	t.complete(uuid)
+	t.lock.Lock()
+	e, ok := t.running[uuid]
+	delete(t.running, uuid)
+	t.lock.Unlock()
+	if ok {
+		close(e.finalized)
+	}
+}
+
+// get returns a running execution, or nil
+func (t *executionTracker) get(uuid string) *runningExecution {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.running[uuid]
+}
+
+// list returns the running executions of a function
+func (t *executionTracker) list(userName, functionName string) []*runningExecution {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	res := make([]*runningExecution, 0)
+	for _, e := range t.running {
+		if e.User == userName && e.Function == functionName {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// cancelExecution cancels a running execution. The caller waiting for the
+// execution gets a "Cancelled" result with the log captured so far, and
+// the execution is recorded as such. Executions are tracked per server,
+// so only the executions started by this server can be cancelled.
+func cancelExecution(ctx context.Context, a *appContext, userName, functionName, uuid string) error {
+	e := a.executions.get(uuid)
+	if e == nil || e.User != userName || e.Function != functionName || isClosed(e.done) {
+		return errExecutionNotRunning
+	}
+	return a.k.CancelJob(ctx, e.JobName, e.Namespace)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/kexec"
+	"github.com/Symantec/Go-kexec/tracing"
+	"github.com/wayn3h0/go-uuid"
+	"golang.org/x/net/context"
+)
+
+// Status of a fan-out execution, named after the pod phases of its items
+var (
+	FanOutSucceeded = "Succeeded"
+	FanOutFailed    = "Failed"
+)
+
+// FanOutResult is the aggregated result of a fan-out execution
+type FanOutResult struct {
+	Result string
+	Uuid   string
+	Items  []*FanOutItem
+}
+
+// FanOutItem is the execution of one item of a fan-out execution. Res is
+// nil if the function could not be called, in which case Err is set.
+type FanOutItem struct {
+	Params string
+	Res    *CallResult
+	Err    error
+}
+
+// callFunctionFanOut calls a function once per item of `items`, as a
+// single job running at most `parallelism` items at a time. The timeout
+// of the function covers all the items, its retry policy applies to
+// each of them.
+func callFunctionFanOut(ctx context.Context, a *appContext, userName, functionName string, items []string, parallelism int) (*FanOutResult, error) {
+	c := &a.conf.FunctionCfg
+	if len(items) == 0 {
+		return nil, errors.New("No items to call the function with.")
+	}
+	if c.MaxFanOut > 0 && len(items) > c.MaxFanOut {
+		return nil, errors.New(fmt.Sprintf("%d items exceed the maximum of %d.", len(items), c.MaxFanOut))
+	}
+	if parallelism <= 0 || parallelism > len(items) {
+		parallelism = len(items)
+	}
+	if c.MaxParallelism > 0 && parallelism > c.MaxParallelism {
+		parallelism = c.MaxParallelism
+	}
+
+	uuid, err := uuid.NewTimeBased()
+	if err != nil {
+		a.logger(ctx).Error("Failed to create uuid for function call", "error", err)
+		return nil, err
+	}
+
+	executionsInFlight.Inc()
+	defer executionsInFlight.Dec()
+	ctx, span := tracing.Start(ctx, "callFunctionFanOut", "user", userName, "function", functionName,
+		"execution", uuid.String(), "items", len(items))
+	defer span.End()
+	a.logger(ctx).Info("Fanning out function", "user", userName, "function", functionName,
+		"items", len(items), "parallelism", parallelism)
+
+	res, err := runFanOut(ctx, a, uuid.String(), userName, functionName, items, parallelism)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	for _, item := range res.Items {
+		if item.Err != nil || item.Res.Result != FanOutSucceeded {
+			res.Result = FanOutFailed
+		}
+		if item.Res != nil {
+			observeInvocation(userName, functionName, item.Res, item.Err, item.Res.Latency)
+		}
+	}
+	span.SetAttributes("result", res.Result)
+	return res, nil
+}
+
+// runFanOut runs the job of a fan-out execution, and returns the result
+// of each item. Like runFunction, it registers the execution so that it
+// can be cancelled, and the job is deleted even if ctx is done.
+func runFanOut(ctx context.Context, a *appContext, uuidStr, userName, functionName string, items []string, parallelism int) (*FanOutResult, error) {
+	start := time.Now()
+	nsName, err := functionNamespace(ctx, a, userName)
+	if err != nil {
+		a.logger(ctx).Error("Failed to set up namespace", "user", userName, "error", err)
+		return nil, err
+	}
+	functionNameLower := strings.ToLower(functionName)
+	jobName := functionNameLower + "-" + strings.Replace(userName, "_", "-", -1) + "-" + uuidStr
+	image := a.conf.DockerCfg.DockerRegistry + "/" + userName + "/" + functionNameLower
+	labels := map[string]string{
+		kexec.JobLabelUser:     userName,
+		kexec.JobLabelFunction: functionNameLower,
+	}
+	if id := requestIDFromContext(ctx); id != "" {
+		labels[kexec.JobLabelRequest] = id
+	}
+
+	f, err := a.dal.GetFunction(ctx, userName, functionName)
+	if err != nil {
+		return nil, err
+	}
+	opts := jobOptions(a, &f.FunctionSettings)
+	env, err := a.dal.ListFunctionEnv(ctx, f.ID)
+	if err != nil {
+		return nil, err
+	}
+	opts.Env, opts.Secrets = splitEnv(env)
+	opts.TraceParent = tracing.Traceparent(ctx)
+
+	if err := a.k.CreateFanOutJob(ctx, jobName, image, items, parallelism, nsName, labels, opts); err != nil {
+		a.logger(ctx).Error("Failed to create fan-out job", "user", userName, "function", functionName, "error", err)
+		return nil, err
+	}
+	a.executions.start(userName, functionName, uuidStr, nsName, jobName)
+	err = a.k.RunFanOutJob(ctx, jobName, nsName, len(items), opts)
+	cancelled := err == kexec.ErrJobCancelled
+	var attempts [][]*kexec.Attempt
+	if err == nil || cancelled {
+		attempts, err = a.k.GetFanOutAttempts(detachContext(ctx), jobName, nsName, len(items), opts.MaxLogSize)
+	}
+
+	err2 := a.k.DeleteFunctionJob(detachContext(ctx), jobName, nsName)
+	a.executions.complete(uuidStr)
+	if err == nil {
+		err = err2
+	} else if err2 != nil {
+		err = errors.New(err.Error() + "\n" + err2.Error())
+	}
+	if err != nil {
+		// No execution record will be stored
+		a.executions.finalize(uuidStr)
+		return nil, err
+	}
+
+	res := &FanOutResult{
+		Result: FanOutSucceeded,
+		Uuid:   uuidStr,
+		Items:  make([]*FanOutItem, len(items)),
+	}
+	for i, params := range items {
+		item := &FanOutItem{Params: params}
+		res.Items[i] = item
+		id, err := uuid.NewTimeBased()
+		if err != nil {
+			item.Err = err
+			continue
+		}
+		status, funcLog := kexec.AggregateAttempts(attempts[i])
+		if cancelled && status != ExecutionSucceeded {
+			status = ExecutionCancelled
+		}
+		latency := time.Since(start)
+		if n := len(attempts[i]); n > 0 && !attempts[i][n-1].FinishTime.IsZero() {
+			latency = attempts[i][n-1].FinishTime.Sub(start)
+		}
+		item.Res = &CallResult{
+			Result:   status,
+			Uuid:     id.String(),
+			Log:      funcLog,
+			Output:   kexec.AttemptsOutput(attempts[i]),
+			Attempts: attempts[i],
+			Mode:     ExecutionModeCold,
+			Latency:  latency,
+		}
+	}
+	return res, nil
+}
+
+// Summary returns one line per item of the fan-out execution, used as
+// the log of the parent execution.
+func (r *FanOutResult) Summary() string {
+	var buf bytes.Buffer
+	for i, item := range r.Items {
+		if item.Err != nil {
+			fmt.Fprintf(&buf, "Item %d: %s: %v\n", i, ResError, item.Err)
+		} else {
+			fmt.Fprintf(&buf, "Item %d: %s (%s)\n", i, item.Res.Result, item.Res.Uuid)
+		}
+	}
+	return buf.String()
+}
+
+// parseFanOutItems splits a JSON array into the params of each item
+func parseFanOutItems(data []byte) ([]string, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.New("Items must be a JSON array: " + err.Error())
+	}
+	items := make([]string, 0, len(raw))
+	for _, r := range raw {
+		items = append(items, string(r))
+	}
+	return items, nil
+}
+
+// PutFanOutExecution records a fan-out execution as a parent execution
+// holding the items array, with one child execution per item. Items that
+// could not be called are recorded with the error as their log. Like
+// PutFunctionExecution, it does not take the context of the request.
+func PutFanOutExecution(a *appContext, userName, functionName, params string, res *FanOutResult, timestamp time.Time) error {
+	a.log.Info("Recording fan-out execution", "execution", res.Uuid, "user", userName, "function", functionName,
+		"items", len(res.Items))
+	defer a.executions.finalize(res.Uuid)
+	ctx := context.Background()
+	tx, err := a.dal.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	f, err := tx.GetFunction(ctx, userName, functionName)
+	if err != nil {
+		return err
+	}
+	parentID, _, err := tx.PutExecution(ctx, f.ID, params, res.Result, res.Uuid, res.Summary(), "", timestamp)
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Items {
+		if item.Err != nil {
+			if _, _, err := tx.PutChildExecution(ctx, parentID, f.ID, item.Params, ResError, "", item.Err.Error(), "", timestamp); err != nil {
+				return err
+			}
+			continue
+		}
+		childID, _, err := tx.PutChildExecution(ctx, parentID, f.ID, item.Params, item.Res.Result, item.Res.Uuid, item.Res.Log, item.Res.Output, timestamp)
+		if err != nil {
+			return err
+		}
+		if err := tx.PutExecutionLatency(ctx, childID, item.Res.Mode, item.Res.Latency); err != nil {
+			return err
+		}
+		if err := tx.PutExecutionAttempts(ctx, childID, executionAttempts(item.Res.Attempts)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
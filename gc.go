@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/docker"
+	"golang.org/x/net/context"
+)
+
+// Function images are pushed before the function is committed to the DB:
+// an image is only deleted once it has had no function for this long, on
+// two runs of the garbage collector at least
+var RegistryGCGrace = 30 * time.Minute
+
+// runRegistryGC periodically deletes function images that no longer
+// have a matching function in the DB, and build contexts that were
+// left behind.
+func runRegistryGC(a *appContext, interval time.Duration) {
+	ctx := context.Background()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// Orphaned repositories, and when they were found orphaned first
+	orphans := make(map[string]time.Time)
+	for {
+		if err := collectRegistryGarbage(ctx, a, orphans, time.Now()); err != nil {
+			a.log.Error("Registry garbage collection failed", "error", err)
+		}
+		if err := docker.CleanBuildContexts(a.log, interval); err != nil {
+			a.log.Error("Build context cleanup failed", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+// collectRegistryGarbage deletes the images of repositories named
+// `<user>/<function>` where <user> is a known user but <function> is not
+// one of its functions, once they were found orphaned in `orphans` for
+// RegistryGCGrace. Repositories of unknown namespaces are not ours and
+// are left alone.
+func collectRegistryGarbage(ctx context.Context, a *appContext, orphans map[string]time.Time, now time.Time) error {
+	a.logger(ctx).Info("Collecting registry garbage")
+
+	known, err := knownFunctions(ctx, a)
+	if err != nil {
+		return err
+	}
+
+	repos, err := a.r.ListRepositories(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted := 0
+	orphaned := make(map[string]bool)
+	for _, repo := range repos {
+		parts := strings.SplitN(repo, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		functions, ok := known[parts[0]]
+		if !ok || functions[parts[1]] != nil {
+			continue
+		}
+		orphaned[repo] = true
+		since, ok := orphans[repo]
+		if !ok {
+			// Maybe the image of a function being created
+			orphans[repo] = now
+			continue
+		}
+		if now.Sub(since) < RegistryGCGrace {
+			continue
+		}
+		a.logger(ctx).Info("Deleting orphaned image", "repository", repo, "orphaned_since", since)
+		if err := a.r.DeleteImage(ctx, repo, "latest"); err != nil {
+			a.logger(ctx).Error("Failed to delete orphaned image", "repository", repo, "error", err)
+			continue
+		}
+		delete(orphans, repo)
+		deleted++
+	}
+	// Forget the repositories which got a function, or were deleted
+	for repo := range orphans {
+		if !orphaned[repo] {
+			delete(orphans, repo)
+		}
+	}
+	a.logger(ctx).Info("Registry garbage collection done", "deleted", deleted)
+	return nil
+}
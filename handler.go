@@ -4,41 +4,64 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
 	"gopkg.in/ldap.v2"
 )
 
 var (
-	MessageCreateFunctionFailed = "Failed to create function"
-	MessageCallFunctionFailed   = "Failed to call function"
-	MessageInternalServerError  = "Server Error"
+	MessageCreateFunctionFailed     = "Failed to create function"
+	MessageCallFunctionFailed       = "Failed to call function"
+	MessageInternalServerError      = "Server Error"
+	MessageFunctionNotFound         = "Function not found"
+	MessageUpdateSettingsFailed     = "Failed to update function settings"
+	MessageUpdateEnvFailed          = "Failed to update function environment"
+	MessageListExecutionsFailed     = "Failed to list function executions"
+	MessageExecutionNotFound        = "Execution not found"
+	MessageCancelExecutionFailed    = "Failed to cancel execution"
+	MessageUpdateScheduleFailed     = "Failed to update function schedules"
+	MessageScheduleNotFound         = "Schedule not found"
+	MessageUpdateWebhookFailed      = "Failed to update function webhooks"
+	MessageWebhookNotFound          = "Webhook not found"
+	MessageWebhookFailed            = "Webhook rejected"
+	MessageUpdateSubscriptionFailed = "Failed to update function subscriptions"
+	MessageSubscriptionNotFound     = "Subscription not found"
+	MessagePublishEventFailed       = "Failed to publish event"
+	MessageUpdateWorkflowFailed     = "Failed to update workflow"
+	MessageWorkflowNotFound         = "Workflow not found"
+	MessageWorkflowRunNotFound      = "Workflow run not found"
+	MessageRunWorkflowFailed        = "Failed to run workflow"
+	MessageUpdateCallbackFailed     = "Failed to update function callback"
+	MessageAdminRequired            = "Administrator required"
+	MessageListAuditFailed          = "Failed to list audit events"
+	MessageOwnerRequired            = "Only the owner can access this resource"
 )
 
-func IndexPageHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func IndexPageHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName != "" {
 		//Already logged in, show dashboard
 		//TODO: redirect or call the handler directly
-		return DashboardHandler(a, response, request)
+		return DashboardHandler(ctx, a, response, request)
 	} else {
 		LoginTemplate.Execute(response, nil)
 	}
 	return nil
 }
 
-func LoginHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func LoginHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	name := request.FormValue("name")
 	pass := request.FormValue("password")
 	redirectTarget := "/"
+	auditActor(ctx, name, AuthPassword)
 	if name != "" && pass != "" {
 		// ... check credentials
-		ok, err := checkCredentials(a, name, pass)
+		ok, err := checkCredentials(ctx, a, name, pass)
 		if !ok {
+			auditDenied(ctx, err)
 			errMsg := err.Error()
 			// Check if it is a LDAP specific error
 			for code, msg := range ldap.LDAPResultCodeMap {
@@ -55,7 +78,8 @@ func LoginHandler(a *appContext, response http.ResponseWriter, request *http.Req
 		}
 
 		// Put authenticated user into DB
-		insertId, rowCnt, err := putUserIfNotExistedInDB(a, "", name)
+		group := groupOfUser(a, name)
+		insertId, rowCnt, err := putUserIfNotExistedInDB(ctx, a, group, name)
 
 		// Return internal server error if DB operation failed
 		if err != nil {
@@ -63,55 +87,79 @@ func LoginHandler(a *appContext, response http.ResponseWriter, request *http.Req
 				Err: err, UserMsg: MessageInternalServerError}
 		}
 
+		// Group membership may have changed since the user was added
+		user, err := a.dal.GetUser(ctx, name)
+		if err != nil {
+			return StatusError{Code: http.StatusInternalServerError,
+				Err: err, UserMsg: MessageInternalServerError}
+		}
+		if err := a.dal.SetUserGroup(ctx, name, group); err != nil {
+			return StatusError{Code: http.StatusInternalServerError,
+				Err: err, UserMsg: MessageInternalServerError}
+		}
+		if user.Group != group {
+			recordAuditEvent(ctx, AuditGroupChange, name, "from="+user.Group+" to="+group)
+		}
+
 		if rowCnt > 0 {
-			log.Printf("Successfully put user into DB, uid = %d", insertId)
+			a.logger(ctx).Info("Added user to DB", "user", name, "uid", insertId)
 		} else {
-			log.Printf("User %s already in DB.", name)
+			a.logger(ctx).Debug("User already in DB", "user", name)
 		}
 
 		setSession(a, name, response)
 		redirectTarget = "/dashboard"
+	} else {
+		auditDenied(ctx, errors.New("Missing username or password"))
 	}
 	http.Redirect(response, request, redirectTarget, http.StatusFound)
 	return nil
 }
 
-func LogoutHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func LogoutHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	clearSession(response)
-	log.Println("Logged out", userName)
+	a.logger(ctx).Info("Logged out", "user", userName)
 	http.Redirect(response, request, "/", http.StatusFound)
 	return nil
 }
 
-func DashboardHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func DashboardHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName != "" {
-		functions, err := getUserFunctions(a, userName, -1)
+		functions, err := getUserFunctions(ctx, a, userName, -1)
 		if err != nil {
-			log.Println("Cannot list functions for", userName)
+			a.logger(ctx).Error("Cannot list functions", "user", userName, "error", err)
+			return StatusError{Code: http.StatusInternalServerError,
+				Err: err, UserMsg: MessageInternalServerError}
+		}
+		workflows, err := a.dal.ListWorkflows(ctx, userName)
+		if err != nil {
+			a.logger(ctx).Error("Cannot list workflows", "user", userName, "error", err)
 			return StatusError{Code: http.StatusInternalServerError,
 				Err: err, UserMsg: MessageInternalServerError}
 		}
 
-		DashboardTemplate.Execute(response, &DashboardPage{Username: userName, Functions: functions})
+		DashboardTemplate.Execute(response, &DashboardPage{Username: userName, Functions: functions, Workflows: workflows})
 	} else {
 		http.Redirect(response, request, "/", http.StatusFound)
 	}
 	return nil
 }
 
-func CreateFuncPageHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func CreateFuncPageHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName == "" {
 		http.Redirect(response, request, "/", http.StatusFound)
 	} else {
-		ConfFuncTemplate.Execute(response, nil)
+		ConfFuncTemplate.Execute(response, &ConfigFuncPage{
+			EnableFuncName: true,
+			Limits:         a.conf.FunctionCfg})
 	}
 	return nil
 }
 
-func ViewFuncPageHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func ViewFuncPageHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName == "" {
 		http.Redirect(response, request, "/", http.StatusFound)
@@ -119,22 +167,33 @@ func ViewFuncPageHandler(a *appContext, response http.ResponseWriter, request *h
 		vars := mux.Vars(request)
 		functionName := vars["function"]
 
-		f, err := a.dal.GetFunction(userName, functionName)
+		f, err := a.dal.GetFunction(ctx, userName, functionName)
 		if err != nil {
-			log.Println("Cannot get function", functionName)
+			a.logger(ctx).Error("Cannot get function", "user", userName, "function", functionName, "error", err)
 			return StatusError{Code: http.StatusInternalServerError,
 				Err: err, UserMsg: MessageInternalServerError}
 		}
+		env, err := a.dal.ListFunctionEnv(ctx, f.ID)
+		if err != nil {
+			a.logger(ctx).Error("Cannot get function environment", "user", userName, "function", functionName, "error", err)
+			return StatusError{Code: http.StatusInternalServerError,
+				Err: err, UserMsg: MessageInternalServerError}
+		}
+		plainEnv, secrets := formatEnvLines(env)
 		ConfFuncTemplate.Execute(response, &ConfigFuncPage{
 			EnableFuncName: false,
 			FuncName:       functionName,
 			FuncRuntime:    "python27",
-			FuncContent:    f.Content})
+			FuncContent:    f.Content,
+			Settings:       f.FunctionSettings,
+			Limits:         a.conf.FunctionCfg,
+			Env:            plainEnv,
+			Secrets:        secrets})
 	}
 	return nil
 }
 
-func DeleteFunctionHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func DeleteFunctionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName == "" {
 		http.Redirect(response, request, "/", http.StatusFound)
@@ -142,14 +201,8 @@ func DeleteFunctionHandler(a *appContext, response http.ResponseWriter, request
 		vars := mux.Vars(request)
 		functionName := vars["function"]
 
-		// Delete function in the database
-		if err := a.dal.DeleteFunction(userName, functionName); err != nil {
-			return StatusError{Code: http.StatusInternalServerError,
-				Err: err, UserMsg: MessageInternalServerError}
-		}
-
-		// Delete function image
-		if err := a.d.DeleteFunctionImage(a.conf.DockerCfg.DockerRegistry, userName, strings.ToLower(functionName)); err != nil {
+		// Delete function in the database and its image
+		if err := deleteFunction(ctx, a, userName, functionName); err != nil {
 			return StatusError{Code: http.StatusInternalServerError,
 				Err: err, UserMsg: MessageInternalServerError}
 		}
@@ -159,7 +212,7 @@ func DeleteFunctionHandler(a *appContext, response http.ResponseWriter, request
 	return nil
 }
 
-func CreateFunctionHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func CreateFunctionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName == "" {
 		// Empty username is not allowed to create function
@@ -175,10 +228,24 @@ func CreateFunctionHandler(a *appContext, response http.ResponseWriter, request
 		functionName := request.FormValue("functionName")
 		runtime := request.FormValue("runtime")
 		code := request.FormValue("codeTextarea")
+		settings, err := parseFunctionSettings(request)
+		if err != nil {
+			return StatusError{Code: http.StatusFound,
+				Err:         err,
+				UserMsg:     MessageCreateFunctionFailed,
+				SendErrResp: true}
+		}
+		env, err := parseFunctionEnvForm(ctx, a, request, userName, functionName)
+		if err != nil {
+			return StatusError{Code: http.StatusFound,
+				Err:         err,
+				UserMsg:     MessageCreateFunctionFailed,
+				SendErrResp: true}
+		}
 
 		// Check if function already exists
-		if f, err := a.dal.GetFunction(userName, functionName); err != sql.ErrNoRows {
-			log.Println(err)
+		if f, err := a.dal.GetFunction(ctx, userName, functionName); err != sql.ErrNoRows {
+			a.logger(ctx).Warn("Function already exists", "user", userName, "function", functionName, "error", err)
 			return StatusError{Code: http.StatusFound,
 				Err: errors.New(fmt.Sprintf(
 					"Function %s already exists for user %s. Note: function name is case insensitive", f.Name, userName)),
@@ -187,7 +254,7 @@ func CreateFunctionHandler(a *appContext, response http.ResponseWriter, request
 
 		}
 
-		if err := createFunction(a, userName, functionName, runtime, code); err != nil {
+		if err := createFunction(ctx, a, userName, functionName, runtime, code, settings, env); err != nil {
 			return StatusError{Code: http.StatusFound,
 				Err:         err,
 				UserMsg:     MessageCreateFunctionFailed,
@@ -197,7 +264,7 @@ func CreateFunctionHandler(a *appContext, response http.ResponseWriter, request
 	return nil
 }
 
-func EditFunctionHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func EditFunctionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	if userName == "" {
 		http.Redirect(response, request, "/", http.StatusFound)
@@ -205,8 +272,22 @@ func EditFunctionHandler(a *appContext, response http.ResponseWriter, request *h
 		functionName := request.FormValue("functionName")
 		runtime := request.FormValue("runtime")
 		code := request.FormValue("codeTextarea")
+		settings, err := parseFunctionSettings(request)
+		if err != nil {
+			return StatusError{Code: http.StatusFound,
+				Err:         err,
+				UserMsg:     MessageCreateFunctionFailed,
+				SendErrResp: true}
+		}
+		env, err := parseFunctionEnvForm(ctx, a, request, userName, functionName)
+		if err != nil {
+			return StatusError{Code: http.StatusFound,
+				Err:         err,
+				UserMsg:     MessageCreateFunctionFailed,
+				SendErrResp: true}
+		}
 
-		if err := createFunction(a, userName, functionName, runtime, code); err != nil {
+		if err := createFunction(ctx, a, userName, functionName, runtime, code, settings, env); err != nil {
 			return StatusError{Code: http.StatusFound,
 				Err:         err,
 				UserMsg:     MessageCreateFunctionFailed,
@@ -216,7 +297,7 @@ func EditFunctionHandler(a *appContext, response http.ResponseWriter, request *h
 	return nil
 }
 
-func CallHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func CallHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	vars := mux.Vars(request)
 	functionName := vars["function"]
@@ -231,20 +312,17 @@ func CallHandler(a *appContext, response http.ResponseWriter, request *http.Requ
 				UserMsg: MessageCallFunctionFailed}
 		}
 
-		if params == "" {
-			log.Println("Calling function", functionName)
-		} else {
-			log.Println("Calling function", functionName, "with parameters", params)
-		}
+		a.logger(ctx).Info("Calling function", "user", userName, "function", functionName, "params", shortParams(params))
 
 		timestamp := time.Now()
-		callRes, err := callFunction(a, userName, functionName, params)
+		callRes, err := callFunction(ctx, a, userName, functionName, params, nil)
 		if err != nil {
 			return StatusError{Code: http.StatusFound, Err: err, UserMsg: MessageCallFunctionFailed}
 		}
 
 		// Insert function execution into DB
-		if err := PutFunctionExecution(a, userName, functionName, params, callRes, timestamp); err != nil {
+		callRes.Trigger = TriggerHTTP
+		if err := PutFunctionExecution(ctx, a, userName, functionName, params, callRes, timestamp); err != nil {
 			return StatusError{Code: http.StatusFound, Err: err, UserMsg: MessageCallFunctionFailed}
 		}
 
@@ -253,7 +331,22 @@ func CallHandler(a *appContext, response http.ResponseWriter, request *http.Requ
 	return nil
 }
 
-func ViewFuncLogsHandler(a *appContext, response http.ResponseWriter, request *http.Request) error {
+func CancelExecutionHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	userName := getUserName(a, request)
+	vars := mux.Vars(request)
+	functionName := vars["function"]
+	if userName == "" {
+		http.Redirect(response, request, "/", http.StatusFound)
+	} else {
+		if err := cancelExecution(ctx, a, userName, functionName, vars["uuid"]); err != nil {
+			return StatusError{Code: http.StatusFound, Err: err, UserMsg: MessageCancelExecutionFailed}
+		}
+		http.Redirect(response, request, "/functions/"+functionName+"/logs", http.StatusFound)
+	}
+	return nil
+}
+
+func ViewFuncLogsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
 	userName := getUserName(a, request)
 	vars := mux.Vars(request)
 	functionName := vars["function"]
@@ -263,12 +356,16 @@ func ViewFuncLogsHandler(a *appContext, response http.ResponseWriter, request *h
 		if functionName == "" {
 			return StatusError{Code: http.StatusFound, Err: errors.New("Failed to get logs")}
 		}
-		execs, err := a.dal.ListExecution(userName, functionName)
+		execs, err := a.dal.ListExecution(ctx, userName, functionName)
 		if err != nil {
 			return StatusError{Code: http.StatusInternalServerError,
 				Err: err, UserMsg: MessageInternalServerError}
 		}
-		ViewLogsTemplate.Execute(response, &ViewLogsPage{FuncName: functionName, Executions: execs})
+		ViewLogsTemplate.Execute(response, &ViewLogsPage{
+			FuncName:   functionName,
+			Running:    a.executions.list(userName, functionName),
+			Executions: execs,
+		})
 	}
 	return nil
 }
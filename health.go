@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Time given to each dependency to answer the readiness probe
+	ReadinessTimeout = 5 * time.Second
+
+	// Delay before the second attempt to connect to a dependency at
+	// startup, doubled for each next one up to StartupMaxBackoff
+	StartupBackoff    = time.Second
+	StartupMaxBackoff = time.Minute
+)
+
+// Dependencies of the server
+var (
+	DependencyDatabase   = "database"
+	DependencyDocker     = "docker"
+	DependencyKubernetes = "kubernetes"
+	DependencyRegistry   = "registry"
+)
+
+// Status of a dependency. It is connecting until the server connected to
+// it at startup.
+var (
+	DependencyUp         = "up"
+	DependencyDown       = "down"
+	DependencyConnecting = "connecting"
+)
+
+// dependency is a service needed to serve requests. ping is nil until the
+// server connected to it.
+type dependency struct {
+	name string
+	ping func(context.Context) error
+}
+
+// healthChecker serves the liveness and readiness probes. The server is
+// ready once connected to all its dependencies, as long as they all
+// answer.
+type healthChecker struct {
+	start time.Time
+	log   *logging.Logger
+
+	lock sync.Mutex
+	deps []*dependency
+}
+
+func newHealthChecker(logger *logging.Logger, names ...string) *healthChecker {
+	h := &healthChecker{start: time.Now(), log: logger}
+	for _, name := range names {
+		h.deps = append(h.deps, &dependency{name: name})
+	}
+	return h
+}
+
+// connect calls `connect` until it succeeds, waiting longer after each
+// failure, then checks the dependency with `ping`
+func (h *healthChecker) connect(name string, connect func() error, ping func(context.Context) error) {
+	backoff := StartupBackoff
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			break
+		}
+		h.log.Warn("Cannot connect to dependency", "dependency", name, "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > StartupMaxBackoff {
+			backoff = StartupMaxBackoff
+		}
+	}
+	h.log.Info("Connected to dependency", "dependency", name)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for _, d := range h.deps {
+		if d.name == name {
+			d.ping = ping
+			return
+		}
+	}
+	h.deps = append(h.deps, &dependency{name: name, ping: ping})
+}
+
+type ApiHealth struct {
+	Status        string `json:"status"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+}
+
+type ApiDependencyStatus struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ApiReadiness struct {
+	// "ready" or "not ready"
+	Status       string                 `json:"status"`
+	Dependencies []*ApiDependencyStatus `json:"dependencies"`
+}
+
+// check pings the dependencies concurrently
+func (h *healthChecker) check(ctx context.Context) *ApiReadiness {
+	h.lock.Lock()
+	deps := make([]dependency, 0, len(h.deps))
+	for _, d := range h.deps {
+		deps = append(deps, *d)
+	}
+	h.lock.Unlock()
+
+	res := &ApiReadiness{Status: "ready", Dependencies: make([]*ApiDependencyStatus, len(deps))}
+	var wg sync.WaitGroup
+	for i, d := range deps {
+		res.Dependencies[i] = &ApiDependencyStatus{Name: d.name, Status: DependencyConnecting}
+		if d.ping == nil {
+			res.Status = "not ready"
+			continue
+		}
+		wg.Add(1)
+		go func(s *ApiDependencyStatus, ping func(context.Context) error) {
+			defer wg.Done()
+			start := time.Now()
+			err := pingWithTimeout(ctx, ping)
+			s.LatencyMs = int64(time.Since(start) / time.Millisecond)
+			if err != nil {
+				s.Status = DependencyDown
+				s.Error = err.Error()
+			} else {
+				s.Status = DependencyUp
+			}
+		}(res.Dependencies[i], d.ping)
+	}
+	wg.Wait()
+
+	for _, s := range res.Dependencies {
+		if s.Status != DependencyUp {
+			res.Status = "not ready"
+		}
+	}
+	return res
+}
+
+// pingWithTimeout returns the error of `ping`, or the error of the
+// context once ReadinessTimeout is over. Clients not taking a context
+// keep waiting in the background.
+func pingWithTimeout(ctx context.Context, ping func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, ReadinessTimeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- ping(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// serveHealthz answers as long as the process serves requests
+func (h *healthChecker) serveHealthz(response http.ResponseWriter, request *http.Request) {
+	writeJSON(response, &ApiHealth{
+		Status:        "alive",
+		UptimeSeconds: int64(time.Since(h.start) / time.Second),
+	})
+}
+
+// serveReadyz answers 200 if the server is ready, 503 otherwise, with the
+// status of each dependency
+func (h *healthChecker) serveReadyz(response http.ResponseWriter, request *http.Request) {
+	res := h.check(context.Background())
+	code := http.StatusOK
+	if res.Status != "ready" {
+		code = http.StatusServiceUnavailable
+		for _, s := range res.Dependencies {
+			if s.Status == DependencyDown {
+				h.log.Warn("Dependency down", "dependency", s.Name, "error", s.Error)
+			}
+		}
+	}
+	writeJSONStatus(response, code, res)
+}
@@ -0,0 +1,301 @@
+package kexec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+// Interval at which FollowFunctionLog looks for the next pod of a job
+var LogPollInterval = time.Second
+
+// Attempt is one pod run of a function job. The Job controller starts a
+// new pod when one fails, so an execution may consist of several
+// attempts.
+type Attempt struct {
+	Pod   string
+	Phase string
+	// Exit code of the function container, -1 if it did not terminate
+	ExitCode int32
+	// Why the container or the pod terminated, e.g. "Error", "OOMKilled"
+	// or "Evicted"
+	Reason     string
+	Message    string
+	StartTime  time.Time
+	FinishTime time.Time
+	Log        string
+	// JSON return value of the function, set if the attempt succeeded
+	// and the function returned one
+	Output string
+}
+
+type attemptsByStart []*Attempt
+
+func (s attemptsByStart) Len() int           { return len(s) }
+func (s attemptsByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s attemptsByStart) Less(i, j int) bool { return s[i].StartTime.Before(s[j].StartTime) }
+
+// GetFunctionAttempts returns the attempts of a job in start order, with
+// the log of each pod. At most `maxLogSize` bytes of log are returned in
+// total, unless it is 0.
+func (k *Kexec) GetFunctionAttempts(ctx context.Context, jobName, namespace string, maxLogSize int64) (attempts []*Attempt, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Start(ctx, "kexec.GetFunctionAttempts", "job", jobName, "namespace", namespace)
+	defer func() {
+		span.SetAttributes("attempts", len(attempts))
+		span.SetError(err)
+		span.End()
+	}()
+
+	podlist, err := k.getFunctionPods(jobName, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(podlist.Items) < 1 {
+		return nil, errors.New(fmt.Sprintf("No pod found for job %s.", jobName))
+	}
+
+	attempts = make([]*Attempt, 0, len(podlist.Items))
+	for i := range podlist.Items {
+		attempts = append(attempts, podAttempt(&podlist.Items[i]))
+	}
+	sort.Stable(attemptsByStart(attempts))
+
+	k.getAttemptLogs(ctx, namespace, attempts, maxLogSize)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// getAttemptLogs sets the log of each attempt, up to `maxLogSize` bytes
+// in total unless it is 0. Attempts whose log cannot be read are left
+// without one.
+func (k *Kexec) getAttemptLogs(ctx context.Context, namespace string, attempts []*Attempt, maxLogSize int64) {
+	remaining := maxLogSize
+	for _, a := range attempts {
+		if maxLogSize > 0 && remaining <= 0 {
+			break
+		}
+		log, err := k.getPodLog(ctx, a.Pod, namespace, remaining)
+		if err != nil {
+			// The pod may not have started a container
+			k.logger(ctx).Warn("Cannot get pod log", "pod", a.Pod, "error", err)
+			continue
+		}
+		a.Log = log
+		remaining -= int64(len(a.Log))
+	}
+}
+
+// AggregateAttempts returns the status of an execution and the logs of
+// all its attempts. The execution succeeded if any attempt did, else its
+// status is the one of the last terminated attempt: a pod the Job
+// controller started after the last retry does not count. When there is
+// more than one attempt, each log is preceded by a header line
+// describing the attempt.
+func AggregateAttempts(attempts []*Attempt) (string, string) {
+	if len(attempts) == 0 {
+		return "", ""
+	}
+	status := attempts[len(attempts)-1].Phase
+	for _, a := range attempts {
+		if a.Phase == string(v1.PodSucceeded) {
+			status = a.Phase
+			break
+		}
+		if a.Phase == string(v1.PodFailed) {
+			status = a.Phase
+		}
+	}
+	if len(attempts) == 1 {
+		return status, attempts[0].Log
+	}
+
+	var buf bytes.Buffer
+	for i, a := range attempts {
+		fmt.Fprintf(&buf, "--- Attempt %d (pod %s): %s", i+1, a.Pod, a.Phase)
+		if a.ExitCode >= 0 {
+			fmt.Fprintf(&buf, ", exit code %d", a.ExitCode)
+		}
+		if a.Reason != "" {
+			fmt.Fprintf(&buf, ", %s", a.Reason)
+		}
+		buf.WriteString(" ---\n")
+		buf.WriteString(a.Log)
+		if len(a.Log) > 0 && a.Log[len(a.Log)-1] != '\n' {
+			buf.WriteString("\n")
+		}
+	}
+	return status, buf.String()
+}
+
+// AttemptsOutput returns the JSON return value of an execution, i.e. the
+// output of its succeeded attempt, or an empty string.
+func AttemptsOutput(attempts []*Attempt) string {
+	for _, a := range attempts {
+		if a.Phase == string(v1.PodSucceeded) {
+			return a.Output
+		}
+	}
+	return ""
+}
+
+// podAttempt describes the attempt a pod represents
+func podAttempt(pod *v1.Pod) *Attempt {
+	a := &Attempt{
+		Pod:       pod.Name,
+		Phase:     string(pod.Status.Phase),
+		ExitCode:  -1,
+		Reason:    pod.Status.Reason,
+		Message:   pod.Status.Message,
+		StartTime: pod.CreationTimestamp.Time,
+	}
+	if pod.Status.StartTime != nil {
+		a.StartTime = pod.Status.StartTime.Time
+	}
+	for _, c := range pod.Status.ContainerStatuses {
+		if c.State.Terminated != nil {
+			t := c.State.Terminated
+			a.ExitCode = t.ExitCode
+			a.FinishTime = t.FinishedAt.Time
+			if a.Reason == "" {
+				a.Reason = t.Reason
+			}
+			if t.ExitCode == 0 {
+				// The termination message holds the result
+				a.Output = strings.TrimSpace(t.Message)
+			} else if a.Message == "" {
+				a.Message = t.Message
+			}
+		} else if c.State.Waiting != nil && a.Reason == "" {
+			a.Reason = c.State.Waiting.Reason
+			a.Message = c.State.Waiting.Message
+		}
+	}
+	return a
+}
+
+func (k *Kexec) getPodLog(ctx context.Context, podName, namespace string, limitBytes int64) (string, error) {
+	opts := &v1.PodLogOptions{
+		Timestamps: false,
+	}
+	if limitBytes > 0 {
+		opts.LimitBytes = &limitBytes
+	}
+
+	response, err := k.Clientset.Core().Pods(namespace).GetLogs(podName, opts).Stream()
+	if err != nil {
+		return "", err
+	}
+	defer response.Close()
+	defer closeOnDone(ctx, response)()
+
+	var r io.Reader = response
+	if limitBytes > 0 {
+		r = io.LimitReader(response, limitBytes)
+	}
+	res, err := ioutil.ReadAll(r)
+	return string(res), err
+}
+
+// FollowFunctionLog writes the logs of the pods of a job to `w` as they
+// are produced, in start order. Each attempt after the first one is
+// preceded by a header line. It returns once `done` is closed and the
+// logs of all started pods were written, or when `ctx` is done.
+func (k *Kexec) FollowFunctionLog(ctx context.Context, jobName, namespace string, w io.Writer, done <-chan struct{}) error {
+	followed := make(map[string]bool)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		finished := false
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+
+		podlist, err := k.getFunctionPods(jobName, namespace)
+		if err != nil {
+			if finished {
+				// The job was deleted once the execution completed
+				return nil
+			}
+			return err
+		}
+		attempts := make([]*Attempt, 0, len(podlist.Items))
+		for i := range podlist.Items {
+			attempts = append(attempts, podAttempt(&podlist.Items[i]))
+		}
+		sort.Stable(attemptsByStart(attempts))
+
+		progressed := false
+		for _, a := range attempts {
+			if followed[a.Pod] || a.Phase == string(v1.PodPending) {
+				continue
+			}
+			followed[a.Pod] = true
+			progressed = true
+			if len(followed) > 1 {
+				fmt.Fprintf(w, "--- Attempt %d (pod %s) ---\n", len(followed), a.Pod)
+			}
+			if err := k.followPodLog(ctx, a.Pod, namespace, w); err != nil {
+				k.logger(ctx).Warn("Cannot follow pod log", "pod", a.Pod, "error", err)
+			}
+		}
+
+		if finished && !progressed {
+			return nil
+		}
+		if !progressed {
+			select {
+			case <-done:
+			case <-ctx.Done():
+			case <-time.After(LogPollInterval):
+			}
+		}
+	}
+}
+
+func (k *Kexec) followPodLog(ctx context.Context, podName, namespace string, w io.Writer) error {
+	opts := &v1.PodLogOptions{
+		Follow:     true,
+		Timestamps: false,
+	}
+	response, err := k.Clientset.Core().Pods(namespace).GetLogs(podName, opts).Stream()
+	if err != nil {
+		return err
+	}
+	defer response.Close()
+	defer closeOnDone(ctx, response)()
+
+	_, err = io.Copy(w, response)
+	return err
+}
+
+// closeOnDone closes `c` when `ctx` is done, which unblocks a read of a log
+// stream. The returned function stops watching `ctx`.
+func closeOnDone(ctx context.Context, c io.Closer) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
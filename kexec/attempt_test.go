@@ -0,0 +1,36 @@
+package kexec
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestAggregateAttempts(t *testing.T) {
+	for _, c := range []struct {
+		phases []string
+		status string
+	}{
+		{[]string{}, ""},
+		{[]string{"Failed"}, "Failed"},
+		{[]string{"Running"}, "Running"},
+		{[]string{"Failed", "Succeeded"}, "Succeeded"},
+		{[]string{"Failed", "Failed"}, "Failed"},
+		// The Job controller replaced the pod of the last attempt
+		{[]string{"Failed", "Failed", "Pending"}, "Failed"},
+		{[]string{"Failed", "Running"}, "Failed"},
+		{[]string{"Succeeded", "Pending"}, "Succeeded"},
+	} {
+		var attempts []*Attempt
+		for i, phase := range c.phases {
+			attempts = append(attempts, &Attempt{Pod: fmt.Sprintf("pod-%d", i), Phase: phase, ExitCode: -1, Log: "log " + phase})
+		}
+		status, log := AggregateAttempts(attempts)
+		if status != c.status {
+			t.Errorf("Attempts %v: expected status %q, got %q", c.phases, c.status, status)
+		}
+		if len(c.phases) > 1 && strings.Count(log, "--- Attempt") != len(c.phases) {
+			t.Errorf("Attempts %v: expected a header per attempt, got %q", c.phases, log)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package kexec
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+	apierrors "k8s.io/client-go/1.4/pkg/api/errors"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
+)
+
+// A fan-out job runs a function once per item, as a single job whose
+// completions are the number of items. Indexed jobs are not available in
+// this API version, so the pods claim their item through kexec: RunFanOutJob
+// annotates each new pod with the index of the next item to run, and the
+// pod reads its annotations from a downward API volume, which the kubelet
+// refreshes when they change. The params of the items are in the input
+// ConfigMap of the job.
+var (
+	// Annotation holding the index of the item of a pod
+	JobAnnotationItem = "serverless-item"
+
+	// Set instead of JobEnvParams in the pods of a fan-out job: the file
+	// with the annotations of the pod, and the directory holding the
+	// params of each item in a file named "item-<index>.json"
+	JobEnvItemFile = "SERVERLESS_ITEM_FILE"
+	JobEnvItemsDir = "SERVERLESS_ITEMS_DIR"
+	JobPodInfoDir  = "/serverless/pod"
+)
+
+const (
+	jobPodInfoVolume   = "serverless-pod"
+	jobAnnotationsFile = "annotations"
+)
+
+// fanOutItemKey returns the key of the params of an item in the input
+// ConfigMap
+func fanOutItemKey(item int) string {
+	return "item-" + strconv.Itoa(item) + ".json"
+}
+
+// CreateFanOutJob creates a job running the function once per item of
+// `items`, at most `parallelism` at a time. Fan-out jobs take no binary
+// inputs.
+func (k *Kexec) CreateFanOutJob(ctx context.Context, jobname, image string, items []string, parallelism int, namespace string, labels map[string]string, opts *JobOptions) (err error) {
+	ctx, span := tracing.Start(ctx, "kexec.CreateFanOutJob", "job", jobname, "namespace", namespace, "items", len(items))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if opts == nil {
+		opts = &JobOptions{}
+	}
+	if len(opts.Inputs) > 0 {
+		return errors.New("Fan-out jobs take no inputs.")
+	}
+	input, err := fanOutInputData(items)
+	if err != nil {
+		return err
+	}
+
+	k.logger(ctx).Info("Starting fan-out job", "job", jobname, "namespace", namespace,
+		"items", len(items), "parallelism", parallelism)
+	template, err := createFanOutJobTemplate(image, jobname, namespace, len(items), parallelism, labels, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(opts.Secrets) > 0 {
+		if err := k.createJobSecret(jobname, namespace, labels, opts.Secrets); err != nil {
+			return err
+		}
+	}
+	err = k.createJobInput(jobname, namespace, labels, input)
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		_, err = k.Clientset.Batch().Jobs(namespace).Create(template)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			jobErrors.Inc("create")
+		}
+		k.deleteJobSecret(jobname, namespace)
+		k.deleteJobInput(jobname, namespace)
+		return err
+	}
+	return nil
+}
+
+// fanOutInputData returns the data of the input ConfigMap of a fan-out job
+func fanOutInputData(items []string) (map[string]string, error) {
+	data := make(map[string]string, len(items))
+	size := 0
+	for i, params := range items {
+		if params == "" {
+			params = "{}"
+		}
+		data[fanOutItemKey(i)] = params
+		size += len(params)
+	}
+	if size > MaxInputSize {
+		return nil, errors.New(fmt.Sprintf("Items take %d bytes, exceeding the maximum of %d.", size, MaxInputSize))
+	}
+	return data, nil
+}
+
+// createFanOutJobTemplate creates the template of a fan-out job: a
+// function job with `items` completions, which mounts the input
+// ConfigMap and the annotations of its pods instead of taking params.
+func createFanOutJobTemplate(image, jobname, namespace string, items, parallelism int, labels map[string]string, opts *JobOptions) (*batchv1.Job, error) {
+	template, err := createJobTemplate(image, jobname, "", namespace, labels, opts)
+	if err != nil {
+		return nil, err
+	}
+	completions := int32(items)
+	p := int32(parallelism)
+	template.Spec.Completions = &completions
+	template.Spec.Parallelism = &p
+
+	spec := &template.Spec.Template.Spec
+	inputVolume, inputMount := jobInputMount(jobname)
+	infoVolume := v1.Volume{
+		Name: jobPodInfoVolume,
+		VolumeSource: v1.VolumeSource{
+			DownwardAPI: &v1.DownwardAPIVolumeSource{
+				Items: []v1.DownwardAPIVolumeFile{{
+					Path:     jobAnnotationsFile,
+					FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.annotations"},
+				}},
+			},
+		},
+	}
+	infoMount := v1.VolumeMount{
+		Name:      jobPodInfoVolume,
+		ReadOnly:  true,
+		MountPath: JobPodInfoDir,
+	}
+	spec.Volumes = append(spec.Volumes, inputVolume, infoVolume)
+
+	container := &spec.Containers[0]
+	container.VolumeMounts = append(container.VolumeMounts, inputMount, infoMount)
+	env := []v1.EnvVar{
+		{Name: JobEnvItemFile, Value: path.Join(JobPodInfoDir, jobAnnotationsFile)},
+		{Name: JobEnvItemsDir, Value: JobInputDir},
+	}
+	for _, e := range container.Env {
+		// The params of a pod are those of its item
+		if e.Name != JobEnvParams {
+			env = append(env, e)
+		}
+	}
+	container.Env = env
+	return template, nil
+}
+
+// RunFanOutJob waits until every one of the `items` items of a fan-out
+// job succeeded, or failed and the retry policy in `opts` does not allow
+// another attempt. Meanwhile, it assigns an item to every new pod of the
+// job. The item of a failed pod is assigned to a later pod once the
+// backoff of the policy elapsed. The timeout and cancellation are those
+// of RunJob, and cover all the items.
+func (k *Kexec) RunFanOutJob(ctx context.Context, jobName, namespace string, items int, opts *JobOptions) (err error) {
+	ctx, span := tracing.Start(ctx, "kexec.RunFanOutJob", "job", jobName, "namespace", namespace, "items", items)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if opts == nil {
+		opts = &JobOptions{}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = MaxPodExecTime * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return k.waitForFanOutComplete(ctx, jobName, namespace, items, &opts.Retry)
+}
+
+func (k *Kexec) waitForFanOutComplete(ctx context.Context, jobName, namespace string, items int, retry *RetryPolicy) error {
+	t, err := k.tracker()
+	if err != nil {
+		return err
+	}
+	notified := t.register(jobName, namespace)
+	defer t.unregister(jobName, namespace)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer k.registerCancel(namespace+"/"+jobName, cancel)()
+
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	// Items waiting for a pod, in order, and when they may be retried
+	pending := make([]int, items)
+	for i := range pending {
+		pending[i] = i
+	}
+	retryAt := make(map[int]time.Time)
+	failures := make([]int, items)
+	done := 0
+
+	// Items of the pods, and the pods that are over
+	assigned := make(map[string]int)
+	finished := make(map[string]bool)
+	for {
+		now := time.Now()
+		for _, pod := range t.jobPods(jobName, namespace) {
+			if finished[pod.Name] {
+				continue
+			}
+			item, ok := assigned[pod.Name]
+			if !ok {
+				if pod.DeletionTimestamp != nil || (pod.Status.Phase != v1.PodPending && pod.Status.Phase != v1.PodRunning) {
+					continue
+				}
+				i := nextFanOutItem(pending, retryAt, now)
+				if i < 0 {
+					// Pods left once all items are assigned wait until
+					// the job is deleted
+					continue
+				}
+				if err := k.assignItem(pod, pending[i]); err != nil {
+					// Retried on the next change of the pod
+					if !apierrors.IsConflict(err) {
+						k.logger(ctx).Warn("Cannot assign item to pod", "job", jobName, "pod", pod.Name, "error", err)
+					}
+					continue
+				}
+				assigned[pod.Name] = pending[i]
+				k.logger(ctx).Info("Assigned item to pod", "job", jobName, "pod", pod.Name, "item", pending[i])
+				pending = append(pending[:i], pending[i+1:]...)
+				continue
+			}
+
+			switch pod.Status.Phase {
+			case v1.PodSucceeded:
+				finished[pod.Name] = true
+				done++
+			case v1.PodFailed:
+				finished[pod.Name] = true
+				failures[item]++
+				a := podAttempt(pod)
+				if failures[item] >= maxAttempts || !retry.Retryable(a) {
+					k.logger(ctx).Warn("Item failed", "job", jobName, "item", item, "attempts", failures[item], "reason", a.Reason)
+					done++
+					continue
+				}
+				backoff := retry.backoff(failures[item])
+				k.logger(ctx).Info("Retrying item", "job", jobName, "item", item, "attempt", failures[item], "backoff", backoff)
+				retryAt[item] = now.Add(backoff)
+				pending = append(pending, item)
+			default:
+				if pod.DeletionTimestamp != nil {
+					// The pod was deleted before it ran its item
+					finished[pod.Name] = true
+					pending = append(pending, item)
+				}
+			}
+		}
+		if done == items {
+			return nil
+		}
+
+		// Wake up for the next retry, the Job controller started its pod
+		// already
+		var wake <-chan time.Time
+		if d, ok := nextFanOutRetry(pending, retryAt, now); ok {
+			wake = time.After(d)
+		}
+		select {
+		case <-notified:
+		case <-wake:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+	}
+}
+
+// nextFanOutItem returns the index in `pending` of the first item that
+// may run at `now`, or -1
+func nextFanOutItem(pending []int, retryAt map[int]time.Time, now time.Time) int {
+	for i, item := range pending {
+		if !retryAt[item].After(now) {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextFanOutRetry returns the time until the first pending item that may
+// not run at `now` may run
+func nextFanOutRetry(pending []int, retryAt map[int]time.Time, now time.Time) (time.Duration, bool) {
+	var next time.Duration
+	found := false
+	for _, item := range pending {
+		if d := retryAt[item].Sub(now); d > 0 && (!found || d < next) {
+			next = d
+			found = true
+		}
+	}
+	return next, found
+}
+
+// assignItem annotates a pod with the index of its item. Pods in the
+// tracker store are shared, so the update is made on a copy.
+func (k *Kexec) assignItem(pod *v1.Pod, item int) error {
+	p := *pod
+	p.Annotations = make(map[string]string, len(pod.Annotations)+1)
+	for key, value := range pod.Annotations {
+		p.Annotations[key] = value
+	}
+	p.Annotations[JobAnnotationItem] = strconv.Itoa(item)
+	_, err := k.Clientset.Core().Pods(pod.Namespace).Update(&p)
+	return err
+}
+
+// GetFanOutAttempts returns the attempts of each item of a fan-out job,
+// in start order, with the log of each pod. At most `maxLogSize` bytes of
+// log are returned per item, unless it is 0. Pods that were not assigned
+// an item are left out.
+func (k *Kexec) GetFanOutAttempts(ctx context.Context, jobName, namespace string, items int, maxLogSize int64) (attempts [][]*Attempt, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Start(ctx, "kexec.GetFanOutAttempts", "job", jobName, "namespace", namespace)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	podlist, err := k.getFunctionPods(jobName, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts = make([][]*Attempt, items)
+	for i := range podlist.Items {
+		pod := &podlist.Items[i]
+		item, err := strconv.Atoi(pod.Annotations[JobAnnotationItem])
+		if err != nil || item < 0 || item >= items {
+			continue
+		}
+		attempts[item] = append(attempts[item], podAttempt(pod))
+	}
+	for _, a := range attempts {
+		sort.Stable(attemptsByStart(a))
+		k.getAttemptLogs(ctx, namespace, a, maxLogSize)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
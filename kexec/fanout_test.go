@@ -0,0 +1,71 @@
+package kexec
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextFanOutItem(t *testing.T) {
+	now := time.Now()
+	retryAt := map[int]time.Time{
+		1: now.Add(-time.Second),
+		2: now.Add(time.Minute),
+		3: now.Add(time.Second),
+	}
+	for _, c := range []struct {
+		pending []int
+		next    int
+		wake    time.Duration
+	}{
+		{[]int{}, -1, 0},
+		{[]int{0, 4}, 0, 0},
+		{[]int{2, 1}, 1, time.Minute},
+		{[]int{2, 3}, -1, time.Second},
+		{[]int{3, 2, 0}, 2, time.Second},
+	} {
+		if i := nextFanOutItem(c.pending, retryAt, now); i != c.next {
+			t.Errorf("Pending %v: expected item at %d, got %d", c.pending, c.next, i)
+		}
+		wake, ok := nextFanOutRetry(c.pending, retryAt, now)
+		if wake != c.wake || ok != (c.wake > 0) {
+			t.Errorf("Pending %v: expected retry in %s, got %s", c.pending, c.wake, wake)
+		}
+	}
+}
+
+func TestFanOutJobTemplate(t *testing.T) {
+	job, err := createFanOutJobTemplate("image", "job", "ns", 5, 2, nil, &JobOptions{Env: map[string]string{"A": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *job.Spec.Completions != 5 || *job.Spec.Parallelism != 2 {
+		t.Error("Unexpected completions and parallelism", *job.Spec.Completions, *job.Spec.Parallelism)
+	}
+	spec := job.Spec.Template.Spec
+	if len(spec.Volumes) != 2 || spec.Volumes[0].ConfigMap == nil || spec.Volumes[1].DownwardAPI == nil {
+		t.Error("Unexpected volumes", spec.Volumes)
+	}
+	env := make(map[string]string)
+	for _, e := range spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	if _, ok := env[JobEnvParams]; ok {
+		t.Error("Fan-out pods take the params of their item")
+	}
+	if env[JobEnvItemFile] != JobPodInfoDir+"/"+jobAnnotationsFile || env[JobEnvItemsDir] != JobInputDir || env["A"] != "a" {
+		t.Error("Unexpected environment", env)
+	}
+
+	data, err := fanOutInputData([]string{`{"a":1}`, ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data["item-0.json"] != `{"a":1}` || data["item-1.json"] != "{}" {
+		t.Error("Unexpected input data", data)
+	}
+	defer func(max int) { MaxInputSize = max }(MaxInputSize)
+	MaxInputSize = 10
+	if _, err := fanOutInputData([]string{`{"a":1}`, `{"b":2}`}); err == nil {
+		t.Error("Expected items exceeding the maximum size to be rejected")
+	}
+}
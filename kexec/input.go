@@ -0,0 +1,131 @@
+package kexec
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+
+	"k8s.io/client-go/1.4/pkg/api"
+	apierrors "k8s.io/client-go/1.4/pkg/api/errors"
+	unversioned "k8s.io/client-go/1.4/pkg/api/unversioned"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+)
+
+var (
+	// Params larger than this many bytes are passed in a ConfigMap
+	// mounted into the pod instead of the environment, which is limited
+	// by Kubernetes and the OS.
+	MaxEnvParamsSize = 32 * 1024
+
+	// Maximum size of the params and encoded inputs of a job passed in a
+	// ConfigMap. etcd rejects objects larger than 1MB.
+	MaxInputSize = 1000 * 1024
+
+	// Set instead of JobEnvParams when the params are passed in a file
+	JobEnvParamsFile = "SERVERLESS_PARAMS_FILE"
+	// Directory the input ConfigMap is mounted on. Inputs are base64
+	// encoded there, the function wrapper decodes them.
+	JobEnvInputDir = "SERVERLESS_INPUT_DIR"
+	JobInputDir    = "/serverless/input"
+)
+
+// Keys of the input ConfigMap. Input names cannot contain dots, so they
+// cannot clash with the params.
+const (
+	jobParamsKey   = "params.json"
+	jobInputSuffix = ".b64"
+	jobInputVolume = "serverless-input"
+)
+
+var inputNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateInputName checks that `name` can name a binary input of a job
+func ValidateInputName(name string) error {
+	if !inputNameRegexp.MatchString(name) {
+		return errors.New(fmt.Sprintf("Invalid input name %q, expected letters, digits, - and _.", name))
+	}
+	return nil
+}
+
+// paramsInFile tells whether the params of a job are passed in a file
+func paramsInFile(params string) bool {
+	return len(params) > MaxEnvParamsSize
+}
+
+// hasJobInput tells whether a job gets an input ConfigMap
+func hasJobInput(params string, opts *JobOptions) bool {
+	return paramsInFile(params) || len(opts.Inputs) > 0
+}
+
+// jobInputData returns the data of the input ConfigMap of a job. The
+// data of a ConfigMap is text in this API version, so binary inputs are
+// base64 encoded.
+func jobInputData(params string, opts *JobOptions) (map[string]string, error) {
+	data := make(map[string]string, len(opts.Inputs)+1)
+	size := 0
+	if paramsInFile(params) {
+		data[jobParamsKey] = params
+		size += len(params)
+	}
+	for name, input := range opts.Inputs {
+		if err := ValidateInputName(name); err != nil {
+			return nil, err
+		}
+		data[name+jobInputSuffix] = base64.StdEncoding.EncodeToString(input)
+		size += len(data[name+jobInputSuffix])
+	}
+	if size > MaxInputSize {
+		return nil, errors.New(fmt.Sprintf("Params and inputs take %d bytes, exceeding the maximum of %d.", size, MaxInputSize))
+	}
+	return data, nil
+}
+
+// jobInputMount returns the volume and mount of the input ConfigMap
+func jobInputMount(jobName string) (v1.Volume, v1.VolumeMount) {
+	volume := v1.Volume{
+		Name: jobInputVolume,
+		VolumeSource: v1.VolumeSource{
+			ConfigMap: &v1.ConfigMapVolumeSource{
+				LocalObjectReference: v1.LocalObjectReference{Name: jobName},
+			},
+		},
+	}
+	mount := v1.VolumeMount{
+		Name:      jobInputVolume,
+		ReadOnly:  true,
+		MountPath: JobInputDir,
+	}
+	return volume, mount
+}
+
+// jobParamsFile is the path of the params file in the pod
+func jobParamsFile() string {
+	return path.Join(JobInputDir, jobParamsKey)
+}
+
+func (k *Kexec) createJobInput(jobName, namespace string, labels map[string]string, data map[string]string) error {
+	configMap := &v1.ConfigMap{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "ConfigMap",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      jobName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Data: data,
+	}
+	_, err := k.Clientset.Core().ConfigMaps(namespace).Create(configMap)
+	return err
+}
+
+func (k *Kexec) deleteJobInput(jobName, namespace string) error {
+	err := k.Clientset.Core().ConfigMaps(namespace).Delete(jobName, &api.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -9,12 +9,19 @@ package kexec
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/metrics"
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
 	"k8s.io/client-go/1.4/kubernetes"
 	"k8s.io/client-go/1.4/pkg/api"
+	apierrors "k8s.io/client-go/1.4/pkg/api/errors"
+	"k8s.io/client-go/1.4/pkg/api/resource"
 	unversioned "k8s.io/client-go/1.4/pkg/api/unversioned"
 	v1 "k8s.io/client-go/1.4/pkg/api/v1"
 	batchv1 "k8s.io/client-go/1.4/pkg/apis/batch/v1"
@@ -22,17 +29,145 @@ import (
 	"k8s.io/client-go/1.4/tools/clientcmd"
 )
 
+// ErrJobCancelled is returned by RunJob when the job was cancelled
+var ErrJobCancelled = errors.New("Job cancelled")
+
 var (
 	JobEnvParams                 = "SERVERLESS_PARAMS"
 	MaxPodExecTime time.Duration = 120
+
+	// Labels put on every function job, identifying the function
+	JobLabelUser     = "serverless-user"
+	JobLabelFunction = "serverless-function"
+
+	// Label put on the jobs started by a request, with the request id
+	JobLabelRequest = "serverless-request"
+
+	// The function wrapper writes the JSON return value of the function
+	// to the file named by JobEnvResultPath. The file is the termination
+	// message of the container, so the value is kept in the pod status
+	// apart from the log.
+	JobEnvResultPath = "SERVERLESS_RESULT_PATH"
+	JobResultPath    = "/dev/termination-log"
+
+	// W3C traceparent of the execution, for the function to continue
+	// the trace
+	JobEnvTraceParent = "TRACEPARENT"
 )
 
+var jobErrors = metrics.NewCounter("kexec_job_errors_total",
+	"Failures to create or delete function jobs, by op: create or delete.", "op")
+
+// JobOptions are the per function settings applied to a function job.
+// Zero values leave the setting unset.
+type JobOptions struct {
+	// CPU and memory as Kubernetes quantities, e.g. "500m" and "128Mi".
+	// They are used for both the requests and the limits of the pod.
+	CPU    string
+	Memory string
+
+	// Execution timeout. Defaults to MaxPodExecTime seconds.
+	Timeout time.Duration
+
+	// Maximum number of bytes of log returned by GetFunctionLog
+	MaxLogSize int64
+
+	// Environment variables of the function. Secrets are put into a
+	// Kubernetes Secret named after the job and referenced from the pod,
+	// so their values do not appear in the job spec.
+	Env     map[string]string
+	Secrets map[string]string
+
+	// How failed executions are retried. The timeout covers all attempts.
+	Retry RetryPolicy
+
+	// Binary inputs of the execution. The function finds each of them in
+	// a file named after its key in the directory JobEnvInputDir names.
+	Inputs map[string][]byte
+
+	// Trace context of the execution, passed to the function in
+	// JobEnvTraceParent
+	TraceParent string
+}
+
+// Validate checks that the options are well formed and do not exceed
+// the ceilings in `max`. Zero values in `max` mean no ceiling.
+func (o *JobOptions) Validate(max *JobOptions) error {
+	if err := validateQuantity("CPU", o.CPU, max.CPU); err != nil {
+		return err
+	}
+	if err := validateQuantity("Memory", o.Memory, max.Memory); err != nil {
+		return err
+	}
+	if o.Timeout < 0 {
+		return errors.New("Timeout cannot be negative.")
+	}
+	if max.Timeout > 0 && o.Timeout > max.Timeout {
+		return errors.New(fmt.Sprintf("Timeout %s exceeds the maximum of %s.", o.Timeout, max.Timeout))
+	}
+	if o.MaxLogSize < 0 {
+		return errors.New("Max log size cannot be negative.")
+	}
+	if max.MaxLogSize > 0 && o.MaxLogSize > max.MaxLogSize {
+		return errors.New(fmt.Sprintf("Max log size %d exceeds the maximum of %d bytes.", o.MaxLogSize, max.MaxLogSize))
+	}
+	return o.Retry.validate(&max.Retry)
+}
+
+func validateQuantity(name, value, max string) error {
+	if value == "" {
+		return nil
+	}
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid %s %q: %v", name, value, err))
+	}
+	if max == "" {
+		return nil
+	}
+	m, err := resource.ParseQuantity(max)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid maximum %s %q: %v", name, max, err))
+	}
+	if q.Cmp(m) > 0 {
+		return errors.New(fmt.Sprintf("%s %s exceeds the maximum of %s.", name, value, max))
+	}
+	return nil
+}
+
 type KexecConfig struct {
 	KubeConfig string
+
+	// Logger of the calls made without a request logger in their
+	// context, and of the background work. logging.Default if nil.
+	Logger *logging.Logger
 }
 
 type Kexec struct {
 	Clientset *kubernetes.Clientset
+
+	// Namespaces already set up by EnsureNamespace
+	namespaces map[string]bool
+	nsLock     sync.Mutex
+
+	// Cancel functions of the jobs RunJob waits for, by namespace/job name
+	cancels    map[string]context.CancelFunc
+	cancelLock sync.Mutex
+
+	// Tracks the pods of all function jobs, started on first use
+	pods        *podTracker
+	trackerLock sync.Mutex
+	stop        chan struct{}
+
+	// Warm pools by namespace/pool name, scaled down by a janitor started
+	// on first use
+	warmPools map[string]*warmPool
+	warmLock  sync.Mutex
+	warmOnce  sync.Once
+	// Owner label value of the warm workers of this instance
+	id string
+
+	log *logging.Logger
 }
 
 // NewKexec creates a new Kexec instance which contains all the methods
@@ -48,121 +183,213 @@ func NewKexec(c *KexecConfig) (*Kexec, error) {
 		return nil, err
 	}
 
+	logger := c.Logger
+	if logger == nil {
+		logger = logging.Default
+	}
 	return &Kexec{
-		Clientset: clientset,
+		Clientset:  clientset,
+		namespaces: make(map[string]bool),
+		cancels:    make(map[string]context.CancelFunc),
+		stop:       make(chan struct{}),
+		warmPools:  make(map[string]*warmPool),
+		id:         strconv.FormatInt(time.Now().UnixNano(), 36),
+		log:        logger,
 	}, nil
 }
 
+// logger returns the logger of the request of ctx, if any, so that the
+// records carry its id
+func (k *Kexec) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, k.log)
+}
+
+// Ping checks that the Kubernetes API server is reachable
+func (k *Kexec) Ping(ctx context.Context) error {
+	_, span := tracing.Start(ctx, "kexec.Ping")
+	defer span.End()
+	_, err := k.Clientset.Discovery().ServerVersion()
+	span.SetError(err)
+	return err
+}
+
 // Create a job template and then create the job
 // instance against the specified kubernetes/openshift cluster.
 //
 // Returns:		(error) if there is one
-func (k *Kexec) CreateFunctionJob(jobname, image, params, namespace string, labels map[string]string) error {
-	log.Println("Starting job", jobname)
-	template := createJobTemplate(image, jobname, params, namespace, labels)
+func (k *Kexec) CreateFunctionJob(ctx context.Context, jobname, image, params, namespace string, labels map[string]string, opts *JobOptions) (err error) {
+	ctx, span := tracing.Start(ctx, "kexec.CreateFunctionJob", "job", jobname, "namespace", namespace)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 
-	_, err := k.Clientset.Batch().Jobs(namespace).Create(template)
+	k.logger(ctx).Info("Starting job", "job", jobname, "namespace", namespace)
+	template, err := createJobTemplate(image, jobname, params, namespace, labels, opts)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-// Get the log for the job.
-// This function loop over all pods created by the job and return
-// the log of the first non-pending and non-running one.
-//
-// Returns: (string) pod status
-//			([]byte) pod log
-//			(error) if there is one
-// TODO: Logs should be return in full if there are multiple pods
-//       for one function execution.
-func (k *Kexec) GetFunctionLog(jobName, namespace string) (string, string, error) {
-
-	podlist, err := k.getFunctionPods(jobName, namespace)
-	if err != nil {
-		return "", "", err
+	if opts == nil {
+		opts = &JobOptions{}
 	}
-
-	if len(podlist.Items) < 1 {
-		return "", "", errors.New(fmt.Sprintf("No pod found for job %s.", jobName))
+	var input map[string]string
+	if hasJobInput(params, opts) {
+		if input, err = jobInputData(params, opts); err != nil {
+			return err
+		}
 	}
 
-	// Get the name and status of the first non-pending and non-running pod
-	var podName string
-	var podPhase v1.PodPhase
-	for _, pod := range podlist.Items {
-		if pod.Status.Phase != v1.PodPending &&
-			pod.Status.Phase != v1.PodRunning {
-			podName = pod.Name
-			podPhase = pod.Status.Phase
-			break
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(opts.Secrets) > 0 {
+		if err := k.createJobSecret(jobname, namespace, labels, opts.Secrets); err != nil {
+			return err
 		}
 	}
-	if podName == "" {
-		return "", "", errors.New(fmt.Sprintf("No completed pod for job %s.", jobName))
+	if input != nil {
+		err = k.createJobInput(jobname, namespace, labels, input)
 	}
 
-	opts := &v1.PodLogOptions{
-		Follow:     true,
-		Timestamps: false,
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		_, err = k.Clientset.Batch().Jobs(namespace).Create(template)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			jobErrors.Inc("create")
+		}
+		k.deleteJobSecret(jobname, namespace)
+		k.deleteJobInput(jobname, namespace)
+		return err
 	}
 
-	response, err := k.Clientset.Core().Pods(namespace).GetLogs(podName, opts).Stream()
+	return nil
+}
 
+// Get the log for the job.
+// This function loop over all pods created by the job and return
+// their logs in start order. At most `maxLogSize` bytes of log are
+// returned, unless it is 0.
+//
+// Returns: (string) job status
+//			([]byte) job log
+//			(error) if there is one
+func (k *Kexec) GetFunctionLog(ctx context.Context, jobName, namespace string, maxLogSize int64) (string, string, error) {
+	attempts, err := k.GetFunctionAttempts(ctx, jobName, namespace, maxLogSize)
 	if err != nil {
 		return "", "", err
 	}
 
-	defer response.Close()
-
-	log.Println("Got log of pod", podName)
-
-	status := string(podPhase)
-	log.Println("Job", jobName, "status:", status)
-
-	res, err := ioutil.ReadAll(response)
-	return status, string(res), err
+	status, funcLog := AggregateAttempts(attempts)
+	k.logger(ctx).Info("Job completed", "job", jobName, "status", status)
+	return status, funcLog, nil
 }
 
 // Get pod(s) that ran a specific function execution (job).
 //
 // Returns:	pod list
-func (k *Kexec) GetFunctionPods(jobName, namespace string) (*v1.PodList, error) {
+func (k *Kexec) GetFunctionPods(ctx context.Context, jobName, namespace string) (*v1.PodList, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return k.getFunctionPods(jobName, namespace)
 }
 
-// Wait for job to complete and delete the job.
+// Wait for job to complete.
 // Note in Kubernetes when a Pod fails, then the Job controller starts a new Pod.
-// The current implementation waits for the first pod completes and exits.
-func (k *Kexec) RunJob(jobName, namespace string) error {
-	// Wait for first pod completes
-	_, err := k.waitForPodComplete(jobName, namespace)
-	if err != nil {
-		return err
+// RunJob waits until a pod succeeds, a pod failed and the retry policy in
+// `opts` does not allow another attempt, or the timeout elapsed. Before a
+// retry, the job is paused for the backoff of the policy. A zero timeout
+// means MaxPodExecTime seconds. ErrJobCancelled is returned if the job was
+// cancelled with CancelJob, or `ctx` was cancelled. The pods are followed
+// by a watch shared by all RunJob calls, which only sees the pods of jobs
+// labelled with JobLabelFunction.
+func (k *Kexec) RunJob(ctx context.Context, jobName, namespace string, opts *JobOptions) (err error) {
+	ctx, span := tracing.Start(ctx, "kexec.RunJob", "job", jobName, "namespace", namespace)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	if opts == nil {
+		opts = &JobOptions{}
 	}
-	return nil
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = MaxPodExecTime * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return k.waitForJobComplete(ctx, jobName, namespace, &opts.Retry)
+}
+
+// Stop stops the watch shared by RunJob calls and scales down the warm
+// pools. RunJob and CallWarm must not be called anymore.
+func (k *Kexec) Stop() {
+	close(k.stop)
+	k.DrainWarmPools()
+}
+
+// CancelJob stops waiting for a job. The RunJob call waiting for it
+// returns ErrJobCancelled, and its caller is expected to collect what the
+// job produced and delete it. If nobody waits for the job, it is deleted
+// right away.
+func (k *Kexec) CancelJob(ctx context.Context, jobName, namespace string) error {
+	key := namespace + "/" + jobName
+	k.cancelLock.Lock()
+	cancel, ok := k.cancels[key]
+	delete(k.cancels, key)
+	k.cancelLock.Unlock()
+
+	if ok {
+		k.logger(ctx).Info("Cancelling job", "job", jobName)
+		cancel()
+		return nil
+	}
+	return k.DeleteFunctionJob(ctx, jobName, namespace)
 }
 
 // Delete the entire job and its pods
-func (k *Kexec) DeleteFunctionJob(jobName, namespace string) error {
-	log.Println("Deleting job", jobName, "and its pods...")
+func (k *Kexec) DeleteFunctionJob(ctx context.Context, jobName, namespace string) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ctx, span := tracing.Start(ctx, "kexec.DeleteFunctionJob", "job", jobName, "namespace", namespace)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	k.logger(ctx).Info("Deleting job and its pods", "job", jobName, "namespace", namespace)
 	var deleteOrphanDep = true
 	deleteOptions := api.DeleteOptions{
 		OrphanDependents: &deleteOrphanDep,
 	}
-	if err := k.Clientset.Batch().Jobs(namespace).Delete(jobName, &deleteOptions); err != nil {
-		return err
+	err = k.Clientset.Batch().Jobs(namespace).Delete(jobName, &deleteOptions)
+	if err == nil {
+		err = k.DeleteFunctionPods(ctx, jobName, namespace)
 	}
-	if err := k.DeleteFunctionPods(jobName, namespace); err != nil {
-		return err
+	if err == nil {
+		err = k.deleteJobSecret(jobName, namespace)
 	}
-	return nil
+	if err == nil {
+		err = k.deleteJobInput(jobName, namespace)
+	}
+	if err != nil {
+		jobErrors.Inc("delete")
+	}
+	return err
 }
 
 // Delete all pods for a specific job
-func (k *Kexec) DeleteFunctionPods(jobName, namespace string) error {
+func (k *Kexec) DeleteFunctionPods(ctx context.Context, jobName, namespace string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	var deleteOrphanDep = true
 	deleteOptions := api.DeleteOptions{
 		OrphanDependents: &deleteOrphanDep,
@@ -180,56 +407,145 @@ func (k *Kexec) DeleteFunctionPods(jobName, namespace string) error {
 	return k.Clientset.Core().Pods(namespace).DeleteCollection(&deleteOptions, listOptions)
 }
 
+// List the jobs of all functions in a namespace, i.e. the jobs carrying
+// the JobLabelFunction label.
+func (k *Kexec) ListFunctionJobs(ctx context.Context, namespace string) ([]batchv1.Job, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	selector, err := labels.Parse(JobLabelFunction)
+	if err != nil {
+		return nil, err
+	}
+	listOptions := api.ListOptions{
+		LabelSelector: selector,
+	}
+	jobs, err := k.Clientset.Batch().Jobs(namespace).List(listOptions)
+	if err != nil {
+		return nil, err
+	}
+	return jobs.Items, nil
+}
+
 // Create a namespace if it does not exist
-func (k *Kexec) CreateUserNamespaceIfNotExist(namespace string) (*v1.Namespace, error) {
+func (k *Kexec) CreateUserNamespaceIfNotExist(ctx context.Context, namespace string) (*v1.Namespace, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if ns, err := k.Clientset.Core().Namespaces().Get(namespace); err == nil {
-		log.Println("Namespace", namespace, "already exists!")
+		k.logger(ctx).Debug("Namespace already exists", "namespace", namespace)
 		return ns, nil
 	}
-	return k.createNamespace(namespace)
+	return k.createNamespace(namespace, nil, nil)
 }
 
-func (k *Kexec) waitForPodComplete(jobName, namespace string) (v1.PodPhase, error) {
-	// Create job label selector
-	jobLabelSelector := labels.SelectorFromSet(labels.Set{
-		"job-name": jobName,
-	})
-
-	// List pods according to `jobLabelSelector`
-	listOptions := api.ListOptions{
-		Watch:         true,
-		LabelSelector: jobLabelSelector,
+func (k *Kexec) waitForJobComplete(ctx context.Context, jobName, namespace string, retry *RetryPolicy) error {
+	t, err := k.tracker()
+	if err != nil {
+		return err
 	}
+	notified := t.register(jobName, namespace)
+	defer t.unregister(jobName, namespace)
 
-	var podPhase v1.PodPhase
-	w, err := k.Clientset.Core().Pods(namespace).Watch(listOptions)
-	if err != nil {
-		return podPhase, err
-	}
-	func() {
-		for {
-			select {
-			case events, ok := <-w.ResultChan():
-				if !ok {
-					return
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer k.registerCancel(namespace+"/"+jobName, cancel)()
+
+	// Time until a pod of the job leaves the Pending phase
+	_, scheduling := tracing.Start(ctx, "kexec.SchedulePod", "job", jobName)
+	defer scheduling.End()
+
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	failures := make(map[string]bool)
+	phases := make(map[string]v1.PodPhase)
+	for {
+		for _, pod := range t.jobPods(jobName, namespace) {
+			if pod.DeletionTimestamp != nil || failures[pod.Name] {
+				// Pods deleted while the job is paused are not attempts
+				continue
+			}
+			podPhase := pod.Status.Phase
+			if phases[pod.Name] != podPhase {
+				phases[pod.Name] = podPhase
+				k.logger(ctx).Info("Pod status changed", "job", jobName, "pod", pod.Name, "phase", podPhase)
+			}
+			if podPhase != v1.PodPending {
+				scheduling.End()
+			}
+			switch podPhase {
+			case v1.PodSucceeded:
+				return nil
+			case v1.PodFailed:
+				failures[pod.Name] = true
+				a := podAttempt(pod)
+				if len(failures) >= maxAttempts || !retry.Retryable(a) {
+					k.logger(ctx).Warn("Job failed", "job", jobName, "attempts", len(failures), "reason", a.Reason)
+					// Stop the Job controller from replacing the pod
+					// before the job is deleted
+					if err := k.pauseJob(ctx, jobName, namespace); err != nil {
+						k.logger(ctx).Warn("Cannot pause failed job", "job", jobName, "error", err)
+					}
+					return nil
+				}
+				backoff := retry.backoff(len(failures))
+				k.logger(ctx).Info("Retrying job", "job", jobName, "attempt", len(failures), "backoff", backoff)
+				if backoff <= 0 {
+					// The Job controller starts the next pod on its own
+					continue
+				}
+				if err := k.pauseJob(ctx, jobName, namespace); err != nil {
+					if ctx.Err() != nil {
+						return contextError(ctx)
+					}
+					return err
 				}
-				resp := events.Object.(*v1.Pod)
-				podPhase = resp.Status.Phase
-				log.Println(jobName, "pod status:", podPhase)
-				if podPhase != v1.PodPending &&
-					podPhase != v1.PodRunning {
-					w.Stop()
+				select {
+				case <-time.After(backoff):
+				case <-ctx.Done():
+					return contextError(ctx)
 				}
-				if podPhase == v1.PodUnknown {
-					log.Println("Pod status unknown. Reason:", resp.Status.Reason)
+				if err := k.resumeJob(ctx, jobName, namespace); err != nil {
+					if ctx.Err() != nil {
+						return contextError(ctx)
+					}
+					return err
 				}
-			case <-time.After(MaxPodExecTime * time.Second):
-				err = errors.New("Function takes too long to complete.")
-				w.Stop()
+			case v1.PodUnknown:
+				k.logger(ctx).Warn("Pod status unknown", "job", jobName, "pod", pod.Name, "reason", pod.Status.Reason)
 			}
 		}
-	}()
-	return podPhase, err
+
+		select {
+		case <-notified:
+		case <-ctx.Done():
+			return contextError(ctx)
+		}
+	}
+}
+
+// registerCancel makes CancelJob call `cancel` for `key`. It returns the
+// function unregistering it.
+func (k *Kexec) registerCancel(key string, cancel context.CancelFunc) func() {
+	k.cancelLock.Lock()
+	k.cancels[key] = cancel
+	k.cancelLock.Unlock()
+	return func() {
+		k.cancelLock.Lock()
+		delete(k.cancels, key)
+		k.cancelLock.Unlock()
+	}
+}
+
+// contextError converts the error of a done context into the error
+// returned by RunJob.
+func contextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("Function takes too long to complete.")
+	}
+	return ErrJobCancelled
 }
 
 // private function to help get the exact pod(s) that ran a specific
@@ -248,9 +564,46 @@ func (k *Kexec) getFunctionPods(jobName, namespace string) (*v1.PodList, error)
 	return k.Clientset.Core().Pods(namespace).List(listOptions)
 }
 
+// private function to create the secret holding the secret environment
+// variables of a job
+func (k *Kexec) createJobSecret(jobName, namespace string, labels map[string]string, secrets map[string]string) error {
+	data := make(map[string][]byte, len(secrets))
+	for name, value := range secrets {
+		data[name] = []byte(value)
+	}
+	secret := &v1.Secret{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Secret",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      jobName,
+			Namespace: namespace,
+			Labels:    labels,
+		},
+		Data: data,
+		Type: v1.SecretTypeOpaque,
+	}
+	_, err := k.Clientset.Core().Secrets(namespace).Create(secret)
+	return err
+}
+
+// private function to delete the secret of a job. Jobs without secrets
+// have none, which is not an error.
+func (k *Kexec) deleteJobSecret(jobName, namespace string) error {
+	err := k.Clientset.Core().Secrets(namespace).Delete(jobName, &api.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 // private function to create a namespace
-func (k *Kexec) createNamespace(namespace string) (*v1.Namespace, error) {
+func (k *Kexec) createNamespace(namespace string, extraLabels, annotations map[string]string) (*v1.Namespace, error) {
 	labels := make(map[string]string)
+	for key, value := range extraLabels {
+		labels[key] = value
+	}
 	labels["name"] = namespace
 	ns := &v1.Namespace{
 		TypeMeta: unversioned.TypeMeta{
@@ -258,8 +611,9 @@ func (k *Kexec) createNamespace(namespace string) (*v1.Namespace, error) {
 			APIVersion: "v1",
 		},
 		ObjectMeta: v1.ObjectMeta{
-			Name:   namespace,
-			Labels: labels,
+			Name:        namespace,
+			Labels:      labels,
+			Annotations: annotations,
 		},
 	}
 	return k.Clientset.Core().Namespaces().Create(ns)
@@ -269,14 +623,45 @@ func (k *Kexec) createNamespace(namespace string) (*v1.Namespace, error) {
 // create a Job instance against the specified kubernetes/openshift
 // cluster.
 //
-// For now, user only provide image, jobname, namespace and labels.
-// Other features like parallelism, etc., cannot be specified.
-//
-// TODO: 1. make parallelism configurable
-func createJobTemplate(image, jobname, params, namespace string, labels map[string]string) *batchv1.Job {
+// For now, user only provide image, jobname, namespace, labels and
+// the resources and timeout in `opts`. A job runs a single execution,
+// see createFanOutJobTemplate for the jobs running several.
+func createJobTemplate(image, jobname, params, namespace string, labels map[string]string, opts *JobOptions) (*batchv1.Job, error) {
 	if params == "" {
 		params = "{}"
 	}
+	if opts == nil {
+		opts = &JobOptions{}
+	}
+
+	resources, err := resourceRequirements(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The job is killed by Kubernetes once the timeout expires, even if
+	// nobody is watching it anymore.
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = MaxPodExecTime * time.Second
+	}
+	activeDeadline := int64(timeout / time.Second)
+
+	env := jobEnv(jobname, params, opts)
+
+	container := v1.Container{
+		Name:                   jobname,
+		Image:                  image,
+		Env:                    env,
+		Resources:              resources,
+		TerminationMessagePath: JobResultPath,
+	}
+	var volumes []v1.Volume
+	if hasJobInput(params, opts) {
+		volume, mount := jobInputMount(jobname)
+		volumes = append(volumes, volume)
+		container.VolumeMounts = append(container.VolumeMounts, mount)
+	}
 
 	return &batchv1.Job{
 		TypeMeta: unversioned.TypeMeta{
@@ -289,26 +674,96 @@ func createJobTemplate(image, jobname, params, namespace string, labels map[stri
 			Labels:    labels,
 		},
 		Spec: batchv1.JobSpec{
+			ActiveDeadlineSeconds: &activeDeadline,
 			Template: v1.PodTemplateSpec{
 				ObjectMeta: v1.ObjectMeta{
-					Name: jobname,
+					Name:   jobname,
+					Labels: labels,
 				},
 				Spec: v1.PodSpec{
-					Containers: []v1.Container{
-						v1.Container{
-							Name:  jobname,
-							Image: image,
-							Env: []v1.EnvVar{
-								v1.EnvVar{
-									Name:  JobEnvParams,
-									Value: params,
-								},
-							},
-						},
-					},
+					Volumes:       volumes,
+					Containers:    []v1.Container{container},
 					RestartPolicy: v1.RestartPolicyNever,
 				},
 			},
 		},
+	}, nil
+}
+
+// jobEnv returns the environment of the function container. The names of
+// the params and paths are reserved, so user variables cannot override
+// them (see buildFunctionEnv). envFrom is not available in this API
+// version, so each secret is referenced on its own.
+func jobEnv(jobname, params string, opts *JobOptions) []v1.EnvVar {
+	env := make([]v1.EnvVar, 0)
+	if paramsInFile(params) {
+		env = append(env, v1.EnvVar{Name: JobEnvParamsFile, Value: jobParamsFile()})
+	} else {
+		env = append(env, v1.EnvVar{Name: JobEnvParams, Value: params})
+	}
+	if hasJobInput(params, opts) {
+		env = append(env, v1.EnvVar{Name: JobEnvInputDir, Value: JobInputDir})
+	}
+	env = append(env, v1.EnvVar{Name: JobEnvResultPath, Value: JobResultPath})
+	if opts.TraceParent != "" {
+		env = append(env, v1.EnvVar{Name: JobEnvTraceParent, Value: opts.TraceParent})
+	}
+	return append(env, functionEnv(jobname, opts)...)
+}
+
+// functionEnv returns the user variables and secrets of a function.
+// Secrets are read from the Secret named `secretName`.
+func functionEnv(secretName string, opts *JobOptions) []v1.EnvVar {
+	env := make([]v1.EnvVar, 0, len(opts.Env)+len(opts.Secrets))
+	for _, name := range sortedKeys(opts.Env) {
+		env = append(env, v1.EnvVar{Name: name, Value: opts.Env[name]})
+	}
+	for _, name := range sortedKeys(opts.Secrets) {
+		env = append(env, v1.EnvVar{
+			Name: name,
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+					Key:                  name,
+				},
+			},
+		})
+	}
+	return env
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// resourceRequirements sets both the requests and the limits to the CPU
+// and memory in `opts`, so functions get what they asked for and nothing
+// more.
+func resourceRequirements(opts *JobOptions) (v1.ResourceRequirements, error) {
+	resources := v1.ResourceRequirements{}
+	list := v1.ResourceList{}
+	if opts.CPU != "" {
+		q, err := resource.ParseQuantity(opts.CPU)
+		if err != nil {
+			return resources, err
+		}
+		list[v1.ResourceCPU] = q
+	}
+	if opts.Memory != "" {
+		q, err := resource.ParseQuantity(opts.Memory)
+		if err != nil {
+			return resources, err
+		}
+		list[v1.ResourceMemory] = q
+	}
+	if len(list) > 0 {
+		resources.Limits = list
+		resources.Requests = list
 	}
+	return resources, nil
 }
@@ -0,0 +1,189 @@
+package kexec
+
+import (
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/pkg/api/resource"
+	unversioned "k8s.io/client-go/1.4/pkg/api/unversioned"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/apis/extensions/v1beta1"
+)
+
+var (
+	// Name of the ResourceQuota, LimitRange and NetworkPolicy created in
+	// each function namespace
+	NamespacePolicyName = "serverless"
+
+	// Namespace annotation turning on network isolation
+	NetworkPolicyAnnotation = "net.beta.kubernetes.io/network-policy"
+	DefaultDenyIngress      = `{"ingress": {"isolation": "DefaultDeny"}}`
+)
+
+// NamespaceOptions describe how a function namespace is set up. Resource
+// lists map resource names to quantities, e.g. {"limits.memory": "4Gi"}.
+type NamespaceOptions struct {
+	Labels map[string]string
+
+	// Hard limits of the namespace ResourceQuota. No quota if empty.
+	Quota map[string]string
+
+	// Per container defaults and maximum of the namespace LimitRange. No
+	// LimitRange if all are empty.
+	DefaultLimits   map[string]string
+	DefaultRequests map[string]string
+	MaxLimits       map[string]string
+
+	// Only allow traffic to the pods from within the namespace
+	Isolate bool
+}
+
+// EnsureNamespace creates the namespace with its ResourceQuota, LimitRange
+// and NetworkPolicy unless they already exist. Namespaces are only set up
+// once per Kexec instance; changes to `opts` are not applied to existing
+// objects.
+func (k *Kexec) EnsureNamespace(ctx context.Context, namespace string, opts *NamespaceOptions) error {
+	k.nsLock.Lock()
+	defer k.nsLock.Unlock()
+	if k.namespaces[namespace] {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := k.Clientset.Core().Namespaces().Get(namespace); err != nil {
+		k.logger(ctx).Info("Creating namespace", "namespace", namespace)
+		var annotations map[string]string
+		if opts.Isolate {
+			annotations = map[string]string{NetworkPolicyAnnotation: DefaultDenyIngress}
+		}
+		if _, err := k.createNamespace(namespace, opts.Labels, annotations); err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Quota) > 0 {
+		if err := k.ensureResourceQuota(namespace, opts); err != nil {
+			return err
+		}
+	}
+	if len(opts.DefaultLimits) > 0 || len(opts.DefaultRequests) > 0 || len(opts.MaxLimits) > 0 {
+		if err := k.ensureLimitRange(namespace, opts); err != nil {
+			return err
+		}
+	}
+	if opts.Isolate {
+		if err := k.ensureNetworkPolicy(namespace, opts); err != nil {
+			return err
+		}
+	}
+
+	k.namespaces[namespace] = true
+	return nil
+}
+
+func (k *Kexec) ensureResourceQuota(namespace string, opts *NamespaceOptions) error {
+	quotas := k.Clientset.Core().ResourceQuotas(namespace)
+	if _, err := quotas.Get(NamespacePolicyName); err == nil {
+		return nil
+	}
+	hard, err := resourceList(opts.Quota)
+	if err != nil {
+		return err
+	}
+	k.log.Info("Creating resource quota", "namespace", namespace)
+	_, err = quotas.Create(&v1.ResourceQuota{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "ResourceQuota",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      NamespacePolicyName,
+			Namespace: namespace,
+			Labels:    opts.Labels,
+		},
+		Spec: v1.ResourceQuotaSpec{Hard: hard},
+	})
+	return err
+}
+
+func (k *Kexec) ensureLimitRange(namespace string, opts *NamespaceOptions) error {
+	limitRanges := k.Clientset.Core().LimitRanges(namespace)
+	if _, err := limitRanges.Get(NamespacePolicyName); err == nil {
+		return nil
+	}
+	item := v1.LimitRangeItem{Type: v1.LimitTypeContainer}
+	var err error
+	if item.Default, err = resourceList(opts.DefaultLimits); err != nil {
+		return err
+	}
+	if item.DefaultRequest, err = resourceList(opts.DefaultRequests); err != nil {
+		return err
+	}
+	if item.Max, err = resourceList(opts.MaxLimits); err != nil {
+		return err
+	}
+	k.log.Info("Creating limit range", "namespace", namespace)
+	_, err = limitRanges.Create(&v1.LimitRange{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "LimitRange",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      NamespacePolicyName,
+			Namespace: namespace,
+			Labels:    opts.Labels,
+		},
+		Spec: v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{item}},
+	})
+	return err
+}
+
+// ensureNetworkPolicy allows ingress from pods of the same namespace only.
+// Everything else is denied by the namespace isolation annotation.
+func (k *Kexec) ensureNetworkPolicy(namespace string, opts *NamespaceOptions) error {
+	policies := k.Clientset.Extensions().NetworkPolicies(namespace)
+	if _, err := policies.Get(NamespacePolicyName); err == nil {
+		return nil
+	}
+	k.log.Info("Creating network policy", "namespace", namespace)
+	_, err := policies.Create(&v1beta1.NetworkPolicy{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "NetworkPolicy",
+			APIVersion: "extensions/v1beta1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			Name:      NamespacePolicyName,
+			Namespace: namespace,
+			Labels:    opts.Labels,
+		},
+		Spec: v1beta1.NetworkPolicySpec{
+			// All pods of the namespace
+			PodSelector: unversioned.LabelSelector{},
+			Ingress: []v1beta1.NetworkPolicyIngressRule{
+				v1beta1.NetworkPolicyIngressRule{
+					From: []v1beta1.NetworkPolicyPeer{
+						v1beta1.NetworkPolicyPeer{
+							PodSelector: &unversioned.LabelSelector{},
+						},
+					},
+				},
+			},
+		},
+	})
+	return err
+}
+
+func resourceList(m map[string]string) (v1.ResourceList, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	list := v1.ResourceList{}
+	for name, value := range m {
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, err
+		}
+		list[v1.ResourceName(name)] = q
+	}
+	return list, nil
+}
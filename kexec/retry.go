@@ -0,0 +1,116 @@
+package kexec
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MaxRetryBackoff caps the delay between two attempts of an execution
+var MaxRetryBackoff = 5 * time.Minute
+
+// RetryPolicy tells how failed executions of a function are retried.
+// The Job API of this Kubernetes version has no backoff limit, so the
+// Job controller replaces every failed pod: kexec decides when to stop
+// waiting for replacements, and pauses the job during the backoff.
+type RetryPolicy struct {
+	// Number of attempts of an execution, including the first one. 0 or
+	// 1 means failed executions are not retried.
+	MaxAttempts int
+
+	// Delay before the first retry, doubled for each next one
+	Backoff time.Duration
+
+	// Exit codes (e.g. "1") and termination reasons (e.g. "Evicted" or
+	// "OOMKilled") of the attempts that are retried. Empty means every
+	// failed attempt is retried.
+	RetryOn []string
+}
+
+// ParseRetryOn parses a comma separated list of exit codes and
+// termination reasons.
+func ParseRetryOn(s string) ([]string, error) {
+	retryOn := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if code, err := strconv.Atoi(v); err == nil && (code <= 0 || code > 255) {
+			return nil, errors.New(fmt.Sprintf("Invalid exit code %d, expected 1 to 255.", code))
+		}
+		retryOn = append(retryOn, v)
+	}
+	return retryOn, nil
+}
+
+// Retryable tells whether the failed attempt `a` may be retried
+func (p *RetryPolicy) Retryable(a *Attempt) bool {
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	code := strconv.Itoa(int(a.ExitCode))
+	for _, v := range p.RetryOn {
+		if v == code || (a.Reason != "" && strings.EqualFold(v, a.Reason)) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the delay before the retry following the `failures`th
+// failed attempt.
+func (p *RetryPolicy) backoff(failures int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < failures && d < MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxRetryBackoff {
+		d = MaxRetryBackoff
+	}
+	return d
+}
+
+func (p *RetryPolicy) validate(max *RetryPolicy) error {
+	if p.MaxAttempts < 0 {
+		return errors.New("Max attempts cannot be negative.")
+	}
+	if max.MaxAttempts > 0 && p.MaxAttempts > max.MaxAttempts {
+		return errors.New(fmt.Sprintf("Max attempts %d exceeds the maximum of %d.", p.MaxAttempts, max.MaxAttempts))
+	}
+	if p.Backoff < 0 {
+		return errors.New("Retry backoff cannot be negative.")
+	}
+	return nil
+}
+
+// pauseJob stops the Job controller from starting a new pod for the job,
+// and deletes the pod it may already have started.
+func (k *Kexec) pauseJob(ctx context.Context, jobName, namespace string) error {
+	return k.setJobParallelism(ctx, jobName, namespace, 0)
+}
+
+// resumeJob reverses pauseJob
+func (k *Kexec) resumeJob(ctx context.Context, jobName, namespace string) error {
+	return k.setJobParallelism(ctx, jobName, namespace, 1)
+}
+
+func (k *Kexec) setJobParallelism(ctx context.Context, jobName, namespace string, parallelism int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	job, err := k.Clientset.Batch().Jobs(namespace).Get(jobName)
+	if err != nil {
+		return err
+	}
+	job.Spec.Parallelism = &parallelism
+	if _, err := k.Clientset.Batch().Jobs(namespace).Update(job); err != nil {
+		return err
+	}
+	k.logger(ctx).Debug("Job parallelism set", "job", jobName, "parallelism", parallelism)
+	return nil
+}
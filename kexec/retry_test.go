@@ -0,0 +1,103 @@
+package kexec
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetryOn(t *testing.T) {
+	for _, c := range []struct {
+		in      string
+		retryOn []string
+		valid   bool
+	}{
+		{"", []string{}, true},
+		{"1", []string{"1"}, true},
+		{" 1, 137 ,OOMKilled,,Evicted ", []string{"1", "137", "OOMKilled", "Evicted"}, true},
+		{"255", []string{"255"}, true},
+		{"0", nil, false},
+		{"256", nil, false},
+		{"-1", nil, false},
+		{"1,300", nil, false},
+	} {
+		retryOn, err := ParseRetryOn(c.in)
+		if (err == nil) != c.valid {
+			t.Errorf("ParseRetryOn(%q): unexpected error %v", c.in, err)
+			continue
+		}
+		if c.valid && !reflect.DeepEqual(retryOn, c.retryOn) {
+			t.Errorf("ParseRetryOn(%q): expected %q, got %q", c.in, c.retryOn, retryOn)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for _, c := range []struct {
+		retryOn   []string
+		exitCode  int32
+		reason    string
+		retryable bool
+	}{
+		{nil, 1, "Error", true},
+		{nil, -1, "DeadlineExceeded", true},
+		{[]string{"1"}, 1, "Error", true},
+		{[]string{"1"}, 2, "Error", false},
+		{[]string{"137"}, 137, "OOMKilled", true},
+		{[]string{"OOMKilled"}, 137, "OOMKilled", true},
+		{[]string{"oomkilled"}, 137, "OOMKilled", true},
+		{[]string{"Evicted"}, -1, "Evicted", true},
+		{[]string{"Evicted"}, 1, "Error", false},
+		{[]string{"1", "Evicted"}, -1, "Evicted", true},
+		// An attempt without reason matches no reason
+		{[]string{""}, 1, "", false},
+	} {
+		p := &RetryPolicy{RetryOn: c.retryOn}
+		a := &Attempt{ExitCode: c.exitCode, Reason: c.reason}
+		if p.Retryable(a) != c.retryable {
+			t.Errorf("RetryOn %q, exit code %d, reason %q: expected retryable %v", c.retryOn, c.exitCode, c.reason, c.retryable)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(max time.Duration) { MaxRetryBackoff = max }(MaxRetryBackoff)
+	MaxRetryBackoff = time.Minute
+
+	for _, c := range []struct {
+		backoff  time.Duration
+		failures int
+		expected time.Duration
+	}{
+		{0, 1, 0},
+		{0, 5, 0},
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 4, 8 * time.Second},
+		{time.Second, 10, time.Minute},
+		{2 * time.Minute, 1, time.Minute},
+	} {
+		p := &RetryPolicy{Backoff: c.backoff}
+		if d := p.backoff(c.failures); d != c.expected {
+			t.Errorf("Backoff %s after %d failures: expected %s, got %s", c.backoff, c.failures, c.expected, d)
+		}
+	}
+}
+
+func TestValidateRetryPolicy(t *testing.T) {
+	max := &RetryPolicy{MaxAttempts: 5}
+	for _, c := range []struct {
+		policy RetryPolicy
+		valid  bool
+	}{
+		{RetryPolicy{}, true},
+		{RetryPolicy{MaxAttempts: 5, Backoff: time.Second}, true},
+		{RetryPolicy{MaxAttempts: 6}, false},
+		{RetryPolicy{MaxAttempts: -1}, false},
+		{RetryPolicy{Backoff: -time.Second}, false},
+	} {
+		if err := c.policy.validate(max); (err == nil) != c.valid {
+			t.Errorf("Policy %+v: unexpected error %v", c.policy, err)
+		}
+	}
+}
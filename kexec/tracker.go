@@ -0,0 +1,144 @@
+package kexec
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"k8s.io/client-go/1.4/pkg/api"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/runtime"
+	"k8s.io/client-go/1.4/pkg/watch"
+	"k8s.io/client-go/1.4/tools/cache"
+)
+
+// Period at which the pod tracker re-delivers every pod, so that a
+// waiter that missed an update still sees the current state of its pods
+var PodResyncPeriod = 30 * time.Second
+
+// podTracker follows the pods of all function jobs over a single watch,
+// shared by all the executions in flight. The informer relists when the
+// watch expires or breaks, so waiters never hold a watch of their own.
+//
+// Waiters are notified when a pod of their job changes, and read the
+// current pods of the job from the informer store: a notification may
+// stand for several changes, but no change is missed.
+type podTracker struct {
+	store      cache.Store
+	controller *cache.Controller
+
+	lock    sync.Mutex
+	waiters map[string]chan struct{}
+
+	log *logging.Logger
+}
+
+func newPodTracker(k *Kexec) (*podTracker, error) {
+	// Function pods carry the labels of their job
+	selector, err := labels.Parse(JobLabelFunction)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &podTracker{waiters: make(map[string]chan struct{}), log: k.log}
+	lw := &cache.ListWatch{
+		ListFunc: func(options api.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return k.Clientset.Core().Pods(api.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options api.ListOptions) (watch.Interface, error) {
+			options.LabelSelector = selector
+			return k.Clientset.Core().Pods(api.NamespaceAll).Watch(options)
+		},
+	}
+	t.store, t.controller = cache.NewInformer(lw, &v1.Pod{}, PodResyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc:    t.notify,
+		UpdateFunc: func(oldObj, newObj interface{}) { t.notify(newObj) },
+		DeleteFunc: t.notify,
+	})
+	return t, nil
+}
+
+// run runs the informer until `stop` is closed
+func (t *podTracker) run(stop <-chan struct{}) {
+	t.log.Info("Starting pod tracker")
+	t.controller.Run(stop)
+}
+
+// register returns the channel a waiter for a job is notified on. There
+// is at most one waiter per job.
+func (t *podTracker) register(jobName, namespace string) chan struct{} {
+	c := make(chan struct{}, 1)
+	t.lock.Lock()
+	t.waiters[namespace+"/"+jobName] = c
+	t.lock.Unlock()
+	return c
+}
+
+func (t *podTracker) unregister(jobName, namespace string) {
+	t.lock.Lock()
+	delete(t.waiters, namespace+"/"+jobName)
+	t.lock.Unlock()
+}
+
+func (t *podTracker) notify(obj interface{}) {
+	if deleted, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		// The pod was deleted while the watch was broken
+		obj = deleted.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+
+	t.lock.Lock()
+	c, ok := t.waiters[pod.Namespace+"/"+pod.Labels["job-name"]]
+	t.lock.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case c <- struct{}{}:
+	default:
+		// A notification is already pending
+	}
+}
+
+// jobPods returns the pods of a job known to the tracker, in start order
+func (t *podTracker) jobPods(jobName, namespace string) []*v1.Pod {
+	pods := make([]*v1.Pod, 0)
+	for _, obj := range t.store.List() {
+		pod, ok := obj.(*v1.Pod)
+		if ok && pod.Namespace == namespace && pod.Labels["job-name"] == jobName {
+			pods = append(pods, pod)
+		}
+	}
+	sort.Stable(podsByStart(pods))
+	return pods
+}
+
+type podsByStart []*v1.Pod
+
+func (s podsByStart) Len() int      { return len(s) }
+func (s podsByStart) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s podsByStart) Less(i, j int) bool {
+	return s[i].CreationTimestamp.Time.Before(s[j].CreationTimestamp.Time)
+}
+
+// tracker returns the pod tracker, started on first use
+func (k *Kexec) tracker() (*podTracker, error) {
+	k.trackerLock.Lock()
+	defer k.trackerLock.Unlock()
+	if k.pods != nil {
+		return k.pods, nil
+	}
+	t, err := newPodTracker(k)
+	if err != nil {
+		return nil, err
+	}
+	go t.run(k.stop)
+	k.pods = t
+	return t, nil
+}
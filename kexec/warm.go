@@ -0,0 +1,514 @@
+package kexec
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/pkg/api"
+	unversioned "k8s.io/client-go/1.4/pkg/api/unversioned"
+	v1 "k8s.io/client-go/1.4/pkg/api/v1"
+	"k8s.io/client-go/1.4/pkg/labels"
+	"k8s.io/client-go/1.4/pkg/util/intstr"
+)
+
+var (
+	// Port the HTTP shim of the function image listens on in warm mode
+	WarmWorkerPort = 8080
+
+	// How long a new warm worker may take to become ready
+	WarmStartTimeout = 2 * time.Minute
+
+	// Period at which idle warm pools are scaled down
+	WarmPoolCheckPeriod = 30 * time.Second
+
+	// Environment of warm workers. The function wrapper serves executions
+	// over HTTP when JobEnvMode is "warm".
+	JobEnvMode = "SERVERLESS_MODE"
+	JobEnvPort = "SERVERLESS_PORT"
+
+	// Label put on warm worker pods
+	PodLabelWarm = "serverless-warm"
+	// Label identifying the Kexec instance owning a warm worker pod
+	PodLabelWarmOwner = "serverless-warm-owner"
+
+	// Request header carrying JobOptions.TraceParent to warm workers,
+	// whose environment is shared by all their executions
+	WarmHeaderTraceParent = "traceparent"
+)
+
+// ErrNoWarmWorker is returned by CallWarm when no warm worker is idle,
+// e.g. while the pool starts. The caller is expected to run the execution
+// as a job instead.
+var ErrNoWarmWorker = errors.New("No warm worker available")
+
+// WarmOptions are the settings of the warm pool of a function
+type WarmOptions struct {
+	// Number of worker pods kept running
+	Size int
+
+	// The pool is scaled down once it was not used for this long. 0 means
+	// it is kept until the server stops.
+	IdleTimeout time.Duration
+
+	// Version of the function code. The pool is replaced when it changes,
+	// as the image tag does not.
+	Version string
+}
+
+// warmPool is a set of long running pods of a function. Each pod runs
+// the function wrapper in warm mode, and serves one execution at a time.
+type warmPool struct {
+	id          string
+	namespace   string
+	fingerprint string
+	template    *v1.Pod
+	secrets     map[string]string
+	labels      map[string]string
+	size        int
+	idleTimeout time.Duration
+
+	// Ready workers not serving an execution
+	idle chan string
+	// Closed once the pool is scaled down. Guarded by lock, so that no
+	// worker is made idle after the pool is drained.
+	stopped chan struct{}
+	lock    sync.Mutex
+
+	// Guarded by Kexec.warmLock
+	lastUsed time.Time
+}
+
+// warmResponse is the response of the HTTP shim to an execution
+type warmResponse struct {
+	ExitCode int32  `json:"exitCode"`
+	Output   string `json:"output"`
+	Log      string `json:"log"`
+}
+
+// CallWarm runs an execution on an idle worker of the warm pool
+// `poolName`, starting the pool if needed. It returns the attempts of the
+// execution, or ErrNoWarmWorker if no worker is idle. Failed attempts are
+// retried on the same worker as RunJob would retry them.
+//
+// Like RunJob, it returns ErrJobCancelled once `callID` is cancelled with
+// CancelJob or ctx is done. The worker is deleted then, and the log of the
+// interrupted attempt is lost.
+func (k *Kexec) CallWarm(ctx context.Context, callID, poolName, image, params, namespace string, labels map[string]string, opts *JobOptions, warm *WarmOptions) (attempts []*Attempt, err error) {
+	if len(opts.Inputs) > 0 {
+		// Inputs are passed as files, which workers cannot get
+		return nil, ErrNoWarmWorker
+	}
+	if params == "" {
+		params = "{}"
+	}
+
+	pool, err := k.warmPool(poolName, image, namespace, labels, opts, warm)
+	if err != nil {
+		return nil, err
+	}
+	var pod string
+	select {
+	case pod = <-pool.idle:
+	default:
+		return nil, ErrNoWarmWorker
+	}
+	k.logger(ctx).Info("Running on warm worker", "call", callID, "pod", pod)
+	ctx, span := tracing.Start(ctx, "kexec.CallWarm", "pool", poolName, "pod", pod)
+	defer func() {
+		span.SetAttributes("attempts", len(attempts))
+		span.SetError(err)
+		span.End()
+	}()
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = MaxPodExecTime * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	defer k.registerCancel(namespace+"/"+callID, cancel)()
+
+	retry := &opts.Retry
+	maxAttempts := retry.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	attempts = make([]*Attempt, 0, 1)
+	for {
+		a, err := k.callWorker(ctx, pool, pod, params, opts.MaxLogSize, opts.TraceParent)
+		if err != nil {
+			// The worker may still run the execution
+			k.replaceWorker(pool, pod)
+			if ctx.Err() != nil {
+				return attempts, contextError(ctx)
+			}
+			return nil, err
+		}
+		attempts = append(attempts, a)
+		if a.Phase == string(v1.PodSucceeded) || len(attempts) >= maxAttempts || !retry.Retryable(a) {
+			break
+		}
+		backoff := retry.backoff(len(attempts))
+		k.logger(ctx).Info("Retrying on warm worker", "call", callID, "attempt", len(attempts), "backoff", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			k.releaseWorker(pool, pod)
+			return attempts, contextError(ctx)
+		}
+	}
+	k.releaseWorker(pool, pod)
+	return attempts, nil
+}
+
+// callWorker runs one attempt of an execution on a worker, through the
+// pod proxy of the API server.
+func (k *Kexec) callWorker(ctx context.Context, pool *warmPool, pod, params string, maxLogSize int64, traceParent string) (*Attempt, error) {
+	a := &Attempt{Pod: pod, ExitCode: -1, StartTime: time.Now()}
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		body, err := k.Clientset.Core().GetRESTClient().Post().
+			Namespace(pool.namespace).
+			Resource("pods").
+			Name(pod+":"+strconv.Itoa(WarmWorkerPort)).
+			SubResource("proxy").
+			SetHeader(WarmHeaderTraceParent, traceParent).
+			Body([]byte(params)).
+			DoRaw()
+		c <- result{body, err}
+	}()
+
+	var r result
+	select {
+	case r = <-c:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	var res warmResponse
+	if err := json.Unmarshal(r.body, &res); err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid response of warm worker %s: %v", pod, err))
+	}
+
+	a.FinishTime = time.Now()
+	a.ExitCode = res.ExitCode
+	a.Log = res.Log
+	if maxLogSize > 0 && int64(len(a.Log)) > maxLogSize {
+		a.Log = a.Log[:maxLogSize]
+	}
+	if res.ExitCode == 0 {
+		a.Phase = string(v1.PodSucceeded)
+		a.Output = res.Output
+	} else {
+		a.Phase = string(v1.PodFailed)
+		a.Reason = "Error"
+	}
+	return a, nil
+}
+
+// warmPool returns the warm pool of a function, starting it if needed. A
+// pool started for another version or other options of the function is
+// replaced.
+func (k *Kexec) warmPool(poolName, image, namespace string, labels map[string]string, opts *JobOptions, warm *WarmOptions) (*warmPool, error) {
+	k.warmOnce.Do(func() { go k.runWarmJanitor(k.stop) })
+
+	fingerprint := warmFingerprint(image, opts, warm)
+	key := namespace + "/" + poolName
+	k.warmLock.Lock()
+	defer k.warmLock.Unlock()
+	pool, ok := k.warmPools[key]
+	if ok && pool.fingerprint == fingerprint {
+		pool.lastUsed = time.Now()
+		return pool, nil
+	}
+	if ok {
+		k.log.Info("Replacing warm pool", "pool", pool.id)
+		delete(k.warmPools, key)
+		go k.drainPool(pool)
+	}
+
+	resources, err := resourceRequirements(opts)
+	if err != nil {
+		return nil, err
+	}
+	id := poolName + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	podLabels := map[string]string{PodLabelWarm: "true", PodLabelWarmOwner: k.id}
+	for name, value := range labels {
+		podLabels[name] = value
+	}
+	pool = &warmPool{
+		id:          id,
+		namespace:   namespace,
+		fingerprint: fingerprint,
+		template:    warmPodTemplate(id, image, namespace, podLabels, resources, opts),
+		secrets:     opts.Secrets,
+		labels:      labels,
+		size:        warm.Size,
+		idleTimeout: warm.IdleTimeout,
+		idle:        make(chan string, warm.Size),
+		stopped:     make(chan struct{}),
+		lastUsed:    time.Now(),
+	}
+	k.warmPools[key] = pool
+
+	go func() {
+		k.log.Info("Starting warm pool", "pool", id, "size", pool.size)
+		if len(pool.secrets) > 0 {
+			if err := k.createJobSecret(id, namespace, pool.labels, pool.secrets); err != nil {
+				k.log.Error("Failed to create warm pool secret", "pool", id, "error", err)
+				// Let the next execution start the pool again
+				k.warmLock.Lock()
+				if k.warmPools[key] == pool {
+					delete(k.warmPools, key)
+				}
+				k.warmLock.Unlock()
+				return
+			}
+		}
+		for i := 0; i < pool.size; i++ {
+			go k.startWorker(pool)
+		}
+	}()
+	return pool, nil
+}
+
+// warmFingerprint identifies what the workers of a pool run
+func warmFingerprint(image string, opts *JobOptions, warm *WarmOptions) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", image, warm.Version, opts.CPU, opts.Memory)
+	for _, name := range sortedKeys(opts.Env) {
+		fmt.Fprintf(h, "%s=%s\n", name, opts.Env[name])
+	}
+	for _, name := range sortedKeys(opts.Secrets) {
+		fmt.Fprintf(h, "%s=%s\n", name, opts.Secrets[name])
+	}
+	io.WriteString(h, strconv.Itoa(warm.Size))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// warmPodTemplate returns the pod of a warm worker. Secrets are read from
+// the Secret named after the pool.
+func warmPodTemplate(id, image, namespace string, labels map[string]string, resources v1.ResourceRequirements, opts *JobOptions) *v1.Pod {
+	env := []v1.EnvVar{
+		v1.EnvVar{Name: JobEnvMode, Value: "warm"},
+		v1.EnvVar{Name: JobEnvPort, Value: strconv.Itoa(WarmWorkerPort)},
+	}
+	env = append(env, functionEnv(id, opts)...)
+
+	return &v1.Pod{
+		TypeMeta: unversioned.TypeMeta{
+			Kind:       "Pod",
+			APIVersion: "v1",
+		},
+		ObjectMeta: v1.ObjectMeta{
+			GenerateName: id + "-",
+			Namespace:    namespace,
+			Labels:       labels,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{
+				v1.Container{
+					Name:      "worker",
+					Image:     image,
+					Env:       env,
+					Resources: resources,
+					Ports: []v1.ContainerPort{
+						v1.ContainerPort{Name: "http", ContainerPort: int32(WarmWorkerPort)},
+					},
+					ReadinessProbe: &v1.Probe{
+						Handler: v1.Handler{
+							HTTPGet: &v1.HTTPGetAction{
+								Path: "/",
+								Port: intstr.FromInt(WarmWorkerPort),
+							},
+						},
+						PeriodSeconds: 2,
+					},
+					// The image tag does not change with the function
+					ImagePullPolicy: v1.PullAlways,
+				},
+			},
+			RestartPolicy: v1.RestartPolicyAlways,
+		},
+	}
+}
+
+// startWorker creates a worker pod and makes it available once ready
+func (k *Kexec) startWorker(pool *warmPool) {
+	pod, err := k.Clientset.Core().Pods(pool.namespace).Create(pool.template)
+	if err != nil {
+		k.log.Error("Failed to start warm worker", "pool", pool.id, "error", err)
+		return
+	}
+	if err := k.waitWorkerReady(pool, pod.Name); err != nil {
+		k.log.Warn("Warm worker did not become ready", "pool", pool.id, "pod", pod.Name, "error", err)
+		k.deleteWorker(pool, pod.Name)
+		return
+	}
+	k.releaseWorker(pool, pod.Name)
+}
+
+func (k *Kexec) waitWorkerReady(pool *warmPool, name string) error {
+	deadline := time.After(WarmStartTimeout)
+	for {
+		pod, err := k.Clientset.Core().Pods(pool.namespace).Get(name)
+		if err != nil {
+			return err
+		}
+		switch pod.Status.Phase {
+		case v1.PodRunning:
+			ready := len(pod.Status.ContainerStatuses) > 0
+			for _, c := range pod.Status.ContainerStatuses {
+				ready = ready && c.Ready
+			}
+			if ready {
+				return nil
+			}
+		case v1.PodFailed, v1.PodSucceeded:
+			return errors.New("Worker terminated: " + pod.Status.Reason)
+		}
+
+		select {
+		case <-time.After(LogPollInterval):
+		case <-deadline:
+			return errors.New("Timed out")
+		case <-pool.stopped:
+			return errors.New("Pool scaled down")
+		}
+	}
+}
+
+// releaseWorker makes a worker available for the next execution, or
+// deletes it if the pool was scaled down.
+func (k *Kexec) releaseWorker(pool *warmPool, name string) {
+	pool.lock.Lock()
+	select {
+	case <-pool.stopped:
+		pool.lock.Unlock()
+		k.deleteWorker(pool, name)
+		return
+	default:
+	}
+	// Never blocks: the pool has at most `size` workers
+	pool.idle <- name
+	pool.lock.Unlock()
+}
+
+// replaceWorker deletes a worker in an unknown state and starts another
+func (k *Kexec) replaceWorker(pool *warmPool, name string) {
+	k.deleteWorker(pool, name)
+	select {
+	case <-pool.stopped:
+	default:
+		go k.startWorker(pool)
+	}
+}
+
+func (k *Kexec) deleteWorker(pool *warmPool, name string) {
+	if err := k.Clientset.Core().Pods(pool.namespace).Delete(name, &api.DeleteOptions{}); err != nil {
+		k.log.Error("Failed to delete warm worker", "pool", pool.id, "pod", name, "error", err)
+	}
+}
+
+// drainPool deletes the idle workers and the secret of a pool. Workers
+// serving an execution or starting are deleted once done.
+func (k *Kexec) drainPool(pool *warmPool) {
+	k.log.Info("Scaling down warm pool", "pool", pool.id)
+	pool.lock.Lock()
+	close(pool.stopped)
+	names := make([]string, 0, len(pool.idle))
+	for len(pool.idle) > 0 {
+		names = append(names, <-pool.idle)
+	}
+	pool.lock.Unlock()
+
+	for _, name := range names {
+		k.deleteWorker(pool, name)
+	}
+	if len(pool.secrets) > 0 {
+		if err := k.deleteJobSecret(pool.id, pool.namespace); err != nil {
+			k.log.Error("Failed to delete warm pool secret", "pool", pool.id, "error", err)
+		}
+	}
+}
+
+// runWarmJanitor scales down the warm pools that were idle for too long,
+// until `stop` is closed.
+func (k *Kexec) runWarmJanitor(stop <-chan struct{}) {
+	ticker := time.NewTicker(WarmPoolCheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		k.warmLock.Lock()
+		for key, pool := range k.warmPools {
+			if pool.idleTimeout > 0 && time.Since(pool.lastUsed) > pool.idleTimeout {
+				delete(k.warmPools, key)
+				go k.drainPool(pool)
+			}
+		}
+		k.warmLock.Unlock()
+	}
+}
+
+// DeleteStrayWarmPods deletes the warm worker pods of all namespaces that
+// this instance does not own, e.g. those left behind by a server that
+// crashed: they would run until deleted. It returns how many were deleted.
+func (k *Kexec) DeleteStrayWarmPods(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	selector, err := labels.Parse(PodLabelWarm)
+	if err != nil {
+		return 0, err
+	}
+	pods, err := k.Clientset.Core().Pods(api.NamespaceAll).List(api.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, pod := range pods.Items {
+		if pod.Labels[PodLabelWarmOwner] == k.id {
+			continue
+		}
+		k.logger(ctx).Info("Deleting stray warm worker", "pod", pod.Name, "namespace", pod.Namespace)
+		if err := k.Clientset.Core().Pods(pod.Namespace).Delete(pod.Name, &api.DeleteOptions{}); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// DrainWarmPools scales down all warm pools. Pools are owned by the
+// server that started them, which should drain them before exiting.
+func (k *Kexec) DrainWarmPools() {
+	k.warmLock.Lock()
+	pools := make([]*warmPool, 0, len(k.warmPools))
+	for key, pool := range k.warmPools {
+		pools = append(pools, pool)
+		delete(k.warmPools, key)
+	}
+	k.warmLock.Unlock()
+	for _, pool := range pools {
+		k.drainPool(pool)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Package logging writes leveled, structured log records, one per line, as
+logfmt or JSON:
+
+	time=2016-11-02T10:04:05.123Z level=info msg="Function called" user=alice function=hello
+
+A record is a message followed by key/value pairs. The pairs of a logger
+created with With, e.g. the id of the request being served, are added to
+each of its records:
+
+	logger := logging.Default.With("request_id", id)
+	logger.Info("Function called", "user", userName, "function", functionName)
+
+Loggers are passed down to the code serving a request through its
+context, see NewContext and FromContext.
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/context"
+)
+
+// Level is the severity of a record. Records below the level of a logger
+// are dropped.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses the name of a level. An empty name is LevelInfo.
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, errors.New(fmt.Sprintf("Unknown log level %q", name))
+}
+
+// Formats of the records
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// output serializes the writes of the loggers sharing a writer
+type output struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// Logger writes records to a writer. It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	format string
+	level  Level
+	fields []interface{}
+}
+
+// New creates a logger writing records of at least `level` to `w`, in
+// `format`. An empty format is FormatLogfmt.
+func New(w io.Writer, format string, level Level) (*Logger, error) {
+	switch format {
+	case "":
+		format = FormatLogfmt
+	case FormatLogfmt, FormatJSON:
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown log format %q", format))
+	}
+	return &Logger{out: &output{w: w}, format: format, level: level}, nil
+}
+
+// Default is the logger used when none is given, writing logfmt records
+// of LevelInfo and above to stderr
+var Default, _ = New(os.Stderr, FormatLogfmt, LevelInfo)
+
+// With returns a logger adding the key/value pairs to each record
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, format: l.format, level: l.level, fields: fields}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// Writer returns a writer logging each line written to it at `level`,
+// e.g. for the standard library loggers
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l, level}
+}
+
+type lineWriter struct {
+	l     *Logger
+	level Level
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		w.l.log(w.level, line, nil)
+	}
+	return len(b), nil
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(keyvals))
+	pairs = append(pairs, "time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00"), "level", level.String(), "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, keyvals...)
+	if len(pairs)%2 != 0 {
+		pairs = append(pairs, "(MISSING)")
+	}
+
+	var buf bytes.Buffer
+	if l.format == FormatJSON {
+		writeJSON(&buf, pairs)
+	} else {
+		writeLogfmt(&buf, pairs)
+	}
+	buf.WriteByte('\n')
+
+	l.out.lock.Lock()
+	l.out.w.Write(buf.Bytes())
+	l.out.lock.Unlock()
+}
+
+// value converts a value to what is written: errors and Stringers as
+// their text
+func value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func writeLogfmt(buf *bytes.Buffer, pairs []interface{}) {
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(logfmtKey(fmt.Sprint(pairs[i])))
+		buf.WriteByte('=')
+		v := value(pairs[i+1])
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		buf.WriteString(logfmtValue(s))
+	}
+}
+
+// logfmtKey drops the characters a key cannot contain
+func logfmtKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, key)
+}
+
+// logfmtValue quotes a value if it is empty, or contains spaces, quotes,
+// equal signs or control characters
+func logfmtValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+func writeJSON(buf *bytes.Buffer, pairs []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(pairs[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		v := value(pairs[i+1])
+		b, err := json.Marshal(v)
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+}
+
+type contextKey int
+
+const loggerKey contextKey = 0
+
+// NewContext returns a context carrying a logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger of a context, or `fallback` if it has
+// none, or Default if `fallback` is nil
+func FromContext(ctx context.Context, fallback *Logger) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return Default
+}
@@ -0,0 +1,83 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatLogfmt, LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.With("request_id", "abc").Info("Function called", "function", "hello world", "latency", 1500*time.Millisecond, "err", errors.New(`bad "x"`))
+
+	line := buf.String()
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, "\n") {
+		t.Error("Unexpected record", line)
+	}
+	expected := ` level=info msg="Function called" request_id=abc function="hello world" latency=1.5s err="bad \"x\""` + "\n"
+	if !strings.HasSuffix(line, expected) {
+		t.Errorf("Expected record ending with %q, got %q", expected, line)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, FormatJSON, LevelDebug)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("Deleted", "count", 3, "odd")
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "debug" || record["msg"] != "Deleted" || record["count"] != float64(3) || record["odd"] != "(MISSING)" {
+		t.Error("Unexpected record", buf.String())
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	level, err := ParseLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := New(&buf, "", level)
+	l.Info("dropped")
+	l.Error("kept")
+	if n := strings.Count(buf.String(), "\n"); n != 1 || !strings.Contains(buf.String(), "msg=kept") {
+		t.Error("Expected only the error record, got", buf.String())
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("Expected an unknown level error")
+	}
+	if _, err := New(&buf, "xml", LevelInfo); err == nil {
+		t.Error("Expected an unknown format error")
+	}
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := New(&buf, FormatLogfmt, LevelInfo)
+	if FromContext(context.Background(), nil) != Default {
+		t.Error("Expected the default logger")
+	}
+	if FromContext(context.Background(), l) != l {
+		t.Error("Expected the fallback logger")
+	}
+	ctx := NewContext(context.Background(), l.With("request_id", "abc"))
+	FromContext(ctx, nil).Info("hello")
+	if !strings.Contains(buf.String(), "request_id=abc") {
+		t.Error("Expected the logger of the context, got", buf.String())
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/kexec"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
+)
+
+// How long a log request waits for the record of a completed execution to
+// be stored
+var FinalizeTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ApiExecutionLogHandler returns the log of an execution. With
+// follow=true, the log of a running execution is streamed as it is
+// produced: over a WebSocket if the request is an upgrade, as server-sent
+// events if the client accepts text/event-stream, and as a chunked text
+// response otherwise. Completed executions return their stored log.
+func ApiExecutionLogHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	return executionLog(ctx, a, response, request, vars["username"], vars["function"], vars["uuid"])
+}
+
+// ExecutionLogHandler is ApiExecutionLogHandler for the logged in user
+func ExecutionLogHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	userName := getUserName(a, request)
+	if userName == "" {
+		http.Redirect(response, request, "/", http.StatusFound)
+		return nil
+	}
+	vars := mux.Vars(request)
+	return executionLog(ctx, a, response, request, userName, vars["function"], vars["uuid"])
+}
+
+func executionLog(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request, userName, functionName, uuid string) error {
+	follow := request.FormValue("follow") == "true"
+
+	e := a.executions.get(uuid)
+	if e != nil && (e.User != userName || e.Function != functionName) {
+		e = nil
+	}
+
+	if e != nil && !isClosed(e.done) {
+		if follow {
+			w, finish, err := openLogStream(response, request)
+			if err != nil {
+				return StatusError{http.StatusBadRequest, err, MessageInternalServerError, true}
+			}
+			defer finish()
+			if err := a.k.FollowFunctionLog(ctx, e.JobName, e.Namespace, w, e.done); err != nil {
+				// The response has started, it cannot become an error
+				a.logger(ctx).Warn("Failed to follow execution log", "execution", uuid, "error", err)
+			}
+			return nil
+		}
+
+		// Return the log produced so far
+		attempts, err := a.k.GetFunctionAttempts(ctx, e.JobName, e.Namespace, a.conf.FunctionCfg.MaxLogSize)
+		if err == nil {
+			_, funcLog := kexec.AggregateAttempts(attempts)
+			return writeLog(ctx, a, response, request, funcLog)
+		}
+		a.logger(ctx).Warn("Failed to get log of running execution", "execution", uuid, "error", err)
+	}
+
+	// The execution completed. Its record may not be stored yet.
+	if e != nil {
+		select {
+		case <-e.finalized:
+		case <-time.After(FinalizeTimeout):
+		}
+	}
+	stored, err := a.dal.GetExecution(ctx, userName, functionName, uuid)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageExecutionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	return writeLog(ctx, a, response, request, stored.Log)
+}
+
+// writeLog writes a complete log in the format the client asked for
+func writeLog(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request, funcLog string) error {
+	w, finish, err := openLogStream(response, request)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageInternalServerError, true}
+	}
+	defer finish()
+	_, err = io.WriteString(w, funcLog)
+	if err != nil {
+		a.logger(ctx).Warn("Failed to write log", "error", err)
+	}
+	return nil
+}
+
+// openLogStream starts a log response. It returns the writer the log is
+// written to, and a function ending the response.
+func openLogStream(response http.ResponseWriter, request *http.Request) (io.Writer, func(), error) {
+	if websocket.IsWebSocketUpgrade(request) {
+		conn, err := upgrader.Upgrade(response, request, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		finish := func() {
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			conn.Close()
+		}
+		return &wsWriter{conn}, finish, nil
+	}
+
+	flusher, ok := response.(http.Flusher)
+	if !ok {
+		return nil, nil, errors.New("Streaming is not supported.")
+	}
+	response.Header().Set("Cache-Control", "no-cache")
+	if strings.Contains(request.Header.Get("Accept"), "text/event-stream") {
+		response.Header().Set("Content-Type", "text/event-stream")
+		response.WriteHeader(http.StatusOK)
+		w := &sseWriter{response, flusher}
+		finish := func() {
+			// Tells the browser not to reconnect
+			fmt.Fprint(response, "event: end\ndata:\n\n")
+			flusher.Flush()
+		}
+		return w, finish, nil
+	}
+	response.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	response.WriteHeader(http.StatusOK)
+	return &flushWriter{response, flusher}, func() {}, nil
+}
+
+// flushWriter sends every write to the client right away
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.f.Flush()
+	return n, err
+}
+
+// sseWriter sends every write to the client as a server-sent event, one
+// data line per log line.
+type sseWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (sw *sseWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		if _, err := fmt.Fprintf(sw.w, "data: %s\n", line); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := fmt.Fprint(sw.w, "\n"); err != nil {
+		return 0, err
+	}
+	sw.f.Flush()
+	return len(p), nil
+}
+
+// wsWriter sends every write as a WebSocket text message
+type wsWriter struct {
+	conn *websocket.Conn
+}
+
+func (ww *wsWriter) Write(p []byte) (int, error) {
+	if err := ww.conn.WriteMessage(websocket.TextMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
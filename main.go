@@ -2,35 +2,59 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/Symantec/Go-kexec/dal"
 	"github.com/Symantec/Go-kexec/docker"
 	"github.com/Symantec/Go-kexec/kexec"
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/tracing"
 	"github.com/gorilla/securecookie"
+	"golang.org/x/net/context"
 )
 
 var (
-	argConfigFile      = flag.String("config", "", "Config file")
-	LoginTemplate      *template.Template
-	DashboardTemplate  *template.Template
-	ConfFuncTemplate   *template.Template
-	FuncCalledTemplate *template.Template
-	ErrorTemplate      *template.Template
-	DeleteFuncTemplate *template.Template
-	ViewLogsTemplate   *template.Template
+	argConfigFile        = flag.String("config", "", "Config file")
+	argCheck             = flag.Bool("check-consistency", false, "Report drift between DB, registry and cluster, then exit")
+	argRepair            = flag.Bool("repair", false, "With -check-consistency, repair the drift found")
+	LoginTemplate        *template.Template
+	DashboardTemplate    *template.Template
+	ConfFuncTemplate     *template.Template
+	FuncCalledTemplate   *template.Template
+	ErrorTemplate        *template.Template
+	DeleteFuncTemplate   *template.Template
+	ViewLogsTemplate     *template.Template
+	ViewWorkflowTemplate *template.Template
 )
 
 const (
-	SERVERLESS_NAMESPACE string = "serverless"
-	DAL_USERS_TABLE      string = "users"
-	DAL_FUNCTIONS_TABLE  string = "functions"
-	DAL_EXECUTIONS_TABLE string = "executions"
+	SERVERLESS_NAMESPACE    string = "serverless"
+	DAL_USERS_TABLE         string = "users"
+	DAL_FUNCTIONS_TABLE     string = "functions"
+	DAL_EXECUTIONS_TABLE    string = "executions"
+	DAL_ENV_TABLE           string = "function_env"
+	DAL_ATTEMPTS_TABLE      string = "execution_attempts"
+	DAL_SCHEDULES_TABLE     string = "schedules"
+	DAL_LEASES_TABLE        string = "leases"
+	DAL_WEBHOOKS_TABLE      string = "webhooks"
+	DAL_DELIVERIES_TABLE    string = "webhook_deliveries"
+	DAL_SUBSCRIPTIONS_TABLE string = "subscriptions"
+	DAL_WORKFLOWS_TABLE     string = "workflows"
+	DAL_RUNS_TABLE          string = "workflow_runs"
+	DAL_STEPS_TABLE         string = "workflow_steps"
+	DAL_CALLBACKS_TABLE     string = "callback_attempts"
+	DAL_AUDIT_TABLE         string = "audit_log"
 )
 
 func main() {
@@ -53,8 +77,30 @@ func main() {
 	}
 	defer logfile.Close()
 
-	log.SetOutput(logfile)
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+	level, err := logging.ParseLevel(conf.LogLevel)
+	if err != nil {
+		log.Fatalf("Cannot set up logging: %v\n", err)
+	}
+	logger, err := logging.New(logfile, conf.LogFormat, level)
+	if err != nil {
+		log.Fatalf("Cannot set up logging: %v\n", err)
+	}
+	logging.Default = logger
+	// Records of the libraries logging through the standard logger
+	log.SetOutput(logger.Writer(logging.LevelInfo))
+	log.SetFlags(0)
+
+	// The probes are served while connecting to the dependencies, which
+	// are retried until they are reachable
+	health := newHealthChecker(logger, DependencyDatabase, DependencyDocker, DependencyKubernetes, DependencyRegistry)
+	served := make(chan error, 1)
+	if !*argCheck {
+		http.HandleFunc("/healthz", health.serveHealthz)
+		http.HandleFunc("/readyz", health.serveReadyz)
+		go func() {
+			served <- http.ListenAndServe(":8080", nil)
+		}()
+	}
 
 	// cookie handling
 	cookieHandler := securecookie.New(
@@ -64,38 +110,88 @@ func main() {
 
 	// docker handler for creating function and pushing function image
 	// to docker registry
-	d, err := docker.NewClient(conf.DockerCfg.DockerHost)
+	d, err := docker.NewClient(conf.DockerCfg.DockerHost, logger)
 	if err != nil {
 		panic(err)
 	}
+	health.connect(DependencyDocker, func() error {
+		return d.Ping(context.Background())
+	}, d.Ping)
+
+	// registry handler for deleting function images from the docker
+	// registry
+	r := docker.NewRegistry(&docker.RegistryConfig{
+		Address:  conf.DockerCfg.DockerRegistry,
+		Username: conf.DockerCfg.RegistryUsername,
+		Password: conf.DockerCfg.RegistryPassword,
+		Insecure: conf.DockerCfg.RegistryInsecure,
+		Logger:   logger,
+	})
+	health.connect(DependencyRegistry, func() error {
+		return r.Ping(context.Background())
+	}, r.Ping)
 
 	// kubernetes handler for calling function and pulling function
 	// execution logs
 	k, err := kexec.NewKexec(&kexec.KexecConfig{
 		KubeConfig: conf.KubeConfig,
+		Logger:     logger,
 	})
 
 	if err != nil {
 		panic(err)
 	}
+	health.connect(DependencyKubernetes, func() error {
+		return k.Ping(context.Background())
+	}, k.Ping)
 
 	// data access layer. Default MySQL
 	//
 	// TODO: dal should be pluggable
-	dal, err := dal.NewMySQL(&dal.DalConfig{
-		DBHost:   conf.DalCfg.DBHost,
-		Username: conf.DalCfg.Username,
-		Password: conf.DalCfg.Password,
+	var db *dal.MySQL
+	health.connect(DependencyDatabase, func() error {
+		var err error
+		db, err = dal.NewMySQL(&dal.DalConfig{
+			DBHost:   conf.DalCfg.DBHost,
+			Username: conf.DalCfg.Username,
+			Password: conf.DalCfg.Password,
+
+			DBName: conf.DalCfg.DBName,
 
-		DBName: conf.DalCfg.DBName,
+			UsersTable:         DAL_USERS_TABLE,
+			FunctionsTable:     DAL_FUNCTIONS_TABLE,
+			ExecutionsTable:    DAL_EXECUTIONS_TABLE,
+			EnvTable:           DAL_ENV_TABLE,
+			AttemptsTable:      DAL_ATTEMPTS_TABLE,
+			SchedulesTable:     DAL_SCHEDULES_TABLE,
+			LeasesTable:        DAL_LEASES_TABLE,
+			WebhooksTable:      DAL_WEBHOOKS_TABLE,
+			DeliveriesTable:    DAL_DELIVERIES_TABLE,
+			SubscriptionsTable: DAL_SUBSCRIPTIONS_TABLE,
+			WorkflowsTable:     DAL_WORKFLOWS_TABLE,
+			WorkflowRunsTable:  DAL_RUNS_TABLE,
+			WorkflowStepsTable: DAL_STEPS_TABLE,
+			CallbacksTable:     DAL_CALLBACKS_TABLE,
+			AuditTable:         DAL_AUDIT_TABLE,
 
-		UsersTable:      DAL_USERS_TABLE,
-		FunctionsTable:  DAL_FUNCTIONS_TABLE,
-		ExecutionsTable: DAL_EXECUTIONS_TABLE,
+			SecretKey: conf.DalCfg.SecretKey,
+			Logger:    logger,
+		})
+		return err
+	}, func(ctx context.Context) error {
+		return db.Ping(ctx)
 	})
 
-	if err != nil {
-		panic(err)
+	if *argCheck {
+		context := &appContext{d: d, r: r, k: k, dal: db, conf: &conf, executions: newExecutionTracker(), log: logger}
+		unrepaired, err := runConsistencyCheck(context, *argRepair, os.Stdout)
+		if err != nil {
+			log.Fatalf("Consistency check failed: %v\n", err)
+		}
+		if unrepaired > 0 {
+			os.Exit(1)
+		}
+		return
 	}
 
 	// initialize templates
@@ -106,12 +202,81 @@ func main() {
 	ErrorTemplate = template.Must(template.ParseFiles(filepath.Join(conf.FileServerDir, "html/error.html")))
 	DeleteFuncTemplate = template.Must(template.ParseFiles(filepath.Join(conf.FileServerDir, "html/func_deleted.html")))
 	ViewLogsTemplate = template.Must(template.ParseFiles(filepath.Join(conf.FileServerDir, "html/view_logs.html")))
+	ViewWorkflowTemplate = template.Must(template.ParseFiles(filepath.Join(conf.FileServerDir, "html/view_workflow.html")))
 
-	context := &appContext{d: d, k: k, dal: dal, cookieHandler: cookieHandler, conf: &conf}
+	// traces of the requests and executions
+	tracer, err := newTracer(&conf.TracingCfg, logger)
+	if err != nil {
+		panic(err)
+	}
+	tracing.Default = tracer
+
+	// event sources for the functions subscribed to topics
+	em, err := newEventManager(&conf.EventsCfg, logger)
+	if err != nil {
+		panic(err)
+	}
+
+	// Warm workers of a previous server that did not stop cleanly would
+	// keep running otherwise
+	if n, err := k.DeleteStrayWarmPods(context.Background()); err != nil {
+		logger.Error("Failed to delete stray warm workers", "error", err)
+	} else if n > 0 {
+		logger.Info("Deleted stray warm workers", "count", n)
+	}
+
+	context := &appContext{d: d, r: r, k: k, dal: db, cookieHandler: cookieHandler, conf: &conf,
+		executions: newExecutionTracker(), events: em, workflows: newWorkflowEngine(), log: logger}
+
+	if conf.DockerCfg.RegistryGCInterval > 0 {
+		go runRegistryGC(context, time.Duration(conf.DockerCfg.RegistryGCInterval)*time.Minute)
+	}
+	go runScheduler(context)
+	go em.run(context)
+	go context.workflows.run(context)
+
+	// Warm workers are owned by this server, scale them down on exit. The
+	// messages being handled are delivered again to another server.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		logger.Info("Stopping, closing event subscriptions and scaling down warm pools")
+		em.close()
+		k.Stop()
+		tracer.Close()
+		os.Exit(0)
+	}()
 
 	router := NewRouter(context)
 
 	http.Handle("/", router)
 
-	panic(http.ListenAndServe(":8080", nil))
+	panic(<-served)
+}
+
+// newTracer creates the tracer exporting the spans as configured
+func newTracer(c *tracingConfig, logger *logging.Logger) (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+	switch c.Exporter {
+	case "":
+	case "otlp":
+		if c.Endpoint == "" {
+			return nil, errors.New("Tracing endpoint is not set.")
+		}
+		exporter = tracing.NewOTLPExporter(c.Endpoint, c.Headers)
+	case "file":
+		e, err := tracing.NewFileExporter(c.File)
+		if err != nil {
+			return nil, err
+		}
+		exporter = e
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown tracing exporter %q.", c.Exporter))
+	}
+	return tracing.NewTracer(&tracing.Config{
+		ServiceName: c.ServiceName,
+		Exporter:    exporter,
+		Logger:      logger,
+	}), nil
 }
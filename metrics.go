@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Symantec/Go-kexec/metrics"
+)
+
+var (
+	httpRequests = metrics.NewCounter("kexec_http_requests_total",
+		"HTTP requests, by route name, method and status code.", "route", "method", "code")
+	httpDuration = metrics.NewHistogram("kexec_http_request_duration_seconds",
+		"Duration of the HTTP requests, by route name and method.", metrics.DefaultBuckets, "route", "method")
+
+	invocations = metrics.NewCounter("kexec_function_invocations_total",
+		"Function executions, by user, function and result.", "user", "function", "result")
+	invocationDuration = metrics.NewHistogram("kexec_function_invocation_duration_seconds",
+		"Duration of the function executions, by user and function.", metrics.LongBuckets, "user", "function")
+	executionsInFlight = metrics.NewGauge("kexec_executions_in_flight",
+		"Function executions running on this server.")
+)
+
+// observeInvocation records an execution. The result of an execution
+// that failed to run is ResError.
+func observeInvocation(userName, functionName string, res *CallResult, err error, d time.Duration) {
+	result := ResError
+	if err == nil {
+		result = res.Result
+	}
+	invocations.Inc(userName, functionName, result)
+	invocationDuration.ObserveDuration(d, userName, functionName)
+}
+
+// statusRecorder keeps the status code written to a response. It passes
+// through the optional interfaces the handlers use.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// status returns the status code of the response. Hijacked connections,
+// i.e. websockets, report 101 Switching Protocols.
+func (r *statusRecorder) status() int {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+	return r.code
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify returns a channel that never fires if the response does not
+// support it
+func (r *statusRecorder) CloseNotify() <-chan bool {
+	if n, ok := r.ResponseWriter.(http.CloseNotifier); ok {
+		return n.CloseNotify()
+	}
+	return nil
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Response does not support hijacking")
+	}
+	if r.code == 0 {
+		r.code = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,363 @@
+/*
+Package metrics keeps the metrics of the server and exposes them in the
+Prometheus text format.
+
+Metrics are declared once, usually as package variables, and registered
+with the default registry:
+
+	var builds = metrics.NewCounter("kexec_image_builds_total",
+		"Function image builds, by result.", "result")
+
+	builds.Inc("success")
+
+Label values are given in the order of the label names the metric was
+declared with.
+*/
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets, in
+// seconds, fitting the latency of requests and queries
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// LongBuckets fit durations of minutes, e.g. function executions and
+// image builds
+var LongBuckets = []float64{.1, .5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// ContentType is the content type of the text format
+var ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric is a family of series, one per combination of label values
+type metric interface {
+	name() string
+	write(w io.Writer) error
+}
+
+// Registry is a set of metrics, written in the order of their names
+type Registry struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]metric)}
+}
+
+// Default is the registry the New* functions register metrics with
+var Default = NewRegistry()
+
+// register adds a metric. Declaring a metric twice is a programming
+// error, so it panics.
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.metrics[m.name()]; ok {
+		panic("metrics: duplicate metric " + m.name())
+	}
+	r.metrics[m.name()] = m
+}
+
+// Write writes the metrics in the text format
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, r.metrics[name])
+	}
+	r.lock.Unlock()
+
+	buf := bufio.NewWriter(w)
+	for _, m := range metrics {
+		if err := m.write(buf); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (r *Registry) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("Content-Type", ContentType)
+	r.Write(response)
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return Default
+}
+
+// family holds the series of a metric, keyed by their label values
+type family struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64
+
+	// Histograms only. counts[i] is the number of observations in bucket
+	// i, not cumulated.
+	counts []uint64
+	count  uint64
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]*series),
+	}
+}
+
+func (f *family) name() string {
+	return f.metricName
+}
+
+// get returns the series of label values, created on first use. It must
+// be called with the lock held.
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// sorted returns the series in the order of their label values. It must
+// be called with the lock held.
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	res := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, f.series[key])
+	}
+	return res
+}
+
+func (f *family) writeHeader(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, escapeHelp(f.help), f.metricName, f.kind)
+	return err
+}
+
+// labelPairs formats the labels of a series, with the extra label if
+// given, e.g. the le label of a histogram bucket
+func (f *family) labelPairs(values []string, extraName, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, f.labels[i]+`="`+escapeLabel(v)+`"`)
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+escapeLabel(extraValue)+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a value that only goes up, e.g. a number of requests
+type Counter struct {
+	*family
+}
+
+// NewCounter declares a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+// Inc adds 1 to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v, which must not be negative, to the series of the label
+// values
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("metrics: counter " + c.metricName + " decreased")
+	}
+	c.lock.Lock()
+	c.get(values).value += v
+	c.lock.Unlock()
+}
+
+func (c *Counter) write(w io.Writer) error {
+	return writeValues(c.family, w)
+}
+
+// Gauge is a value that goes up and down, e.g. a number of executions
+// in flight
+type Gauge struct {
+	*family
+}
+
+// NewGauge declares a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+// Set sets the series of the label values to v
+func (g *Gauge) Set(v float64, values ...string) {
+	g.lock.Lock()
+	g.get(values).value = v
+	g.lock.Unlock()
+}
+
+// Add adds v to the series of the label values
+func (g *Gauge) Add(v float64, values ...string) {
+	g.lock.Lock()
+	g.get(values).value += v
+	g.lock.Unlock()
+}
+
+func (g *Gauge) Inc(values ...string) {
+	g.Add(1, values...)
+}
+
+func (g *Gauge) Dec(values ...string) {
+	g.Add(-1, values...)
+}
+
+func (g *Gauge) write(w io.Writer) error {
+	return writeValues(g.family, w)
+}
+
+func writeValues(f *family, w io.Writer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if err := f.writeHeader(w); err != nil {
+		return err
+	}
+	for _, s := range f.sorted() {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", f.metricName, f.labelPairs(s.values, "", ""), formatFloat(s.value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Histogram counts observations, e.g. durations, in buckets
+type Histogram struct {
+	*family
+	buckets []float64
+}
+
+// NewHistogram declares a histogram with the given upper bounds of its
+// buckets, in increasing order, and label names. The +Inf bucket is
+// implicit.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: buckets of " + name + " are not sorted")
+	}
+	h := &Histogram{newFamily(name, help, "histogram", labels), buckets}
+	Default.register(h)
+	return h
+}
+
+// Observe adds an observation to the series of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s := h.get(values)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.value += v
+}
+
+// ObserveDuration observes a duration in seconds
+func (h *Histogram) ObserveDuration(d time.Duration, values ...string) {
+	h.Observe(d.Seconds(), values...)
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err := h.writeHeader(w); err != nil {
+		return err
+	}
+	for _, s := range h.sorted() {
+		var cumulated uint64
+		for i, bound := range h.buckets {
+			cumulated += s.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelPairs(s.values, "le", formatFloat(bound)), cumulated); err != nil {
+				return err
+			}
+		}
+		labels := h.labelPairs(s.values, "", "")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.metricName, h.labelPairs(s.values, "le", "+Inf"), s.count,
+			h.metricName, labels, formatFloat(s.value),
+			h.metricName, labels, s.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
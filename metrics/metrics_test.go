@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func output(t *testing.T) string {
+	var buf bytes.Buffer
+	if err := Default.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func expectLines(t *testing.T, out string, lines ...string) {
+	for _, line := range lines {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Expected line %q in:\n%s", line, out)
+		}
+	}
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "route", "code")
+	c.Inc("Index", "200")
+	c.Inc("Index", "200")
+	c.Add(3, "Call", "500")
+
+	expectLines(t, output(t),
+		"# HELP test_requests_total Requests.",
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="Call",code="500"} 3`,
+		`test_requests_total{route="Index",code="200"} 2`,
+	)
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_in_flight", "In flight.")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	expectLines(t, output(t), "# TYPE test_in_flight gauge", "test_in_flight 1")
+
+	g.Set(0.5)
+	expectLines(t, output(t), "test_in_flight 0.5")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 2}, "op")
+	h.Observe(0.5, "query")
+	h.Observe(1, "query")
+	h.Observe(1.5, "query")
+	h.Observe(4, "query")
+
+	expectLines(t, output(t),
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{op="query",le="1"} 2`,
+		`test_duration_seconds_bucket{op="query",le="2"} 3`,
+		`test_duration_seconds_bucket{op="query",le="+Inf"} 4`,
+		`test_duration_seconds_sum{op="query"} 7`,
+		`test_duration_seconds_count{op="query"} 4`,
+	)
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounter("test_escaped_total", "Line\nbreak.", "name")
+	c.Inc(`a"b\c`)
+	expectLines(t, output(t),
+		`# HELP test_escaped_total Line\nbreak.`,
+		`test_escaped_total{name="a\"b\\c"} 1`,
+	)
+}
+
+func TestDuplicate(t *testing.T) {
+	NewGauge("test_duplicate", "Duplicate.")
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic on a duplicate metric")
+		}
+	}()
+	NewGauge("test_duplicate", "Duplicate.")
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_served_total", "Served.").Inc()
+	request, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := httptest.NewRecorder()
+	Handler().ServeHTTP(response, request)
+	if ct := response.Header().Get("Content-Type"); ct != ContentType {
+		t.Error("Expected content type", ContentType, "got", ct)
+	}
+	expectLines(t, response.Body.String(), "test_served_total 1")
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/kexec"
+	"golang.org/x/net/context"
+)
+
+// Namespace modes
+const (
+	// All functions run in SERVERLESS_NAMESPACE
+	NamespaceModeShared = "shared"
+	// Each user's functions run in their own namespace
+	NamespaceModeUser = "user"
+	// Functions run in the namespace of their owner's group. Users without
+	// a group get their own namespace.
+	NamespaceModeGroup = "group"
+)
+
+var (
+	invalidNamespaceChars = regexp.MustCompile(`[^a-z0-9-]+`)
+	invalidLabelChars     = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+)
+
+// groupOfUser returns the group a user belongs to according to the
+// configuration, or an empty string.
+func groupOfUser(a *appContext, userName string) string {
+	for group, members := range a.conf.NamespaceCfg.Groups {
+		for _, m := range members {
+			if m == userName {
+				return group
+			}
+		}
+	}
+	return ""
+}
+
+// namespaceOfUser returns the namespace the functions of a user run in.
+func namespaceOfUser(a *appContext, user *dal.User) string {
+	c := &a.conf.NamespaceCfg
+	switch c.Mode {
+	case NamespaceModeUser:
+		return namespaceName(c.Prefix + "user-" + user.Name)
+	case NamespaceModeGroup:
+		if user.Group != "" {
+			return namespaceName(c.Prefix + "group-" + user.Group)
+		}
+		return namespaceName(c.Prefix + "user-" + user.Name)
+	default:
+		return SERVERLESS_NAMESPACE
+	}
+}
+
+// namespaceName turns a name into a valid namespace name (DNS label).
+// Names differing only in the characters replaced or truncated would map
+// to the same namespace, so a short hash of the name is appended.
+func namespaceName(name string) string {
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(name)))[:8]
+	name = invalidNamespaceChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 63-len(hash)-1 {
+		name = name[:63-len(hash)-1]
+	}
+	return strings.Trim(name, "-") + "-" + hash
+}
+
+// labelValue turns a name into a valid label value: at most 63
+// alphanumerics, '-', '_' or '.', starting and ending with an
+// alphanumeric.
+func labelValue(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "-")
+	if len(name) > 63 {
+		name = name[:63]
+	}
+	return strings.Trim(name, "-_.")
+}
+
+// functionNamespace returns the namespace the functions of a user run in,
+// creating it with its quota, limits and network policy if needed.
+func functionNamespace(ctx context.Context, a *appContext, userName string) (string, error) {
+	c := &a.conf.NamespaceCfg
+	if c.Mode == "" || c.Mode == NamespaceModeShared {
+		return SERVERLESS_NAMESPACE, nil
+	}
+
+	user, err := a.dal.GetUser(ctx, userName)
+	if err != nil {
+		return "", err
+	}
+	namespace := namespaceOfUser(a, user)
+
+	labels := map[string]string{kexec.JobLabelUser: labelValue(user.Name)}
+	if c.Mode == NamespaceModeGroup && user.Group != "" {
+		labels = map[string]string{"serverless-group": labelValue(user.Group)}
+	}
+	err = a.k.EnsureNamespace(ctx, namespace, &kexec.NamespaceOptions{
+		Labels:          labels,
+		Quota:           c.Quota,
+		DefaultLimits:   c.DefaultLimits,
+		DefaultRequests: c.DefaultRequests,
+		MaxLimits:       c.MaxLimits,
+		Isolate:         c.NetworkIsolation,
+	})
+	return namespace, err
+}
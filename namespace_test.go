@@ -0,0 +1,50 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var validNamespace = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+func TestNamespaceName(t *testing.T) {
+	long := "user-" + strings.Repeat("a", 70)
+	names := []string{"user-alice", "user-Alice", "user-a.b", "user-a_b", "user-a-b", "group-", long, long + "b"}
+	seen := make(map[string]string)
+	for _, name := range names {
+		ns := namespaceName(name)
+		if !validNamespace.MatchString(ns) {
+			t.Errorf("%q: invalid namespace %q", name, ns)
+		}
+		if other, ok := seen[ns]; ok {
+			t.Errorf("%q and %q: same namespace %q", name, other, ns)
+		}
+		seen[ns] = name
+	}
+	if ns := namespaceName("user-alice"); !strings.HasPrefix(ns, "user-alice-") || ns != namespaceName("user-alice") {
+		t.Error("Unexpected namespace", ns)
+	}
+}
+
+var validLabelValue = regexp.MustCompile(`^([A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?)?$`)
+
+func TestLabelValue(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		expected string
+	}{
+		{"alice", "alice"},
+		{"Alice.Smith_2", "Alice.Smith_2"},
+		{"alice@example.com", "alice-example.com"},
+		{"DOMAIN\\alice", "DOMAIN-alice"},
+		{"_alice.", "alice"},
+		{"!!", ""},
+		{strings.Repeat("a", 62) + "-b", strings.Repeat("a", 62)},
+	} {
+		v := labelValue(c.name)
+		if v != c.expected || !validLabelValue.MatchString(v) {
+			t.Errorf("%q: expected label value %q, got %q", c.name, c.expected, v)
+		}
+	}
+}
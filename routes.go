@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"net/http"
+	"regexp"
+	"strconv"
 	"time"
 
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/metrics"
+	"github.com/Symantec/Go-kexec/tracing"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/context"
 )
 
 type Route struct {
@@ -20,19 +26,55 @@ type Routes []Route
 
 func (ah appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	log.Printf(
-		"%s\t%s\t%s\n",
-		r.Method,
-		r.RequestURI,
-		time.Since(start),
-	)
-	err := ah.H(ah.appContext, w, r)
+	id := requestID(r)
+	w.Header().Set(RequestIDHeader, id)
+	logger := ah.log.With("request_id", id)
+	recorder := &statusRecorder{ResponseWriter: w}
+	w = recorder
+
+	// Written once the request is served, with its status and duration
+	defer func() {
+		code := recorder.status()
+		duration := time.Since(start)
+		logger.Info("Request served", "method", r.Method, "uri", r.RequestURI, "route", ah.route,
+			"status", code, "duration", duration, "remote", r.RemoteAddr)
+		httpRequests.Inc(ah.route, r.Method, strconv.Itoa(code))
+		httpDuration.ObserveDuration(duration, ah.route, r.Method)
+	}()
+
+	ctx, cancel := requestContext(w, r, id, logger)
+	defer cancel()
+
+	// Continues the trace of the client, if it sent a traceparent
+	remote, _ := tracing.ParseTraceparent(r.Header.Get(TraceParentHeader))
+	ctx, span := tracing.StartServer(ctx, r.Method+" "+ah.route, remote,
+		"http.method", r.Method, "http.target", r.RequestURI, "request_id", id)
+	defer func() {
+		span.SetAttributes("http.status_code", recorder.status())
+		span.End()
+	}()
+
+	// Audited actions are recorded once served, after the error response
+	ctx, audit := startAudit(ctx, ah.appContext, r, ah.route)
+	var err error
+	if audit != nil {
+		defer func() {
+			audit.record(ctx, recorder.status(), err)
+		}()
+	}
+
+	err = ah.H(ctx, ah.appContext, w, r)
 	if err != nil {
+		span.SetError(err)
 		switch e := err.(type) {
 		case Error:
 			// We can retrieve the status here and write out a specific
 			// HTTP status code.
-			log.Printf("HTTP %d - %s", e.Status(), e)
+			if e.Status() >= http.StatusInternalServerError {
+				logger.Error(e.Message(), "status", e.Status(), "error", e)
+			} else {
+				logger.Warn(e.Message(), "status", e.Status(), "error", e)
+			}
 			errMsg := fmt.Sprintf("%s: %s", e.Message(), e)
 			if e.SendErrorResponse() {
 				http.Error(w, errMsg, e.Status())
@@ -42,12 +84,92 @@ func (ah appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		default:
 			// Any error types we don't specifically look out for default
 			// to serving a HTTP 500
+			logger.Error("Request failed", "error", err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError),
 				http.StatusInternalServerError)
 		}
 	}
 }
 
+// requestContext returns the context of a request, carrying its id and
+// logger, and cancelled when the client closes the connection. Calls in
+// flight for the request, such as a function execution or an image
+// build, are then aborted.
+func requestContext(w http.ResponseWriter, r *http.Request, id string, logger *logging.Logger) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(withRequestID(context.Background(), id, logger))
+	notifier, ok := w.(http.CloseNotifier)
+	if !ok || websocket.IsWebSocketUpgrade(r) {
+		// Hijacked connections are not watched by net/http
+		return ctx, cancel
+	}
+	closed := notifier.CloseNotify()
+	go func() {
+		select {
+		case <-closed:
+			logger.Info("Client closed the connection", "method", r.Method, "uri", r.RequestURI)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// TraceParentHeader carries the W3C trace context of a request
+var TraceParentHeader = "traceparent"
+
+// RequestIDHeader carries the id of a request. An id sent by the client,
+// e.g. by a proxy, is kept if it is a valid label value, so that the
+// records of both can be matched.
+var RequestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?$`)
+
+// requestID returns the id of a request, generated unless the client
+// sent a valid one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID.MatchString(id) {
+		return id
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return id
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a context carrying the id and logger of a request
+func withRequestID(ctx context.Context, id string, logger *logging.Logger) context.Context {
+	return logging.NewContext(context.WithValue(ctx, requestIDKey{}, id), logger)
+}
+
+// requestIDFromContext returns the id of the request of ctx, or "" if ctx
+// is not the context of a request
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// detachContext returns a context carrying the request id, logger and
+// span of ctx, for work outliving the request
+func detachContext(ctx context.Context) context.Context {
+	detached := context.Background()
+	if id := requestIDFromContext(ctx); id != "" {
+		detached = withRequestID(detached, id, logging.FromContext(ctx, nil))
+	}
+	if span := tracing.FromContext(ctx); span != nil {
+		detached = tracing.NewContext(detached, span)
+	}
+	return detached
+}
+
+// logger returns the logger of the request of ctx, or of the server if
+// ctx is not the context of a request
+func (a *appContext) logger(ctx context.Context) *logging.Logger {
+	return logging.FromContext(ctx, a.log)
+}
+
 func NewRouter(context *appContext) *mux.Router {
 
 	router := mux.NewRouter()
@@ -56,9 +178,10 @@ func NewRouter(context *appContext) *mux.Router {
 			Methods(route.Method).
 			Path(route.Pattern).
 			Name(route.Name).
-			Handler(appHandler{context, route.Handler})
+			Handler(appHandler{context, route.Name, route.Handler})
 	}
 
+	router.Methods("GET").Path("/metrics").Name("Metrics").Handler(metrics.Handler())
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir(context.conf.FileServerDir)))
 	return router
 }
@@ -118,6 +241,18 @@ var routes = Routes{
 		"/functions/{function}/delete",
 		DeleteFunctionHandler,
 	},
+	Route{
+		"ExecutionLog",
+		"GET",
+		"/functions/{function}/executions/{uuid}/logs",
+		ExecutionLogHandler,
+	},
+	Route{
+		"CancelExecution",
+		"POST",
+		"/functions/{function}/executions/{uuid}/cancel",
+		CancelExecutionHandler,
+	},
 	Route{
 		"Call",
 		"POST",
@@ -136,4 +271,196 @@ var routes = Routes{
 		"/users/{username}/functions/{function}/call",
 		ApiCallFunctionHandler,
 	},
+	Route{
+		"FanOut",
+		"POST",
+		"/users/{username}/functions/{function}/fanout",
+		ApiFanOutHandler,
+	},
+	Route{
+		"Settings",
+		"GET",
+		"/users/{username}/functions/{function}/settings",
+		ApiGetFunctionSettingsHandler,
+	},
+	Route{
+		"Settings",
+		"POST",
+		"/users/{username}/functions/{function}/settings",
+		ApiUpdateFunctionSettingsHandler,
+	},
+	Route{
+		"Env",
+		"GET",
+		"/users/{username}/functions/{function}/env",
+		ApiGetFunctionEnvHandler,
+	},
+	Route{
+		"Env",
+		"POST",
+		"/users/{username}/functions/{function}/env",
+		ApiUpdateFunctionEnvHandler,
+	},
+	Route{
+		"Executions",
+		"GET",
+		"/users/{username}/functions/{function}/executions",
+		ApiListExecutionsHandler,
+	},
+	Route{
+		"ExecutionLog",
+		"GET",
+		"/users/{username}/functions/{function}/executions/{uuid}/logs",
+		ApiExecutionLogHandler,
+	},
+	Route{
+		"CancelExecution",
+		"POST",
+		"/users/{username}/functions/{function}/executions/{uuid}/cancel",
+		ApiCancelExecutionHandler,
+	},
+	Route{
+		"Schedules",
+		"GET",
+		"/users/{username}/functions/{function}/schedules",
+		ApiListSchedulesHandler,
+	},
+	Route{
+		"Schedules",
+		"POST",
+		"/users/{username}/functions/{function}/schedules",
+		ApiCreateScheduleHandler,
+	},
+	Route{
+		"Schedule",
+		"DELETE",
+		"/users/{username}/functions/{function}/schedules/{id}",
+		ApiDeleteScheduleHandler,
+	},
+	Route{
+		"Webhooks",
+		"GET",
+		"/users/{username}/functions/{function}/webhooks",
+		ApiListWebhooksHandler,
+	},
+	Route{
+		"Webhooks",
+		"POST",
+		"/users/{username}/functions/{function}/webhooks",
+		ApiCreateWebhookHandler,
+	},
+	Route{
+		"Webhook",
+		"DELETE",
+		"/users/{username}/functions/{function}/webhooks/{id}",
+		ApiDeleteWebhookHandler,
+	},
+	Route{
+		"Hook",
+		"POST",
+		"/hooks/{token}",
+		WebhookHandler,
+	},
+	Route{
+		"Workflow",
+		"GET",
+		"/workflows/{workflow}",
+		ViewWorkflowHandler,
+	},
+	Route{
+		"RunWorkflow",
+		"POST",
+		"/workflows/{workflow}/run",
+		RunWorkflowHandler,
+	},
+	Route{
+		"Workflows",
+		"GET",
+		"/users/{username}/workflows",
+		ApiListWorkflowsHandler,
+	},
+	Route{
+		"Workflows",
+		"POST",
+		"/users/{username}/workflows",
+		ApiPutWorkflowHandler,
+	},
+	Route{
+		"Workflow",
+		"GET",
+		"/users/{username}/workflows/{workflow}",
+		ApiGetWorkflowHandler,
+	},
+	Route{
+		"Workflow",
+		"DELETE",
+		"/users/{username}/workflows/{workflow}",
+		ApiDeleteWorkflowHandler,
+	},
+	Route{
+		"WorkflowRuns",
+		"GET",
+		"/users/{username}/workflows/{workflow}/runs",
+		ApiListWorkflowRunsHandler,
+	},
+	Route{
+		"WorkflowRuns",
+		"POST",
+		"/users/{username}/workflows/{workflow}/runs",
+		ApiStartWorkflowRunHandler,
+	},
+	Route{
+		"WorkflowRun",
+		"GET",
+		"/users/{username}/workflows/{workflow}/runs/{id}",
+		ApiGetWorkflowRunHandler,
+	},
+	Route{
+		"Subscriptions",
+		"GET",
+		"/users/{username}/functions/{function}/subscriptions",
+		ApiListSubscriptionsHandler,
+	},
+	Route{
+		"Subscriptions",
+		"POST",
+		"/users/{username}/functions/{function}/subscriptions",
+		ApiCreateSubscriptionHandler,
+	},
+	Route{
+		"Subscription",
+		"DELETE",
+		"/users/{username}/functions/{function}/subscriptions/{id}",
+		ApiDeleteSubscriptionHandler,
+	},
+	Route{
+		"Callback",
+		"GET",
+		"/users/{username}/functions/{function}/callback",
+		ApiGetCallbackHandler,
+	},
+	Route{
+		"Callback",
+		"POST",
+		"/users/{username}/functions/{function}/callback",
+		ApiSetCallbackHandler,
+	},
+	Route{
+		"PublishEvent",
+		"POST",
+		"/events/{source}/{topic}",
+		ApiPublishEventHandler,
+	},
+	Route{
+		"Audit",
+		"GET",
+		"/audit",
+		ApiListAuditHandler,
+	},
+	Route{
+		"AuditExport",
+		"GET",
+		"/audit/export",
+		ApiExportAuditHandler,
+	},
 }
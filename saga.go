@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+)
+
+// sagaStep is one step of a saga. Undo is the compensating action of Do
+// and is only called if Do succeeded and a later step failed. Undo may be
+// nil for steps which do not need to be compensated.
+type sagaStep struct {
+	Name string
+	Do   func() error
+	Undo func() error
+}
+
+// saga runs a workflow which spans the DB, the docker registry and the
+// cluster. Those cannot share a transaction, so each step comes with a
+// compensating action that is run, in reverse order, when a later step
+// fails.
+type saga struct {
+	name  string
+	steps []sagaStep
+	log   *logging.Logger
+	// Context of the spans of the steps
+	ctx context.Context
+}
+
+func newSaga(ctx context.Context, name string, logger *logging.Logger) *saga {
+	return &saga{name: name, log: logger.With("saga", name), ctx: ctx}
+}
+
+func (s *saga) Add(name string, do, undo func() error) {
+	s.steps = append(s.steps, sagaStep{Name: name, Do: do, Undo: undo})
+}
+
+// Run executes the steps in order. If a step fails, the completed steps
+// are compensated and the error of the failed step is returned, together
+// with the errors of any compensation that failed as well.
+func (s *saga) Run() error {
+	for i, step := range s.steps {
+		s.log.Info("Running saga step", "step", step.Name)
+		err := s.trace("saga step", step.Name, step.Do)
+		if err == nil {
+			continue
+		}
+		s.log.Warn("Saga step failed", "step", step.Name, "error", err)
+
+		msgs := []string{err.Error()}
+		for j := i - 1; j >= 0; j-- {
+			if s.steps[j].Undo == nil {
+				continue
+			}
+			s.log.Info("Compensating saga step", "step", s.steps[j].Name)
+			if uerr := s.trace("saga undo", s.steps[j].Name, s.steps[j].Undo); uerr != nil {
+				s.log.Error("Saga step compensation failed", "step", s.steps[j].Name, "error", uerr)
+				msgs = append(msgs, "Failed to undo "+s.steps[j].Name+": "+uerr.Error())
+			}
+		}
+		if len(msgs) == 1 {
+			return err
+		}
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// trace runs an action of a step in a span
+func (s *saga) trace(name, step string, action func() error) error {
+	_, span := tracing.Start(s.ctx, name, "saga", s.name, "step", step)
+	err := action()
+	span.SetError(err)
+	span.End()
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/Symantec/Go-kexec/tracing"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Period at which the scheduler checks for due runs
+	SchedulerPeriod = 15 * time.Second
+
+	// Only the server holding this lease fires the schedules. It is
+	// renewed every SchedulerPeriod, and taken over by another server
+	// once it expires.
+	SchedulerLease    = "scheduler"
+	SchedulerLeaseTTL = time.Minute
+
+	// Runs fired later than this after they were due are missed runs
+	MissedRunGrace = time.Minute
+
+	// Maximum number of missed runs of a schedule fired with MissedRunsAll
+	MaxCatchUpRuns = 10
+)
+
+// Missed runs policies, telling what to do with the runs that were due
+// while no server fired them, e.g. during an upgrade.
+var (
+	// Skip them. Default.
+	MissedRunsSkip = "skip"
+	// Fire the last one
+	MissedRunsOnce = "once"
+	// Fire each of them, up to MaxCatchUpRuns
+	MissedRunsAll = "all"
+)
+
+// runScheduler fires the runs of the function schedules as they come
+// due, as long as this server is the leader.
+func runScheduler(a *appContext) {
+	ctx := context.Background()
+	holder := schedulerID()
+	leader := false
+	ticker := time.NewTicker(SchedulerPeriod)
+	defer ticker.Stop()
+	for {
+		ok, err := a.dal.AcquireLease(ctx, SchedulerLease, holder, SchedulerLeaseTTL)
+		if err != nil {
+			a.log.Error("Failed to acquire scheduler lease", "error", err)
+			ok = false
+		}
+		if ok != leader {
+			leader = ok
+			a.log.Info("Scheduler leadership changed", "leader", leader)
+		}
+		if leader {
+			if err := fireDueSchedules(ctx, a, time.Now()); err != nil {
+				a.log.Error("Failed to fire schedules", "error", err)
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// schedulerID identifies this server as a lease holder
+func schedulerID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// fireDueSchedules fires the runs due up to `now`. A schedule is marked
+// checked before its runs are fired, so a run is fired at most once even
+// if the leader changes.
+func fireDueSchedules(ctx context.Context, a *appContext, now time.Time) error {
+	schedules, err := a.dal.ListAllSchedules(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range schedules {
+		runs, skipped, err := dueRuns(a.log, s, now)
+		if err != nil {
+			a.log.Warn("Skipping invalid schedule", "schedule_id", s.ID, "function", s.FunctionName, "error", err)
+			continue
+		}
+		// Skipped runs are marked checked too, so that they are skipped
+		// once
+		if len(runs) == 0 && !skipped {
+			continue
+		}
+		if err := a.dal.SetScheduleLastRun(ctx, s.ID, now); err != nil {
+			return err
+		}
+		for _, run := range runs {
+			go fireSchedule(a, s, run)
+		}
+	}
+	return nil
+}
+
+// dueRuns returns the runs of a schedule to fire at `now`, applying its
+// missed runs policy, and whether missed runs were skipped. The first run
+// of a new schedule is the first one due after it was created.
+func dueRuns(logger *logging.Logger, s *dal.Schedule, now time.Time) ([]time.Time, bool, error) {
+	cron, err := parseCron(s.Spec)
+	if err != nil {
+		return nil, false, err
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return nil, false, err
+	}
+	from := s.LastRun
+	if from.IsZero() {
+		from = s.Created
+	}
+
+	// Keep the last MaxCatchUpRuns runs due
+	due := make([]time.Time, 0, MaxCatchUpRuns)
+	for t := cron.next(from.In(loc)); !t.IsZero() && !t.After(now); t = cron.next(t) {
+		if len(due) == MaxCatchUpRuns {
+			due = due[1:]
+		}
+		due = append(due, t)
+	}
+	if len(due) == 0 {
+		return nil, false, nil
+	}
+
+	last := due[len(due)-1]
+	switch s.MissedRuns {
+	case MissedRunsAll:
+		return due, false, nil
+	case MissedRunsOnce:
+		return due[len(due)-1:], false, nil
+	default:
+		if now.Sub(last) > MissedRunGrace {
+			logger.Warn("Skipping missed run", "schedule_id", s.ID, "function", s.FunctionName, "due", last)
+			return nil, true, nil
+		}
+		return due[len(due)-1:], false, nil
+	}
+}
+
+// fireSchedule runs a function for a schedule, and records the
+// execution.
+func fireSchedule(a *appContext, s *dal.Schedule, due time.Time) {
+	a.log.Info("Running schedule", "schedule_id", s.ID, "user", s.UserName, "function", s.FunctionName, "due", due)
+	ctx, span := tracing.Start(context.Background(), "schedule", "schedule_id", s.ID)
+	defer span.End()
+	timestamp := time.Now()
+	res, err := callFunction(ctx, a, s.UserName, s.FunctionName, s.Params, nil)
+	if err != nil {
+		a.log.Error("Scheduled run failed", "user", s.UserName, "function", s.FunctionName, "error", err)
+		span.SetError(err)
+		return
+	}
+	res.Trigger = TriggerSchedule
+	if err := PutFunctionExecution(ctx, a, s.UserName, s.FunctionName, s.Params, res, timestamp); err != nil {
+		a.log.Error("Failed to record scheduled run", "user", s.UserName, "function", s.FunctionName, "error", err)
+	}
+}
+
+// validateSchedule checks a schedule before it is stored
+func validateSchedule(s *dal.Schedule) error {
+	if _, err := parseCron(s.Spec); err != nil {
+		return err
+	}
+	if _, err := time.LoadLocation(s.TimeZone); err != nil {
+		return errors.New(fmt.Sprintf("Invalid time zone %q.", s.TimeZone))
+	}
+	switch s.MissedRuns {
+	case "", MissedRunsSkip, MissedRunsOnce, MissedRunsAll:
+	default:
+		return errors.New(fmt.Sprintf("Invalid missed runs policy %q, expected %s, %s or %s.",
+			s.MissedRuns, MissedRunsSkip, MissedRunsOnce, MissedRunsAll))
+	}
+	if s.Params != "" {
+		var v interface{}
+		if err := json.Unmarshal([]byte(s.Params), &v); err != nil {
+			return errors.New("Parameters are not in valid json format: " + err.Error())
+		}
+	}
+	return nil
+}
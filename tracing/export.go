@@ -0,0 +1,207 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OTLP/JSON encoding of the spans, as sent to the /v1/traces endpoint of
+// a collector. Ids are hex, times are nanoseconds since the epoch, as
+// strings like every 64 bit integer.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              Kind            `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status code of the failed spans
+const otlpStatusError = 2
+
+// ScopeName is the instrumentation scope of the exported spans
+var ScopeName = "github.com/Symantec/Go-kexec"
+
+// encodeOTLP encodes spans as an OTLP/JSON export request
+func encodeOTLP(service string, spans []*SpanData) ([]byte, error) {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.ParentSpanID != (SpanID{}) {
+			span.ParentSpanID = s.ParentSpanID.String()
+		}
+		if s.Error != "" {
+			span.Status = &otlpStatus{Code: otlpStatusError, Message: s.Error}
+		}
+		encoded = append(encoded, span)
+	}
+	return json.Marshal(otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: otlpAttributes([]interface{}{"service.name", service})},
+			ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: ScopeName}, Spans: encoded}},
+		}},
+	})
+}
+
+// otlpAttributes converts key/value pairs. Values of other types than
+// strings, booleans and numbers are converted to their text.
+func otlpAttributes(keyvals []interface{}) []otlpAttribute {
+	attrs := make([]otlpAttribute, 0, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		attr := otlpAttribute{Key: fmt.Sprint(keyvals[i])}
+		switch v := keyvals[i+1].(type) {
+		case string:
+			attr.Value.StringValue = &v
+		case bool:
+			attr.Value.BoolValue = &v
+		case int, int8, int16, int32, int64, uint8, uint16, uint32:
+			s := fmt.Sprint(v)
+			attr.Value.IntValue = &s
+		case float32:
+			f := float64(v)
+			attr.Value.DoubleValue = &f
+		case float64:
+			attr.Value.DoubleValue = &v
+		case error:
+			s := v.Error()
+			attr.Value.StringValue = &s
+		default:
+			s := fmt.Sprint(v)
+			attr.Value.StringValue = &s
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs
+}
+
+// FileExporter appends the spans to a file, one OTLP/JSON export request
+// per line, as the file exporter of the OpenTelemetry collector does
+type FileExporter struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(service string, spans []*SpanData) error {
+	b, err := encodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err = e.file.Write(append(b, '\n'))
+	return err
+}
+
+func (e *FileExporter) Close() error {
+	return e.file.Close()
+}
+
+// OTLPExporter posts the spans to an OTLP/HTTP endpoint, e.g.
+// http://collector:4318/v1/traces, encoded as JSON
+type OTLPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+// NewOTLPExporter creates an exporter to `endpoint`. `headers` are added
+// to each request, e.g. for authentication.
+func NewOTLPExporter(endpoint string, headers map[string]string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (e *OTLPExporter) Export(service string, spans []*SpanData) error {
+	b, err := encodeOTLP(service, spans)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", e.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range e.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := e.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(response.Body)
+		return errors.New(fmt.Sprintf("OTLP endpoint responded %s: %s", response.Status, bytes.TrimSpace(body)))
+	}
+	return nil
+}
@@ -0,0 +1,390 @@
+/*
+Package tracing records the spans of the work done for a request, and
+exports them as OpenTelemetry (OTLP) traces.
+
+A span is started from the context of the work it covers, and is the
+parent of the spans started from the context it returns:
+
+	ctx, span := tracing.Start(ctx, "build image", "function", name)
+	defer span.End()
+	...
+	span.SetError(err)
+
+The trace context crosses process boundaries as a W3C traceparent, e.g.
+in the headers of the HTTP requests served, see Traceparent and
+ParseTraceparent.
+
+Spans are only recorded by a tracer with an exporter. Otherwise they are
+cheap no-ops, but still carry the trace context of the request.
+*/
+package tracing
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/logging"
+	"golang.org/x/net/context"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+
+// SpanContext identifies a span across processes
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Whether the span is recorded
+	Sampled bool
+}
+
+// IsValid returns whether the ids are set
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != TraceID{} && c.SpanID != SpanID{}
+}
+
+// Traceparent returns the W3C traceparent of the span, or "" if the
+// context is not valid
+func (c SpanContext) Traceparent() string {
+	if !c.IsValid() {
+		return ""
+	}
+	flags := "00"
+	if c.Sampled {
+		flags = "01"
+	}
+	return "00-" + c.TraceID.String() + "-" + c.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent. ok is false if it is not a
+// valid one.
+func ParseTraceparent(s string) (c SpanContext, ok bool) {
+	// version-traceid-spanid-flags, as 2, 32, 16 and 2 hex digits
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' || (len(s) > 55 && s[55] != '-') {
+		return c, false
+	}
+	version, err := hex.DecodeString(s[:2])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return c, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(s[3:35])); err != nil {
+		return c, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(s[36:52])); err != nil {
+		return c, false
+	}
+	flags, err := hex.DecodeString(s[53:55])
+	if err != nil {
+		return c, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+// Kind is the role of a span in a trace, as defined by OTLP
+type Kind int
+
+const (
+	KindInternal Kind = 1
+	KindServer   Kind = 2
+	KindClient   Kind = 3
+)
+
+// SpanData is a span once ended, as exported
+type SpanData struct {
+	Name         string
+	Kind         Kind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	// Key/value pairs, as given to Start and SetAttributes
+	Attributes []interface{}
+	// Error of the work, "" if it succeeded
+	Error string
+}
+
+// Span is the work being traced. Its methods are safe for concurrent use,
+// and do nothing on spans which are not recorded.
+type Span struct {
+	tracer *Tracer
+	sc     SpanContext
+
+	lock  sync.Mutex
+	data  *SpanData
+	ended bool
+}
+
+// Context returns the trace context of the span
+func (s *Span) Context() SpanContext {
+	return s.sc
+}
+
+// SetAttributes adds key/value pairs to the span
+func (s *Span) SetAttributes(keyvals ...interface{}) {
+	if s.data == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.Attributes = append(s.data.Attributes, keyvals...)
+	s.lock.Unlock()
+}
+
+// SetError marks the span as failed, unless err is nil
+func (s *Span) SetError(err error) {
+	if s.data == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	s.data.Error = err.Error()
+	s.lock.Unlock()
+}
+
+// End ends the span and hands it to the exporter. Spans are ended once,
+// later calls do nothing.
+func (s *Span) End() {
+	if s.data == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+	s.tracer.enqueue(data)
+}
+
+// Exporter sends ended spans to a tracing backend
+type Exporter interface {
+	Export(service string, spans []*SpanData) error
+}
+
+type Config struct {
+	// Name of the traced service, "kexec" if empty
+	ServiceName string
+	// Spans are not recorded if nil
+	Exporter Exporter
+
+	// Spans are exported in batches of at most BatchSize spans, at least
+	// every FlushInterval. At most QueueSize spans wait to be exported,
+	// later ones are dropped. Defaults to 512, 5s and 2048.
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+
+	// Logger of the export failures. logging.Default if nil.
+	Logger *logging.Logger
+}
+
+// Tracer starts spans and exports them in the background
+type Tracer struct {
+	service       string
+	exporter      Exporter
+	batchSize     int
+	flushInterval time.Duration
+	log           *logging.Logger
+
+	queue   chan *SpanData
+	done    chan struct{}
+	closing sync.Once
+
+	// Source of the ids, seeded from crypto/rand
+	idLock sync.Mutex
+	ids    *rand.Rand
+}
+
+// NewTracer creates a tracer. If it has an exporter, the spans are
+// exported until Close is called.
+func NewTracer(c *Config) *Tracer {
+	t := &Tracer{
+		service:       c.ServiceName,
+		exporter:      c.Exporter,
+		batchSize:     c.BatchSize,
+		flushInterval: c.FlushInterval,
+		log:           c.Logger,
+		done:          make(chan struct{}),
+	}
+	if t.service == "" {
+		t.service = "kexec"
+	}
+	if t.batchSize <= 0 {
+		t.batchSize = 512
+	}
+	if t.flushInterval <= 0 {
+		t.flushInterval = 5 * time.Second
+	}
+	if t.log == nil {
+		t.log = logging.Default
+	}
+	queueSize := c.QueueSize
+	if queueSize <= 0 {
+		queueSize = 2048
+	}
+
+	var seed int64
+	if err := binary.Read(crand.Reader, binary.LittleEndian, &seed); err != nil {
+		seed = time.Now().UnixNano()
+	}
+	t.ids = rand.New(rand.NewSource(seed))
+
+	if t.exporter == nil {
+		close(t.done)
+		return t
+	}
+	t.queue = make(chan *SpanData, queueSize)
+	go t.run()
+	return t
+}
+
+// Default is the tracer of Start. It records nothing until replaced by
+// a tracer with an exporter.
+var Default = NewTracer(&Config{})
+
+// Start starts a span with the default tracer
+func Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, *Span) {
+	return Default.Start(ctx, name, keyvals...)
+}
+
+// StartServer starts a span with the default tracer, for a request from
+// another process
+func StartServer(ctx context.Context, name string, remote SpanContext, keyvals ...interface{}) (context.Context, *Span) {
+	return Default.StartServer(ctx, name, remote, keyvals...)
+}
+
+// Start starts a span, child of the span of ctx if any. The span is
+// carried by the returned context.
+func (t *Tracer) Start(ctx context.Context, name string, keyvals ...interface{}) (context.Context, *Span) {
+	var parent SpanContext
+	if s := FromContext(ctx); s != nil {
+		parent = s.sc
+	}
+	return t.start(ctx, name, KindInternal, parent, keyvals)
+}
+
+// StartServer starts a span serving a request from another process, child
+// of `remote` if it is valid. Spans of a remote parent not sampled are
+// not recorded either.
+func (t *Tracer) StartServer(ctx context.Context, name string, remote SpanContext, keyvals ...interface{}) (context.Context, *Span) {
+	return t.start(ctx, name, KindServer, remote, keyvals)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind Kind, parent SpanContext, keyvals []interface{}) (context.Context, *Span) {
+	s := &Span{tracer: t}
+	if !parent.IsValid() && t.exporter == nil {
+		// Nothing to record nor to propagate
+		return NewContext(ctx, s), s
+	}
+
+	s.sc.TraceID = parent.TraceID
+	t.idLock.Lock()
+	if !parent.IsValid() {
+		t.ids.Read(s.sc.TraceID[:])
+	}
+	t.ids.Read(s.sc.SpanID[:])
+	t.idLock.Unlock()
+	s.sc.Sampled = t.exporter != nil && (!parent.IsValid() || parent.Sampled)
+
+	if s.sc.Sampled {
+		s.data = &SpanData{
+			Name:         name,
+			Kind:         kind,
+			TraceID:      s.sc.TraceID,
+			SpanID:       s.sc.SpanID,
+			ParentSpanID: parent.SpanID,
+			Start:        time.Now(),
+			Attributes:   keyvals,
+		}
+	}
+	return NewContext(ctx, s), s
+}
+
+// enqueue hands an ended span to the exporter, unless the queue is full
+func (t *Tracer) enqueue(data *SpanData) {
+	defer func() {
+		// The tracer was closed
+		recover()
+	}()
+	select {
+	case t.queue <- data:
+	default:
+		t.log.Warn("Tracing queue full, dropping span", "span", data.Name)
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*SpanData, 0, t.batchSize)
+	for {
+		select {
+		case data, ok := <-t.queue:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			batch = append(batch, data)
+			if len(batch) < t.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = make([]*SpanData, 0, t.batchSize)
+	}
+}
+
+func (t *Tracer) export(batch []*SpanData) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exporter.Export(t.service, batch); err != nil {
+		t.log.Error("Failed to export spans", "spans", len(batch), "error", err)
+	}
+}
+
+// Close exports the spans ended so far. Spans ended later are dropped.
+func (t *Tracer) Close() {
+	if t.exporter == nil {
+		return
+	}
+	t.closing.Do(func() { close(t.queue) })
+	<-t.done
+}
+
+type contextKey int
+
+const spanKey contextKey = 0
+
+// NewContext returns a context carrying a span
+func NewContext(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey, s)
+}
+
+// FromContext returns the span of a context, or nil if it has none
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+// Traceparent returns the W3C traceparent of the span of ctx, or "" if
+// ctx has none, for the processes continuing the trace
+func Traceparent(ctx context.Context) string {
+	if s := FromContext(ctx); s != nil {
+		return s.sc.Traceparent()
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type memoryExporter struct {
+	lock  sync.Mutex
+	spans []*SpanData
+}
+
+func (e *memoryExporter) Export(service string, spans []*SpanData) error {
+	e.lock.Lock()
+	e.spans = append(e.spans, spans...)
+	e.lock.Unlock()
+	return nil
+}
+
+func TestTraceparent(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	c, ok := ParseTraceparent(s)
+	if !ok || !c.Sampled || c.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || c.SpanID.String() != "00f067aa0ba902b7" {
+		t.Fatal("Unexpected span context", c, ok)
+	}
+	if c.Traceparent() != s {
+		t.Error("Expected", s, "got", c.Traceparent())
+	}
+	for _, invalid := range []string{
+		"",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceparent(invalid); ok {
+			t.Error("Expected invalid traceparent", invalid)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	e := &memoryExporter{}
+	tracer := NewTracer(&Config{Exporter: e})
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := tracer.StartServer(context.Background(), "GET /", remote)
+	_, child := tracer.Start(ctx, "build", "function", "hello")
+	child.SetError(errors.New("failed"))
+	child.End()
+	child.End()
+	root.End()
+	tracer.Close()
+
+	if len(e.spans) != 2 {
+		t.Fatal("Expected 2 spans, got", len(e.spans))
+	}
+	c, r := e.spans[0], e.spans[1]
+	if r.TraceID != remote.TraceID || r.ParentSpanID != remote.SpanID || r.Kind != KindServer {
+		t.Error("Expected the root span to continue the remote trace", r)
+	}
+	if c.TraceID != remote.TraceID || c.ParentSpanID != r.SpanID || c.Error != "failed" || c.Attributes[1] != "hello" {
+		t.Error("Unexpected child span", c)
+	}
+	if Traceparent(ctx) != root.Context().Traceparent() {
+		t.Error("Expected the traceparent of the root span")
+	}
+}
+
+func TestNotRecorded(t *testing.T) {
+	// Without exporter, the remote trace context is still propagated
+	tracer := NewTracer(&Config{})
+	ctx, span := tracer.Start(context.Background(), "call")
+	if span.Context().IsValid() || Traceparent(ctx) != "" {
+		t.Error("Expected no trace context")
+	}
+	span.SetAttributes("ignored", 1)
+	span.End()
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, span = tracer.StartServer(context.Background(), "call", remote)
+	if span.Context().TraceID != remote.TraceID || span.Context().Sampled {
+		t.Error("Expected the remote trace, not sampled", span.Context())
+	}
+
+	// Spans of a remote parent not sampled are not recorded
+	e := &memoryExporter{}
+	tracer = NewTracer(&Config{Exporter: e})
+	remote.Sampled = false
+	_, span = tracer.StartServer(context.Background(), "call", remote)
+	span.End()
+	tracer.Close()
+	if len(e.spans) != 0 {
+		t.Error("Expected no span, got", len(e.spans))
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	e, err := NewFileExporter(filepath.Join(dir, "traces.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := NewTracer(&Config{ServiceName: "test", Exporter: e})
+	_, span := tracer.Start(context.Background(), "call", "attempts", 2, "cold", true)
+	span.End()
+	tracer.Close()
+	e.Close()
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "traces.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request otlpRequest
+	if err := json.Unmarshal(b, &request); err != nil {
+		t.Fatal(err)
+	}
+	rs := request.ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "test" {
+		t.Error("Expected the service name, got", string(b))
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	if s.Name != "call" || s.ParentSpanID != "" || len(s.TraceID) != 32 || *s.Attributes[0].Value.IntValue != "2" || !*s.Attributes[1].Value.BoolValue {
+		t.Error("Unexpected span", string(b))
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	e := NewOTLPExporter(ts.URL+"/v1/traces", map[string]string{"Authorization": "Bearer token"})
+	if err := e.Export("test", []*SpanData{{Name: "call", Kind: KindInternal}}); err != nil {
+		t.Fatal(err)
+	}
+	var request otlpRequest
+	if err := json.Unmarshal(body, &request); err != nil || request.ResourceSpans[0].ScopeSpans[0].Spans[0].Name != "call" {
+		t.Error("Unexpected request", string(body), err)
+	}
+
+	e = NewOTLPExporter(ts.URL+"/v1/traces", nil)
+	if err := e.Export("test", []*SpanData{{Name: "call"}}); err == nil {
+		t.Error("Expected an error response")
+	}
+}
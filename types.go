@@ -7,7 +7,9 @@ import (
 	"github.com/Symantec/Go-kexec/dal"
 	"github.com/Symantec/Go-kexec/docker"
 	"github.com/Symantec/Go-kexec/kexec"
+	"github.com/Symantec/Go-kexec/logging"
 	"github.com/gorilla/securecookie"
+	"golang.org/x/net/context"
 )
 
 // Error type
@@ -47,19 +49,39 @@ func (se StatusError) SendErrorResponse() bool {
 	return se.SendErrResp
 }
 
-//App configuration
+// App configuration
 type appConfig struct {
 	FileServerDir string
 	LogFileDir    string
-	KubeConfig    string
-	DockerCfg     dockerConfig
-	DalCfg        dalConfig
-	LDAPCfg       ldapConfig
+	// "logfmt" or "json", and the lowest level written: "debug",
+	// "info", "warn" or "error". logfmt and info by default.
+	LogFormat    string
+	LogLevel     string
+	KubeConfig   string
+	DockerCfg    dockerConfig
+	DalCfg       dalConfig
+	LDAPCfg      ldapConfig
+	FunctionCfg  functionConfig
+	NamespaceCfg namespaceConfig
+	EventsCfg    eventsConfig
+	TracingCfg   tracingConfig
+
+	// Users allowed to read the audit log
+	Admins []string
 }
 
 type dockerConfig struct {
 	DockerHost     string
 	DockerRegistry string
+
+	// Credentials and TLS verification for the registry HTTP API
+	RegistryUsername string
+	RegistryPassword string
+	RegistryInsecure bool
+
+	// Minutes between two runs of the registry garbage collector.
+	// 0 disables it.
+	RegistryGCInterval int
 }
 
 type dalConfig struct {
@@ -67,6 +89,9 @@ type dalConfig struct {
 	Username string
 	Password string
 	DBName   string
+
+	// Key used to encrypt function secrets in the DB
+	SecretKey string
 }
 
 type ldapConfig struct {
@@ -76,22 +101,126 @@ type ldapConfig struct {
 	LDAPBaseDn  string
 }
 
+// Operator configured function settings. Timeouts are in seconds and log
+// sizes in bytes.
+type functionConfig struct {
+	// Used when a function does not set its own
+	DefaultCPU        string
+	DefaultMemory     string
+	DefaultTimeout    int64
+	DefaultMaxLogSize int64
+
+	// Retry policy used when a function does not set its own. Backoff is
+	// in seconds.
+	DefaultMaxAttempts  int64
+	DefaultRetryBackoff int64
+	DefaultRetryOn      string
+
+	// Ceilings a function cannot exceed. Empty or 0 means no ceiling.
+	MaxCPU      string
+	MaxMemory   string
+	MaxTimeout  int64
+	MaxLogSize  int64
+	MaxAttempts int64
+
+	// Maximum number of items of a fan-out execution, and of items run at
+	// the same time. 0 means no maximum.
+	MaxFanOut      int
+	MaxParallelism int
+
+	// Maximum number of warm workers of a function, 0 disables the warm
+	// mode. Warm pools are scaled down after WarmIdleTimeout seconds
+	// without executions.
+	MaxWarmPoolSize int
+	WarmIdleTimeout int64
+
+	// Hosts completion callbacks may be posted to, e.g. "*.example.com"
+	// for the subdomains of example.com. Empty means any host. Private
+	// addresses are never allowed.
+	CallbackHosts []string
+}
+
+// Kubernetes namespaces the functions run in
+type namespaceConfig struct {
+	// "shared" (default), "user" or "group". See NamespaceMode*.
+	Mode string
+	// Prefix of the per user or per group namespace names
+	Prefix string
+
+	// Group name to user names
+	Groups map[string][]string
+
+	// Resource name to quantity, e.g. {"pods": "10"}. Applied to each
+	// per user or per group namespace as a ResourceQuota and LimitRange.
+	Quota           map[string]string
+	DefaultLimits   map[string]string
+	DefaultRequests map[string]string
+	MaxLimits       map[string]string
+
+	// Deny traffic to function pods from other namespaces. Warm workers
+	// are called through the API server proxy, which the network plugin
+	// must still let through.
+	NetworkIsolation bool
+}
+
+// Event sources functions can subscribe to
+type eventsConfig struct {
+	// Source name to source. The messages of the "local" driver are
+	// stored under options["dir"], which must not be shared by servers.
+	Sources map[string]eventSourceConfig
+
+	// Deliveries of a message before it is dead-lettered, when a
+	// subscription does not set its own, and seconds before the first
+	// redelivery of a failed message
+	DefaultMaxDeliveries int
+	RetryBackoff         int64
+}
+
+type eventSourceConfig struct {
+	Driver  string
+	Options map[string]string
+}
+
+// Export of the traces of the requests and executions
+type tracingConfig struct {
+	// "otlp" posts the spans to Endpoint, an OTLP/HTTP traces endpoint
+	// such as http://collector:4318/v1/traces, with Headers. "file"
+	// appends them to File as OTLP/JSON lines. Empty disables tracing,
+	// the trace context of the clients is still passed to the functions.
+	Exporter string
+	Endpoint string
+	Headers  map[string]string
+	File     string
+
+	// "kexec" by default
+	ServiceName string
+}
+
 type appContext struct {
 	d             *docker.Docker
+	r             *docker.Registry
 	k             *kexec.Kexec
 	dal           dal.DAL
 	cookieHandler *securecookie.SecureCookie
 	conf          *appConfig
+	executions    *executionTracker
+	events        *eventManager
+	workflows     *workflowEngine
+	log           *logging.Logger
 }
 
-type appRouteHandler func(*appContext, http.ResponseWriter, *http.Request) error
+// appRouteHandler handles a request. The context is done once the
+// request is served or the client goes away.
+type appRouteHandler func(context.Context, *appContext, http.ResponseWriter, *http.Request) error
 
 type appHandler struct {
 	*appContext
-	H appRouteHandler
+	// Name of the route, e.g. "CallFunction"
+	route string
+	H     appRouteHandler
 }
 
-//Page types
+// Page types
 type LoginPage struct {
 	LoginErr bool
 	ErrMsg   string
@@ -106,12 +235,29 @@ type FunctionRow struct {
 type DashboardPage struct {
 	Username  string
 	Functions []*FunctionRow
+	Workflows []*dal.Workflow
 }
 
 type CallResult struct {
 	Result string
 	Uuid   string
 	Log    string
+	// JSON return value of the function, empty if it returned none
+	Output   string
+	Attempts []*kexec.Attempt
+
+	// ExecutionModeWarm or ExecutionModeCold, and the time from the call
+	// to the completion
+	Mode    string
+	Latency time.Duration
+
+	// What started the execution, e.g. TriggerSchedule. Set by the caller
+	// of callFunction.
+	Trigger string
+
+	// URL the completion is posted to, instead of the callback of the
+	// function. Set by the caller of callFunction.
+	CallbackURL string
 }
 
 type ConfigFuncPage struct {
@@ -119,6 +265,12 @@ type ConfigFuncPage struct {
 	FuncName       string
 	FuncRuntime    string
 	FuncContent    string
+	Settings       dal.FunctionSettings
+	Limits         functionConfig
+
+	// NAME=value lines. Secret values are masked.
+	Env     string
+	Secrets string
 }
 
 type ErrorPage struct {
@@ -127,5 +279,16 @@ type ErrorPage struct {
 
 type ViewLogsPage struct {
 	FuncName   string
+	Running    []*runningExecution
 	Executions []*dal.FunctionExecution
 }
+
+type ViewWorkflowPage struct {
+	Workflow *dal.Workflow
+	Runs     []*WorkflowRunRow
+}
+
+type WorkflowRunRow struct {
+	Run   *dal.WorkflowRun
+	Graph *WorkflowNode
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/kexec"
+	"golang.org/x/net/context"
+)
+
+// Execution modes. Warm executions run on a worker pod of the warm pool
+// of the function, cold executions in a new job.
+var (
+	ExecutionModeWarm = "warm"
+	ExecutionModeCold = "cold"
+)
+
+// callFunctionWarm runs an execution on a warm worker of the function.
+// It returns kexec.ErrNoWarmWorker if none is idle, in which case the
+// caller runs the execution as a job. Warm pools are kept by the server
+// that started them, so each server runs its own workers.
+func callFunctionWarm(ctx context.Context, a *appContext, userName string, f *dal.Function, uuidStr, jobName, image, params, nsName string, labels map[string]string, opts *kexec.JobOptions, start time.Time) (*CallResult, error) {
+	c := &a.conf.FunctionCfg
+	size := int(f.WarmPoolSize)
+	if size > c.MaxWarmPoolSize {
+		size = c.MaxWarmPoolSize
+	}
+	warm := &kexec.WarmOptions{
+		Size:        size,
+		IdleTimeout: time.Duration(c.WarmIdleTimeout) * time.Second,
+		// The image tag does not change when the function is updated
+		Version: fmt.Sprintf("%x", sha1.Sum([]byte(f.Content))),
+	}
+	poolName := strings.ToLower(f.Name) + "-" + strings.Replace(userName, "_", "-", -1)
+
+	// The job name identifies the execution, so CancelJob works the same
+	// for warm executions.
+	a.executions.start(userName, f.Name, uuidStr, nsName, jobName)
+	attempts, err := a.k.CallWarm(ctx, jobName, poolName, image, params, nsName, labels, opts, warm)
+	a.executions.complete(uuidStr)
+	cancelled := err == kexec.ErrJobCancelled
+	if err != nil && !cancelled {
+		a.executions.finalize(uuidStr)
+		return nil, err
+	}
+
+	status, funcLog := kexec.AggregateAttempts(attempts)
+	if cancelled {
+		status = ExecutionCancelled
+	}
+	a.logger(ctx).Debug("Function log", "execution", uuidStr, "log", funcLog)
+	return &CallResult{
+		Result:   status,
+		Uuid:     uuidStr,
+		Log:      funcLog,
+		Output:   kexec.AttemptsOutput(attempts),
+		Attempts: attempts,
+		Mode:     ExecutionModeWarm,
+		Latency:  time.Since(start),
+	}, nil
+}
+
+// validateWarmPoolSize checks the warm pool size of a function against
+// the operator configured maximum.
+func validateWarmPoolSize(a *appContext, size int64) error {
+	max := a.conf.FunctionCfg.MaxWarmPoolSize
+	if size < 0 {
+		return errors.New("Warm pool size cannot be negative.")
+	}
+	if size > 0 && max == 0 {
+		return errors.New("Warm execution mode is disabled.")
+	}
+	if size > int64(max) {
+		return errors.New(fmt.Sprintf("Warm pool size %d exceeds the maximum of %d.", size, max))
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+)
+
+var (
+	// Defaults of new webhooks, as sent by GitHub
+	DefaultSignatureHeader = "X-Hub-Signature-256"
+	DefaultSignatureAlg    = "sha256"
+	DefaultDeliveryHeader  = "X-GitHub-Delivery"
+
+	// Delivery ids and body digests are remembered this long to reject
+	// replayed requests
+	WebhookReplayWindow = 24 * time.Hour
+
+	// Maximum size of a webhook request body
+	MaxWebhookBodySize int64 = 1 << 20
+)
+
+// Signature algorithms of webhooks. The HMAC algorithms sign the request
+// body, with an optional "<algorithm>=" prefix as sent by GitHub. With
+// "token", the header holds the secret itself, as sent by GitLab.
+var webhookAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"token":  nil,
+}
+
+var (
+	errInvalidSignature = errors.New("Invalid webhook signature")
+	errReplayedDelivery = errors.New("Webhook delivery already received")
+)
+
+// WebhookParams are the params of an execution started by a webhook
+type WebhookParams struct {
+	// The request headers configured on the webhook
+	Headers map[string]string `json:"headers"`
+	// The request body, as JSON if it is a JSON document, or as a string
+	Body interface{} `json:"body"`
+}
+
+// WebhookHandler calls the function of a webhook on a signed request. The
+// function runs in the background, as senders usually give up after a
+// few seconds: the response only tells the execution was accepted.
+func WebhookHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	token := mux.Vars(request)["token"]
+	w, err := a.dal.GetWebhook(ctx, token)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageWebhookNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	auditActor(ctx, fmt.Sprintf("webhook:%d", w.ID), AuthWebhook)
+	auditTarget(ctx, w.UserName, w.FunctionName)
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, MaxWebhookBodySize))
+	if err != nil {
+		return StatusError{http.StatusRequestEntityTooLarge, err, MessageWebhookFailed, true}
+	}
+	if err := verifyWebhookSignature(w, request.Header.Get(w.SignatureHeader), body); err != nil {
+		return StatusError{http.StatusUnauthorized, err, MessageWebhookFailed, true}
+	}
+	if w.DeliveryHeader != "" {
+		delivery := request.Header.Get(w.DeliveryHeader)
+		if delivery == "" {
+			err := errors.New("Missing " + w.DeliveryHeader + " header")
+			return StatusError{http.StatusBadRequest, err, MessageWebhookFailed, true}
+		}
+		// The delivery id is not signed, a replayed request may come with
+		// a new one: the signed body is remembered too
+		for _, d := range []string{delivery, bodyDigest(body)} {
+			if ok, err := a.dal.PutWebhookDelivery(ctx, w.ID, d, WebhookReplayWindow); err != nil {
+				return StatusError{http.StatusInternalServerError, err, MessageWebhookFailed, true}
+			} else if !ok {
+				return StatusError{http.StatusConflict, errReplayedDelivery, MessageWebhookFailed, true}
+			}
+		}
+	}
+
+	params, err := webhookParams(w, request.Header, body)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageWebhookFailed, true}
+	}
+	a.logger(ctx).Info("Webhook calls function", "webhook_id", w.ID, "user", w.UserName, "function", w.FunctionName)
+	go fireWebhook(detachContext(ctx), a, w, params)
+
+	response.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// verifyWebhookSignature checks the signature of a webhook request
+func verifyWebhookSignature(w *dal.Webhook, signature string, body []byte) error {
+	newHash, ok := webhookAlgorithms[w.Algorithm]
+	if !ok {
+		return errors.New(fmt.Sprintf("Unknown signature algorithm %q", w.Algorithm))
+	}
+	if signature == "" {
+		return errInvalidSignature
+	}
+	if newHash == nil {
+		if subtle.ConstantTimeCompare([]byte(signature), []byte(w.Secret)) != 1 {
+			return errInvalidSignature
+		}
+		return nil
+	}
+
+	signature = strings.TrimPrefix(signature, w.Algorithm+"=")
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return errInvalidSignature
+	}
+	mac := hmac.New(newHash, []byte(w.Secret))
+	mac.Write(body)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errInvalidSignature
+	}
+	return nil
+}
+
+// bodyDigest identifies a webhook request body among the delivery ids
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "body:sha256=" + hex.EncodeToString(sum[:])
+}
+
+// webhookParams maps a webhook request into the params of the function
+func webhookParams(w *dal.Webhook, header http.Header, body []byte) (string, error) {
+	p := WebhookParams{Headers: make(map[string]string)}
+	for _, name := range strings.Split(w.Headers, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			p.Headers[name] = header.Get(name)
+		}
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		p.Body = json.RawMessage(body)
+	} else {
+		p.Body = string(body)
+	}
+	params, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return string(params), nil
+}
+
+// fireWebhook runs the function of a webhook, and records the execution.
+// ctx carries the id of the webhook request, and is not cancelled.
+func fireWebhook(ctx context.Context, a *appContext, w *dal.Webhook, params string) {
+	timestamp := time.Now()
+	res, err := callFunction(ctx, a, w.UserName, w.FunctionName, params, nil)
+	if err != nil {
+		a.logger(ctx).Error("Webhook call failed", "user", w.UserName, "function", w.FunctionName, "error", err)
+		return
+	}
+	res.Trigger = TriggerWebhook
+	if err := PutFunctionExecution(ctx, a, w.UserName, w.FunctionName, params, res, timestamp); err != nil {
+		a.logger(ctx).Error("Failed to record webhook call", "user", w.UserName, "function", w.FunctionName, "error", err)
+	}
+}
+
+// randomHex returns `n` random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// ApiWebhook is a webhook of a function. The secret is only returned when
+// the webhook is created.
+type ApiWebhook struct {
+	ID              int64    `json:"id"`
+	Path            string   `json:"path"`
+	Secret          string   `json:"secret,omitempty"`
+	SignatureHeader string   `json:"signatureHeader"`
+	Algorithm       string   `json:"algorithm"`
+	Headers         []string `json:"headers"`
+	// Header of the delivery id, which enables replay protection. Empty
+	// disables it. The id is not authenticated by the signature: requests
+	// are also rejected if their body was received within
+	// WebhookReplayWindow, so senders must not sign identical bodies
+	// twice in that window.
+	DeliveryHeader string    `json:"deliveryHeader"`
+	Created        time.Time `json:"created"`
+}
+
+// ApiWebhookRequest creates a webhook. A missing delivery header is
+// GitHub's, an empty one disables replay protection, e.g. for senders
+// which repeat identical payloads.
+type ApiWebhookRequest struct {
+	SignatureHeader string   `json:"signatureHeader"`
+	Algorithm       string   `json:"algorithm"`
+	Headers         []string `json:"headers"`
+	DeliveryHeader  *string  `json:"deliveryHeader"`
+}
+
+func apiWebhook(w *dal.Webhook) *ApiWebhook {
+	res := &ApiWebhook{
+		ID:              w.ID,
+		Path:            "/hooks/" + w.Token,
+		Secret:          w.Secret,
+		SignatureHeader: w.SignatureHeader,
+		Algorithm:       w.Algorithm,
+		Headers:         make([]string, 0),
+		DeliveryHeader:  w.DeliveryHeader,
+		Created:         w.Created,
+	}
+	for _, name := range strings.Split(w.Headers, ",") {
+		if name != "" {
+			res.Headers = append(res.Headers, name)
+		}
+	}
+	return res
+}
+
+func ApiListWebhooksHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	webhooks, err := a.dal.ListWebhooks(ctx, f.ID)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	res := make([]*ApiWebhook, 0, len(webhooks))
+	for _, w := range webhooks {
+		res = append(res, apiWebhook(w))
+	}
+	return writeJSON(response, res)
+}
+
+// ApiCreateWebhookHandler adds a webhook to a function, with a generated
+// token and secret. The settings left empty are GitHub's, but for the
+// delivery header.
+func ApiCreateWebhookHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	var req ApiWebhookRequest
+	if err := json.NewDecoder(request.Body).Decode(&req); err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateWebhookFailed, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	w := &dal.Webhook{
+		FunctionID:      f.ID,
+		SignatureHeader: strings.TrimSpace(req.SignatureHeader),
+		Algorithm:       strings.ToLower(strings.TrimSpace(req.Algorithm)),
+		Headers:         strings.Join(req.Headers, ","),
+		DeliveryHeader:  DefaultDeliveryHeader,
+		Created:         time.Now(),
+	}
+	if w.SignatureHeader == "" {
+		w.SignatureHeader = DefaultSignatureHeader
+	}
+	if w.Algorithm == "" {
+		w.Algorithm = DefaultSignatureAlg
+	}
+	if _, ok := webhookAlgorithms[w.Algorithm]; !ok {
+		err := errors.New(fmt.Sprintf("Unknown signature algorithm %q, expected sha1, sha256, sha512 or token.", w.Algorithm))
+		return StatusError{http.StatusBadRequest, err, MessageUpdateWebhookFailed, true}
+	}
+	if req.DeliveryHeader != nil {
+		w.DeliveryHeader = strings.TrimSpace(*req.DeliveryHeader)
+	}
+	if w.Token, err = randomHex(16); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWebhookFailed, true}
+	}
+	if w.Secret, err = randomHex(32); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWebhookFailed, true}
+	}
+
+	if w.ID, err = a.dal.PutWebhook(ctx, w); err == dal.ErrNoSecretKey {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateWebhookFailed, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWebhookFailed, true}
+	}
+	return writeJSON(response, apiWebhook(w))
+}
+
+func ApiDeleteWebhookHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	webhookID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return StatusError{http.StatusNotFound, err, MessageWebhookNotFound, true}
+	}
+
+	f, err := a.dal.GetFunction(ctx, vars["username"], vars["function"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageFunctionNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	err = a.dal.DeleteWebhook(ctx, f.ID, webhookID)
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageWebhookNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWebhookFailed, true}
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
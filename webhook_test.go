@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Symantec/Go-kexec/dal"
+)
+
+func sign(newHash func() hash.Hash, secret string, body []byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	secret := "s3cr3t"
+	body := []byte(`{"action":"opened"}`)
+	for _, c := range []struct {
+		algorithm string
+		signature string
+		valid     bool
+	}{
+		{"sha256", "sha256=" + sign(sha256.New, secret, body), true},
+		{"sha256", sign(sha256.New, secret, body), true},
+		{"sha256", "sha256=" + strings.ToUpper(sign(sha256.New, secret, body)), true},
+		{"sha1", "sha1=" + sign(sha1.New, secret, body), true},
+		{"sha512", "sha512=" + sign(sha512.New, secret, body), true},
+		{"token", secret, true},
+
+		{"sha256", "", false},
+		{"sha256", "sha256=", false},
+		{"sha256", "sha256=zz", false},
+		{"sha256", "sha256=" + sign(sha256.New, "other", body), false},
+		{"sha256", "sha256=" + sign(sha256.New, secret, []byte(`{"action":"closed"}`)), false},
+		{"sha256", "sha256=" + sign(sha256.New, secret, body)[:62], false},
+		{"sha256", "sha1=" + sign(sha1.New, secret, body), false},
+		{"sha256", "sha1=" + sign(sha256.New, secret, body), false},
+		{"sha1", "sha1=" + sign(sha256.New, secret, body), false},
+		{"token", "", false},
+		{"token", "S3CR3T", false},
+		{"token", "sha256=" + sign(sha256.New, secret, body), false},
+		{"md5", "md5=" + sign(sha1.New, secret, body), false},
+		{"", secret, false},
+	} {
+		w := &dal.Webhook{Secret: secret, Algorithm: c.algorithm}
+		if err := verifyWebhookSignature(w, c.signature, body); (err == nil) != c.valid {
+			t.Errorf("Algorithm %q, signature %q: unexpected error %v", c.algorithm, c.signature, err)
+		}
+	}
+}
+
+func TestWebhookParams(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Other", "ignored")
+	for _, c := range []struct {
+		headers  string
+		body     string
+		expected WebhookParams
+	}{
+		{"", `{"ref":"main"}`, WebhookParams{
+			Headers: map[string]string{},
+			Body:    map[string]interface{}{"ref": "main"},
+		}},
+		{"X-GitHub-Event, X-Missing,", `[1,2]`, WebhookParams{
+			Headers: map[string]string{"X-GitHub-Event": "push", "X-Missing": ""},
+			Body:    []interface{}{1.0, 2.0},
+		}},
+		{"x-github-event", `ref=main`, WebhookParams{
+			Headers: map[string]string{"x-github-event": "push"},
+			Body:    "ref=main",
+		}},
+		{"", ``, WebhookParams{
+			Headers: map[string]string{},
+			Body:    "",
+		}},
+	} {
+		w := &dal.Webhook{Headers: c.headers}
+		params, err := webhookParams(w, header, []byte(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var p WebhookParams
+		if err := json.Unmarshal([]byte(params), &p); err != nil {
+			t.Fatal("Params are not JSON:", params, err)
+		}
+		if !reflect.DeepEqual(p, c.expected) {
+			t.Errorf("Headers %q, body %q: expected %+v, got %+v", c.headers, c.body, c.expected, p)
+		}
+	}
+}
+
+func TestBodyDigest(t *testing.T) {
+	a := bodyDigest([]byte(`{"a":1}`))
+	if a != bodyDigest([]byte(`{"a":1}`)) {
+		t.Error("Digest of the same body differs")
+	}
+	if a == bodyDigest([]byte(`{"a":2}`)) {
+		t.Error("Digests of different bodies are the same")
+	}
+	if !strings.HasPrefix(a, "body:sha256=") {
+		t.Error("Digest could clash with a delivery id:", a)
+	}
+}
@@ -0,0 +1,855 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Symantec/Go-kexec/dal"
+	"github.com/Symantec/Go-kexec/logging"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/context"
+	"k8s.io/client-go/1.4/pkg/util/yaml"
+)
+
+var (
+	// Period at which the unfinished runs no server executes are resumed,
+	// and the leases of the runs of this server renewed
+	WorkflowPeriod   = 15 * time.Second
+	WorkflowLeaseTTL = time.Minute
+
+	// Maximum number of steps of a workflow, nested steps included, and
+	// maximum size of its definition
+	MaxWorkflowSteps       = 100
+	MaxWorkflowSize  int64 = 1 << 20
+
+	// Number of runs listed, most recent first
+	WorkflowRunsListed = 20
+)
+
+// Status of a workflow run or step, besides ExecutionSucceeded and the
+// status of the function executions
+var (
+	WorkflowRunning = "Running"
+	WorkflowFailed  = "Failed"
+	WorkflowSkipped = "Skipped"
+	// Shown for the steps which did not start yet
+	WorkflowPending = "Pending"
+)
+
+// Conditions of a step on the status of the previous step of its
+// sequence
+var (
+	// Default
+	WhenSucceeded = "succeeded"
+	WhenFailed    = "failed"
+	WhenAlways    = "always"
+)
+
+var workflowNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// WorkflowDefinition is the document defining a workflow, in JSON or
+// YAML. Its steps run in sequence.
+type WorkflowDefinition struct {
+	Name  string          `json:"name"`
+	Steps []*WorkflowStep `json:"steps"`
+}
+
+// WorkflowStep is either a call of a function of the workflow owner, a
+// sequence of steps, or parallel branches.
+//
+// A function is called with Params if set, and otherwise with the output
+// of the previous succeeded step of its sequence, or with the input of
+// its parent for the first one. The output of a sequence is the output of
+// its last succeeded step, and the output of parallel branches the JSON
+// array of the branch outputs.
+type WorkflowStep struct {
+	Name     string          `json:"name,omitempty"`
+	Function string          `json:"function,omitempty"`
+	Params   json.RawMessage `json:"params,omitempty"`
+	Sequence []*WorkflowStep `json:"sequence,omitempty"`
+	Parallel []*WorkflowStep `json:"parallel,omitempty"`
+
+	// WhenSucceeded, WhenFailed or WhenAlways. Evaluated against the
+	// status of the sequence so far, i.e. failed once one of its steps
+	// failed. The first step of a sequence and parallel branches run
+	// whenever their parent does.
+	When string `json:"when,omitempty"`
+}
+
+// parseWorkflow parses and checks a workflow definition
+func parseWorkflow(data []byte) (*WorkflowDefinition, error) {
+	data, err := yaml.ToJSON(data)
+	if err != nil {
+		return nil, errors.New("Workflow definition is neither JSON nor YAML: " + err.Error())
+	}
+	var def WorkflowDefinition
+	if err := json.Unmarshal(data, &def); err != nil {
+		return nil, errors.New("Invalid workflow definition: " + err.Error())
+	}
+	if !workflowNameRegexp.MatchString(def.Name) {
+		return nil, errors.New(fmt.Sprintf("Invalid workflow name %q, expected letters, digits, '_', '.' and '-'.", def.Name))
+	}
+	if len(def.Steps) == 0 {
+		return nil, errors.New("Workflow has no steps.")
+	}
+	n := 0
+	if err := validateWorkflowSteps(def.Steps, &n); err != nil {
+		return nil, err
+	}
+	return &def, nil
+}
+
+func validateWorkflowSteps(steps []*WorkflowStep, n *int) error {
+	for _, s := range steps {
+		if s == nil {
+			return errors.New("Empty workflow step.")
+		}
+		if *n++; *n > MaxWorkflowSteps {
+			return errors.New(fmt.Sprintf("Workflow exceeds the maximum of %d steps.", MaxWorkflowSteps))
+		}
+		kinds := 0
+		for _, set := range []bool{s.Function != "", len(s.Sequence) > 0, len(s.Parallel) > 0} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return errors.New(fmt.Sprintf("Step %q must have exactly one of function, sequence or parallel.", s.Name))
+		}
+		if len(s.Params) > 0 && s.Function == "" {
+			return errors.New(fmt.Sprintf("Step %q has params but calls no function.", s.Name))
+		}
+		switch s.When {
+		case "", WhenSucceeded, WhenFailed, WhenAlways:
+		default:
+			return errors.New(fmt.Sprintf("Invalid condition %q of step %q, expected %s, %s or %s.",
+				s.When, s.Name, WhenSucceeded, WhenFailed, WhenAlways))
+		}
+		if err := validateWorkflowSteps(s.Sequence, n); err != nil {
+			return err
+		}
+		if err := validateWorkflowSteps(s.Parallel, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workflowFunctions returns the names of the functions a workflow calls
+func workflowFunctions(steps []*WorkflowStep, names map[string]bool) map[string]bool {
+	for _, s := range steps {
+		if s.Function != "" {
+			names[s.Function] = true
+		}
+		workflowFunctions(s.Sequence, names)
+		workflowFunctions(s.Parallel, names)
+	}
+	return names
+}
+
+// matchWhen tells if a step with condition `when` runs after `status`
+func matchWhen(when, status string) bool {
+	switch when {
+	case WhenAlways:
+		return true
+	case WhenFailed:
+		return status != ExecutionSucceeded
+	default:
+		return status == ExecutionSucceeded
+	}
+}
+
+// stepPath is the path of the `i`th child of the step at `parent`
+func stepPath(parent string, i int) string {
+	if parent == "" {
+		return strconv.Itoa(i)
+	}
+	return parent + "." + strconv.Itoa(i)
+}
+
+// rawJSON returns `s` if it is a JSON document, and null otherwise
+func rawJSON(s string) json.RawMessage {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
+
+// workflowEngine executes the workflow runs. A run is executed by the
+// server holding its lease, so that the runs of a server which stopped
+// are resumed by another one once their leases expire.
+type workflowEngine struct {
+	holder string
+
+	lock sync.Mutex
+	// Runs executed by this server, and how to stop them once their
+	// lease is lost
+	running map[int64]context.CancelFunc
+}
+
+func newWorkflowEngine() *workflowEngine {
+	return &workflowEngine{holder: schedulerID(), running: make(map[int64]context.CancelFunc)}
+}
+
+var errLostWorkflowLease = errors.New("Lost workflow run lease to another server")
+
+func workflowLease(runID int64) string {
+	return fmt.Sprintf("workflow-run-%d", runID)
+}
+
+// run periodically renews the leases of the runs of this server, and
+// resumes the runs no server executes
+func (e *workflowEngine) run(a *appContext) {
+	ticker := time.NewTicker(WorkflowPeriod)
+	defer ticker.Stop()
+	for {
+		if err := e.resume(context.Background(), a); err != nil {
+			a.log.Error("Failed to resume workflow runs", "error", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (e *workflowEngine) resume(ctx context.Context, a *appContext) error {
+	runs, err := a.dal.ListUnfinishedWorkflowRuns(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		ok, err := a.dal.AcquireLease(ctx, workflowLease(r.ID), e.holder, WorkflowLeaseTTL)
+		if err != nil {
+			a.log.Error("Failed to acquire workflow run lease", "workflow_run_id", r.ID, "error", err)
+			continue
+		}
+		e.lock.Lock()
+		cancel, running := e.running[r.ID]
+		e.lock.Unlock()
+		if !ok && running {
+			// The new holder runs the steps again, stop running them here
+			a.log.Warn("Lost workflow run lease to another server, stopping the run", "workflow_run_id", r.ID)
+			cancel()
+		} else if ok && !running {
+			a.log.Info("Resuming workflow run", "workflow_run_id", r.ID, "user", r.UserName, "workflow", r.WorkflowName)
+			e.execute(a, r)
+		}
+	}
+	return nil
+}
+
+// start starts a run of a workflow with `input` as params
+func (e *workflowEngine) start(ctx context.Context, a *appContext, w *dal.Workflow, input string) (*dal.WorkflowRun, error) {
+	r := &dal.WorkflowRun{
+		WorkflowID:   w.ID,
+		UserName:     w.UserName,
+		WorkflowName: w.Name,
+		Definition:   w.Definition,
+		Status:       WorkflowRunning,
+		Input:        input,
+		Created:      time.Now(),
+	}
+	var err error
+	if r.ID, err = a.dal.PutWorkflowRun(ctx, r); err != nil {
+		return nil, err
+	}
+	ok, err := a.dal.AcquireLease(ctx, workflowLease(r.ID), e.holder, WorkflowLeaseTTL)
+	if err != nil {
+		// Resumed by a server later
+		a.logger(ctx).Error("Failed to acquire workflow run lease", "workflow_run_id", r.ID, "error", err)
+	} else if ok {
+		e.execute(a, r)
+	}
+	return r, nil
+}
+
+// execute executes a run in the background, skipping the steps which
+// finished already. The steps which were running when the run was
+// interrupted are run again. The execution stops, without recording
+// anything more, once the lease of the run is lost.
+func (e *workflowEngine) execute(a *appContext, r *dal.WorkflowRun) {
+	logger := a.log.With("workflow_run_id", r.ID)
+	base := logging.NewContext(context.Background(), logger)
+	ctx, cancel := context.WithCancel(base)
+	e.lock.Lock()
+	e.running[r.ID] = cancel
+	e.lock.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			e.lock.Lock()
+			delete(e.running, r.ID)
+			e.lock.Unlock()
+			if err := a.dal.ReleaseLease(base, workflowLease(r.ID), e.holder); err != nil {
+				logger.Error("Failed to release workflow run lease", "error", err)
+			}
+		}()
+
+		// The run may have finished since it was listed
+		if current, err := a.dal.GetWorkflowRun(ctx, r.ID); err != nil {
+			logger.Error("Failed to get workflow run", "error", err)
+			return
+		} else if !current.Finished.IsZero() {
+			return
+		}
+		x, err := newWorkflowExecution(ctx, a, r, e.holder, cancel)
+		if err != nil {
+			logger.Error("Failed to load workflow run", "error", err)
+			return
+		}
+
+		status, output := WorkflowFailed, ""
+		var def WorkflowDefinition
+		if err := json.Unmarshal([]byte(r.Definition), &def); err != nil {
+			logger.Error("Invalid workflow run definition", "error", err)
+		} else {
+			status, output = x.sequence(ctx, def.Steps, "", r.Input)
+		}
+		if ctx.Err() != nil {
+			logger.Warn("Workflow run stopped", "error", errLostWorkflowLease)
+			return
+		}
+		if err := a.dal.FinishWorkflowRun(ctx, r.ID, status, output); err != nil {
+			logger.Error("Failed to record end of workflow run", "error", err)
+		}
+	}()
+}
+
+// workflowExecution is the state of a run being executed
+type workflowExecution struct {
+	a   *appContext
+	run *dal.WorkflowRun
+	// Holder of the lease of the run, and how to stop the execution
+	holder string
+	cancel context.CancelFunc
+
+	lock  sync.Mutex
+	steps map[string]*dal.WorkflowStep
+}
+
+func newWorkflowExecution(ctx context.Context, a *appContext, r *dal.WorkflowRun, holder string, cancel context.CancelFunc) (*workflowExecution, error) {
+	steps, err := a.dal.ListWorkflowSteps(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	x := &workflowExecution{a: a, run: r, holder: holder, cancel: cancel, steps: make(map[string]*dal.WorkflowStep)}
+	for _, s := range steps {
+		x.steps[s.Path] = s
+	}
+	return x, nil
+}
+
+// put stores the state of a step. The run goes on if it cannot be
+// stored, the step then runs again if the run is resumed. Nothing is
+// stored once the execution is stopped, the state of the steps being
+// the new lease holder's.
+func (x *workflowExecution) put(ctx context.Context, s *dal.WorkflowStep) {
+	if ctx.Err() != nil {
+		return
+	}
+	x.lock.Lock()
+	x.steps[s.Path] = s
+	x.lock.Unlock()
+	if err := x.a.dal.PutWorkflowStep(context.Background(), s); err != nil {
+		x.a.log.Error("Failed to store workflow step", "workflow_run_id", x.run.ID, "step", s.Path, "error", err)
+	}
+}
+
+// finished returns the state of a step if it finished in a previous
+// execution of the run
+func (x *workflowExecution) finished(path string) (*dal.WorkflowStep, bool) {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+	s, ok := x.steps[path]
+	if !ok || s.Status == WorkflowRunning || s.Finished.IsZero() {
+		return nil, false
+	}
+	return s, true
+}
+
+// step runs a step if `when` matches the status of its sequence so far,
+// and returns its status and output
+func (x *workflowExecution) step(ctx context.Context, s *WorkflowStep, path, input, status string) (string, string) {
+	if state, ok := x.finished(path); ok {
+		return state.Status, state.Output
+	}
+	state := &dal.WorkflowStep{RunID: x.run.ID, Path: path, Started: time.Now()}
+	if !matchWhen(s.When, status) {
+		state.Status, state.Finished = WorkflowSkipped, state.Started
+		x.put(ctx, state)
+		return WorkflowSkipped, ""
+	}
+
+	var output string
+	switch {
+	case s.Function != "":
+		status, output = x.call(ctx, s, state, input)
+	case len(s.Sequence) > 0:
+		status, output = x.sequence(ctx, s.Sequence, path, input)
+	default:
+		status, output = x.parallel(ctx, s.Parallel, path, input)
+	}
+	state.Status, state.Output, state.Finished = status, output, time.Now()
+	x.put(ctx, state)
+	return status, output
+}
+
+// sequence runs steps one after the other. It fails if one of them
+// failed.
+func (x *workflowExecution) sequence(ctx context.Context, steps []*WorkflowStep, path, input string) (string, string) {
+	status, output := ExecutionSucceeded, input
+	for i, s := range steps {
+		st, out := x.step(ctx, s, stepPath(path, i), output, status)
+		if st == ExecutionSucceeded {
+			output = out
+		} else if st != WorkflowSkipped {
+			status = WorkflowFailed
+		}
+	}
+	return status, output
+}
+
+// parallel runs branches at the same time. It fails if one of them
+// failed.
+func (x *workflowExecution) parallel(ctx context.Context, branches []*WorkflowStep, path, input string) (string, string) {
+	statuses := make([]string, len(branches))
+	outputs := make([]json.RawMessage, len(branches))
+	var wg sync.WaitGroup
+	for i, b := range branches {
+		wg.Add(1)
+		go func(i int, b *WorkflowStep) {
+			defer wg.Done()
+			var out string
+			statuses[i], out = x.step(ctx, b, stepPath(path, i), input, ExecutionSucceeded)
+			outputs[i] = rawJSON(out)
+		}(i, b)
+	}
+	wg.Wait()
+
+	status := ExecutionSucceeded
+	for _, st := range statuses {
+		if st != ExecutionSucceeded && st != WorkflowSkipped {
+			status = WorkflowFailed
+		}
+	}
+	output, err := json.Marshal(outputs)
+	if err != nil {
+		return WorkflowFailed, ""
+	}
+	return status, string(output)
+}
+
+// call runs the function of a step, and records its execution
+func (x *workflowExecution) call(ctx context.Context, s *WorkflowStep, state *dal.WorkflowStep, input string) (string, string) {
+	params := input
+	if len(s.Params) > 0 {
+		params = string(s.Params)
+	}
+	if params == "" {
+		params = "{}"
+	}
+	// Another server may have taken the run over since its lease was
+	// renewed
+	if err := x.checkLease(ctx); err != nil {
+		x.a.logger(ctx).Warn("Not calling workflow step function", "step", state.Path, "function", s.Function, "error", err)
+		return WorkflowFailed, ""
+	}
+	state.Status, state.Params = WorkflowRunning, params
+	x.put(ctx, state)
+
+	x.a.logger(ctx).Info("Workflow step calls function", "step", state.Path, "user", x.run.UserName, "function", s.Function)
+	timestamp := time.Now()
+	res, err := callFunction(ctx, x.a, x.run.UserName, s.Function, params, nil)
+	if err != nil {
+		x.a.logger(ctx).Error("Workflow call failed", "step", state.Path, "function", s.Function, "error", err)
+		state.Message = err.Error()
+		return WorkflowFailed, ""
+	}
+	res.Trigger = TriggerWorkflow
+	if err := PutFunctionExecution(ctx, x.a, x.run.UserName, s.Function, params, res, timestamp); err != nil {
+		x.a.logger(ctx).Error("Failed to record workflow call", "step", state.Path, "function", s.Function, "error", err)
+	}
+	state.Uuid = res.Uuid
+	return res.Result, res.Output
+}
+
+// checkLease renews the lease of the run, and stops the execution if
+// this server does not hold it anymore, or cannot tell
+func (x *workflowExecution) checkLease(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ok, err := x.a.dal.AcquireLease(ctx, workflowLease(x.run.ID), x.holder, WorkflowLeaseTTL)
+	if err == nil && !ok {
+		err = errLostWorkflowLease
+	}
+	if err != nil {
+		x.cancel()
+	}
+	return err
+}
+
+// WorkflowNode is a step of a workflow run, as shown in the run graph
+type WorkflowNode struct {
+	Path     string          `json:"path"`
+	Name     string          `json:"name"`
+	Kind     string          `json:"kind"`
+	Function string          `json:"function,omitempty"`
+	When     string          `json:"when,omitempty"`
+	Status   string          `json:"status"`
+	Uuid     string          `json:"uuid,omitempty"`
+	Params   string          `json:"params,omitempty"`
+	Output   string          `json:"output,omitempty"`
+	Message  string          `json:"message,omitempty"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Children []*WorkflowNode `json:"children,omitempty"`
+
+	// Unique in the page showing the graphs of the runs
+	ID string `json:"-"`
+}
+
+// workflowGraph returns the steps of a run with their state. Its root is
+// the sequence of the top level steps.
+func workflowGraph(r *dal.WorkflowRun, steps []*dal.WorkflowStep) (*WorkflowNode, error) {
+	var def WorkflowDefinition
+	if err := json.Unmarshal([]byte(r.Definition), &def); err != nil {
+		return nil, err
+	}
+	states := make(map[string]*dal.WorkflowStep)
+	for _, s := range steps {
+		states[s.Path] = s
+	}
+	root := &WorkflowNode{
+		Name:     r.WorkflowName,
+		Kind:     "sequence",
+		Status:   r.Status,
+		Params:   r.Input,
+		Output:   r.Output,
+		Started:  r.Created,
+		Finished: r.Finished,
+		Children: workflowNodes(r.ID, def.Steps, "", states),
+	}
+	return root, nil
+}
+
+func workflowNodes(runID int64, steps []*WorkflowStep, path string, states map[string]*dal.WorkflowStep) []*WorkflowNode {
+	nodes := make([]*WorkflowNode, 0, len(steps))
+	for i, s := range steps {
+		n := &WorkflowNode{
+			Path:     stepPath(path, i),
+			Name:     s.Name,
+			Function: s.Function,
+			When:     s.When,
+			Status:   WorkflowPending,
+		}
+		n.ID = fmt.Sprintf("step-%d-%s", runID, strings.Replace(n.Path, ".", "-", -1))
+		switch {
+		case s.Function != "":
+			n.Kind = "function"
+		case len(s.Sequence) > 0:
+			n.Kind = "sequence"
+			n.Children = workflowNodes(runID, s.Sequence, n.Path, states)
+		default:
+			n.Kind = "parallel"
+			n.Children = workflowNodes(runID, s.Parallel, n.Path, states)
+		}
+		if n.Name == "" {
+			n.Name = n.Function
+		}
+		if state, ok := states[n.Path]; ok {
+			n.Status = state.Status
+			n.Uuid = state.Uuid
+			n.Params = state.Params
+			n.Output = state.Output
+			n.Message = state.Message
+			n.Started = state.Started
+			n.Finished = state.Finished
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// ApiWorkflow is a workflow of a user. The definition is only returned
+// for a single workflow.
+type ApiWorkflow struct {
+	Name       string          `json:"name"`
+	Definition json.RawMessage `json:"definition,omitempty"`
+	Created    time.Time       `json:"created"`
+	Updated    time.Time       `json:"updated"`
+}
+
+func apiWorkflow(w *dal.Workflow) *ApiWorkflow {
+	res := &ApiWorkflow{Name: w.Name, Created: w.Created, Updated: w.Updated}
+	if w.Definition != "" {
+		res.Definition = json.RawMessage(w.Definition)
+	}
+	return res
+}
+
+// ApiWorkflowRun is a run of a workflow. The graph of its steps is only
+// returned for a single run.
+type ApiWorkflowRun struct {
+	ID       int64         `json:"id"`
+	Status   string        `json:"status"`
+	Input    string        `json:"input"`
+	Output   string        `json:"output"`
+	Created  time.Time     `json:"created"`
+	Finished time.Time     `json:"finished"`
+	Graph    *WorkflowNode `json:"graph,omitempty"`
+}
+
+func apiWorkflowRun(r *dal.WorkflowRun) *ApiWorkflowRun {
+	return &ApiWorkflowRun{
+		ID:       r.ID,
+		Status:   r.Status,
+		Input:    r.Input,
+		Output:   r.Output,
+		Created:  r.Created,
+		Finished: r.Finished,
+	}
+}
+
+func ApiListWorkflowsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	workflows, err := a.dal.ListWorkflows(ctx, mux.Vars(request)["username"])
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	res := make([]*ApiWorkflow, 0, len(workflows))
+	for _, w := range workflows {
+		res = append(res, apiWorkflow(w))
+	}
+	return writeJSON(response, res)
+}
+
+// ApiPutWorkflowHandler adds a workflow defined by the request body, in
+// JSON or YAML, or replaces the workflow of the same name. The runs
+// already started keep the definition they started with.
+func ApiPutWorkflowHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	userName := mux.Vars(request)["username"]
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, MaxWorkflowSize))
+	if err != nil {
+		return StatusError{http.StatusRequestEntityTooLarge, err, MessageUpdateWorkflowFailed, true}
+	}
+	def, err := parseWorkflow(body)
+	if err != nil {
+		return StatusError{http.StatusBadRequest, err, MessageUpdateWorkflowFailed, true}
+	}
+	for name := range workflowFunctions(def.Steps, make(map[string]bool)) {
+		if _, err := a.dal.GetFunction(ctx, userName, name); err == sql.ErrNoRows {
+			err := errors.New(fmt.Sprintf("Function %s not exist for user %s.", name, userName))
+			return StatusError{http.StatusBadRequest, err, MessageUpdateWorkflowFailed, true}
+		} else if err != nil {
+			return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+		}
+	}
+
+	definition, err := json.Marshal(def)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWorkflowFailed, true}
+	}
+	w := &dal.Workflow{Name: def.Name, Definition: string(definition)}
+	if _, err := a.dal.PutWorkflow(ctx, userName, w); err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageUpdateWorkflowFailed, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWorkflowFailed, true}
+	}
+	w, err = a.dal.GetWorkflow(ctx, userName, def.Name)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	return writeJSON(response, apiWorkflow(w))
+}
+
+func ApiGetWorkflowHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	w, err := a.dal.GetWorkflow(ctx, vars["username"], vars["workflow"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageWorkflowNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	return writeJSON(response, apiWorkflow(w))
+}
+
+func ApiDeleteWorkflowHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	err := a.dal.DeleteWorkflow(ctx, vars["username"], vars["workflow"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageWorkflowNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageUpdateWorkflowFailed, true}
+	}
+	response.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// ApiStartWorkflowRunHandler starts a run of a workflow with the request
+// body as input. The run goes on in the background.
+func ApiStartWorkflowRunHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, MaxWorkflowSize))
+	if err != nil {
+		return StatusError{http.StatusRequestEntityTooLarge, err, MessageRunWorkflowFailed, true}
+	}
+	r, err := startWorkflowRun(ctx, a, vars["username"], vars["workflow"], string(body))
+	if err != nil {
+		return err
+	}
+	response.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	response.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(response).Encode(apiWorkflowRun(r))
+}
+
+// startWorkflowRun checks the input of a run and starts it. It returns a
+// StatusError.
+func startWorkflowRun(ctx context.Context, a *appContext, userName, workflowName, input string) (*dal.WorkflowRun, error) {
+	if input == "" {
+		input = "{}"
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(input), &v); err != nil {
+		err = errors.New("Input is not in valid json format: " + err.Error())
+		return nil, StatusError{http.StatusBadRequest, err, MessageRunWorkflowFailed, true}
+	}
+	w, err := a.dal.GetWorkflow(ctx, userName, workflowName)
+	if err == sql.ErrNoRows {
+		return nil, StatusError{http.StatusNotFound, err, MessageWorkflowNotFound, true}
+	} else if err != nil {
+		return nil, StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	r, err := a.workflows.start(ctx, a, w, input)
+	if err != nil {
+		return nil, StatusError{http.StatusInternalServerError, err, MessageRunWorkflowFailed, true}
+	}
+	return r, nil
+}
+
+func ApiListWorkflowRunsHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	w, err := a.dal.GetWorkflow(ctx, vars["username"], vars["workflow"])
+	if err == sql.ErrNoRows {
+		return StatusError{http.StatusNotFound, err, MessageWorkflowNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	runs, err := a.dal.ListWorkflowRuns(ctx, w.ID, WorkflowRunsListed)
+	if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	res := make([]*ApiWorkflowRun, 0, len(runs))
+	for _, r := range runs {
+		res = append(res, apiWorkflowRun(r))
+	}
+	return writeJSON(response, res)
+}
+
+// ApiGetWorkflowRunHandler returns a run with the graph of its steps
+func ApiGetWorkflowRunHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	if err := requireOwner(a, request); err != nil {
+		return err
+	}
+	vars := mux.Vars(request)
+	runID, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		return StatusError{http.StatusNotFound, err, MessageWorkflowRunNotFound, true}
+	}
+	r, err := a.dal.GetWorkflowRun(ctx, runID)
+	if err == sql.ErrNoRows || (err == nil && (r.UserName != vars["username"] || r.WorkflowName != vars["workflow"])) {
+		return StatusError{http.StatusNotFound, sql.ErrNoRows, MessageWorkflowRunNotFound, true}
+	} else if err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+
+	res := apiWorkflowRun(r)
+	if res.Graph, err = runGraph(ctx, a, r); err != nil {
+		return StatusError{http.StatusInternalServerError, err, MessageInternalServerError, true}
+	}
+	return writeJSON(response, res)
+}
+
+func runGraph(ctx context.Context, a *appContext, r *dal.WorkflowRun) (*WorkflowNode, error) {
+	steps, err := a.dal.ListWorkflowSteps(ctx, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	return workflowGraph(r, steps)
+}
+
+// ViewWorkflowHandler shows the last runs of a workflow, with the graph
+// of their steps
+func ViewWorkflowHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	userName := getUserName(a, request)
+	if userName == "" {
+		http.Redirect(response, request, "/", http.StatusFound)
+		return nil
+	}
+	w, err := a.dal.GetWorkflow(ctx, userName, mux.Vars(request)["workflow"])
+	if err == sql.ErrNoRows {
+		return StatusError{Code: http.StatusNotFound, Err: err, UserMsg: MessageWorkflowNotFound}
+	} else if err != nil {
+		return StatusError{Code: http.StatusInternalServerError, Err: err, UserMsg: MessageInternalServerError}
+	}
+	runs, err := a.dal.ListWorkflowRuns(ctx, w.ID, WorkflowRunsListed)
+	if err != nil {
+		return StatusError{Code: http.StatusInternalServerError, Err: err, UserMsg: MessageInternalServerError}
+	}
+
+	page := &ViewWorkflowPage{Workflow: w}
+	for _, r := range runs {
+		graph, err := runGraph(ctx, a, r)
+		if err != nil {
+			return StatusError{Code: http.StatusInternalServerError, Err: err, UserMsg: MessageInternalServerError}
+		}
+		page.Runs = append(page.Runs, &WorkflowRunRow{Run: r, Graph: graph})
+	}
+	ViewWorkflowTemplate.Execute(response, page)
+	return nil
+}
+
+// RunWorkflowHandler starts a run of a workflow from the UI
+func RunWorkflowHandler(ctx context.Context, a *appContext, response http.ResponseWriter, request *http.Request) error {
+	userName := getUserName(a, request)
+	if userName == "" {
+		http.Redirect(response, request, "/", http.StatusFound)
+		return nil
+	}
+	workflowName := mux.Vars(request)["workflow"]
+	if _, err := startWorkflowRun(ctx, a, userName, workflowName, request.FormValue("params")); err != nil {
+		if e, ok := err.(StatusError); ok {
+			e.SendErrResp = false
+			return e
+		}
+		return err
+	}
+	http.Redirect(response, request, "/workflows/"+workflowName, http.StatusFound)
+	return nil
+}
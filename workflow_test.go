@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseWorkflow(t *testing.T) {
+	defer func(max int) { MaxWorkflowSteps = max }(MaxWorkflowSteps)
+	MaxWorkflowSteps = 4
+
+	for _, c := range []struct {
+		def   string
+		valid bool
+	}{
+		{`{"name": "wf", "steps": [{"function": "a"}]}`, true},
+		{`{"name": "wf.v2-x_", "steps": [{"function": "a", "params": {"x": 1}}, {"function": "b", "when": "failed"}]}`, true},
+		{`{"name": "wf", "steps": [{"sequence": [{"function": "a"}, {"function": "b", "when": "always"}]}]}`, true},
+		{`{"name": "wf", "steps": [{"parallel": [{"function": "a"}, {"sequence": [{"function": "b"}]}]}]}`, true},
+		{`{"name": "wf", "steps": [{"function": "a", "when": "succeeded"}]}`, true},
+
+		// Documents
+		{``, false},
+		{`[]`, false},
+		{`{"name": "wf", "steps": {"function": "a"}}`, false},
+		// Names
+		{`{"steps": [{"function": "a"}]}`, false},
+		{`{"name": "-wf", "steps": [{"function": "a"}]}`, false},
+		{`{"name": "w f", "steps": [{"function": "a"}]}`, false},
+		{`{"name": "wf/x", "steps": [{"function": "a"}]}`, false},
+		// Steps
+		{`{"name": "wf"}`, false},
+		{`{"name": "wf", "steps": []}`, false},
+		{`{"name": "wf", "steps": [null]}`, false},
+		{`{"name": "wf", "steps": [{}]}`, false},
+		{`{"name": "wf", "steps": [{"name": "x"}]}`, false},
+		{`{"name": "wf", "steps": [{"sequence": []}]}`, false},
+		{`{"name": "wf", "steps": [{"function": "a", "sequence": [{"function": "b"}]}]}`, false},
+		{`{"name": "wf", "steps": [{"sequence": [{"function": "a"}], "parallel": [{"function": "b"}]}]}`, false},
+		{`{"name": "wf", "steps": [{"parallel": [{"function": "a"}], "params": {}}]}`, false},
+		{`{"name": "wf", "steps": [{"sequence": [{"name": "nested"}]}]}`, false},
+		{`{"name": "wf", "steps": [{"parallel": [{"function": "a"}, null]}]}`, false},
+		// Conditions
+		{`{"name": "wf", "steps": [{"function": "a", "when": "never"}]}`, false},
+		{`{"name": "wf", "steps": [{"function": "a", "when": "Failed"}]}`, false},
+		{`{"name": "wf", "steps": [{"sequence": [{"function": "a", "when": "sometimes"}]}]}`, false},
+		// Size, nested steps included
+		{`{"name": "wf", "steps": [{"function": "a"}, {"function": "b"}, {"function": "c"}, {"function": "d"}]}`, true},
+		{`{"name": "wf", "steps": [{"function": "a"}, {"function": "b"}, {"function": "c"}, {"function": "d"}, {"function": "e"}]}`, false},
+		{`{"name": "wf", "steps": [{"sequence": [{"function": "a"}, {"parallel": [{"function": "b"}, {"function": "c"}]}]}]}`, false},
+	} {
+		def, err := parseWorkflow([]byte(c.def))
+		if (err == nil) != c.valid {
+			t.Errorf("parseWorkflow(%s): unexpected error %v", c.def, err)
+			continue
+		}
+		if c.valid && !strings.Contains(c.def, fmt.Sprintf("%q", def.Name)) {
+			t.Errorf("parseWorkflow(%s): unexpected name %q", c.def, def.Name)
+		}
+	}
+}
+
+func TestMatchWhen(t *testing.T) {
+	for _, c := range []struct {
+		when   string
+		status string
+		match  bool
+	}{
+		{"", ExecutionSucceeded, true},
+		{"", WorkflowFailed, false},
+		{"", ExecutionCancelled, false},
+		{"", ResError, false},
+		{WhenSucceeded, ExecutionSucceeded, true},
+		{WhenSucceeded, WorkflowFailed, false},
+		{WhenFailed, ExecutionSucceeded, false},
+		{WhenFailed, WorkflowFailed, true},
+		{WhenFailed, ExecutionCancelled, true},
+		{WhenFailed, ResError, true},
+		{WhenAlways, ExecutionSucceeded, true},
+		{WhenAlways, WorkflowFailed, true},
+		{WhenAlways, ExecutionCancelled, true},
+	} {
+		if matchWhen(c.when, c.status) != c.match {
+			t.Errorf("When %q after %q: expected %v", c.when, c.status, c.match)
+		}
+	}
+}
+
+func TestWorkflowFunctions(t *testing.T) {
+	def, err := parseWorkflow([]byte(`{"name": "wf", "steps": [
+		{"function": "a"},
+		{"parallel": [{"function": "b"}, {"sequence": [{"function": "c"}, {"function": "a"}]}]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := workflowFunctions(def.Steps, make(map[string]bool))
+	if len(names) != 3 || !names["a"] || !names["b"] || !names["c"] {
+		t.Error("Unexpected functions", names)
+	}
+}